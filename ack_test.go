@@ -0,0 +1,124 @@
+package shared_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+)
+
+// receiveKind waits for the next packet of kind on packets, and decodes it into msg
+func receiveKind(t *testing.T, packets chan *shared.Packet, kind shared.MessageKind, msg interface{}) {
+	for {
+		select {
+		case p := <-packets:
+			if p.Kind() != kind {
+				continue
+			}
+
+			err := p.IntoMessage(msg)
+			if err != nil {
+				t.Fatalf("Did not expect error, but got: %s", err)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not receive a '%s' packet", kind)
+		}
+	}
+}
+
+// TestAckAfterReconnect checks that a message is acknowledged with its ID and time, and
+// that sending it again after reconnecting returns the same Ack instead of sending it twice
+func TestAckAfterReconnect(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	server := startChat(t, pipe, nil, "chat")
+
+	transport := &flakyTransport{Transport: pipe}
+	packets := make(chan *shared.Packet, 100)
+	output := &syncBuffer{}
+	alice := connectReconnecting(t, transport, "alice", output, func(p *shared.Packet) { packets <- p })
+
+	bobPackets := make(chan *shared.Packet, 100)
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+	bob := connectClient(t, "chat", "bob", opts, func(p *shared.Packet) { bobPackets <- p })
+	waitFor(t, func() bool { return len(alice.Rooms()) > 0 && len(bob.Rooms()) > 0 })
+
+	nonce, err := alice.SendLine("once", shared.DEFAULT_ROOM)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	var ack shared.Ack
+	receiveKind(t, packets, shared.KIND_ACK, &ack)
+	receiveMessage(t, bobPackets, "once", "")
+
+	msgs, _, err := server.Store.Page(shared.DEFAULT_ROOM, 0, 0, 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Expected one stored message, got %v, %v", msgs, err)
+	}
+
+	expected := shared.Ack{Nonce: nonce, ID: msgs[0].ID, Time: msgs[0].Time, Room: shared.DEFAULT_ROOM}
+	if ack != expected || ack.ID == 0 || ack.Time == 0 {
+		t.Errorf("Expected %v, got %v", expected, ack)
+	}
+
+	transport.down()
+	waitFor(t, func() bool { return server.SessionByUsername("alice") == nil })
+	transport.up()
+	waitFor(t, func() bool {
+		return strings.Contains(output.String(), "Reconnected") && server.SessionByUsername("alice") != nil
+	})
+
+	// Sent again, as if the Ack was lost along with the connection
+	err = alice.SendMessage(shared.KIND_MESSAGE, shared.Message{Msg: "once", Room: shared.DEFAULT_ROOM, Nonce: nonce})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	var again shared.Ack
+	receiveKind(t, packets, shared.KIND_ACK, &again)
+	if again != expected {
+		t.Errorf("Expected the first Ack again, %v, got %v", expected, again)
+	}
+
+	bob.SendLine("sync", shared.DEFAULT_ROOM)
+	if count := receiveMessage(t, bobPackets, "sync", "once"); count != 0 {
+		t.Errorf("Expected the resent message to be dropped, got it %d more times", count)
+	}
+
+	msgs, _, err = server.Store.Page(shared.DEFAULT_ROOM, 0, 0, 10)
+	if err != nil || len(msgs) != 2 {
+		t.Errorf("Expected the resent message to be stored once, got %v, %v", msgs, err)
+	}
+}
+
+// TestErrorEchoesNonce checks that a rejected message is answered with an error carrying
+// its nonce, which settles the message on the client
+func TestErrorEchoesNonce(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	startChat(t, pipe, nil, "chat")
+
+	packets := make(chan *shared.Packet, 100)
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+	alice := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) { packets <- p })
+	waitFor(t, func() bool { return len(alice.Rooms()) > 0 })
+
+	nonce, err := alice.SendLine("lost", "elsewhere")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	var msg shared.ErrorMessage
+	receiveKind(t, packets, shared.KIND_ERROR, &msg)
+	if msg.Nonce != nonce || msg.Msg == "" {
+		t.Errorf("Expected an error for nonce %d, got %v", nonce, msg)
+	}
+
+	waitFor(t, func() bool { return len(alice.Pending()) == 0 })
+}
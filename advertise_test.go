@@ -0,0 +1,68 @@
+package shared_test
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func TestAdvertised(t *testing.T) {
+	server := tcp_server.Create(tcp_server.HandleChat)
+
+	tests := []struct {
+		advertise string
+		expected  string
+	}{
+		{"chat.lan", "chat.lan:42069"},
+		{"chat.lan:443", "chat.lan:443"},
+		{"10.0.0.5", "10.0.0.5:42069"},
+		{"[fd00::5]:7000", "[fd00::5]:7000"},
+	}
+
+	for _, test := range tests {
+		server.Advertise = test.advertise
+		if got := server.Advertised(42069); got != test.expected {
+			t.Errorf("Expected '%s' to advertise %s, got %s", test.advertise, test.expected, got)
+		}
+	}
+}
+
+// listenTransport passes on the addresses its listeners got, to connect to ports chosen by the system
+type listenTransport struct {
+	shared.Transport
+	addrs chan net.Addr
+}
+
+func (t listenTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := t.Transport.Listen(addr)
+	if err == nil {
+		t.addrs <- listener.Addr()
+	}
+	return listener, err
+}
+
+func TestStartWithoutInterfaces(t *testing.T) {
+	transport := listenTransport{shared.NetTransport{}, make(chan net.Addr, 1)}
+
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = transport
+	server.Limits = tcp_server.RateLimits{}
+	server.DiscoveryPort = 0
+	server.Interfaces = func() ([]net.IP, error) {
+		return nil, errors.New("No interfaces")
+	}
+	startServer(t, &server, "0.0.0.0:0")
+
+	addr := (<-transport.addrs).(*net.TCPAddr)
+	opts := tcp_client.DefaultOptions()
+	opts.PingInterval = 0
+	client := connectClient(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(addr.Port)), "alice", opts, func(p *shared.Packet) {})
+	if client.Username() != "alice" {
+		t.Errorf("Expected to log in as alice, got %s", client.Username())
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+)
+
+// How long -discover waits for servers to answer
+const DISCOVER_TIMEOUT = 2 * time.Second
+
+// discoverServer lists the servers on the local network, and lets the user pick one
+// when more than one answers. Questions are written to out.
+func discoverServer(stdin *bufio.Reader, out io.Writer, port int) (tcp_client.DiscoveredServer, error) {
+	fmt.Fprintln(out, "Looking for servers on the local network...")
+
+	servers, err := tcp_client.Discover(port, DISCOVER_TIMEOUT)
+	if err != nil {
+		return tcp_client.DiscoveredServer{}, err
+	}
+
+	if len(servers) == 0 {
+		return tcp_client.DiscoveredServer{}, errors.New("No servers found, give the address of the server instead")
+	}
+
+	for i, server := range servers {
+		fmt.Fprintf(out, "%d: %s\n", i+1, describeServer(server))
+	}
+
+	if len(servers) == 1 {
+		return servers[0], nil
+	}
+
+	for {
+		fmt.Fprintf(out, "Which server? [1-%d] ", len(servers))
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return tcp_client.DiscoveredServer{}, err
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(line))
+		if err == nil && n >= 1 && n <= len(servers) {
+			return servers[n-1], nil
+		}
+	}
+}
+
+// describeServer shows a discovered server in the list of -discover
+func describeServer(server tcp_client.DiscoveredServer) string {
+	text := fmt.Sprintf("%s at %s, %d online in %d rooms", server.Name, server.Addr, server.Users, server.Rooms)
+	if server.TLS {
+		text += ", TLS"
+	}
+
+	return text
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func TestDiscoverServer(t *testing.T) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	udp.Close()
+
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Name = "discover test"
+	server.Advertise = "chat.lan:7000"
+	server.DiscoveryPort = port
+	err = server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	found, err := discoverServer(bufio.NewReader(strings.NewReader("")), io.Discard, port)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if found.Name != "discover test" || found.Addr != "chat.lan:7000" {
+		t.Errorf("Expected the server advertised at chat.lan:7000, got %+v", found)
+	}
+}
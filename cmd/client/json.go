@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+)
+
+// runJSON reads one JSON message per line from r and sends it, and prints every
+// received message as a line of JSON. Errors are written to stderr, so stdout
+// only ever holds JSON.
+func runJSON(client *tcp_client.Client, r io.Reader) {
+	go client.Listen(jsonHandler)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		p, err := shared.PacketFromJSON([]byte(line))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: invalid message %s: %s\n", line, err)
+			continue
+		}
+
+		err = client.SendPacket(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: sending message: %s\n", err)
+			return
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR reading from stdin: %s\n", err)
+	}
+}
+
+func jsonHandler(p *shared.Packet) {
+	data, err := shared.PacketToJSON(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return
+	}
+
+	fmt.Println(string(data))
+}
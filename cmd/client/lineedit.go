@@ -0,0 +1,233 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+type keyCode int
+
+const (
+	KEY_RUNE keyCode = iota
+	KEY_ENTER
+	KEY_BACKSPACE
+	KEY_DELETE
+	KEY_TAB
+	KEY_BACKTAB
+	KEY_UP
+	KEY_DOWN
+	KEY_LEFT
+	KEY_RIGHT
+	KEY_HOME
+	KEY_END
+	KEY_PAGE_UP
+	KEY_PAGE_DOWN
+	KEY_ESCAPE
+	// Ctrl combinations that are not handled as one of the keys above
+	KEY_CTRL
+)
+
+type key struct {
+	code keyCode
+	// The character typed for KEY_RUNE, or the letter for KEY_CTRL
+	r rune
+}
+
+// escapeSequences maps the escape sequences sent by common terminals
+// (without the leading ESC) to keys.
+var escapeSequences = map[string]keyCode{
+	"[A":  KEY_UP,
+	"[B":  KEY_DOWN,
+	"[C":  KEY_RIGHT,
+	"[D":  KEY_LEFT,
+	"[H":  KEY_HOME,
+	"[F":  KEY_END,
+	"OH":  KEY_HOME,
+	"OF":  KEY_END,
+	"[1~": KEY_HOME,
+	"[7~": KEY_HOME,
+	"[4~": KEY_END,
+	"[8~": KEY_END,
+	"[3~": KEY_DELETE,
+	"[5~": KEY_PAGE_UP,
+	"[6~": KEY_PAGE_DOWN,
+	"[Z":  KEY_BACKTAB,
+}
+
+// parseKeys splits raw terminal input into key presses. Terminals send
+// an escape sequence in a single write, so it is never split between reads.
+func parseKeys(b []byte) []key {
+	keys := make([]key, 0, len(b))
+
+	for len(b) > 0 {
+		if b[0] == 0x1b {
+			matched := false
+			for seq, code := range escapeSequences {
+				if len(b) > len(seq) && string(b[1:1+len(seq)]) == seq {
+					keys = append(keys, key{code: code})
+					b = b[1+len(seq):]
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				keys = append(keys, key{code: KEY_ESCAPE})
+				b = b[1:]
+			}
+			continue
+		}
+
+		switch b[0] {
+		case '\r', '\n':
+			keys = append(keys, key{code: KEY_ENTER})
+		case 0x7f, 0x08:
+			keys = append(keys, key{code: KEY_BACKSPACE})
+		case '\t':
+			keys = append(keys, key{code: KEY_TAB})
+		default:
+			if b[0] < 0x20 {
+				keys = append(keys, key{code: KEY_CTRL, r: rune('a' + b[0] - 1)})
+				break
+			}
+
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, key{code: KEY_RUNE, r: r})
+			b = b[size:]
+			continue
+		}
+
+		b = b[1:]
+	}
+
+	return keys
+}
+
+// lineEditor is a single line of input with a cursor, and a history of submitted lines
+type lineEditor struct {
+	buf     []rune
+	cursor  int
+	history []string
+	// Index into history while browsing it, len(history) when editing a new line
+	histIndex int
+	// The line being edited before browsing the history
+	draft []rune
+}
+
+func (l *lineEditor) String() string {
+	return string(l.buf)
+}
+
+// handle applies the key to the line. It returns false if the key is not used for editing.
+func (l *lineEditor) handle(k key) bool {
+	switch k.code {
+	case KEY_RUNE:
+		l.insert(k.r)
+	case KEY_BACKSPACE:
+		if l.cursor > 0 {
+			l.buf = append(l.buf[:l.cursor-1], l.buf[l.cursor:]...)
+			l.cursor -= 1
+		}
+	case KEY_DELETE:
+		if l.cursor < len(l.buf) {
+			l.buf = append(l.buf[:l.cursor], l.buf[l.cursor+1:]...)
+		}
+	case KEY_LEFT:
+		l.cursor = max(l.cursor-1, 0)
+	case KEY_RIGHT:
+		l.cursor = min(l.cursor+1, len(l.buf))
+	case KEY_HOME:
+		l.cursor = 0
+	case KEY_END:
+		l.cursor = len(l.buf)
+	case KEY_UP:
+		l.historyMove(-1)
+	case KEY_DOWN:
+		l.historyMove(1)
+	case KEY_CTRL:
+		switch k.r {
+		case 'a':
+			l.cursor = 0
+		case 'e':
+			l.cursor = len(l.buf)
+		case 'b':
+			l.cursor = max(l.cursor-1, 0)
+		case 'f':
+			l.cursor = min(l.cursor+1, len(l.buf))
+		case 'u':
+			l.buf = l.buf[l.cursor:]
+			l.cursor = 0
+		case 'k':
+			l.buf = l.buf[:l.cursor]
+		case 'w':
+			l.deleteWord()
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (l *lineEditor) insert(r rune) {
+	l.buf = append(l.buf, 0)
+	copy(l.buf[l.cursor+1:], l.buf[l.cursor:])
+	l.buf[l.cursor] = r
+	l.cursor += 1
+}
+
+// deleteWord deletes the word before the cursor, and the spaces following it
+func (l *lineEditor) deleteWord() {
+	start := l.cursor
+	for start > 0 && unicode.IsSpace(l.buf[start-1]) {
+		start -= 1
+	}
+	for start > 0 && !unicode.IsSpace(l.buf[start-1]) {
+		start -= 1
+	}
+
+	l.buf = append(l.buf[:start], l.buf[l.cursor:]...)
+	l.cursor = start
+}
+
+func (l *lineEditor) historyMove(delta int) {
+	if len(l.history) == 0 {
+		return
+	}
+
+	if l.histIndex == len(l.history) {
+		l.draft = append([]rune{}, l.buf...)
+	}
+
+	l.histIndex = min(max(l.histIndex+delta, 0), len(l.history))
+	if l.histIndex == len(l.history) {
+		l.buf = append([]rune{}, l.draft...)
+	} else {
+		l.buf = []rune(l.history[l.histIndex])
+	}
+	l.cursor = len(l.buf)
+}
+
+// set replaces the line with text, with the cursor at the end
+func (l *lineEditor) set(text string) {
+	l.buf = []rune(text)
+	l.cursor = len(l.buf)
+	l.draft = nil
+	l.histIndex = len(l.history)
+}
+
+// submit returns the line, adds it to the history and clears the editor
+func (l *lineEditor) submit() string {
+	line := string(l.buf)
+	if line != "" && (len(l.history) == 0 || l.history[len(l.history)-1] != line) {
+		l.history = append(l.history, line)
+	}
+
+	l.buf = nil
+	l.cursor = 0
+	l.draft = nil
+	l.histIndex = len(l.history)
+	return line
+}
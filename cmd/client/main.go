@@ -1,46 +1,306 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/TobiasTheDanish/tcp-chat/shared"
 	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
 )
 
-type Message struct {
-	Username string
-	Msg      string
-}
-
 func main() {
+	username := flag.String("username", "", "Username to log in with, asked for when not given")
+	secret := flag.String("secret", "", "Secret proving the username is yours, kept by the server the first time it is given. Needed to get a role")
+	record := flag.String("record", "", "Record every packet sent and received to this file")
+	pingInterval := flag.Duration("ping-interval", shared.DEFAULT_PING_INTERVAL, "How often the server is pinged, 0 disables pings")
+	reconnect := flag.Bool("reconnect", true, "Reconnect automatically when the connection is lost")
+	tuiMode := flag.Bool("tui", false, "Run a full screen terminal UI")
+	jsonMode := flag.Bool("json", false, "Read messages as JSON lines from stdin, and print received messages as JSON lines")
+	useTLS := flag.Bool("tls", false, "Connect over TLS")
+	tlsCA := flag.String("tls-ca", "", "Trust the certificates in this PEM file for TLS, instead of the system certificates")
+	tlsInsecure := flag.Bool("tls-insecure", false, "Do not verify the certificate of the server for TLS")
+	discover := flag.Bool("discover", false, "Look for servers on the local network, instead of giving host:port")
+	discoveryPort := flag.Int("discovery-port", shared.DISCOVERY_PORT, "UDP port servers answer discovery probes on")
+	flag.Parse()
 
-	if len(os.Args) == 1 {
-		fmt.Println("Please provide host:port to connect to")
+	if flag.NArg() == 0 && !*discover {
+		fmt.Println("Please provide host:port to connect to, or use -discover")
 		os.Exit(1)
 	}
 
+	stdin := bufio.NewReader(os.Stdin)
+
+	addr := flag.Arg(0)
+	if *discover {
+		// Keep stdout for JSON only
+		out := os.Stdout
+		if *jsonMode {
+			out = os.Stderr
+		}
+
+		server, err := discoverServer(stdin, out, *discoveryPort)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			os.Exit(1)
+		}
+
+		addr = server.Addr
+		*useTLS = *useTLS || server.TLS
+		fmt.Fprintf(out, "Connecting to %s\n", server.Name)
+	}
+
+	opts := tcp_client.DefaultOptions()
+	opts.Username = *username
+	opts.Secret = *secret
+	opts.PingInterval = *pingInterval
+	opts.Reconnect = *reconnect
+	if *useTLS || *tlsCA != "" || *tlsInsecure {
+		config, err := tlsConfig(*tlsCA, *tlsInsecure)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.TLS = config
+	}
+	if *record != "" {
+		file, err := os.Create(*record)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		opts.Recorder = shared.NewRecorder(file)
+	}
+
+	if *jsonMode {
+		// Keep stdout for JSON only
+		opts.Output = os.Stderr
+		if opts.Username == "" {
+			fmt.Fprintln(os.Stderr, "Please provide -username in JSON mode")
+			os.Exit(1)
+		}
+	}
+
+	var ui *tui
+	if *tuiMode {
+		ui = newTUI()
+		opts.Output = tuiOutput{t: ui}
+	}
+
+	if opts.Username == "" {
+		fmt.Print("What is your username? ")
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			fmt.Println("ERROR reading from stdin: ", err)
+			os.Exit(1)
+		}
+		opts.Username = strings.TrimSpace(line)
+	}
+
 	// Resolve the string address to a TCP address
-	tcpClient, err := tcp_client.Connect(os.Args[1])
+	tcpClient, err := tcp_client.ConnectWithOptions(addr, opts)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	defer tcpClient.Close()
 
-	go tcpClient.Listen(messageHandler)
+	if *jsonMode {
+		runJSON(tcpClient, stdin)
+		return
+	}
 
-	for {
-		err := tcpClient.ReadSend(os.Stdin)
+	if ui != nil {
+		err = runTUI(ui, tcpClient)
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Printf("Welcome %s! Type /help for a list of commands.\n", tcpClient.Username())
+	currentRoom.Store(shared.DEFAULT_ROOM)
+	go tcpClient.Listen(messageHandler(tcpClient))
+
+	for !tcpClient.Closed() {
+		text, err := stdin.ReadString('\n')
 		if err != nil {
 			fmt.Println("ERROR reading from stdin: ", err)
 			return
 		}
+
+		reply, ok, err := fileCommand(tcpClient, text)
+		if ok {
+			if err != nil {
+				fmt.Printf("ERROR: %s\n", err)
+			} else {
+				fmt.Println(reply)
+			}
+			continue
+		}
+
+		_, err = tcpClient.SendLine(text, currentRoom.Load().(string))
+		if err != nil {
+			fmt.Printf("ERROR: message not sent: %s\n", err)
+		}
+	}
+}
+
+// currentRoom is the room lines are sent to in line mode, the last room joined
+var currentRoom atomic.Value
+
+// messageHandler prints the packets received in line mode
+func messageHandler(client *tcp_client.Client) tcp_client.MessageHandler {
+	transfers := newTransferEvents()
+	// When each user was last shown typing, by room and username. Clients send Typing
+	// again while the user keeps typing, which is only shown again after TYPING_TIMEOUT.
+	typing := make(map[[2]string]time.Time)
+
+	return func(p *shared.Packet) {
+		if text, ok := transfers.describe(client, p); ok {
+			fmt.Println(text)
+			return
+		}
+
+		kind, msg, err := p.DecodeMessage()
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			return
+		}
+
+		switch kind {
+		case shared.KIND_MESSAGE:
+			msg := msg.(*shared.Message)
+			delete(typing, [2]string{msg.Room, msg.Username})
+			printMessage(msg, "")
+		case shared.KIND_TYPING:
+			msg := msg.(*shared.Typing)
+			key := [2]string{msg.Room, msg.Username}
+			if !msg.Typing {
+				delete(typing, key)
+			} else if shown, ok := typing[key]; !ok || time.Since(shown) > shared.TYPING_TIMEOUT {
+				typing[key] = time.Now()
+				fmt.Printf("[%s] %s is typing…\n", msg.Room, msg.Username)
+			}
+		case shared.KIND_HISTORY, shared.KIND_THREAD:
+			msg := msg.(*shared.Message)
+			printMessage(msg, time.UnixMilli(msg.Time).Format("15:04 "))
+		case shared.KIND_EDIT:
+			edit := msg.(*shared.Edit)
+			fmt.Printf("[%s] %s edited message %d: %s\n", edit.Room, edit.Username, edit.ID, edit.Msg)
+		case shared.KIND_DELETE:
+			del := msg.(*shared.Delete)
+			fmt.Printf("[%s] %s deleted message %d\n", del.Room, del.Username, del.ID)
+		case shared.KIND_REACTION:
+			reaction := msg.(*shared.Reaction)
+			if reaction.Added {
+				fmt.Printf("[%s] %s reacted %s to message %d\n", reaction.Room, reaction.Username, reaction.Emoji, reaction.ID)
+			} else {
+				fmt.Printf("[%s] %s removed %s from message %d\n", reaction.Room, reaction.Username, reaction.Emoji, reaction.ID)
+			}
+		case shared.KIND_HISTORY_END:
+			end := msg.(*shared.HistoryEnd)
+			if end.Count > 0 {
+				fmt.Printf("[%s] --- end of history ---\n", end.Room)
+			}
+		case shared.KIND_JOIN:
+			room := msg.(*shared.Join).Room
+			currentRoom.Store(room)
+			fmt.Printf("Joined %s\n", room)
+		case shared.KIND_LEAVE:
+			room := msg.(*shared.Leave).Room
+			if currentRoom.CompareAndSwap(room, shared.DEFAULT_ROOM) {
+				fmt.Printf("Left %s, now talking in %s\n", room, shared.DEFAULT_ROOM)
+			} else {
+				fmt.Printf("Left %s\n", room)
+			}
+		case shared.KIND_PRESENCE:
+			// Presence sent when joining a room only fills in who is there
+			presence := msg.(*shared.Presence)
+			if presence.Room == "" && presence.Username != client.Username() {
+				fmt.Printf("* %s is %s\n", presence.Username, presence.Status)
+			}
+		case shared.KIND_COMMAND_REPLY:
+			fmt.Println(msg.(*shared.CommandReply).Msg)
+		case shared.KIND_PRIVATE_MESSAGE:
+			msg := msg.(*shared.PrivateMessage)
+			fmt.Printf("[%s -> %s] %s\n", msg.From, msg.To, msg.Msg)
+		case shared.KIND_ERROR:
+			msg := msg.(*shared.ErrorMessage)
+			if msg.Nonce != 0 {
+				fmt.Printf("ERROR: message not sent: %s\n", msg.Msg)
+			} else if msg.Command != "" {
+				fmt.Printf("ERROR /%s: %s\n", msg.Command, msg.Msg)
+			} else {
+				fmt.Printf("ERROR: %s\n", msg.Msg)
+			}
+		}
 	}
 }
 
-func messageHandler(p *shared.Packet) {
-	var msg Message
-	p.IntoType(&msg)
+// printMessage prints a chat message in line mode, with its ID for commands like /reply
+func printMessage(msg *shared.Message, stamp string) {
+	text := msg.Msg
+	if msg.Deleted {
+		text = "(message deleted)"
+	} else if msg.Edited != 0 {
+		text += " (edited)"
+	}
+	if msg.Replies > 0 {
+		text += fmt.Sprintf(" (%d replies)", msg.Replies)
+	}
+
+	id := fmt.Sprintf("#%d", msg.ID)
+	if msg.Parent != 0 {
+		id += fmt.Sprintf(" ↳#%d", msg.Parent)
+	}
+
+	if msg.Action {
+		fmt.Printf("[%s] %s%s * %s %s\n", msg.Room, stamp, id, msg.Username, text)
+	} else {
+		fmt.Printf("[%s] %s%s %s: %s\n", msg.Room, stamp, id, msg.Username, text)
+	}
+
+	if len(msg.Reactions) > 0 {
+		fmt.Printf("[%s]       %s\n", msg.Room, formatReactions(msg.Reactions))
+	}
+}
+
+// formatReactions shows every emoji followed by how many reacted with it, e.g. "👍 2  🎉 1"
+func formatReactions(reactions shared.Reactions) string {
+	parts := make([]string, 0, len(reactions))
+	for _, group := range reactions {
+		parts = append(parts, fmt.Sprintf("%s %d", group.Emoji, len(group.Users)))
+	}
+
+	return strings.Join(parts, "  ")
+}
+
+// tlsConfig trusts the certificates in the PEM file at ca, or the system certificates without one
+func tlsConfig(ca string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+	if ca == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New(fmt.Sprintf("No certificates in %s", ca))
+	}
 
-	fmt.Printf("%s: %s\n", msg.Username, msg.Msg)
+	return config, nil
 }
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var unsupportedTerminal = errors.New("The terminal UI is only supported on linux.")
+
+func makeRaw(fd int) (func(), error) {
+	return nil, unsupportedTerminal
+}
+
+func terminalSize(fd int) (int, int, error) {
+	return 0, 0, unsupportedTerminal
+}
+
+func notifyResize(ch chan<- os.Signal) {}
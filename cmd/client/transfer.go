@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+)
+
+// fileCommand runs the file transfer commands, which are handled by the client instead
+// of being sent to the server. It returns what to show the user, and false for any other line.
+func fileCommand(client *tcp_client.Client, line string) (string, bool, error) {
+	name, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args = strings.TrimSpace(args)
+
+	switch name {
+	case "/send":
+		to, path, _ := strings.Cut(args, " ")
+		path = strings.TrimSpace(path)
+		if to == "" || path == "" {
+			return "", true, errors.New("Usage: /send <user> <path>")
+		}
+
+		t, err := client.SendFile(to, path)
+		if err != nil {
+			return "", true, err
+		}
+
+		return fmt.Sprintf("Offered %s (%s) to %s as file %d", t.Offer.Name, formatSize(t.Offer.Size), to, t.Number), true, nil
+
+	case "/accept":
+		number, path, _ := strings.Cut(args, " ")
+		t, err := findTransfer(client, number, func(t tcp_client.Transfer) bool {
+			return !t.Outgoing && t.State == tcp_client.TRANSFER_OFFERED
+		})
+		if err != nil {
+			return "", true, err
+		}
+
+		t, err = client.AcceptFile(t.Offer.Transfer, strings.TrimSpace(path))
+		if err != nil {
+			return "", true, err
+		}
+
+		return fmt.Sprintf("Receiving %s from %s into %s", t.Offer.Name, t.Offer.From, t.Path), true, nil
+
+	case "/reject":
+		number, reason, _ := strings.Cut(args, " ")
+		t, err := findTransfer(client, number, func(t tcp_client.Transfer) bool {
+			return !t.Outgoing && t.State == tcp_client.TRANSFER_OFFERED
+		})
+		if err != nil {
+			return "", true, err
+		}
+
+		err = client.RejectFile(t.Offer.Transfer, strings.TrimSpace(reason))
+		if err != nil {
+			return "", true, err
+		}
+
+		return fmt.Sprintf("Rejected %s from %s", t.Offer.Name, t.Offer.From), true, nil
+
+	case "/cancel":
+		t, err := findTransfer(client, args, func(t tcp_client.Transfer) bool { return !t.Finished() })
+		if err != nil {
+			return "", true, err
+		}
+
+		err = client.CancelFile(t.Offer.Transfer)
+		if err != nil {
+			return "", true, err
+		}
+
+		return fmt.Sprintf("Cancelled %s", t.Offer.Name), true, nil
+
+	case "/files":
+		transfers := client.Transfers()
+		if len(transfers) == 0 {
+			return "No file transfers", true, nil
+		}
+
+		lines := make([]string, 0, len(transfers))
+		for _, t := range transfers {
+			lines = append(lines, describeTransfer(t))
+		}
+		return strings.Join(lines, "\n"), true, nil
+	}
+
+	return "", false, nil
+}
+
+// findTransfer returns the transfer with the number the user typed, or the latest
+// one matching when no number is given
+func findTransfer(client *tcp_client.Client, number string, match func(tcp_client.Transfer) bool) (tcp_client.Transfer, error) {
+	transfers := client.Transfers()
+
+	if number == "" {
+		for i := len(transfers) - 1; i >= 0; i-- {
+			if match(transfers[i]) {
+				return transfers[i], nil
+			}
+		}
+
+		return tcp_client.Transfer{}, errors.Join(tcp_client.UnknownTransfer, errors.New("No file to use it on"))
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(number, "#"))
+	if err != nil {
+		return tcp_client.Transfer{}, errors.New(fmt.Sprintf("Invalid file number '%s'", number))
+	}
+
+	for _, t := range transfers {
+		if t.Number == n && match(t) {
+			return t, nil
+		}
+	}
+
+	return tcp_client.Transfer{}, errors.Join(tcp_client.UnknownTransfer, errors.New(fmt.Sprintf("No file %d to use it on", n)))
+}
+
+// describeTransfer shows a transfer in the list of /files
+func describeTransfer(t tcp_client.Transfer) string {
+	peer := "from " + t.Offer.From
+	if t.Outgoing {
+		peer = "to " + t.Offer.To
+	}
+
+	text := fmt.Sprintf("%d: %s (%s) %s, %s", t.Number, t.Offer.Name, formatSize(t.Offer.Size), peer, t.State)
+	switch t.State {
+	case tcp_client.TRANSFER_ACTIVE:
+		text += fmt.Sprintf(" %d%%", t.Percent())
+	case tcp_client.TRANSFER_FAILED:
+		text += ": " + t.Reason
+	}
+
+	return text
+}
+
+// formatSize shows a number of bytes the way people read them, e.g. "1.5 KB"
+func formatSize(size uint64) string {
+	switch {
+	case size < 1<<10:
+		return fmt.Sprintf("%d B", size)
+	case size < 1<<20:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	}
+}
+
+// transferEvents turns the file transfer packets from the server into lines for the user,
+// reporting the progress of a transfer every quarter of the file
+type transferEvents struct {
+	mu sync.Mutex
+	// The last quarter reported of every transfer
+	reported map[uint64]int
+}
+
+func newTransferEvents() *transferEvents {
+	return &transferEvents{reported: make(map[uint64]int)}
+}
+
+// describe returns the line to show for the packet, and false if there is nothing to show.
+// The client must have tracked the packet already.
+func (e *transferEvents) describe(client *tcp_client.Client, p *shared.Packet) (string, bool) {
+	var id uint64
+	switch p.Kind() {
+	case shared.KIND_FILE_OFFER:
+		var offer shared.FileOffer
+		p.IntoMessage(&offer)
+		id = offer.Transfer
+	case shared.KIND_FILE_ANSWER:
+		var answer shared.FileAnswer
+		p.IntoMessage(&answer)
+		id = answer.Transfer
+	case shared.KIND_FILE_CHUNK:
+		var chunk shared.FileChunk
+		p.IntoMessage(&chunk)
+		id = chunk.Transfer
+	case shared.KIND_FILE_PROGRESS:
+		var progress shared.FileProgress
+		p.IntoMessage(&progress)
+		id = progress.Transfer
+	case shared.KIND_FILE_DONE:
+		var done shared.FileDone
+		p.IntoMessage(&done)
+		id = done.Transfer
+	default:
+		return "", false
+	}
+
+	t, ok := client.Transfer(id)
+	if !ok {
+		return "", false
+	}
+
+	switch p.Kind() {
+	case shared.KIND_FILE_OFFER:
+		return fmt.Sprintf("%s offers you %s (%s), /accept %d [path] or /reject %d", t.Offer.From, t.Offer.Name, formatSize(t.Offer.Size), t.Number, t.Number), true
+	case shared.KIND_FILE_ANSWER:
+		if t.State == tcp_client.TRANSFER_FAILED {
+			return fmt.Sprintf("%s: %s", t.Offer.Name, t.Reason), true
+		}
+		return fmt.Sprintf("%s accepted %s, sending it", t.Offer.To, t.Offer.Name), true
+	case shared.KIND_FILE_CHUNK, shared.KIND_FILE_PROGRESS:
+		if t.State != tcp_client.TRANSFER_ACTIVE {
+			return "", false
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		quarter := t.Percent() / 25
+		if quarter == 0 || quarter >= 4 || quarter <= e.reported[id] {
+			return "", false
+		}
+		e.reported[id] = quarter
+		return fmt.Sprintf("%s: %d%% (%s of %s)", t.Offer.Name, t.Percent(), formatSize(t.Progress), formatSize(t.Offer.Size)), true
+	case shared.KIND_FILE_DONE:
+		e.mu.Lock()
+		delete(e.reported, id)
+		e.mu.Unlock()
+
+		switch {
+		case t.State != tcp_client.TRANSFER_DONE:
+			return fmt.Sprintf("File transfer %s failed: %s", t.Offer.Name, t.Reason), true
+		case t.Outgoing:
+			return fmt.Sprintf("Sent %s to %s", t.Offer.Name, t.Offer.To), true
+		default:
+			return fmt.Sprintf("Received %s from %s, saved as %s", t.Offer.Name, t.Offer.From, t.Path), true
+		}
+	}
+
+	return "", false
+}
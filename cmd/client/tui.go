@@ -0,0 +1,1086 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+)
+
+const (
+	SIDEBAR_WIDTH      = 22
+	MIN_SIDEBAR_WIDTH  = 60
+	MAX_LINES_PER_ROOM = 1000
+	// How many older messages are requested when scrolling to the top
+	HISTORY_PAGE = 50
+)
+
+var usernameColors = []string{"31", "32", "33", "34", "35", "36", "91", "92", "93", "94", "95", "96"}
+
+// usernameColor picks a color for the username, the same username always gets the same color
+func usernameColor(username string) string {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return usernameColors[h.Sum32()%uint32(len(usernameColors))]
+}
+
+type chatLine struct {
+	// ID of the message, 0 for lines that are not chat messages
+	id       uint64
+	time     time.Time
+	username string
+	text     string
+	// Action lines are sent with /me, and shown as "* username text"
+	action bool
+	// Nonce of a message sent by the user, pending until the server acknowledges it
+	nonce   uint64
+	pending bool
+	// Why the server rejected the message
+	failed    string
+	edited    bool
+	deleted   bool
+	reactions shared.Reactions
+	// ID of the message this replies to, and how many replies this message has
+	parent  uint64
+	replies uint16
+	// System lines are status messages from the client or server, not chat
+	system bool
+}
+
+type tui struct {
+	client *tcp_client.Client
+	out    *bufio.Writer
+
+	mu     sync.Mutex
+	width  int
+	height int
+	room   string
+	lines  map[string][]chatLine
+	unread map[string]int
+	// Users seen in each room, from their messages and presence
+	users  map[string]map[string]bool
+	input  lineEditor
+	scroll int
+	quit   chan struct{}
+	// Closes quit once
+	quitOnce sync.Once
+	// Status of every user seen
+	presence map[string]shared.PresenceStatus
+	// When users typing in each room stop being shown as typing
+	typing map[string]map[string]time.Time
+	// The room the user is shown as typing in, empty when not typing
+	typingRoom string
+	// When a Typing start was last sent, and when the line was last edited
+	typingSent time.Time
+	lastEdit   time.Time
+	// ID and room of the message being edited, 0 when writing a new message
+	editing     uint64
+	editingRoom string
+	// ID of the message whose thread is open in the current room, 0 for the room itself
+	thread uint64
+	// ID of the message selected for opening its thread, 0 when not selecting
+	selected uint64
+	// Rooms with older messages on the server, from the last HistoryEnd
+	more map[string]bool
+	// Rooms with a HistoryRequest waiting for its HistoryEnd
+	fetching map[string]bool
+	// Lines shown for the files sent and received
+	transfers *transferEvents
+}
+
+// tuiOutput receives the status messages of the client, and shows them as system lines
+type tuiOutput struct {
+	t *tui
+}
+
+func (o tuiOutput) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		o.t.system(line)
+	}
+
+	return len(p), nil
+}
+
+func newTUI() *tui {
+	return &tui{
+		out:       bufio.NewWriter(os.Stdout),
+		room:      shared.DEFAULT_ROOM,
+		lines:     make(map[string][]chatLine),
+		unread:    make(map[string]int),
+		users:     make(map[string]map[string]bool),
+		quit:      make(chan struct{}),
+		presence:  make(map[string]shared.PresenceStatus),
+		typing:    make(map[string]map[string]time.Time),
+		more:      make(map[string]bool),
+		fetching:  make(map[string]bool),
+		transfers: newTransferEvents(),
+	}
+}
+
+// runTUI takes over the terminal until the user quits with Ctrl-C or Ctrl-D
+func runTUI(t *tui, client *tcp_client.Client) error {
+	t.client = client
+
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	t.mu.Lock()
+	t.resize()
+	t.mu.Unlock()
+
+	// Switch to the alternate screen, so the previous content of the terminal is restored on exit
+	fmt.Print("\x1b[?1049h")
+	defer fmt.Print("\x1b[?1049l")
+
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+
+	keys := make(chan []key)
+	go readKeys(keys)
+	go client.Listen(t.handlePacket)
+
+	t.system(fmt.Sprintf("Logged in as %s. Tab switches room, PgUp/PgDn scrolls, Ctrl-O edits your last message, Ctrl-T opens a thread, +:emoji: reacts to the last message, /help lists commands, Ctrl-C quits.", client.Username()))
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.quit:
+			return nil
+		case batch, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			for _, k := range batch {
+				if !t.handleKey(k) {
+					return nil
+				}
+			}
+		case <-resized:
+			t.mu.Lock()
+			t.resize()
+			t.mu.Unlock()
+		case <-ticker.C:
+			t.mu.Lock()
+			if time.Since(t.lastEdit) > shared.TYPING_TIMEOUT/2 {
+				t.stopTyping()
+			}
+			t.mu.Unlock()
+		}
+
+		t.render()
+	}
+}
+
+func readKeys(keys chan<- []key) {
+	defer close(keys)
+
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+
+		keys <- parseKeys(buf[:n])
+	}
+}
+
+// resize reads the size of the terminal, t.mu must be held
+func (t *tui) resize() {
+	width, height, err := terminalSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	t.width = width
+	t.height = height
+}
+
+// handleKey returns false when the user wants to quit
+func (t *tui) handleKey(k key) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if k.code == KEY_CTRL && (k.r == 'c' || k.r == 'd') {
+		return false
+	}
+
+	if k.code == KEY_CTRL && k.r == 'o' {
+		t.editPrevious()
+		return true
+	}
+
+	if k.code == KEY_CTRL && k.r == 't' {
+		if t.selected == 0 && t.thread == 0 {
+			t.selected = t.selectable(0, -1)
+		}
+		return true
+	}
+
+	// While selecting a message the arrows move the selection, any other key stops selecting
+	if t.selected != 0 {
+		switch k.code {
+		case KEY_UP, KEY_DOWN:
+			delta := -1
+			if k.code == KEY_DOWN {
+				delta = 1
+			}
+			if id := t.selectable(t.selected, delta); id != 0 {
+				t.selected = id
+			}
+			return true
+		case KEY_ENTER:
+			t.openThread(t.selected)
+			t.selected = 0
+			return true
+		case KEY_ESCAPE:
+			t.selected = 0
+			return true
+		}
+		t.selected = 0
+	}
+
+	before := t.input.String()
+	if t.input.handle(k) {
+		if t.input.String() != before {
+			t.lastEdit = time.Now()
+		}
+		t.updateTyping()
+		return true
+	}
+	defer t.updateTyping()
+
+	switch k.code {
+	case KEY_ENTER:
+		t.stopTyping()
+		line := t.input.submit()
+		if t.editing != 0 {
+			go t.sendEdit(t.editingRoom, t.editing, line)
+			t.editing = 0
+		} else if emoji, ok := reactionShortcut(line); ok {
+			t.reactToLast(emoji)
+		} else if strings.TrimSpace(line) != "" {
+			go t.send(line)
+		}
+	case KEY_ESCAPE:
+		if t.editing != 0 {
+			t.editing = 0
+			t.input.set("")
+		} else if t.thread != 0 {
+			t.thread = 0
+			t.scroll = 0
+		}
+	case KEY_TAB:
+		t.switchRoom(1)
+	case KEY_BACKTAB:
+		t.switchRoom(-1)
+	case KEY_PAGE_UP:
+		t.scroll += t.paneHeight() - 1
+	case KEY_PAGE_DOWN:
+		t.scroll = max(t.scroll-(t.paneHeight()-1), 0)
+	case KEY_CTRL:
+		switch k.r {
+		case 'n':
+			t.switchRoom(1)
+		case 'p':
+			t.switchRoom(-1)
+		case 'l':
+			// Redrawn after every key
+		}
+	}
+
+	return true
+}
+
+func (t *tui) send(line string) {
+	if reply, ok, err := fileCommand(t.client, line); ok {
+		if err != nil {
+			reply = fmt.Sprintf("ERROR: %s", err)
+		}
+		for _, text := range strings.Split(reply, "\n") {
+			t.system(text)
+		}
+		return
+	}
+
+	// Held while sending, so the Ack is handled after the pending line is added
+	t.mu.Lock()
+	room := t.room
+	nonce, err := t.client.SendReply(line, room, t.thread)
+	if err == nil && nonce != 0 {
+		t.addLine(room, chatLine{
+			time:     time.Now(),
+			username: t.client.Username(),
+			text:     shared.UnescapeLine(strings.TrimSpace(line)),
+			nonce:    nonce,
+			pending:  true,
+			parent:   t.thread,
+		})
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		t.system(fmt.Sprintf("Message not sent: %s", err))
+	}
+
+	if t.client.Closed() {
+		t.quitOnce.Do(func() { close(t.quit) })
+	}
+}
+
+// visible reports whether the line is shown in the current view: in the room
+// every message not in a thread, in a thread the message starting it and its replies.
+// t.mu must be held.
+func (t *tui) visible(line chatLine) bool {
+	if line.system {
+		return true
+	}
+
+	if t.thread == 0 {
+		return line.parent == 0
+	}
+
+	return line.id == t.thread || line.parent == t.thread
+}
+
+// selectable returns the ID of the next visible message from the message with
+// the ID from, going up for a negative delta and down otherwise. From 0 starts
+// at the bottom. It returns 0 if there is no such message, t.mu must be held.
+func (t *tui) selectable(from uint64, delta int) uint64 {
+	lines := t.lines[t.room]
+	i := len(lines)
+	if from != 0 {
+		i = slices.IndexFunc(lines, func(line chatLine) bool { return line.id == from })
+	}
+
+	for i += delta; i >= 0 && i < len(lines); i += delta {
+		if lines[i].id != 0 && !lines[i].deleted && t.visible(lines[i]) {
+			return lines[i].id
+		}
+	}
+
+	return 0
+}
+
+// openThread shows the thread of the message, and fetches its replies, t.mu must be held
+func (t *tui) openThread(id uint64) {
+	if line := t.lineById(t.room, id); line != nil && line.parent != 0 {
+		id = line.parent
+	}
+
+	t.thread = id
+	t.scroll = 0
+
+	req := shared.ThreadRequest{Room: t.room, ID: id}
+	go func() {
+		err := t.client.SendMessage(shared.KIND_THREAD_REQUEST, req)
+		if err != nil {
+			t.system(fmt.Sprintf("ERROR: fetching thread: %s", err))
+		}
+	}()
+}
+
+// editPrevious starts editing the last message the user sent to the current
+// room, or the one before the message being edited. t.mu must be held.
+func (t *tui) editPrevious() {
+	if t.editingRoom != t.room {
+		t.editing = 0
+	}
+
+	lines := t.lines[t.room]
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := lines[i]
+		if line.id == 0 || line.deleted || line.username != t.client.Username() || !t.visible(line) {
+			continue
+		}
+		if t.editing != 0 && line.id >= t.editing {
+			continue
+		}
+
+		t.stopTyping()
+		t.editing = line.id
+		t.editingRoom = t.room
+		t.input.set(line.text)
+		return
+	}
+}
+
+// sendEdit replaces the text of the message, or deletes it when text is empty
+func (t *tui) sendEdit(room string, id uint64, text string) {
+	var err error
+	if text = strings.TrimSpace(text); text == "" {
+		err = t.client.SendMessage(shared.KIND_DELETE, shared.Delete{ID: id, Room: room})
+	} else {
+		err = t.client.SendMessage(shared.KIND_EDIT, shared.Edit{ID: id, Room: room, Msg: text})
+	}
+
+	if err != nil {
+		t.system(fmt.Sprintf("Message not changed: %s", err))
+	}
+}
+
+// reactionShortcut reports whether the line is a reaction to the last message,
+// like "+:tada:" or "+🎉", and returns the emoji
+func reactionShortcut(line string) (string, bool) {
+	emoji, ok := strings.CutPrefix(strings.TrimSpace(line), "+")
+	if !ok || emoji == "" || strings.ContainsAny(emoji, " \t") {
+		return "", false
+	}
+
+	shortCode := len(emoji) > 2 && strings.HasPrefix(emoji, ":") && strings.HasSuffix(emoji, ":")
+	r, _ := utf8.DecodeRuneInString(emoji)
+	return emoji, shortCode || r >= utf8.RuneSelf
+}
+
+// reactToLast toggles the reaction of the user on the last message in the
+// current room, t.mu must be held
+func (t *tui) reactToLast(emoji string) {
+	lines := t.lines[t.room]
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i].id == 0 || lines[i].deleted || !t.visible(lines[i]) {
+			continue
+		}
+
+		reaction := shared.Reaction{ID: lines[i].id, Room: t.room, Emoji: emoji}
+		go func() {
+			err := t.client.SendMessage(shared.KIND_REACTION, reaction)
+			if err != nil {
+				t.system(fmt.Sprintf("Reaction not sent: %s", err))
+			}
+		}()
+		return
+	}
+
+	t.addLine(t.room, chatLine{time: time.Now(), text: "No message to react to", system: true})
+}
+
+// lineById finds the line of the message with the ID in the room, t.mu must be held
+func (t *tui) lineById(room string, id uint64) *chatLine {
+	lines := t.lines[room]
+	for i := range lines {
+		if lines[i].id == id {
+			return &lines[i]
+		}
+	}
+
+	return nil
+}
+
+// updateTyping tells the server whether the user is writing a message in the
+// current room, t.mu must be held
+func (t *tui) updateTyping() {
+	line := strings.TrimSpace(t.input.String())
+	// Commands and reactions are not messages being written
+	_, reacting := reactionShortcut(line)
+	writing := line != "" && t.editing == 0 && !reacting && (!strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//"))
+	if !writing || time.Since(t.lastEdit) > shared.TYPING_TIMEOUT/2 {
+		t.stopTyping()
+		return
+	}
+
+	if t.typingRoom != t.room {
+		t.stopTyping()
+	} else if time.Since(t.typingSent) < shared.TYPING_RESEND_INTERVAL {
+		return
+	}
+
+	t.typingRoom = t.room
+	t.typingSent = time.Now()
+	t.client.SendMessage(shared.KIND_TYPING, shared.Typing{Room: t.room, Typing: true})
+}
+
+// stopTyping tells the server the user stopped writing, t.mu must be held
+func (t *tui) stopTyping() {
+	if t.typingRoom == "" {
+		return
+	}
+
+	t.client.SendMessage(shared.KIND_TYPING, shared.Typing{Room: t.typingRoom, Typing: false})
+	t.typingRoom = ""
+}
+
+// typingUsers returns the users typing in the current room, t.mu must be held
+func (t *tui) typingUsers() []string {
+	now := time.Now()
+	users := make([]string, 0)
+	for user, until := range t.typing[t.room] {
+		if now.Before(until) {
+			users = append(users, user)
+		}
+	}
+
+	sort.Strings(users)
+	return users
+}
+
+// rooms returns the rooms shown in the sidebar, t.mu must be held
+func (t *tui) rooms() []string {
+	rooms := t.client.Rooms()
+	if !slices.Contains(rooms, t.room) {
+		rooms = append(rooms, t.room)
+		sort.Strings(rooms)
+	}
+
+	return rooms
+}
+
+// switchRoom moves delta rooms down the sidebar, t.mu must be held
+func (t *tui) switchRoom(delta int) {
+	rooms := t.rooms()
+	i := slices.Index(rooms, t.room)
+	i = (i + delta + len(rooms)) % len(rooms)
+
+	t.room = rooms[i]
+	t.unread[t.room] = 0
+	t.scroll = 0
+	t.thread = 0
+	t.selected = 0
+}
+
+func (t *tui) addLine(room string, line chatLine) {
+	if !t.insertLine(room, line) {
+		return
+	}
+
+	if lines := t.lines[room]; len(lines) > MAX_LINES_PER_ROOM {
+		t.lines[room] = lines[len(lines)-MAX_LINES_PER_ROOM:]
+	}
+
+	if room != t.room && !line.system {
+		t.unread[room] += 1
+	}
+}
+
+// insertLine adds a chat message in the order of its ID, and other lines at the
+// end. It returns false if a message with the same ID was already shown.
+func (t *tui) insertLine(room string, line chatLine) bool {
+	lines := t.lines[room]
+
+	i := len(lines)
+	if line.id != 0 {
+		for j, other := range lines {
+			if other.id == line.id {
+				return false
+			}
+			if other.id > line.id && i == len(lines) {
+				i = j
+			}
+		}
+	}
+
+	t.lines[room] = slices.Insert(lines, i, line)
+	return true
+}
+
+// lineByNonce finds the line of the message the user sent with the nonce, t.mu must be held
+func (t *tui) lineByNonce(nonce uint64) *chatLine {
+	for _, lines := range t.lines {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if lines[i].nonce == nonce {
+				return &lines[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchOlder requests the messages before the oldest message of the current room,
+// if the server has any, t.mu must be held
+func (t *tui) fetchOlder() {
+	room := t.room
+	if !t.more[room] || t.fetching[room] {
+		return
+	}
+
+	var before uint64
+	for _, line := range t.lines[room] {
+		if line.id != 0 {
+			before = line.id
+			break
+		}
+	}
+
+	t.fetching[room] = true
+	go func() {
+		err := t.client.SendMessage(shared.KIND_HISTORY_REQUEST, shared.HistoryRequest{
+			Room:   room,
+			Before: before,
+			Limit:  HISTORY_PAGE,
+		})
+		if err != nil {
+			t.system(fmt.Sprintf("ERROR: fetching history: %s", err))
+		}
+	}()
+}
+
+// messageLine turns a chat message into a line
+func messageLine(msg *shared.Message) chatLine {
+	stamp := time.Now()
+	if msg.Time != 0 {
+		stamp = time.UnixMilli(msg.Time)
+	}
+
+	return chatLine{
+		id:        msg.ID,
+		time:      stamp,
+		username:  msg.Username,
+		text:      msg.Msg,
+		action:    msg.Action,
+		edited:    msg.Edited != 0,
+		deleted:   msg.Deleted,
+		reactions: msg.Reactions,
+		parent:    msg.Parent,
+		replies:   msg.Replies,
+	}
+}
+
+// system shows a status message in the current room
+func (t *tui) system(text string) {
+	t.mu.Lock()
+	t.addLine(t.room, chatLine{time: time.Now(), text: text, system: true})
+	t.mu.Unlock()
+
+	t.render()
+}
+
+func (t *tui) handlePacket(p *shared.Packet) {
+	if text, ok := t.transfers.describe(t.client, p); ok {
+		t.system(text)
+		return
+	}
+
+	kind, msg, err := p.DecodeMessage()
+	if err != nil {
+		t.system(fmt.Sprintf("ERROR: %s", err))
+		return
+	}
+
+	t.mu.Lock()
+	switch kind {
+	case shared.KIND_MESSAGE:
+		msg := msg.(*shared.Message)
+		delete(t.typing[msg.Room], msg.Username)
+		if line := t.ownLine(msg); line != nil {
+			line.id = msg.ID
+			line.time = time.UnixMilli(msg.Time)
+			line.pending = false
+		} else {
+			t.addLine(msg.Room, messageLine(msg))
+		}
+		if t.users[msg.Room] == nil {
+			t.users[msg.Room] = make(map[string]bool)
+		}
+		t.users[msg.Room][msg.Username] = true
+	case shared.KIND_HISTORY, shared.KIND_THREAD:
+		msg := msg.(*shared.Message)
+		t.insertLine(msg.Room, messageLine(msg))
+	case shared.KIND_THREAD_INFO:
+		info := msg.(*shared.ThreadInfo)
+		if line := t.lineById(info.Room, info.ID); line != nil {
+			line.replies = info.Replies
+		}
+	case shared.KIND_EDIT:
+		edit := msg.(*shared.Edit)
+		if line := t.lineById(edit.Room, edit.ID); line != nil {
+			line.text = edit.Msg
+			line.edited = true
+		}
+	case shared.KIND_DELETE:
+		del := msg.(*shared.Delete)
+		if line := t.lineById(del.Room, del.ID); line != nil {
+			line.text = ""
+			line.deleted = true
+			line.reactions = nil
+		}
+		if t.editing == del.ID {
+			t.editing = 0
+			t.input.set("")
+		}
+	case shared.KIND_REACTION:
+		reaction := msg.(*shared.Reaction)
+		if line := t.lineById(reaction.Room, reaction.ID); line != nil {
+			line.reactions = line.reactions.Set(reaction.Emoji, reaction.Username, reaction.Added)
+		}
+	case shared.KIND_HISTORY_END:
+		end := msg.(*shared.HistoryEnd)
+		t.more[end.Room] = end.More
+		t.fetching[end.Room] = false
+	case shared.KIND_JOIN:
+		room := msg.(*shared.Join).Room
+		t.addLine(room, chatLine{time: time.Now(), text: fmt.Sprintf("Joined %s", room), system: true})
+		// Rooms joined with /join are switched to right away
+		t.room = room
+		t.unread[room] = 0
+		t.scroll = 0
+		t.thread = 0
+		t.selected = 0
+	case shared.KIND_LEAVE:
+		room := msg.(*shared.Leave).Room
+		if room == t.room {
+			t.room = shared.DEFAULT_ROOM
+			t.thread = 0
+			t.selected = 0
+		}
+		t.addLine(t.room, chatLine{time: time.Now(), text: fmt.Sprintf("Left %s", room), system: true})
+	case shared.KIND_COMMAND_REPLY:
+		t.addLine(t.room, chatLine{time: time.Now(), text: msg.(*shared.CommandReply).Msg, system: true})
+	case shared.KIND_PRIVATE_MESSAGE:
+		msg := msg.(*shared.PrivateMessage)
+		t.addLine(t.room, chatLine{time: time.Now(), username: fmt.Sprintf("%s -> %s", msg.From, msg.To), text: msg.Msg})
+	case shared.KIND_TYPING:
+		typing := msg.(*shared.Typing)
+		if t.typing[typing.Room] == nil {
+			t.typing[typing.Room] = make(map[string]time.Time)
+		}
+		if typing.Typing {
+			t.typing[typing.Room][typing.Username] = time.Now().Add(shared.TYPING_TIMEOUT)
+		} else {
+			delete(t.typing[typing.Room], typing.Username)
+		}
+	case shared.KIND_PRESENCE:
+		presence := msg.(*shared.Presence)
+		old, known := t.presence[presence.Username]
+		t.presence[presence.Username] = presence.Status
+		if presence.Room != "" {
+			if t.users[presence.Room] == nil {
+				t.users[presence.Room] = make(map[string]bool)
+			}
+			t.users[presence.Room][presence.Username] = true
+		} else if known && old != presence.Status && presence.Username != t.client.Username() {
+			for room, users := range t.users {
+				if users[presence.Username] {
+					t.addLine(room, chatLine{time: time.Now(), text: fmt.Sprintf("%s is %s", presence.Username, presence.Status), system: true})
+				}
+			}
+		}
+	case shared.KIND_ACK:
+		ack := msg.(*shared.Ack)
+		if line := t.lineByNonce(ack.Nonce); line != nil {
+			line.id = ack.ID
+			line.time = time.UnixMilli(ack.Time)
+			line.pending = false
+		}
+	case shared.KIND_ERROR:
+		msg := msg.(*shared.ErrorMessage)
+		if line := t.lineByNonce(msg.Nonce); msg.Nonce != 0 && line != nil {
+			line.pending = false
+			line.failed = msg.Msg
+			break
+		}
+
+		text := fmt.Sprintf("ERROR: %s", msg.Msg)
+		if msg.Command != "" {
+			text = fmt.Sprintf("ERROR /%s: %s", msg.Command, msg.Msg)
+		}
+		t.addLine(t.room, chatLine{time: time.Now(), text: text, system: true})
+	}
+	t.mu.Unlock()
+
+	t.render()
+}
+
+// paneHeight is the number of rows used for messages, t.mu must be held
+func (t *tui) paneHeight() int {
+	return max(t.height-2, 1)
+}
+
+// paneWidth is the number of columns used for messages, t.mu must be held
+func (t *tui) paneWidth() int {
+	if t.width < MIN_SIDEBAR_WIDTH {
+		return t.width
+	}
+
+	return t.width - SIDEBAR_WIDTH - 1
+}
+
+// wrap splits text into rows of at most width characters
+func wrap(text string, width int) []string {
+	runes := []rune(text)
+	if width <= 0 {
+		return []string{text}
+	}
+
+	rows := make([]string, 0, len(runes)/width+1)
+	for len(runes) > width {
+		cut := width
+		// Prefer breaking at a space, if there is one in the second half of the row
+		for i := width; i > width/2; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+
+		rows = append(rows, string(runes[:cut]))
+		runes = runes[cut:]
+		if len(runes) > 0 && runes[0] == ' ' {
+			runes = runes[1:]
+		}
+	}
+
+	return append(rows, string(runes))
+}
+
+// formatLine wraps the line to width, and colors the username in the first row.
+// Reactions are shown in a row beneath, with the ones of self highlighted.
+func formatLine(line chatLine, width int, self string) []string {
+	stamp := line.time.Format("15:04")
+	if line.system {
+		rows := wrap(fmt.Sprintf("%s * %s", stamp, line.text), width)
+		for i := range rows {
+			rows[i] = "\x1b[2m" + rows[i] + "\x1b[0m"
+		}
+		return rows
+	}
+
+	format := "%s %s: "
+	if line.action {
+		format = "%s * %s "
+	}
+
+	text := line.text
+	if line.deleted {
+		text = "(message deleted)"
+	} else if line.edited {
+		text += " (edited)"
+	}
+
+	if line.pending {
+		text += " (sending)"
+	} else if line.failed != "" {
+		text += fmt.Sprintf(" (not sent: %s)", line.failed)
+	}
+
+	prefix := fmt.Sprintf(format, stamp, line.username)
+	rows := wrap(prefix+text, width)
+
+	colored := fmt.Sprintf(format, stamp, fmt.Sprintf("\x1b[1;%sm%s\x1b[0m", usernameColor(line.username), line.username))
+	if strings.HasPrefix(rows[0], prefix) {
+		rows[0] = colored + strings.TrimPrefix(rows[0], prefix)
+	}
+
+	// Messages not acknowledged by the server and deleted messages are dimmed,
+	// and rejected messages are red
+	if line.pending || line.deleted || line.failed != "" {
+		style := "\x1b[2m"
+		if line.failed != "" {
+			style = "\x1b[31m"
+		}
+		for i := range rows {
+			rows[i] = style + strings.ReplaceAll(rows[i], "\x1b[0m", "\x1b[0m"+style) + "\x1b[0m"
+		}
+	}
+
+	if len(line.reactions) > 0 {
+		rows = append(rows, formatReactionRow(line.reactions, width, self))
+	}
+
+	return rows
+}
+
+// formatReactionRow shows as many of the reactions as fit in width, indented
+// below the message
+func formatReactionRow(reactions shared.Reactions, width int, self string) string {
+	row := "      "
+	used := len(row)
+	for _, group := range reactions {
+		part := fmt.Sprintf("%s %d", group.Emoji, len(group.Users))
+		// Emojis usually take two columns
+		size := len([]rune(part)) + 3
+		if used+size > width {
+			break
+		}
+		used += size
+
+		if slices.Contains(group.Users, self) {
+			row += fmt.Sprintf("\x1b[1;36m[%s]\x1b[0m ", part)
+		} else {
+			row += fmt.Sprintf("\x1b[2m[%s]\x1b[0m ", part)
+		}
+	}
+
+	return row
+}
+
+func (t *tui) render() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.width == 0 {
+		return
+	}
+
+	paneWidth := t.paneWidth()
+	paneHeight := t.paneHeight()
+
+	rows := make([]string, 0)
+	for _, line := range t.lines[t.room] {
+		if !t.visible(line) {
+			continue
+		}
+
+		lineRows := formatLine(line, paneWidth, t.client.Username())
+		if line.id != 0 && line.id == t.selected {
+			lineRows[0] = "\x1b[7m" + strings.ReplaceAll(lineRows[0], "\x1b[0m", "\x1b[0m\x1b[7m") + "\x1b[0m"
+		}
+		rows = append(rows, lineRows...)
+
+		if t.thread == 0 && line.replies > 0 {
+			replies := fmt.Sprintf("%d replies", line.replies)
+			if line.replies == 1 {
+				replies = "1 reply"
+			}
+			rows = append(rows, fmt.Sprintf("      \x1b[2;36m↳ %s\x1b[0m", replies))
+		}
+	}
+
+	// Show the rows ending scroll rows from the bottom
+	t.scroll = min(t.scroll, max(len(rows)-paneHeight, 0))
+	end := len(rows) - t.scroll
+	start := max(end-paneHeight, 0)
+	visible := rows[start:end]
+
+	// Page in older messages once the oldest one is visible
+	if start == 0 && t.thread == 0 {
+		t.fetchOlder()
+	}
+
+	sidebar := t.sidebar()
+
+	out := t.out
+	out.WriteString("\x1b[?25l")
+	for i := range paneHeight {
+		fmt.Fprintf(out, "\x1b[%d;1H\x1b[K", i+1)
+
+		// Messages stick to the bottom of the pane
+		row := i - (paneHeight - len(visible))
+		if row >= 0 {
+			out.WriteString(visible[row])
+		}
+
+		if paneWidth < t.width {
+			fmt.Fprintf(out, "\x1b[%d;%dH\x1b[K\x1b[2m│\x1b[0m", i+1, paneWidth+1)
+			if i < len(sidebar) {
+				out.WriteString(sidebar[i])
+			}
+		}
+	}
+
+	status := fmt.Sprintf(" %s in %s", t.client.Username(), t.room)
+	if latency := t.client.Latency(); latency > 0 {
+		status += fmt.Sprintf(" | %s", latency.Round(time.Millisecond))
+	}
+	if t.scroll > 0 {
+		status += fmt.Sprintf(" | scrolled up %d rows", t.scroll)
+	}
+	if t.selected != 0 {
+		status += " | ↑/↓ selects a message, Enter opens its thread, Esc cancels"
+	} else if line := t.lineById(t.room, t.thread); line != nil {
+		status += fmt.Sprintf(" | thread of %s, Esc closes it", line.username)
+	}
+	for _, transfer := range t.client.Transfers() {
+		if transfer.State == tcp_client.TRANSFER_ACTIVE {
+			status += fmt.Sprintf(" | %s %d%%", transfer.Offer.Name, transfer.Percent())
+		}
+	}
+	switch typing := t.typingUsers(); len(typing) {
+	case 0:
+	case 1:
+		status += fmt.Sprintf(" | %s is typing…", typing[0])
+	case 2, 3:
+		status += fmt.Sprintf(" | %s are typing…", strings.Join(typing, ", "))
+	default:
+		status += " | several people are typing…"
+	}
+	status = truncate(status, t.width)
+	fmt.Fprintf(out, "\x1b[%d;1H\x1b[K\x1b[7m%s%s\x1b[0m", paneHeight+1, status, strings.Repeat(" ", max(t.width-len([]rune(status)), 0)))
+
+	// Scroll the input horizontally to keep the cursor visible
+	prompt := fmt.Sprintf("[%s] > ", t.room)
+	if t.editing != 0 {
+		prompt = fmt.Sprintf("[%s] edit (Esc cancels, empty deletes) > ", t.room)
+	} else if t.thread != 0 {
+		prompt = fmt.Sprintf("[%s] reply > ", t.room)
+	}
+	available := max(t.width-len([]rune(prompt))-1, 1)
+	input := []rune(t.input.String())
+	offset := max(t.input.cursor-available, 0)
+	shown := input[offset:min(len(input), offset+available)]
+	fmt.Fprintf(out, "\x1b[%d;1H\x1b[K%s%s", paneHeight+2, prompt, string(shown))
+	fmt.Fprintf(out, "\x1b[%d;%dH\x1b[?25h", paneHeight+2, len([]rune(prompt))+t.input.cursor-offset+1)
+
+	out.Flush()
+}
+
+// sidebar returns the rows of the room and user list, t.mu must be held
+func (t *tui) sidebar() []string {
+	rows := []string{"\x1b[1m Rooms\x1b[0m"}
+	for _, room := range t.rooms() {
+		marker := "  "
+		if room == t.room {
+			marker = "> "
+		}
+
+		row := truncate(" "+marker+room, SIDEBAR_WIDTH-5)
+		if n := t.unread[room]; n > 0 {
+			row += fmt.Sprintf(" \x1b[1;33m(%d)\x1b[0m", min(n, 99))
+		}
+		rows = append(rows, row)
+	}
+
+	rows = append(rows, "", "\x1b[1m Users\x1b[0m")
+	users := make([]string, 0, len(t.users[t.room]))
+	for user := range t.users[t.room] {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	for _, user := range users {
+		// Online users get a green dot, away users a yellow ring, offline users are dimmed
+		switch t.presence[user] {
+		case shared.PRESENCE_AWAY:
+			rows = append(rows, fmt.Sprintf(" \x1b[33m○\x1b[0m \x1b[%sm%s\x1b[0m", usernameColor(user), truncate(user, SIDEBAR_WIDTH-3)))
+		case shared.PRESENCE_OFFLINE:
+			rows = append(rows, fmt.Sprintf("   \x1b[2m%s\x1b[0m", truncate(user, SIDEBAR_WIDTH-3)))
+		default:
+			rows = append(rows, fmt.Sprintf(" \x1b[32m●\x1b[0m \x1b[%sm%s\x1b[0m", usernameColor(user), truncate(user, SIDEBAR_WIDTH-3)))
+		}
+	}
+
+	return rows
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+
+	return string(runes[:max(width, 0)])
+}
+
+// ownLine finds the pending line of a message sent by the user, when the server
+// passes the message back. t.mu must be held.
+func (t *tui) ownLine(msg *shared.Message) *chatLine {
+	if msg.Nonce == 0 || msg.Username != t.client.Username() {
+		return nil
+	}
+
+	return t.lineByNonce(msg.Nonce)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+var ansi = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// testTUI returns a tui of 80x12 rendering into screen, for a client logged in as
+// alice on an in-process server. The packets of the server are not passed on to the
+// tui, tests hand it the packets they need with handlePacket.
+func testTUI(t *testing.T) (*tui, *bytes.Buffer) {
+	transport := shared.NewPipeTransport()
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = transport
+	server.Limits = tcp_server.RateLimits{}
+	err := server.Start("chat")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	go func() {
+		for range server.PChan {
+		}
+	}()
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	opts.Username = "alice"
+	opts.PingInterval = 0
+	opts.Reconnect = false
+	opts.Output = io.Discard
+	client, err := tcp_client.ConnectWithOptions("chat", opts)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	go client.Listen(func(p *shared.Packet) {})
+
+	screen := &bytes.Buffer{}
+	ui := newTUI()
+	ui.client = client
+	ui.out = bufio.NewWriter(screen)
+	ui.width = 80
+	ui.height = 12
+	return ui, screen
+}
+
+// rendered renders the tui, and returns the screen without escape sequences
+func rendered(ui *tui, screen *bytes.Buffer) string {
+	screen.Reset()
+	ui.render()
+	return ansi.ReplaceAllString(screen.String(), "")
+}
+
+func handle(t *testing.T, ui *tui, kind shared.MessageKind, msg interface{}) {
+	p, err := shared.PacketFromMessage(kind, msg)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	ui.handlePacket(p)
+}
+
+func typeKeys(ui *tui, input string) {
+	for _, k := range parseKeys([]byte(input)) {
+		ui.handleKey(k)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys := parseKeys([]byte("aé\x1b[A\x1b[5~\r\x7f\t\x1b[Z\x03\x1b"))
+	expected := []key{
+		{code: KEY_RUNE, r: 'a'},
+		{code: KEY_RUNE, r: 'é'},
+		{code: KEY_UP},
+		{code: KEY_PAGE_UP},
+		{code: KEY_ENTER},
+		{code: KEY_BACKSPACE},
+		{code: KEY_TAB},
+		{code: KEY_BACKTAB},
+		{code: KEY_CTRL, r: 'c'},
+		{code: KEY_ESCAPE},
+	}
+
+	if !slices.Equal(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	var editor lineEditor
+	for _, k := range parseKeys([]byte("hello world\x17")) {
+		editor.handle(k)
+	}
+	if editor.String() != "hello " || editor.cursor != 6 {
+		t.Errorf("Expected Ctrl-W to delete the last word, got '%s' at %d", editor.String(), editor.cursor)
+	}
+
+	for _, k := range parseKeys([]byte("\x01> \x1b[C\x1b[C\x0b")) {
+		editor.handle(k)
+	}
+	if editor.String() != "> he" || editor.cursor != 4 {
+		t.Errorf("Expected to insert at the start and cut after the cursor, got '%s' at %d", editor.String(), editor.cursor)
+	}
+
+	if editor.handle(key{code: KEY_ENTER}) {
+		t.Errorf("Expected Enter not to be handled by the editor")
+	}
+
+	editor.submit()
+	editor.set("")
+	for _, k := range parseKeys([]byte("second\r")) {
+		if !editor.handle(k) {
+			editor.submit()
+		}
+	}
+
+	// Browsing the history keeps the draft
+	for _, k := range parseKeys([]byte("draft\x1b[A")) {
+		editor.handle(k)
+	}
+	if editor.String() != "second" {
+		t.Errorf("Expected the last line, got '%s'", editor.String())
+	}
+
+	editor.handle(key{code: KEY_UP})
+	editor.handle(key{code: KEY_UP})
+	if editor.String() != "> he" {
+		t.Errorf("Expected the first line, got '%s'", editor.String())
+	}
+
+	editor.handle(key{code: KEY_DOWN})
+	editor.handle(key{code: KEY_DOWN})
+	if editor.String() != "draft" || editor.cursor != 5 {
+		t.Errorf("Expected the draft back, got '%s' at %d", editor.String(), editor.cursor)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		rows  []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"hello world again", 11, []string{"hello world", "again"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"æøå æøå", 4, []string{"æøå", "æøå"}},
+	}
+
+	for _, test := range tests {
+		rows := wrap(test.text, test.width)
+		if !slices.Equal(rows, test.rows) {
+			t.Errorf("Expected '%s' wrapped to %d to be %q, got %q", test.text, test.width, test.rows, rows)
+		}
+	}
+}
+
+func TestReactionShortcut(t *testing.T) {
+	tests := map[string]bool{
+		"+:tada:":     true,
+		" +🎉 ":        true,
+		"+1":          false,
+		"+:":          false,
+		"+:tada: yay": false,
+		"hello":       false,
+	}
+
+	for line, expected := range tests {
+		if _, ok := reactionShortcut(line); ok != expected {
+			t.Errorf("Expected '%s' to be a reaction: %v, got %v", line, expected, ok)
+		}
+	}
+}
+
+func TestFormatLine(t *testing.T) {
+	stamp := time.Date(2024, 1, 2, 15, 4, 0, 0, time.Local)
+
+	tests := []struct {
+		line     chatLine
+		expected string
+	}{
+		{chatLine{time: stamp, username: "bob", text: "hi"}, "15:04 bob: hi"},
+		{chatLine{time: stamp, username: "bob", text: "waves", action: true}, "15:04 * bob waves"},
+		{chatLine{time: stamp, username: "bob", text: "hi", edited: true}, "15:04 bob: hi (edited)"},
+		{chatLine{time: stamp, username: "bob", text: "hi", deleted: true}, "15:04 bob: (message deleted)"},
+		{chatLine{time: stamp, username: "alice", text: "hi", pending: true}, "15:04 alice: hi (sending)"},
+		{chatLine{time: stamp, username: "alice", text: "hi", failed: "Muted."}, "15:04 alice: hi (not sent: Muted.)"},
+		{chatLine{time: stamp, text: "Joined general", system: true}, "15:04 * Joined general"},
+	}
+
+	for _, test := range tests {
+		rows := formatLine(test.line, 80, "alice")
+		if len(rows) != 1 || ansi.ReplaceAllString(rows[0], "") != test.expected {
+			t.Errorf("Expected '%s', got %q", test.expected, rows)
+		}
+	}
+
+	line := chatLine{time: stamp, username: "bob", text: "hi", reactions: shared.Reactions{}.Set("👍", "alice", true)}
+	rows := formatLine(line, 80, "alice")
+	if len(rows) != 2 || !strings.Contains(rows[1], "\x1b[1;36m[👍 1]") {
+		t.Errorf("Expected a highlighted reaction row, got %q", rows)
+	}
+}
+
+func TestInsertLine(t *testing.T) {
+	ui := newTUI()
+
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 3})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 1})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{text: "system", system: true})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 2})
+	if ui.insertLine(shared.DEFAULT_ROOM, chatLine{id: 2}) {
+		t.Errorf("Expected a message already shown not to be added again")
+	}
+
+	ids := make([]uint64, 0)
+	for _, line := range ui.lines[shared.DEFAULT_ROOM] {
+		ids = append(ids, line.id)
+	}
+	if !slices.Equal(ids, []uint64{1, 2, 3, 0}) {
+		t.Errorf("Expected messages in order of ID, and other lines at the end, got %v", ids)
+	}
+
+	ui.addLine("random", chatLine{id: 1})
+	ui.addLine("random", chatLine{text: "system", system: true})
+	if ui.unread["random"] != 1 || ui.unread[shared.DEFAULT_ROOM] != 0 {
+		t.Errorf("Expected one unread message in random, got %v", ui.unread)
+	}
+}
+
+func TestSelectThread(t *testing.T) {
+	ui := newTUI()
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 1, text: "first"})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 2, text: "reply", parent: 1})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 3, text: "deleted", deleted: true})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 4, text: "last"})
+
+	// Replies and deleted messages are skipped in the room
+	if id := ui.selectable(0, -1); id != 4 {
+		t.Errorf("Expected the last message to be selected, got %d", id)
+	}
+	if id := ui.selectable(4, -1); id != 1 {
+		t.Errorf("Expected the first message above the last, got %d", id)
+	}
+	if id := ui.selectable(1, -1); id != 0 {
+		t.Errorf("Expected nothing above the first message, got %d", id)
+	}
+
+	ui.thread = 1
+	visible := make([]uint64, 0)
+	for _, line := range ui.lines[shared.DEFAULT_ROOM] {
+		if ui.visible(line) {
+			visible = append(visible, line.id)
+		}
+	}
+	if !slices.Equal(visible, []uint64{1, 2}) {
+		t.Errorf("Expected the thread to show the message and its reply, got %v", visible)
+	}
+}
+
+func TestTUIHandlePacket(t *testing.T) {
+	ui, screen := testTUI(t)
+
+	handle(t, ui, shared.KIND_PRESENCE, shared.Presence{Username: "bob", Room: shared.DEFAULT_ROOM, Status: shared.PRESENCE_ONLINE})
+	handle(t, ui, shared.KIND_TYPING, shared.Typing{Username: "bob", Room: shared.DEFAULT_ROOM, Typing: true})
+	if screen := rendered(ui, screen); !strings.Contains(screen, "bob is typing…") || !strings.Contains(screen, "● bob") {
+		t.Errorf("Expected bob to be shown online and typing, got %q", screen)
+	}
+
+	handle(t, ui, shared.KIND_MESSAGE, shared.Message{ID: 1, Username: "bob", Room: shared.DEFAULT_ROOM, Msg: "hi alice"})
+	if screen := rendered(ui, screen); strings.Contains(screen, "typing") || !strings.Contains(screen, "bob: hi alice") {
+		t.Errorf("Expected the message of bob, and bob no longer typing, got %q", screen)
+	}
+
+	handle(t, ui, shared.KIND_MESSAGE, shared.Message{Username: "bob", Room: "random", Msg: "over here"})
+	if screen := rendered(ui, screen); strings.Contains(screen, "over here") || ui.unread["random"] != 1 {
+		t.Errorf("Expected an unread message in random, got %q", screen)
+	}
+
+	// A message sent by alice is pending until it is acknowledged
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{username: "alice", text: "hello bob", nonce: 7, pending: true})
+	if screen := rendered(ui, screen); !strings.Contains(screen, "alice: hello bob (sending)") {
+		t.Errorf("Expected the message of alice to be sending, got %q", screen)
+	}
+
+	handle(t, ui, shared.KIND_ACK, shared.Ack{Nonce: 7, ID: 2})
+	handle(t, ui, shared.KIND_EDIT, shared.Edit{ID: 2, Room: shared.DEFAULT_ROOM, Msg: "hello again"})
+	handle(t, ui, shared.KIND_DELETE, shared.Delete{ID: 1, Room: shared.DEFAULT_ROOM})
+	if screen := rendered(ui, screen); !strings.Contains(screen, "alice: hello again (edited)") || !strings.Contains(screen, "bob: (message deleted)") {
+		t.Errorf("Expected the edit and delete to be shown, got %q", screen)
+	}
+
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{username: "alice", text: "again", nonce: 8, pending: true})
+	handle(t, ui, shared.KIND_ERROR, shared.ErrorMessage{Msg: "Message is empty.", Nonce: 8})
+	if screen := rendered(ui, screen); !strings.Contains(screen, "alice: again (not sent: Message is empty.)") {
+		t.Errorf("Expected the message of alice to be rejected, got %q", screen)
+	}
+
+	handle(t, ui, shared.KIND_ERROR, shared.ErrorMessage{Msg: "Not in room 'x'"})
+	handle(t, ui, shared.KIND_COMMAND_REPLY, shared.CommandReply{Command: "who", Msg: "Users in general: alice, bob"})
+	if screen := rendered(ui, screen); !strings.Contains(screen, "* ERROR: Not in room 'x'") || !strings.Contains(screen, "* Users in general: alice, bob") {
+		t.Errorf("Expected the error and the reply to be shown, got %q", screen)
+	}
+
+	handle(t, ui, shared.KIND_PRESENCE, shared.Presence{Username: "bob", Status: shared.PRESENCE_AWAY})
+	if screen := rendered(ui, screen); !strings.Contains(screen, "* bob is away") || !strings.Contains(screen, "○ bob") {
+		t.Errorf("Expected bob to be shown away, got %q", screen)
+	}
+
+	// Joining a room switches to it, leaving it goes back to the default room
+	handle(t, ui, shared.KIND_JOIN, shared.Join{Room: "random"})
+	if ui.room != "random" || ui.unread["random"] != 0 {
+		t.Errorf("Expected to switch to random, got %s with %d unread", ui.room, ui.unread["random"])
+	}
+	handle(t, ui, shared.KIND_LEAVE, shared.Leave{Room: "random"})
+	if ui.room != shared.DEFAULT_ROOM {
+		t.Errorf("Expected to be back in %s, got %s", shared.DEFAULT_ROOM, ui.room)
+	}
+}
+
+func TestTUIKeys(t *testing.T) {
+	ui, screen := testTUI(t)
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 1, username: "bob", text: "question"})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 2, username: "alice", text: "my answer"})
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 3, username: "alice", text: "in thread", parent: 1})
+
+	// Ctrl-O edits the last message of alice in the room, not in a thread
+	typeKeys(ui, "\x0f")
+	if ui.editing != 2 || ui.input.String() != "my answer" {
+		t.Errorf("Expected to edit message 2, got %d with '%s'", ui.editing, ui.input.String())
+	}
+	if screen := rendered(ui, screen); !strings.Contains(screen, "[general] edit (Esc cancels, empty deletes) > my answer") {
+		t.Errorf("Expected the edit prompt, got %q", screen)
+	}
+
+	typeKeys(ui, "\x1b")
+	if ui.editing != 0 || ui.input.String() != "" {
+		t.Errorf("Expected Escape to cancel the edit, got %d with '%s'", ui.editing, ui.input.String())
+	}
+
+	// Ctrl-T selects the last message, up selects the one before, and Enter opens its thread
+	typeKeys(ui, "\x14")
+	if ui.selected != 2 {
+		t.Errorf("Expected message 2 to be selected, got %d", ui.selected)
+	}
+	typeKeys(ui, "\x1b[A\r")
+	if ui.selected != 0 || ui.thread != 1 {
+		t.Errorf("Expected the thread of message 1 to be open, got thread %d, selected %d", ui.thread, ui.selected)
+	}
+	if screen := rendered(ui, screen); !strings.Contains(screen, "thread of bob") || !strings.Contains(screen, "[general] reply > ") || strings.Contains(screen, "my answer") {
+		t.Errorf("Expected only the thread to be shown, got %q", screen)
+	}
+
+	typeKeys(ui, "\x1b")
+	if ui.thread != 0 {
+		t.Errorf("Expected Escape to close the thread")
+	}
+
+	// Page up scrolls, but not past the first row
+	ui.addLine(shared.DEFAULT_ROOM, chatLine{id: 4, username: "bob", text: "thanks"})
+	ui.height = 4
+	typeKeys(ui, "\x1b[5~\x1b[5~")
+	rendered(ui, screen)
+	if ui.scroll != 1 {
+		t.Errorf("Expected to scroll up to the first row, got %d", ui.scroll)
+	}
+	typeKeys(ui, "\x1b[6~")
+	if ui.scroll != 0 {
+		t.Errorf("Expected page down to scroll back, got %d", ui.scroll)
+	}
+
+	if ui.handleKey(key{code: KEY_CTRL, r: 'c'}) {
+		t.Errorf("Expected Ctrl-C to quit")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+const (
+	COMPARE_EXACT = "exact"
+	COMPARE_KIND  = "kind"
+)
+
+type replayOptions struct {
+	speed   float64
+	timeout time.Duration
+	compare string
+}
+
+func main() {
+	connect := flag.String("connect", "", "Replay a client session against the server at this address")
+	listen := flag.String("listen", "", "Replay a server session against the first client connecting to this address")
+	session := flag.Uint("session", 0, "Id of the session to replay. Defaults to the first session in the file")
+	speed := flag.Float64("speed", 1, "Timing multiplier, 2 plays twice as fast, 0 sends without delays")
+	timeout := flag.Duration("timeout", 5*time.Second, "How long to wait for each expected packet")
+	compare := flag.String("compare", COMPARE_EXACT, "How received packets are compared to recorded ones: exact or kind")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s -connect host:port [options] session_file\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s -listen :port [options] session_file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || (*connect == "") == (*listen == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *compare != COMPARE_EXACT && *compare != COMPARE_KIND {
+		fmt.Printf("Unknown compare mode '%s'\n", *compare)
+		os.Exit(1)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	records, err := shared.ReadRecords(file)
+	file.Close()
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+
+	records = sessionRecords(records, *session)
+	if len(records) == 0 {
+		fmt.Println("No records to replay")
+		os.Exit(1)
+	}
+
+	var conn net.Conn
+	if *connect != "" {
+		conn, err = dial(*connect)
+	} else {
+		conn, err = accept(*listen)
+	}
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	failures := replay(conn, records, replayOptions{
+		speed:   *speed,
+		timeout: *timeout,
+		compare: *compare,
+	})
+	if failures > 0 {
+		fmt.Printf("FAIL: %d of %d records did not match\n", failures, len(records))
+		os.Exit(1)
+	}
+
+	fmt.Printf("OK: replayed %d records\n", len(records))
+}
+
+// sessionRecords returns the records of the given session, or of the first
+// session in the file when session is 0.
+func sessionRecords(records []*shared.Record, session uint) []*shared.Record {
+	if session == 0 && len(records) > 0 {
+		session = uint(records[0].Session)
+	}
+
+	res := make([]*shared.Record, 0)
+	for _, record := range records {
+		// Pings depend on timing, and are answered as they arrive instead
+		kind := record.Packet.Kind()
+		if kind == shared.KIND_PING || kind == shared.KIND_PONG {
+			continue
+		}
+
+		if uint(record.Session) == session {
+			res = append(res, record)
+		}
+	}
+
+	return res
+}
+
+func dial(addr string) (net.Conn, error) {
+	return shared.NetTransport{}.Dial(addr)
+}
+
+func accept(addr string) (net.Conn, error) {
+	listener, err := shared.NetTransport{}.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	fmt.Printf("Waiting for a client on %s\n", listener.Addr())
+	return listener.Accept()
+}
+
+// replay sends every outgoing record with its original timing scaled by speed,
+// and checks that every incoming record is matched by what is received.
+// It returns the number of records that did not match.
+func replay(conn net.Conn, records []*shared.Record, opts replayOptions) int {
+	reader := bufio.NewReader(conn)
+	start := time.Now()
+	first := records[0].Time
+	failures := 0
+
+	for i, record := range records {
+		if opts.speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(first)) / opts.speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		switch record.Direction {
+		case shared.DIRECTION_OUT:
+			_, err := conn.Write(record.Packet.Encode())
+			if err != nil {
+				fmt.Printf("#%d ERROR sending: %s\n", i, err)
+				return failures + len(records) - i
+			}
+			fmt.Printf("#%d sent     %s\n", i, record.Packet.Kind())
+
+		case shared.DIRECTION_IN:
+			conn.SetReadDeadline(time.Now().Add(opts.timeout))
+			p, err := readPacket(conn, reader)
+			if err != nil {
+				fmt.Printf("#%d ERROR expected %s, but reading failed: %s\n", i, record.Packet.Kind(), err)
+				return failures + len(records) - i
+			}
+
+			if !matches(record.Packet, p, opts.compare) {
+				failures += 1
+				fmt.Printf("#%d MISMATCH\n    expected: %s\n    received: %s\n", i, describe(record.Packet), describe(p))
+				continue
+			}
+			fmt.Printf("#%d received %s\n", i, p.Kind())
+		}
+	}
+
+	return failures
+}
+
+// readPacket reads the next packet that is not a ping or pong, answering any pings
+func readPacket(conn net.Conn, reader *bufio.Reader) (*shared.Packet, error) {
+	var heartbeat *shared.Heartbeat
+	for {
+		p, err := shared.ParsePacket(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		handled, err := heartbeat.HandleKeepalive(p, func(pong *shared.Packet) error {
+			_, err := conn.Write(pong.Encode())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if !handled {
+			return p, nil
+		}
+	}
+}
+
+func matches(expected *shared.Packet, received *shared.Packet, compare string) bool {
+	if compare == COMPARE_KIND {
+		return expected.Kind() == received.Kind()
+	}
+
+	return bytes.Equal(expected.Data, received.Data)
+}
+
+func describe(p *shared.Packet) string {
+	kind, msg, err := p.DecodeMessage()
+	if err != nil {
+		return fmt.Sprintf("%s (%s) % x", kind, err, p.Data)
+	}
+
+	return fmt.Sprintf("%s %+v", kind, msg)
+}
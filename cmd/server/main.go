@@ -1,97 +1,245 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/TobiasTheDanish/tcp-chat/shared"
 	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
 )
 
-func main() {
-	if len(os.Args) == 1 {
-		fmt.Println("Please provide port")
-		os.Exit(1)
+// listFlag is a comma separated list of names
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
 	}
-	port := os.Args[1]
 
-	server := tcp_server.Create(handleConnection)
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	*f.list = strings.Split(value, ",")
+	return nil
+}
+
+// bindFlags defines a flag for every setting of the config, named like its key in a config file
+func bindFlags(flags *flag.FlagSet, config *tcp_server.Config) {
+	flags.Var(listFlag{&config.Listen}, "listen", "Comma separated addresses to listen on, a host:port, only a port, unix:path for a unix socket, or ws: before any of them for WebSocket connections from browsers. Also given as arguments")
+	flags.StringVar(&config.Advertise, "advertise", config.Advertise, "Host or host:port to print for clients to connect to, instead of the addresses of this machine")
+	flags.StringVar(&config.Name, "name", config.Name, "Name of the server shown to clients discovering it, the host name when not given")
+	flags.IntVar(&config.DiscoveryPort, "discovery-port", config.DiscoveryPort, "UDP port to answer discovery probes of clients on, 0 disables discovery")
+	flags.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "Certificate in PEM to accept TLS connections with, together with -tls-key")
+	flags.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "Private key in PEM of -tls-cert")
+	flags.Var(listFlag{&config.AllowedOrigins}, "allowed-origins", "Comma separated origins of web pages allowed to open WebSocket connections, like https://chat.example.com, or * for any. The server itself is always allowed")
+	flags.StringVar(&config.Data, "data", config.Data, "Keep users, rooms, memberships and history in this directory, so they survive restarts")
+	flags.StringVar(&config.HistoryFile, "history-file", config.HistoryFile, "Store messages in this file, instead of only in memory or in -data")
+	flags.IntVar(&config.HistorySize, "history-size", config.HistorySize, "How many messages per room are kept in memory, without -history-file")
+	flags.IntVar(&config.HistoryOnJoin, "history-on-join", config.HistoryOnJoin, "How many stored messages are sent to users joining a room")
+	flags.StringVar(&config.Log, "log", config.Log, "Append what the server prints to this file, instead of printing it")
+	flags.StringVar(&config.Record, "record", config.Record, "Record every packet of every session to this file")
+	flags.Var(&config.PingInterval, "ping-interval", "How often clients are pinged, 0 disables pings")
+	flags.IntVar(&config.MaxMissedPongs, "max-missed-pongs", config.MaxMissedPongs, "Clients are disconnected after this many unanswered pings")
+	flags.Var(&config.AwayAfter, "away-after", "Users are marked away after being idle this long, 0 disables it")
+	flags.Int64Var(&config.MaxFileSize, "max-file-size", config.MaxFileSize, "Largest file in bytes users can send each other, 0 disables file transfer")
+	flags.Var(listFlag{&config.Owners}, "owners", "Comma separated users owning the whole server, who can give server roles")
+	flags.Var(listFlag{&config.Moderators}, "moderators", "Comma separated users moderating every room, who can also edit and delete the messages of others")
+	flags.Var(listFlag{&config.Rooms}, "rooms", "Comma separated rooms to create when the server starts, without an owner")
+	flags.StringVar(&config.MOTD, "motd", config.MOTD, "Message of the day, sent to users when they log in")
+	flags.Var(&config.SessionMessages, "session-messages", "Messages a second a session can send, as rate/burst, 0 disables the limit")
+	flags.Var(&config.SessionBytes, "session-bytes", "Bytes a second a session can send, as rate/burst, 0 disables the limit")
+	flags.Var(&config.IPMessages, "ip-messages", "Messages a second every session from an IP can send together, as rate/burst, 0 disables the limit")
+	flags.Var(&config.IPBytes, "ip-bytes", "Bytes a second every session from an IP can send together, as rate/burst, 0 disables the limit")
+	flags.Var(&config.IPConnections, "ip-connections", "New connections a second from an IP, as rate/burst, 0 disables the limit")
+	flags.IntVar(&config.MaxConnsPerIP, "max-conns-per-ip", config.MaxConnsPerIP, "Most connections open from an IP at once, 0 disables the limit")
+	flags.Var(&config.FloodPenalty, "flood-penalty", "What happens to clients sending too fast: drop, warn, mute or disconnect")
+	flags.Var(&config.FloodMute, "flood-mute", "How long the mute penalty lasts")
+}
+
+// loadConfig reads the configuration from the defaults, the config file and then the
+// command line, so flags override the file. It reports whether only to check the configuration.
+func loadConfig(args []string) (tcp_server.Config, bool, error) {
+	config := tcp_server.DefaultConfig()
 
-	err := server.Start(port)
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configPath := flags.String("config", "", "Read the settings from this JSON file, using the flag names as keys")
+	checkOnly := flags.Bool("check-config", false, "Only check the configuration, and exit")
+	bindFlags(flags, &config)
+
+	err := flags.Parse(args)
 	if err != nil {
-		fmt.Println("ERROR: ", err)
+		return config, false, err
 	}
 
-	for p := range server.PChan {
-		var msg Message
-		p.IntoType(&msg)
+	if *configPath != "" {
+		fileConfig := tcp_server.DefaultConfig()
+		err = tcp_server.LoadConfig(*configPath, &fileConfig)
+		if err != nil {
+			return config, false, err
+		}
 
-		fmt.Printf("%s: %s\n", msg.Username, msg.Msg)
-		for _, conn := range server.Conns {
-			conn.Write(p.Encode())
+		// Only the flags given on the command line override the file
+		fileFlags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		bindFlags(fileFlags, &fileConfig)
+		flags.Visit(func(f *flag.Flag) {
+			if err == nil && fileFlags.Lookup(f.Name) != nil {
+				err = fileFlags.Set(f.Name, f.Value.String())
+			}
+		})
+		if err != nil {
+			return config, false, err
 		}
+		config = fileConfig
+	}
+
+	if flags.NArg() > 0 {
+		config.Listen = flags.Args()
 	}
+
+	return config, *checkOnly, config.Validate()
 }
 
-type Message struct {
-	Username string
-	Msg      string
+// reloadOnHangup reloads the configuration every time the server gets SIGHUP
+func reloadOnHangup(server *tcp_server.Server) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		config, _, err := loadConfig(os.Args[1:])
+		if err == nil {
+			err = server.Reload(config)
+		}
+		if err != nil {
+			fmt.Println("ERROR: reloading configuration: ", err)
+			continue
+		}
+
+		fmt.Println("Reloaded configuration")
+	}
 }
 
-func handleConnection(conn net.Conn, c chan *shared.Packet) {
-	defer conn.Close()
-	connIp := conn.LocalAddr().String()
-	reader := bufio.NewReader(conn)
+// closeOnInterrupt closes the files on SIGINT or SIGTERM, last opened first, and exits.
+// Closing the storage writes a snapshot, the log is enough to recover otherwise.
+func closeOnInterrupt(files []io.Closer) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	<-interrupt
+	for i := len(files) - 1; i >= 0; i-- {
+		err := files[i].Close()
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+		}
+	}
+	os.Exit(0)
+}
 
-	welcome := Message{
-		Username: "Server",
-		Msg:      "Welcome! What is your username?",
+func main() {
+	config, checkOnly, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
 	}
-	packet, err := shared.PacketFromType(welcome)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
 	}
 
-	conn.Write(packet.Encode())
-	usernamePacket, err := shared.ParsePacket(reader)
-	if err != nil {
-		if err == io.EOF {
-			fmt.Printf("Connection to %s closed\n", connIp)
-		} else {
-			fmt.Printf("ERROR: %s\n", err)
-		}
-		return
+	if checkOnly {
+		fmt.Println("Configuration is valid")
+		os.Exit(0)
 	}
-	username := strings.Trim(string(usernamePacket.Data), "\r\n \t")
 
-	for {
-		// Read from the connection until a new line is send
-		data, err := shared.ParsePacket(reader)
+	// Closed on the way out
+	files := make([]io.Closer, 0)
+
+	if config.Log != "" {
+		file, err := os.OpenFile(config.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			if err == io.EOF {
-				fmt.Printf("Connection to %s closed\n", username)
-			} else {
-				fmt.Printf("ERROR: %s\n", err)
-			}
-			return
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
 		}
+		files = append(files, file)
+		os.Stdout = file
+	}
 
-		sentMessage := strings.Trim(string(data.Data), "\r\n \t")
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.PingInterval = time.Duration(config.PingInterval)
+	server.MaxMissedPongs = config.MaxMissedPongs
+	server.AwayAfter = time.Duration(config.AwayAfter)
+	server.Advertise = config.Advertise
+	server.AllowedOrigins = config.AllowedOrigins
+	server.DiscoveryPort = config.DiscoveryPort
+	if config.Name != "" {
+		server.Name = config.Name
+	}
+	server.Store = tcp_server.NewMemoryStore(config.HistorySize)
+
+	// Validated already
+	server.TLS, _ = config.TLSConfig()
+
+	if config.Data != "" {
+		storage, err := tcp_server.OpenStorage(config.Data)
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		files = append(files, storage)
+		server.Storage = storage
+		server.Store = storage
+	}
 
-		message := Message{
-			Username: username,
-			Msg:      sentMessage,
+	if config.HistoryFile != "" {
+		store, err := tcp_server.OpenFileStore(config.HistoryFile)
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
 		}
-		p, err := shared.PacketFromType(message)
+		files = append(files, store)
+		server.Store = store
+	}
+
+	if config.Record != "" {
+		file, err := os.Create(config.Record)
 		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
-			return
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
 		}
+		files = append(files, file)
+		server.Recorder = shared.NewRecorder(file)
+	}
+	go closeOnInterrupt(files)
+
+	err = server.Reload(config)
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	go reloadOnHangup(&server)
+
+	err = server.Start(config.Listen...)
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
 
-		c <- p
+	for p := range server.PChan {
+		var msg shared.Message
+		p.IntoMessage(&msg)
+
+		if msg.Action {
+			fmt.Printf("[%s] * %s %s\n", msg.Room, msg.Username, msg.Msg)
+		} else {
+			fmt.Printf("[%s] %s: %s\n", msg.Room, msg.Username, msg.Msg)
+		}
+		server.BroadcastRoom(msg.Room, p)
 	}
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func TestLoadConfigFlagsOverFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(path, []byte(`{
+		"listen": ["42069"],
+		"motd": "From the file",
+		"history-size": 5,
+		"owners": ["olivia"],
+		"session-messages": "5/20"
+	}`), 0644)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	config, checkOnly, err := loadConfig([]string{"-motd", "From a flag", "-config", path, "-owners", "oscar,otto", "-check-config"})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if !checkOnly {
+		t.Errorf("Expected -check-config to be reported")
+	}
+
+	// Flags win wherever they are given, the file fills in the rest
+	if config.MOTD != "From a flag" || !slices.Equal(config.Owners, []string{"oscar", "otto"}) {
+		t.Errorf("Expected the flags to override the file, got %+v", config)
+	}
+	if config.HistorySize != 5 || config.SessionMessages != (tcp_server.Limit{Rate: 5, Burst: 20}) || !slices.Equal(config.Listen, []string{"42069"}) {
+		t.Errorf("Expected the settings of the file without flags, got %+v", config)
+	}
+	if config.HistoryOnJoin != tcp_server.DEFAULT_HISTORY_ON_JOIN {
+		t.Errorf("Expected the defaults for settings in neither, got %+v", config)
+	}
+
+	config, _, err = loadConfig([]string{"-config", path, "4000"})
+	if err != nil || !slices.Equal(config.Listen, []string{"4000"}) {
+		t.Errorf("Expected the arguments to override listen, got %v, %v", config.Listen, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+const (
+	COLOR_RED   = "\x1b[31m"
+	COLOR_RESET = "\x1b[0m"
+)
+
+var (
+	printMu sync.Mutex
+	color   = false
+)
+
+func main() {
+	listen := flag.String("listen", "", "Run as a proxy listening on this address, e.g. :42070")
+	target := flag.String("target", "", "Address of the server to proxy to, e.g. 127.0.0.1:42069")
+	flag.BoolVar(&color, "color", false, "Highlight malformed frames in red")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [-color] [capture_file]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [-color] -listen addr -target addr\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *listen != "" || *target != "" {
+		if *listen == "" || *target == "" {
+			fmt.Println("Proxy mode needs both -listen and -target")
+			os.Exit(1)
+		}
+
+		err := proxy(*listen, *target)
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var input io.Reader = os.Stdin
+	if flag.NArg() > 0 && flag.Arg(0) != "-" {
+		file, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	dissect(input, "")
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// dissect splits the stream into frames, and prints every frame until the stream ends
+// or a frame cannot be parsed, as there is no way to find the start of the next frame.
+func dissect(r io.Reader, label string) {
+	counter := &countingReader{r: r}
+	reader := bufio.NewReader(counter)
+
+	frame := 0
+	offset := int64(0)
+	for {
+		p, err := shared.ParsePacket(reader)
+		end := counter.n - int64(reader.Buffered())
+
+		if end == offset && (err == io.EOF || errors.Is(err, net.ErrClosed)) {
+			return
+		}
+
+		if err != nil {
+			printMalformed(label, frame, offset, fmt.Sprintf("cannot parse frame: %s", err))
+			return
+		}
+
+		printFrame(label, frame, offset, end-offset, p)
+
+		frame += 1
+		offset = end
+	}
+}
+
+func printFrame(label string, frame int, offset int64, wireLen int64, p *shared.Packet) {
+	// ParsePacket has already decompressed the data, which is only visible
+	// from the number of bytes the frame took up on the wire
+	flags := p.Header.Flags
+	compression := ""
+	if wireLen-3 != int64(p.Header.DataLength) {
+		flags |= shared.FLAG_COMPRESSED
+		compression = fmt.Sprintf(" compressed=%d", wireLen-3)
+	}
+
+	header := fmt.Sprintf("%s#%d offset=%d version=%s flags=0x%x length=%d%s",
+		label, frame, offset, p.VersionString(), flags, p.Header.DataLength, compression)
+
+	kind, msg, err := p.DecodeMessage()
+	if err != nil {
+		printMalformed(label, frame, offset, fmt.Sprintf("%s kind=%s: %s\n%s", header, kind, err, indent(hex.Dump(p.Data))))
+		return
+	}
+
+	printMu.Lock()
+	defer printMu.Unlock()
+	fmt.Printf("%s kind=%s %+v\n", header, kind, msg)
+}
+
+func printMalformed(label string, frame int, offset int64, text string) {
+	printMu.Lock()
+	defer printMu.Unlock()
+
+	if color {
+		fmt.Printf("%s%s#%d MALFORMED %s%s\n", COLOR_RED, label, frame, text, COLOR_RESET)
+	} else {
+		fmt.Printf("%s#%d MALFORMED %s\n", label, frame, text)
+	}
+}
+
+func indent(s string) string {
+	return "    " + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n    ")
+}
+
+// proxy accepts clients on listen, and connects each of them to target,
+// printing every frame sent in either direction.
+func proxy(listen string, target string) error {
+	transport := shared.NetTransport{}
+	listener, err := transport.Listen(listen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Proxying %s -> %s\n", listen, target)
+
+	id := 0
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		server, err := transport.Dial(target)
+		if err != nil {
+			fmt.Printf("ERROR: connecting to %s: %s\n", target, err)
+			client.Close()
+			continue
+		}
+
+		id += 1
+		fmt.Printf("[%d] %s connected\n", id, client.RemoteAddr())
+		go pipe(client, server, fmt.Sprintf("[%d] client->server ", id))
+		go pipe(server, client, fmt.Sprintf("[%d] server->client ", id))
+	}
+}
+
+// pipe forwards everything from src to dst untouched, while dissecting a copy of it
+func pipe(src net.Conn, dst net.Conn, label string) {
+	defer dst.Close()
+	defer src.Close()
+
+	tee := io.TeeReader(src, dst)
+	dissect(tee, label)
+
+	// Keep forwarding if dissecting stopped on a malformed frame
+	io.Copy(io.Discard, tee)
+}
@@ -0,0 +1,67 @@
+package shared_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+func TestParseCommand(t *testing.T) {
+	cmd, ok, err := shared.ParseCommand("/MSG  bob hello   there\n", "lobby")
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	if !ok {
+		t.Errorf("Expected line to be a command")
+		return
+	}
+
+	if cmd.Name != "msg" || cmd.Room != "lobby" || !slices.Equal(cmd.Args, []string{"bob", "hello", "there"}) {
+		t.Errorf("Parsed command malformed.\nGot: %v", cmd)
+	}
+}
+
+func TestParseCommandNotCommand(t *testing.T) {
+	for _, line := range []string{"hello", "//slash", "a /b", ""} {
+		_, ok, err := shared.ParseCommand(line, "")
+		if ok || err != nil {
+			t.Errorf("Expected '%s' to not be a command, got %v, %v", line, ok, err)
+		}
+	}
+
+	if line := shared.UnescapeLine("//slash"); line != "/slash" {
+		t.Errorf("Expected '/slash', got '%s'", line)
+	}
+}
+
+func TestParseCommandMissingName(t *testing.T) {
+	_, ok, err := shared.ParseCommand("/  ", "")
+	if !ok || !errors.Is(err, shared.InvalidCommand) {
+		t.Errorf("Expected InvalidCommand, got %v, %v", ok, err)
+	}
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	cmd := shared.Command{Name: "join", Args: []string{"lobby"}, Room: "general"}
+
+	packet, err := shared.PacketFromMessage(shared.KIND_COMMAND, cmd)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	var decoded shared.Command
+	err = packet.IntoMessage(&decoded)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	if decoded.Name != cmd.Name || decoded.Room != cmd.Room || !slices.Equal(decoded.Args, cmd.Args) {
+		t.Errorf("Decoded data malformed.\nExpected: %v\nGot: %v", cmd, decoded)
+	}
+}
@@ -0,0 +1,131 @@
+package shared_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("Hello world! ", 200))
+	packet, err := shared.PacketFromData(data)
+	if err != nil {
+		t.Errorf("Didn't expect error, got: %s\n", err)
+		return
+	}
+
+	compressed, err := packet.Compress()
+	if err != nil {
+		t.Errorf("Didn't expect error, got: %s\n", err)
+		return
+	}
+
+	if !compressed.IsCompressed() {
+		t.Errorf("Expected packet to be compressed")
+		return
+	}
+
+	if compressed.Header.DataLength >= packet.Header.DataLength {
+		t.Errorf("Expected compressed data to be smaller than %d, got %d", packet.Header.DataLength, compressed.Header.DataLength)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(compressed.Encode()))
+	parsed, err := shared.ParsePacket(reader)
+	if err != nil {
+		t.Errorf("Didn't expect error, got: %s\n", err)
+		return
+	}
+
+	if parsed.IsCompressed() {
+		t.Errorf("Expected parsed packet to be decompressed")
+	}
+
+	if parsed.Header.DataLength != packet.Header.DataLength {
+		t.Errorf("Expected dataLength header to be: %d, got: %d\n", packet.Header.DataLength, parsed.Header.DataLength)
+	}
+
+	if !bytes.Equal(data, parsed.Data) {
+		t.Errorf("Decompressed data does not match original data")
+	}
+}
+
+func TestCompressBelowThreshold(t *testing.T) {
+	settings := shared.Negotiate(
+		shared.Hello{Compression: shared.COMPRESSION_DEFLATE, Threshold: 64},
+		shared.Hello{Compression: shared.COMPRESSION_DEFLATE, Threshold: 128},
+	)
+
+	if settings.Compression != shared.COMPRESSION_DEFLATE || settings.Threshold != 128 {
+		t.Errorf("Unexpected negotiated settings: %v", settings)
+	}
+
+	small, _ := shared.PacketFromData([]byte(strings.Repeat("a", 100)))
+	p, err := settings.CompressFor(small)
+	if err != nil {
+		t.Errorf("Didn't expect error, got: %s\n", err)
+	}
+	if p.IsCompressed() {
+		t.Errorf("Expected packet below threshold to stay uncompressed")
+	}
+
+	large, _ := shared.PacketFromData([]byte(strings.Repeat("a", 200)))
+	p, err = settings.CompressFor(large)
+	if err != nil {
+		t.Errorf("Didn't expect error, got: %s\n", err)
+	}
+	if !p.IsCompressed() {
+		t.Errorf("Expected packet above threshold to be compressed")
+	}
+
+	settings = shared.Negotiate(
+		shared.Hello{Compression: shared.COMPRESSION_DEFLATE, Threshold: 64},
+		shared.Hello{Compression: shared.COMPRESSION_NONE, Threshold: 64},
+	)
+	p, _ = settings.CompressFor(large)
+	if p.IsCompressed() {
+		t.Errorf("Expected packet to stay uncompressed when compression was not agreed")
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(make([]byte, shared.MAX_DECOMPRESSED_LEN*4))
+	w.Close()
+
+	bomb := shared.Packet{
+		Header: shared.PacketHeader{
+			Version:    (shared.MAJOR_VERSION << 4) | shared.MINOR_VERSION,
+			DataLength: uint16(buf.Len()),
+			Flags:      shared.FLAG_COMPRESSED,
+		},
+		Data: buf.Bytes(),
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(bomb.Encode()))
+	_, err := shared.ParsePacket(reader)
+	if !errors.Is(err, shared.DecompressionLimit) {
+		t.Errorf("Expected decompression limit error, got: %v", err)
+	}
+}
+
+func TestParseLongPacket(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3}, 1000)
+	packet, _ := shared.PacketFromData(data)
+
+	reader := bufio.NewReader(bytes.NewReader(packet.Encode()))
+	parsed, err := shared.ParsePacket(reader)
+	if err != nil {
+		t.Errorf("Didn't expect error, got: %s\n", err)
+		return
+	}
+
+	if !bytes.Equal(data, parsed.Data) {
+		t.Errorf("Expected %d bytes of data to survive encoding, got %d", len(data), len(parsed.Data))
+	}
+}
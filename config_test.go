@@ -0,0 +1,92 @@
+package shared_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": ["42069", "[::1]:42070", "unix:/tmp/chat.sock"],
+		"rooms": ["lobby", "random"],
+		"motd": "Welcome",
+		"away-after": "10m",
+		"session-messages": "5/20",
+		"flood-penalty": "mute"
+	}`)
+
+	config := tcp_server.DefaultConfig()
+	err := tcp_server.LoadConfig(path, &config)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if len(config.Listen) != 3 {
+		t.Errorf("Expected 3 listen addresses, got %v", config.Listen)
+	}
+	if len(config.Rooms) != 2 || config.MOTD != "Welcome" || time.Duration(config.AwayAfter) != 10*time.Minute {
+		t.Errorf("Expected the settings of the file, got %+v", config)
+	}
+
+	limits := config.RateLimits()
+	if limits.SessionMessages != (tcp_server.Limit{Rate: 5, Burst: 20}) || limits.Penalty != tcp_server.PENALTY_MUTE {
+		t.Errorf("Expected the limits of the file, got %+v", limits)
+	}
+
+	// Settings left out of the file keep their defaults
+	if config.HistorySize != tcp_server.DEFAULT_HISTORY_SIZE || limits.IPBytes != tcp_server.DefaultRateLimits().IPBytes {
+		t.Errorf("Expected the defaults for settings not in the file, got %+v", config)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := writeConfig(t, `{"listen": ["42069"], "colour": "blue"}`)
+
+	config := tcp_server.DefaultConfig()
+	err := tcp_server.LoadConfig(path, &config)
+	if !errors.Is(err, tcp_server.InvalidConfig) || !strings.Contains(err.Error(), "colour") {
+		t.Fatalf("Expected InvalidConfig naming the unknown key, got: %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := tcp_server.DefaultConfig()
+	config.TLSCert = "server.pem"
+	config.HistorySize = 0
+	config.Rooms = []string{"has space"}
+	config.FloodPenalty = "ban"
+	config.Advertise = "chat.lan:99999"
+	config.SessionBytes = tcp_server.Limit{Rate: 100, Burst: 100}
+
+	err := config.Validate()
+	if !errors.Is(err, tcp_server.InvalidConfig) {
+		t.Fatalf("Expected InvalidConfig, got: %v", err)
+	}
+
+	for _, problem := range []string{"listen", "tls-key", "history-size", "has space", "ban", "99999", "session-bytes"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected a problem about '%s', got: %s", problem, err)
+		}
+	}
+}
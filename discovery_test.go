@@ -0,0 +1,69 @@
+package shared_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+// freeUDPPort returns a UDP port nothing listens on
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestDiscoveryReply(t *testing.T) {
+	transport := listenTransport{shared.NetTransport{}, make(chan net.Addr, 1)}
+
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = transport
+	server.Limits = tcp_server.RateLimits{}
+	server.Name = "test server"
+	server.DiscoveryPort = freeUDPPort(t)
+	startServer(t, &server, "127.0.0.1:0")
+	listenAddr := (<-transport.addrs).(*net.TCPAddr)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer conn.Close()
+
+	probe, err := shared.PacketFromMessage(shared.KIND_DISCOVERY_PROBE, shared.DiscoveryProbe{Nonce: 42})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	_, err = conn.WriteToUDP(probe.Encode(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: server.DiscoveryPort})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	buf := make([]byte, shared.MAX_DATA_LEN+3)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Did not receive a reply: %s", err)
+	}
+
+	var reply shared.DiscoveryReply
+	p, err := shared.ParseDatagram(buf[:n])
+	if err == nil {
+		err = p.IntoMessage(&reply)
+	}
+	if err != nil || p.Kind() != shared.KIND_DISCOVERY_REPLY {
+		t.Fatalf("Expected a discovery reply, got %v, %v", p, err)
+	}
+
+	if reply.Nonce != 42 || reply.Name != "test server" || reply.Host != "" || int(reply.Port) != listenAddr.Port || reply.TLS {
+		t.Errorf("Expected the reply to describe the server on port %d, got %+v", listenAddr.Port, reply)
+	}
+}
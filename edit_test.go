@@ -0,0 +1,100 @@
+package shared_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+// editChat logs in alice without a secret, and carol and mod with one, where mod
+// moderates the server. It returns the clients with the packets each of them received.
+func editChat(t *testing.T) (*tcp_server.Server, shared.Transport, map[string]*tcp_client.Client, map[string]chan *shared.Packet) {
+	pipe := shared.NewPipeTransport()
+	server := startChat(t, pipe, nil, "chat")
+
+	clients := make(map[string]*tcp_client.Client)
+	packets := make(map[string]chan *shared.Packet)
+	for _, username := range []string{"alice", "carol", "mod"} {
+		opts := tcp_client.DefaultOptions()
+		opts.Transport = pipe
+		opts.PingInterval = 0
+		if username != "alice" {
+			opts.Secret = username + "'s secret"
+		}
+
+		received := make(chan *shared.Packet, 100)
+		clients[username] = connectClient(t, "chat", username, opts, func(p *shared.Packet) { received <- p })
+		packets[username] = received
+		waitFor(t, func() bool { return len(clients[username].Rooms()) > 0 })
+	}
+
+	err := server.Storage.SetRole(tcp_server.RoleRecord{Username: "mod", Role: tcp_server.ROLE_MODERATOR})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	return server, pipe, clients, packets
+}
+
+func TestEditAuthorization(t *testing.T) {
+	server, pipe, clients, packets := editChat(t)
+	alice, carol, mod := server.SessionByUsername("alice"), server.SessionByUsername("carol"), server.SessionByUsername("mod")
+
+	aliceMsg := sendReply(t, clients["alice"], packets["alice"], "from alice", shared.DEFAULT_ROOM, 0)
+	carolMsg := sendReply(t, clients["carol"], packets["carol"], "from carol", shared.DEFAULT_ROOM, 0)
+
+	// Authors change their own messages, and moderators those of everyone
+	for _, edit := range []struct {
+		session *tcp_server.Session
+		id      uint64
+	}{{alice, aliceMsg}, {carol, carolMsg}, {mod, aliceMsg}, {mod, carolMsg}} {
+		err := server.EditMessage(edit.session, shared.DEFAULT_ROOM, edit.id, "edited by "+edit.session.Username())
+		if err != nil {
+			t.Errorf("Expected %s to edit message %d, got: %s", edit.session.Username(), edit.id, err)
+		}
+	}
+
+	// Other users change nothing
+	err := server.EditMessage(alice, shared.DEFAULT_ROOM, carolMsg, "edited by alice")
+	if !errors.Is(err, tcp_server.NotAllowed) {
+		t.Errorf("Expected alice not to edit the message of carol, got: %v", err)
+	}
+	err = server.DeleteMessage(carol, shared.DEFAULT_ROOM, aliceMsg)
+	if !errors.Is(err, tcp_server.NotAllowed) {
+		t.Errorf("Expected carol not to delete the message of alice, got: %v", err)
+	}
+
+	// A new login with the name of alice, who has no secret, is not her
+	clients["alice"].Close()
+	clients["carol"].Close()
+	waitFor(t, func() bool {
+		return server.SessionByUsername("alice") == nil && server.SessionByUsername("carol") == nil
+	})
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+	impostor := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) {})
+	opts.Secret = "carol's secret"
+	carolAgain := connectClient(t, "chat", "carol", opts, func(p *shared.Packet) {})
+	waitFor(t, func() bool { return len(impostor.Rooms()) > 0 && len(carolAgain.Rooms()) > 0 })
+
+	err = server.DeleteMessage(server.SessionByUsername("alice"), shared.DEFAULT_ROOM, aliceMsg)
+	if !errors.Is(err, tcp_server.NotAllowed) {
+		t.Errorf("Expected a new login as alice not to delete her message, got: %v", err)
+	}
+
+	// carol proved who she is with her secret
+	err = server.DeleteMessage(server.SessionByUsername("carol"), shared.DEFAULT_ROOM, carolMsg)
+	if err != nil {
+		t.Errorf("Expected carol to delete her message after logging in again, got: %s", err)
+	}
+
+	msg, ok, err := server.Store.Get(shared.DEFAULT_ROOM, aliceMsg)
+	if !ok || err != nil || msg.Deleted || msg.Msg != "edited by mod" {
+		t.Errorf("Expected the message of alice as mod left it, got %v, %v, %v", msg, ok, err)
+	}
+}
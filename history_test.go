@@ -0,0 +1,300 @@
+package shared_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func fillStore(t *testing.T, store tcp_server.MessageStore, n int) {
+	for i := range n {
+		room := "general"
+		if i%2 == 1 {
+			room = "other"
+		}
+
+		msg, err := store.Append(shared.Message{Username: "Tobias", Msg: fmt.Sprintf("msg %d", i), Room: room})
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+
+		if msg.ID != uint64(i+1) {
+			t.Fatalf("Expected ID %d, got %d", i+1, msg.ID)
+		}
+	}
+}
+
+func checkPage(t *testing.T, store tcp_server.MessageStore, before uint64, after uint64, limit int, ids []uint64, more bool) {
+	msgs, gotMore, err := store.Page("general", before, after, limit)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	got := make([]uint64, 0, len(msgs))
+	for _, msg := range msgs {
+		got = append(got, msg.ID)
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(ids) || gotMore != more {
+		t.Errorf("Page(%d, %d, %d) malformed.\nExpected: %v %v\nGot: %v %v", before, after, limit, ids, more, got, gotMore)
+	}
+}
+
+func testStorePaging(t *testing.T, store tcp_server.MessageStore) {
+	// general holds the odd IDs 1 to 19
+	fillStore(t, store, 20)
+
+	checkPage(t, store, 0, 0, 3, []uint64{15, 17, 19}, true)
+	checkPage(t, store, 15, 0, 3, []uint64{9, 11, 13}, true)
+	checkPage(t, store, 5, 0, 3, []uint64{1, 3}, false)
+	checkPage(t, store, 0, 14, 2, []uint64{15, 17}, true)
+	checkPage(t, store, 0, 15, 5, []uint64{17, 19}, false)
+	checkPage(t, store, 9, 3, 10, []uint64{5, 7}, false)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStorePaging(t, tcp_server.NewMemoryStore(100))
+}
+
+func TestMemoryStoreDropsOldest(t *testing.T) {
+	store := tcp_server.NewMemoryStore(4)
+	fillStore(t, store, 20)
+
+	checkPage(t, store, 0, 0, 10, []uint64{13, 15, 17, 19}, false)
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	store, err := tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	testStorePaging(t, store)
+	store.Close()
+
+	// A partially written message is dropped when the store is opened again
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	file.Write([]byte{shared.MAJOR_VERSION << 4, 0x10})
+	file.Close()
+
+	store, err = tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer store.Close()
+
+	checkPage(t, store, 0, 0, 3, []uint64{15, 17, 19}, true)
+
+	msg, err := store.Append(shared.Message{Username: "Tobias", Msg: "after reopen", Room: "general"})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if msg.ID != 21 {
+		t.Errorf("Expected ID 21 after reopening, got %d", msg.ID)
+	}
+
+	checkPage(t, store, 0, 0, 2, []uint64{19, 21}, true)
+}
+
+func TestFileStoreCorruptMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	store, err := tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	fillStore(t, store, 4)
+	store.Close()
+
+	// Turn the second message into a packet of another kind, keeping its length
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	second := 3 + shared.DataLength(data)
+	data[second+3] = 200
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	_, err = tcp_server.OpenFileStore(path)
+	if err == nil {
+		t.Fatalf("Expected a corrupt message to fail opening the store")
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil || len(after) != len(data) {
+		t.Errorf("Expected the file to be left as it was, %d bytes became %d (%v)", len(data), len(after), err)
+	}
+}
+
+// failingFile only writes half of what it is given while fail is set
+type failingFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *failingFile) Write(data []byte) (int, error) {
+	if !f.fail {
+		return f.File.Write(data)
+	}
+
+	n, _ := f.File.Write(data[:len(data)/2])
+	return n, errors.New("Disk full.")
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	failing := &failingFile{File: file}
+	store, err := tcp_server.NewFileStore(failing)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	fillStore(t, store, 2)
+
+	failing.fail = true
+	_, err = store.Append(shared.Message{Username: "Tobias", Msg: "lost", Room: "general"})
+	if err == nil {
+		t.Fatalf("Expected the failed write to return an error")
+	}
+
+	failing.fail = false
+	msg, err := store.Append(shared.Message{Username: "Tobias", Msg: "after failure", Room: "general"})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	store.Close()
+
+	// Nothing of the failed message is left between the messages around it
+	store, err = tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer store.Close()
+
+	checkPage(t, store, 0, 0, 10, []uint64{1, msg.ID}, false)
+}
+
+func testStoreEdits(t *testing.T, store tcp_server.MessageStore) {
+	msg, ok, err := store.Get("general", 3)
+	if !ok || err != nil || msg.Msg != "msg 2" {
+		t.Fatalf("Expected message 3 to be 'msg 2', got %v, %v, %v", msg, ok, err)
+	}
+
+	msg.Msg = "edited"
+	msg.Edited = 1
+	store.Update(msg)
+	msg.Msg = ""
+	msg.Deleted = true
+	store.Update(msg)
+
+	msg, ok, err = store.Get("general", 3)
+	if !ok || err != nil || !msg.Deleted || msg.Msg != "" {
+		t.Errorf("Expected message 3 to be deleted, got %v, %v, %v", msg, ok, err)
+	}
+
+	revisions, err := store.Revisions("general", 3)
+	if err != nil || len(revisions) != 2 || revisions[0].Msg != "msg 2" || revisions[1].Msg != "edited" {
+		t.Errorf("Expected both earlier versions, got %v, %v", revisions, err)
+	}
+
+	// Updating keeps the message in its place
+	checkPage(t, store, 7, 0, 10, []uint64{1, 3, 5}, false)
+
+	err = store.Update(shared.Message{Room: "general", ID: 4})
+	if !errors.Is(err, tcp_server.MessageNotFound) {
+		t.Errorf("Expected MessageNotFound for a message of another room, got %v", err)
+	}
+}
+
+func TestStoreEdits(t *testing.T) {
+	memory := tcp_server.NewMemoryStore(100)
+	fillStore(t, memory, 20)
+	testStoreEdits(t, memory)
+
+	storage := tcp_server.NewMemoryStorage()
+	fillStore(t, storage, 20)
+	testStoreEdits(t, storage)
+
+	path := filepath.Join(t.TempDir(), "history")
+	store, err := tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	fillStore(t, store, 20)
+	testStoreEdits(t, store)
+	store.Close()
+
+	// The edits are replayed from the file
+	store, err = tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer store.Close()
+
+	if msg, _, _ := store.Get("general", 3); !msg.Deleted {
+		t.Errorf("Expected message 3 to still be deleted, got %v", msg)
+	}
+
+	if revisions, _ := store.Revisions("general", 3); len(revisions) != 2 {
+		t.Errorf("Expected 2 earlier versions after reopening, got %v", revisions)
+	}
+}
+
+func testStoreThread(t *testing.T, store tcp_server.MessageStore) {
+	parent, _ := store.Append(shared.Message{Username: "tobias", Msg: "incident", Room: "general"})
+	store.Append(shared.Message{Username: "bob", Msg: "elsewhere", Room: "other"})
+	store.Append(shared.Message{Username: "bob", Msg: "on it", Room: "general", Parent: parent.ID})
+	store.Append(shared.Message{Username: "tobias", Msg: "thanks", Room: "general", Parent: parent.ID})
+
+	replies, err := store.Thread("general", parent.ID)
+	if err != nil || len(replies) != 2 || replies[0].Msg != "on it" || replies[1].Msg != "thanks" {
+		t.Errorf("Expected both replies in order, got %v, %v", replies, err)
+	}
+
+	if replies, _ := store.Thread("general", replies[0].ID); len(replies) != 0 {
+		t.Errorf("Expected no replies to a reply, got %v", replies)
+	}
+}
+
+func TestStoreThreads(t *testing.T) {
+	testStoreThread(t, tcp_server.NewMemoryStore(100))
+	testStoreThread(t, tcp_server.NewMemoryStorage())
+
+	path := filepath.Join(t.TempDir(), "history")
+	store, err := tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	testStoreThread(t, store)
+	store.Close()
+
+	// The thread index is rebuilt from the file
+	store, err = tcp_server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer store.Close()
+
+	if replies, _ := store.Thread("general", 1); len(replies) != 2 {
+		t.Errorf("Expected 2 replies after reopening, got %v", replies)
+	}
+}
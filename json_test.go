@@ -0,0 +1,76 @@
+package shared_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+func TestPacketJSONRoundTrip(t *testing.T) {
+	for _, kind := range shared.RegisteredKinds() {
+		msg, err := shared.NewMessage(kind)
+		if err != nil {
+			t.Errorf("Did not expect error, but got: %s", err)
+			continue
+		}
+
+		packet, err := shared.PacketFromMessage(kind, msg)
+		if err != nil {
+			t.Errorf("Did not expect error for '%s', but got: %s", kind, err)
+			continue
+		}
+
+		data, err := shared.PacketToJSON(packet)
+		if err != nil {
+			t.Errorf("Did not expect error for '%s', but got: %s", kind, err)
+			continue
+		}
+
+		parsed, err := shared.PacketFromJSON(data)
+		if err != nil {
+			t.Errorf("Did not expect error for '%s', but got: %s", kind, err)
+			continue
+		}
+
+		if string(parsed.Data) != string(packet.Data) {
+			t.Errorf("JSON round trip of '%s' changed data.\nExpected: %v\nGot: %v", kind, packet.Data, parsed.Data)
+		}
+	}
+}
+
+func TestPacketFromJSON(t *testing.T) {
+	packet, err := shared.PacketFromJSON([]byte(`{"type":"message","data":{"Msg":"Hello"}}`))
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	var msg shared.Message
+	err = packet.IntoMessage(&msg)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+	}
+
+	if msg.Msg != "Hello" || msg.Username != "" {
+		t.Errorf("Decoded data malformed: %+v", msg)
+	}
+
+	data, _ := shared.PacketToJSON(packet)
+	var jsonMsg shared.JSONMessage
+	json.Unmarshal(data, &jsonMsg)
+	if jsonMsg.Type != "message" {
+		t.Errorf("Expected type 'message', got '%s'", jsonMsg.Type)
+	}
+
+	_, err = shared.PacketFromJSON([]byte(`{"type":"nope","data":{}}`))
+	if !errors.Is(err, shared.UnknownKind) {
+		t.Errorf("Expected unknown kind error, got: %v", err)
+	}
+
+	_, err = shared.PacketFromJSON([]byte(`{"type":"message","data":{"Text":"Hello"}}`))
+	if err == nil {
+		t.Errorf("Expected error for unknown field, but got none")
+	}
+}
@@ -0,0 +1,73 @@
+package shared_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+func TestHeartbeatMissedPongs(t *testing.T) {
+	heartbeat := shared.NewHeartbeat(time.Second, 2)
+
+	for range 2 {
+		_, err := heartbeat.NextPing()
+		if err != nil {
+			t.Errorf("Did not expect error, but got: %s", err)
+		}
+	}
+
+	_, err := heartbeat.NextPing()
+	if !errors.Is(err, shared.MissedPongs) {
+		t.Errorf("Expected missed pongs error, got: %v", err)
+	}
+}
+
+func TestHeartbeatPingPong(t *testing.T) {
+	client := shared.NewHeartbeat(time.Second, 1)
+	server := shared.NewHeartbeat(time.Second, 1)
+
+	ping, err := client.NextPing()
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	var pong *shared.Packet
+	handled, err := server.HandleKeepalive(ping, func(p *shared.Packet) error {
+		pong = p
+		return nil
+	})
+	if !handled || err != nil {
+		t.Errorf("Expected ping to be handled without error, got %v, %v", handled, err)
+		return
+	}
+
+	if pong == nil || pong.Kind() != shared.KIND_PONG {
+		t.Errorf("Expected pong in reply to ping, got: %v", pong)
+		return
+	}
+
+	time.Sleep(time.Millisecond)
+	handled, err = client.HandleKeepalive(pong, nil)
+	if !handled || err != nil {
+		t.Errorf("Expected pong to be handled without error, got %v, %v", handled, err)
+	}
+
+	if client.RTT() <= 0 {
+		t.Errorf("Expected round trip time to be measured, got %s", client.RTT())
+	}
+
+	// The pong resets the missed count, so another ping is allowed
+	_, err = client.NextPing()
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+	}
+
+	message, _ := shared.PacketFromMessage(shared.KIND_MESSAGE, shared.Message{Msg: "Hello"})
+	handled, _ = client.HandleKeepalive(message, nil)
+	if handled {
+		t.Errorf("Expected chat message to not be handled as keepalive")
+	}
+}
@@ -0,0 +1,191 @@
+package shared_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+func TestPacketFromMessage(t *testing.T) {
+	msg := shared.Message{
+		Username:  "Tobias",
+		Msg:       "Hello",
+		Reactions: shared.Reactions{{Emoji: "👍", Users: []string{"bob", "alice"}}},
+	}
+
+	packet, err := shared.PacketFromMessage(shared.KIND_MESSAGE, msg)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	if packet.Kind() != shared.KIND_MESSAGE {
+		t.Errorf("Expected kind %s, got %s", shared.KIND_MESSAGE, packet.Kind())
+	}
+
+	var decoded shared.Message
+	err = packet.IntoMessage(&decoded)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+	}
+
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Errorf("Decoded data malformed.\nExpected: %v\nGot: %v", msg, decoded)
+	}
+
+	kind, generic, err := packet.DecodeMessage()
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	if kind != shared.KIND_MESSAGE || !reflect.DeepEqual(*generic.(*shared.Message), msg) {
+		t.Errorf("Decoded data malformed.\nExpected: %v\nGot: %v", msg, generic)
+	}
+}
+
+func TestPacketFromMessageMismatchedKind(t *testing.T) {
+	_, err := shared.PacketFromMessage(shared.KIND_HELLO, shared.Message{})
+	if !errors.Is(err, shared.MismatchedKind) {
+		t.Errorf("Expected mismatched kind error, got: %v", err)
+	}
+
+	packet, _ := shared.PacketFromMessage(shared.KIND_MESSAGE, shared.Message{})
+	var hello shared.Hello
+	err = packet.IntoMessage(&hello)
+	if !errors.Is(err, shared.MismatchedKind) {
+		t.Errorf("Expected mismatched kind error, got: %v", err)
+	}
+}
+
+func TestDecodeMalformedMessage(t *testing.T) {
+	unknown, _ := shared.PacketFromData([]byte{200, 1, 2})
+	_, _, err := unknown.DecodeMessage()
+	if !errors.Is(err, shared.UnknownKind) {
+		t.Errorf("Expected unknown kind error, got: %v", err)
+	}
+
+	// String length claims more bytes than the packet holds
+	truncated, _ := shared.PacketFromData([]byte{byte(shared.KIND_MESSAGE), 10, 'a', 'b'})
+	_, _, err = truncated.DecodeMessage()
+	if !errors.Is(err, shared.MalformedData) {
+		t.Errorf("Expected malformed data error, got: %v", err)
+	}
+
+	trailing, _ := shared.PacketFromData([]byte{byte(shared.KIND_MESSAGE), 1, 'a', 1, 'b', 42})
+	_, _, err = trailing.DecodeMessage()
+	if !errors.Is(err, shared.MalformedData) {
+		t.Errorf("Expected malformed data error, got: %v", err)
+	}
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	ack := shared.Ack{Nonce: 1 << 40, ID: 42, Time: 1700000000000, Room: "general"}
+
+	packet, err := shared.PacketFromMessage(shared.KIND_ACK, ack)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	var decoded shared.Ack
+	err = packet.IntoMessage(&decoded)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+	}
+
+	if decoded != ack {
+		t.Errorf("Decoded data malformed.\nExpected: %v\nGot: %v", ack, decoded)
+	}
+}
+
+func TestFileChunkRoundTrip(t *testing.T) {
+	data := make([]byte, shared.FILE_CHUNK_SIZE)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	chunk := shared.FileChunk{Transfer: shared.NewTransferId(), Offset: 1 << 20, Data: data}
+
+	packet, err := shared.PacketFromMessage(shared.KIND_FILE_CHUNK, chunk)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	var decoded shared.FileChunk
+	err = packet.IntoMessage(&decoded)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+	}
+
+	if !reflect.DeepEqual(decoded, chunk) {
+		t.Errorf("Decoded data malformed.\nExpected: %v\nGot: %v", chunk, decoded)
+	}
+
+	chunk.Data = make([]byte, shared.FILE_CHUNK_SIZE+1)
+	_, err = shared.PacketFromMessage(shared.KIND_FILE_CHUNK, chunk)
+	if err == nil {
+		t.Errorf("Expected a chunk larger than FILE_CHUNK_SIZE to fail")
+	}
+}
+
+func TestDiscoveryReplyDatagram(t *testing.T) {
+	reply := shared.DiscoveryReply{Nonce: 42, Name: "office", Port: 42069, Version: "1.0", Rooms: 3, Users: 7, TLS: true}
+
+	packet, err := shared.PacketFromMessage(shared.KIND_DISCOVERY_REPLY, reply)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	parsed, err := shared.ParseDatagram(packet.Encode())
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if parsed.Kind() != shared.KIND_DISCOVERY_REPLY {
+		t.Fatalf("Expected kind %d, got %d", shared.KIND_DISCOVERY_REPLY, parsed.Kind())
+	}
+
+	var decoded shared.DiscoveryReply
+	err = parsed.IntoMessage(&decoded)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if decoded != reply {
+		t.Errorf("Decoded data malformed.\nExpected: %v\nGot: %v", reply, decoded)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	var reactions shared.Reactions
+	reactions = reactions.Set("👍", "alice", true)
+	reactions = reactions.Set("🎉", "bob", true)
+	reactions = reactions.Set("👍", "bob", true)
+	reactions = reactions.Set("👍", "bob", true)
+
+	expected := shared.Reactions{{Emoji: "👍", Users: []string{"alice", "bob"}}, {Emoji: "🎉", Users: []string{"bob"}}}
+	if !reflect.DeepEqual(reactions, expected) {
+		t.Errorf("Reactions malformed.\nExpected: %v\nGot: %v", expected, reactions)
+	}
+
+	removed := reactions.Set("🎉", "bob", false).Set("👍", "alice", false)
+	expected = shared.Reactions{{Emoji: "👍", Users: []string{"bob"}}}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("Reactions malformed.\nExpected: %v\nGot: %v", expected, removed)
+	}
+
+	if !reactions.Has("🎉", "bob") || removed.Has("🎉", "bob") {
+		t.Errorf("Expected Set to leave the reactions it was called on unchanged")
+	}
+
+	if emoji, ok := shared.NormalizeEmoji(":TADA:"); !ok || emoji != "🎉" {
+		t.Errorf("Expected :TADA: to become 🎉, got %s", emoji)
+	}
+
+	if _, ok := shared.NormalizeEmoji("two words"); ok {
+		t.Errorf("Expected an emoji with whitespace to be invalid")
+	}
+}
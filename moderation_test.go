@@ -0,0 +1,238 @@
+package shared_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+// addrTransport gives the connections accepted by its listeners the remote addresses
+// of addrs in turn, so a test can connect from many IP addresses over pipes
+type addrTransport struct {
+	shared.Transport
+	addrs chan string
+}
+
+func (t addrTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return addrListener{listener, t.addrs}, nil
+}
+
+type addrListener struct {
+	net.Listener
+	addrs chan string
+}
+
+func (l addrListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return addrConn{conn, &net.TCPAddr{IP: net.ParseIP(<-l.addrs), Port: 1234}}, nil
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// moderatedChat logs in the users, each from its own IP address and with a secret, with the given server roles
+func moderatedChat(t *testing.T, roles map[string]tcp_server.Role, users ...string) (*tcp_server.Server, map[string]*tcp_client.Client) {
+	pipe := shared.NewPipeTransport()
+	transport := addrTransport{pipe, make(chan string, len(users))}
+	server := startChat(t, transport, nil, "chat")
+
+	for username, role := range roles {
+		err := server.Storage.SetRole(tcp_server.RoleRecord{Username: username, Role: role})
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+	}
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+
+	clients := make(map[string]*tcp_client.Client)
+	for i, username := range users {
+		transport.addrs <- net.IPv4(10, 0, 0, byte(i+1)).String()
+		opts.Secret = username + "'s secret"
+		clients[username] = connectClient(t, "chat", username, opts, func(p *shared.Packet) {})
+	}
+
+	// The users, and their secrets, are stored before they join their rooms
+	for _, client := range clients {
+		waitFor(t, func() bool { return len(client.Rooms()) > 0 })
+	}
+
+	return server, clients
+}
+
+func TestUnbanNeedsRoleOfBan(t *testing.T) {
+	server, _ := moderatedChat(t, map[string]tcp_server.Role{
+		"olivia": tcp_server.ROLE_OWNER,
+		"mod":    tcp_server.ROLE_MODERATOR,
+		"mod2":   tcp_server.ROLE_MODERATOR,
+	}, "olivia", "mod", "mod2")
+	olivia, mod, mod2 := server.SessionByUsername("olivia"), server.SessionByUsername("mod"), server.SessionByUsername("mod2")
+
+	for _, room := range []string{"", shared.DEFAULT_ROOM} {
+		err := server.Ban(olivia, room, "troll", 0, "")
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+
+		err = server.Unban(mod, room, "troll")
+		if !errors.Is(err, tcp_server.NotAllowed) {
+			t.Errorf("Expected a moderator not to lift the ban of an owner in '%s', got: %v", room, err)
+		}
+
+		err = server.Ban(mod, room, "spammer", 0, "")
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+
+		err = server.Unban(mod2, room, "spammer")
+		if !errors.Is(err, tcp_server.NotAllowed) {
+			t.Errorf("Expected a moderator not to lift the ban of another moderator in '%s', got: %v", room, err)
+		}
+
+		for _, unban := range []struct {
+			session *tcp_server.Session
+			target  string
+		}{{olivia, "troll"}, {mod, "spammer"}} {
+			err = server.Unban(unban.session, room, unban.target)
+			if err != nil {
+				t.Errorf("Expected %s to lift the ban of %s in '%s', got: %s", unban.session.Username(), unban.target, room, err)
+			}
+		}
+	}
+}
+
+func TestIPBanRoles(t *testing.T) {
+	server, clients := moderatedChat(t, map[string]tcp_server.Role{
+		"olivia": tcp_server.ROLE_OWNER,
+		"mod":    tcp_server.ROLE_MODERATOR,
+		"mod2":   tcp_server.ROLE_MODERATOR,
+	}, "olivia", "mod", "mod2", "member")
+	mod := server.SessionByUsername("mod")
+
+	// olivia, mod and mod2 cannot be banned by mod
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		err := server.Ban(mod, "", addr, 0, "")
+		if !errors.Is(err, tcp_server.NotAllowed) {
+			t.Errorf("Expected banning %s to be refused, got: %v", addr, err)
+		}
+	}
+
+	err := server.Ban(mod, "", "10.0.0.4", 0, "")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	waitFor(t, func() bool { return server.SessionByUsername("member") == nil })
+	for _, username := range []string{"olivia", "mod", "mod2"} {
+		if server.SessionByUsername(username) == nil || clients[username].Closed() {
+			t.Errorf("Expected %s to stay connected", username)
+		}
+	}
+}
+
+// login connects as username with the secret, and returns why logging in failed
+func login(transport shared.Transport, username string, secret string) error {
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	opts.PingInterval = 0
+	opts.Reconnect = false
+	opts.Output = io.Discard
+	opts.Username = username
+	opts.Secret = secret
+
+	client, err := tcp_client.ConnectWithOptions("chat", opts)
+	if err == nil {
+		client.Close()
+	}
+	return err
+}
+
+// TestRolesNeedSecret checks that the name of a user with a role cannot be taken
+// without the secret of the user
+func TestRolesNeedSecret(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = pipe
+	server.Limits = tcp_server.RateLimits{}
+	server.Owners = []string{"oscar"}
+	startServer(t, &server, "chat")
+
+	// A configured owner cannot log in, or claim the name with a secret, before having one
+	for _, secret := range []string{"", "guess"} {
+		err := login(pipe, "oscar", secret)
+		if !errors.Is(err, tcp_client.LoginFailed) || !strings.Contains(err.Error(), tcp_server.NotAllowed.Error()) {
+			t.Errorf("Expected the owner without a secret to be refused, got: %v", err)
+		}
+	}
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+	opts.Secret = "olivia's secret"
+	olivia := connectClient(t, "chat", "olivia", opts, func(p *shared.Packet) {})
+	opts.Secret = ""
+	mallory := connectClient(t, "chat", "mallory", opts, func(p *shared.Packet) {})
+	waitFor(t, func() bool { return len(olivia.Rooms()) > 0 && len(mallory.Rooms()) > 0 })
+
+	// Roles are only given to users with a secret
+	err := server.Storage.SetRole(tcp_server.RoleRecord{Username: "olivia", Role: tcp_server.ROLE_OWNER})
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	err = server.SetRole(server.SessionByUsername("olivia"), "", "mallory", tcp_server.ROLE_MODERATOR)
+	if !errors.Is(err, tcp_server.NotAllowed) {
+		t.Errorf("Expected a role for a user without a secret to be refused, got: %v", err)
+	}
+
+	err = server.Join(server.SessionByUsername("mallory"), "lobby")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	if role := server.RoleOf("mallory", "lobby"); role != tcp_server.ROLE_MEMBER {
+		t.Errorf("Expected a user without a secret not to own a new room, got %s", role)
+	}
+
+	err = server.Rename(server.SessionByUsername("mallory"), "oscar")
+	if !errors.Is(err, tcp_server.UsernameTaken) {
+		t.Errorf("Expected the name of the configured owner to be taken, got: %v", err)
+	}
+
+	olivia.Close()
+	waitFor(t, func() bool { return server.SessionByUsername("olivia") == nil })
+
+	for _, secret := range []string{"", "guess"} {
+		err = login(pipe, "olivia", secret)
+		if !errors.Is(err, tcp_client.LoginFailed) || !strings.Contains(err.Error(), tcp_server.WrongSecret.Error()) {
+			t.Errorf("Expected logging in as olivia with '%s' to be refused, got: %v", secret, err)
+		}
+	}
+
+	err = login(pipe, "olivia", "olivia's secret")
+	if err != nil {
+		t.Errorf("Expected olivia to log in with the secret, got: %s", err)
+	}
+}
@@ -0,0 +1,112 @@
+package shared_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+// presenceChat logs in alice and bob on a server marking users away after awayAfter,
+// and passes on the packets bob receives
+func presenceChat(t *testing.T, awayAfter time.Duration) (*tcp_client.Client, *tcp_client.Client, chan *shared.Packet) {
+	transport := shared.NewPipeTransport()
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = transport
+	server.Limits = tcp_server.RateLimits{}
+	server.AwayAfter = awayAfter
+	startServer(t, &server, "chat")
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	opts.PingInterval = 0
+
+	packets := make(chan *shared.Packet, 100)
+	alice := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) {})
+	bob := connectClient(t, "chat", "bob", opts, func(p *shared.Packet) { packets <- p })
+	waitFor(t, func() bool { return len(alice.Rooms()) > 0 && len(bob.Rooms()) > 0 })
+
+	return alice, bob, packets
+}
+
+// expectPresence waits for a presence change of the user, not sent for joining a room
+func expectPresence(t *testing.T, packets chan *shared.Packet, username string, status shared.PresenceStatus) {
+	for {
+		select {
+		case p := <-packets:
+			var presence shared.Presence
+			if p.Kind() != shared.KIND_PRESENCE || p.IntoMessage(&presence) != nil {
+				continue
+			}
+			if presence.Username == username && presence.Room == "" {
+				if presence.Status != status {
+					t.Fatalf("Expected %s to be %s, got %s", username, status, presence.Status)
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not receive the presence of %s", username)
+		}
+	}
+}
+
+// expectReply sends the command line from the client, and checks the reply
+func expectReply(t *testing.T, client *tcp_client.Client, packets chan *shared.Packet, line string, expected string) {
+	_, err := client.SendLine(line, shared.DEFAULT_ROOM)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	for {
+		select {
+		case p := <-packets:
+			var reply shared.CommandReply
+			if p.Kind() != shared.KIND_COMMAND_REPLY || p.IntoMessage(&reply) != nil || reply.Command == "motd" {
+				continue
+			}
+			if reply.Msg != expected {
+				t.Errorf("Expected %s to reply '%s', got '%s'", line, expected, reply.Msg)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not receive the reply to %s", line)
+		}
+	}
+}
+
+func TestPresenceAwayWhenIdle(t *testing.T) {
+	alice, _, packets := presenceChat(t, 100*time.Millisecond)
+
+	expectPresence(t, packets, "alice", shared.PRESENCE_AWAY)
+
+	_, err := alice.SendLine("hello", shared.DEFAULT_ROOM)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	expectPresence(t, packets, "alice", shared.PRESENCE_ONLINE)
+}
+
+func TestPresenceManualAway(t *testing.T) {
+	alice, bob, packets := presenceChat(t, time.Hour)
+
+	expectReply(t, bob, packets, "/who", "Users in "+shared.DEFAULT_ROOM+": alice, bob")
+
+	alice.SendLine("/away", "")
+	expectPresence(t, packets, "alice", shared.PRESENCE_AWAY)
+
+	// Manually set away is kept while talking
+	alice.SendLine("hello", shared.DEFAULT_ROOM)
+	receiveMessage(t, packets, "hello", "")
+	expectReply(t, bob, packets, "/who", "Users in "+shared.DEFAULT_ROOM+": alice (away), bob")
+	expectReply(t, bob, packets, "/who *", "2 online: alice (away), bob")
+
+	alice.SendLine("/back", "")
+	expectPresence(t, packets, "alice", shared.PRESENCE_ONLINE)
+
+	alice.Close()
+	expectPresence(t, packets, "alice", shared.PRESENCE_OFFLINE)
+	expectReply(t, bob, packets, "/who", "Users in "+shared.DEFAULT_ROOM+": alice (offline, last seen just now), bob")
+	expectReply(t, bob, packets, "/who *", "1 online: bob")
+}
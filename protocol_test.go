@@ -83,6 +83,10 @@ func TestEncode(t *testing.T) {
 		t.Errorf("Datalength doesnt match!")
 	}
 
+	if shared.DataLength(b) != len("Hello world") {
+		t.Errorf("Expected the data length read back to be %d, got %d", len("Hello world"), shared.DataLength(b))
+	}
+
 	data := b[3:]
 	if strings.Compare(string(packet.Data), string(data)) != 0 {
 		t.Errorf("Expected data to be: \"%v\", got: \"%v\"\n", packet.Data, data)
@@ -746,3 +750,25 @@ func TestPacketIntoNilPointer(t *testing.T) {
 		t.Errorf("Expected error but got data: %v", decoded)
 	}
 }
+
+func TestSplitAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+	}{
+		{"42069", "tcp", ":42069"},
+		{"localhost:42069", "tcp", "localhost:42069"},
+		{"0.0.0.0:42069", "tcp4", "0.0.0.0:42069"},
+		{"[::]:42069", "tcp6", "[::]:42069"},
+		{"[::1]:42069", "tcp", "[::1]:42069"},
+		{"unix:/tmp/chat.sock", "unix", "/tmp/chat.sock"},
+	}
+
+	for _, test := range tests {
+		network, addr := shared.SplitAddress(test.address)
+		if network != test.network || addr != test.addr {
+			t.Errorf("Expected '%s' to be %s %s, got %s %s", test.address, test.network, test.addr, network, addr)
+		}
+	}
+}
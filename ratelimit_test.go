@@ -0,0 +1,152 @@
+package shared_test
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func TestBucketBurstAndRefill(t *testing.T) {
+	bucket := tcp_server.NewBucket(tcp_server.Limit{Rate: 2, Burst: 3})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !bucket.Take(1, now) {
+			t.Fatalf("Expected token %d of the burst to be taken", i+1)
+		}
+	}
+	if bucket.Take(1, now) {
+		t.Fatalf("Expected the bucket to be empty after the burst")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !bucket.Take(1, now) {
+		t.Fatalf("Expected a token after half a second at 2 a second")
+	}
+	if bucket.Take(1, now) {
+		t.Fatalf("Expected only a single token after half a second")
+	}
+
+	now = now.Add(time.Hour)
+	if !bucket.Full(now) {
+		t.Fatalf("Expected the bucket to be full after an hour")
+	}
+	if !bucket.Take(3, now) || bucket.Take(1, now) {
+		t.Fatalf("Expected the bucket to refill only up to its burst")
+	}
+}
+
+func TestBucketHas(t *testing.T) {
+	bucket := tcp_server.NewBucket(tcp_server.Limit{Rate: 1, Burst: 2})
+	now := time.Now()
+
+	if !bucket.Has(2, now) || !bucket.Has(2, now) {
+		t.Fatalf("Expected Has to leave the tokens in the bucket")
+	}
+	if bucket.Has(3, now) {
+		t.Fatalf("Expected Has to report too few tokens")
+	}
+}
+
+// TestPingFlood floods a session with pings, and checks that only the burst is answered
+func TestPingFlood(t *testing.T) {
+	transport := shared.NewPipeTransport()
+
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = transport
+	server.PingInterval = 0
+	server.Limits = tcp_server.RateLimits{
+		SessionMessages: tcp_server.Limit{Rate: 0.1, Burst: 5},
+		Penalty:         tcp_server.PENALTY_DROP,
+	}
+	err := server.Start("chat")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	conn, err := transport.Dial("chat")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer conn.Close()
+
+	const PINGS = 50
+	go func() {
+		for i := range PINGS {
+			ping, _ := shared.PacketFromMessage(shared.KIND_PING, shared.Ping{Nonce: uint32(i)})
+			_, err := conn.Write(ping.Encode())
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	pongs := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		p, err := shared.ParsePacket(reader)
+		if err != nil {
+			break
+		}
+		if p.Kind() == shared.KIND_PONG {
+			pongs += 1
+		}
+	}
+
+	if pongs != 5 {
+		t.Errorf("Expected only the burst of 5 pings to be answered, got %d pongs", pongs)
+	}
+}
+
+func TestBucketDisabled(t *testing.T) {
+	bucket := tcp_server.NewBucket(tcp_server.Limit{})
+	now := time.Now()
+
+	for i := 0; i < 1000; i++ {
+		if !bucket.Take(4096, now) {
+			t.Fatalf("Expected a bucket without a rate to never run out")
+		}
+	}
+}
+
+func TestLimitSet(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected tcp_server.Limit
+	}{
+		{"10/30", tcp_server.Limit{Rate: 10, Burst: 30}},
+		{"5", tcp_server.Limit{Rate: 5, Burst: 5}},
+		{"0.5", tcp_server.Limit{Rate: 0.5, Burst: 1}},
+		{"0", tcp_server.Limit{Rate: 0, Burst: 1}},
+	}
+
+	for _, test := range tests {
+		var limit tcp_server.Limit
+		err := limit.Set(test.value)
+		if err != nil {
+			t.Fatalf("Did not expect error for '%s', but got: %s", test.value, err)
+		}
+		if limit != test.expected {
+			t.Errorf("Expected '%s' to be %+v, got %+v", test.value, test.expected, limit)
+		}
+	}
+
+	for _, value := range []string{"", "fast", "-1", "10/", "10/0", "10/x"} {
+		var limit tcp_server.Limit
+		if limit.Set(value) == nil {
+			t.Errorf("Expected error for '%s'", value)
+		}
+	}
+
+	var penalty tcp_server.Penalty
+	if penalty.Set("Mute") != nil || penalty != tcp_server.PENALTY_MUTE {
+		t.Errorf("Expected 'Mute' to be %s, got %s", tcp_server.PENALTY_MUTE, penalty)
+	}
+	if penalty.Set("ban") == nil {
+		t.Errorf("Expected error for the unknown penalty 'ban'")
+	}
+}
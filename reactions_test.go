@@ -0,0 +1,90 @@
+package shared_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+// storedReactions returns the reactions stored with the message
+func storedReactions(t *testing.T, server *tcp_server.Server, id uint64) shared.Reactions {
+	msg, ok, err := server.Store.Get(shared.DEFAULT_ROOM, id)
+	if !ok || err != nil {
+		t.Fatalf("Expected message %d to be stored, got %v, %v", id, ok, err)
+	}
+
+	return msg.Reactions
+}
+
+func TestReact(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	server := startChat(t, pipe, nil, "chat")
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+
+	packets := make(chan *shared.Packet, 1000)
+	alice := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) { packets <- p })
+	connectClient(t, "chat", "bob", opts, func(p *shared.Packet) {})
+	waitFor(t, func() bool { return server.SessionByUsername("bob") != nil && len(alice.Rooms()) > 0 })
+	bob := server.SessionByUsername("bob")
+
+	alice.SendLine("react to me", shared.DEFAULT_ROOM)
+	var ack shared.Ack
+	receiveKind(t, packets, shared.KIND_ACK, &ack)
+
+	// Reacting again with the same emoji, here by its short code, removes the reaction
+	for _, added := range []bool{true, false} {
+		err := server.React(bob, shared.DEFAULT_ROOM, ack.ID, ":tada:")
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+
+		var reaction shared.Reaction
+		receiveKind(t, packets, shared.KIND_REACTION, &reaction)
+		expected := shared.Reaction{ID: ack.ID, Room: shared.DEFAULT_ROOM, Emoji: "🎉", Username: "bob", Added: added}
+		if reaction != expected {
+			t.Errorf("Expected %v, got %v", expected, reaction)
+		}
+
+		if has := storedReactions(t, server, ack.ID).Has("🎉", "bob"); has != added {
+			t.Errorf("Expected the stored reaction to be %v, got %v", added, has)
+		}
+	}
+
+	if reactions := storedReactions(t, server, ack.ID); len(reactions) != 0 {
+		t.Errorf("Expected no reactions left, got %v", reactions)
+	}
+
+	// Reactions stop once the message would not fit in a packet
+	var err error
+	added := 0
+	for ; added < shared.MAX_DATA_LEN; added++ {
+		err = server.React(bob, shared.DEFAULT_ROOM, ack.ID, fmt.Sprintf("%032d", added))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "Too many reactions") {
+		t.Fatalf("Expected too many reactions, got: %v", err)
+	}
+	if reactions := storedReactions(t, server, ack.ID); len(reactions) != added {
+		t.Errorf("Expected the %d reactions that fit to be stored, got %d", added, len(reactions))
+	}
+
+	err = server.DeleteMessage(server.SessionByUsername("alice"), shared.DEFAULT_ROOM, ack.ID)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	err = server.React(bob, shared.DEFAULT_ROOM, ack.ID, ":tada:")
+	if !errors.Is(err, tcp_server.MessageNotFound) {
+		t.Errorf("Expected MessageNotFound for a deleted message, got: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package shared_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := shared.NewRecorder(&buf)
+
+	hello, _ := shared.PacketFromMessage(shared.KIND_HELLO, shared.Hello{Compression: shared.COMPRESSION_DEFLATE})
+	message, _ := shared.PacketFromMessage(shared.KIND_MESSAGE, shared.Message{Msg: strings.Repeat("a", 200)})
+	compressed, _ := message.Compress()
+
+	recorder.Record(1, shared.DIRECTION_OUT, hello)
+	recorder.Record(2, shared.DIRECTION_IN, compressed)
+
+	records, err := shared.ReadRecords(&buf)
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+		return
+	}
+
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records, got %d", len(records))
+		return
+	}
+
+	if records[0].Session != 1 || records[0].Direction != shared.DIRECTION_OUT || !bytes.Equal(records[0].Packet.Data, hello.Data) {
+		t.Errorf("First record malformed: %+v", records[0])
+	}
+
+	if records[1].Session != 2 || records[1].Direction != shared.DIRECTION_IN || !bytes.Equal(records[1].Packet.Data, message.Data) {
+		t.Errorf("Second record malformed: %+v", records[1])
+	}
+
+	if records[1].Time.Before(records[0].Time) {
+		t.Errorf("Expected records to be in chronological order")
+	}
+}
+
+func TestRecordTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := shared.NewRecorder(&buf)
+
+	message, _ := shared.PacketFromMessage(shared.KIND_MESSAGE, shared.Message{Msg: "Hello"})
+	recorder.Record(1, shared.DIRECTION_OUT, message)
+
+	truncated := buf.Bytes()[:shared.RECORD_HEADER_LEN+2]
+	_, err := shared.ReadRecords(bytes.NewReader(truncated))
+	if err == nil {
+		t.Errorf("Expected error reading truncated record, but got none")
+	}
+}
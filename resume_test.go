@@ -0,0 +1,261 @@
+package shared_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+// flakyTransport dials over another transport, and can drop the connections it made
+// and refuse new ones, like a network going down
+type flakyTransport struct {
+	shared.Transport
+	mu      sync.Mutex
+	conns   []net.Conn
+	failing bool
+}
+
+func (t *flakyTransport) Dial(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failing {
+		return nil, errors.New("Network is down")
+	}
+
+	conn, err := t.Transport.Dial(addr)
+	if err == nil {
+		t.conns = append(t.conns, conn)
+	}
+	return conn, err
+}
+
+// down closes every connection made so far, and fails new ones until up is called
+func (t *flakyTransport) down() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failing = true
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = nil
+}
+
+func (t *flakyTransport) up() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failing = false
+}
+
+// syncBuffer collects the status messages of a client while it is listening
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// connectReconnecting logs in as username over the flaky transport, reconnecting
+// quickly whenever the connection is lost
+func connectReconnecting(t *testing.T, transport *flakyTransport, username string, output *syncBuffer, handler tcp_client.MessageHandler) *tcp_client.Client {
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	opts.Username = username
+	opts.PingInterval = 0
+	opts.MinBackoff = 10 * time.Millisecond
+	opts.MaxBackoff = 40 * time.Millisecond
+	opts.Output = output
+
+	client, err := tcp_client.ConnectWithOptions("chat", opts)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	go client.Listen(handler)
+	return client
+}
+
+// receiveMessage waits for a message with the text msg on packets, and returns how
+// many messages with the text counted were received before it
+func receiveMessage(t *testing.T, packets chan *shared.Packet, msg string, counted string) int {
+	count := 0
+	for {
+		select {
+		case p := <-packets:
+			var message shared.Message
+			if p.Kind() != shared.KIND_MESSAGE || p.IntoMessage(&message) != nil {
+				continue
+			}
+			if message.Msg == counted {
+				count++
+			}
+			if message.Msg == msg {
+				return count
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not receive '%s'", msg)
+		}
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	startChat(t, pipe, nil, "chat")
+
+	transport := &flakyTransport{Transport: pipe}
+	output := &syncBuffer{}
+	connectReconnecting(t, transport, "alice", output, func(p *shared.Packet) {})
+
+	const FAILURES = 4
+	transport.down()
+	waitFor(t, func() bool { return strings.Count(output.String(), "Reconnect failed") >= FAILURES })
+	transport.up()
+	waitFor(t, func() bool { return strings.Contains(output.String(), "Reconnected") })
+
+	delays := make([]time.Duration, 0)
+	for _, line := range strings.Split(output.String(), "\n") {
+		delay, ok := strings.CutPrefix(line, "Reconnecting in ")
+		if !ok {
+			continue
+		}
+
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+		delays = append(delays, d)
+	}
+
+	if len(delays) <= FAILURES {
+		t.Fatalf("Expected more than %d reconnect attempts, got %v", FAILURES, delays)
+	}
+
+	// The delay doubles up to MaxBackoff, of which up to half is jitter
+	for attempt, delay := range delays {
+		limit := min(10*time.Millisecond<<attempt, 40*time.Millisecond)
+		if delay < limit/2-time.Millisecond || delay > limit+time.Millisecond {
+			t.Errorf("Expected attempt %d to wait between %s and %s, got %s", attempt, limit/2, limit, delay)
+		}
+	}
+}
+
+// TestResumeMissedMessages drops the connection of a client, and checks that it resumes
+// its session and gets the messages sent while it was gone exactly once
+func TestResumeMissedMessages(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	server := startChat(t, pipe, nil, "chat")
+
+	transport := &flakyTransport{Transport: pipe}
+	packets := make(chan *shared.Packet, 100)
+	output := &syncBuffer{}
+	alice := connectReconnecting(t, transport, "alice", output, func(p *shared.Packet) { packets <- p })
+
+	bobPackets := make(chan *shared.Packet, 100)
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+	bob := connectClient(t, "chat", "bob", opts, func(p *shared.Packet) { bobPackets <- p })
+	waitFor(t, func() bool { return len(alice.Rooms()) > 0 && len(bob.Rooms()) > 0 })
+
+	transport.down()
+	waitFor(t, func() bool { return server.SessionByUsername("alice") == nil })
+
+	// The second message is only broadcast once the first has been kept for alice
+	bob.SendLine("missed", shared.DEFAULT_ROOM)
+	bob.SendLine("sync", shared.DEFAULT_ROOM)
+	receiveMessage(t, bobPackets, "sync", "")
+
+	transport.up()
+	if count := receiveMessage(t, packets, "missed", "missed"); count != 1 {
+		t.Errorf("Expected the missed message once, got it %d times", count)
+	}
+
+	bob.SendLine("after", shared.DEFAULT_ROOM)
+	if count := receiveMessage(t, packets, "after", "missed"); count != 0 {
+		t.Errorf("Expected the missed message once, got it %d more times", count)
+	}
+
+	if alice.Username() != "alice" || server.SessionByUsername("alice") == nil {
+		t.Errorf("Expected alice to be logged in again, got %s", alice.Username())
+	}
+}
+
+// TestLoginTakesOverDetachedSession checks that a user whose connection was lost can log
+// in again without the resume token, but not while another connection uses the name
+func TestLoginTakesOverDetachedSession(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	server := startChat(t, pipe, nil, "chat")
+
+	transport := &flakyTransport{Transport: pipe}
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	opts.PingInterval = 0
+	old := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) {})
+	waitFor(t, func() bool { return len(old.Rooms()) > 0 })
+
+	transport.down()
+	waitFor(t, func() bool { return server.SessionByUsername("alice") == nil })
+
+	opts.Transport = pipe
+	fresh := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) {})
+	if fresh.Username() != "alice" {
+		t.Errorf("Expected to log in as alice, got %s", fresh.Username())
+	}
+
+	opts.Username = "alice"
+	opts.Output = &syncBuffer{}
+	_, err := tcp_client.ConnectWithOptions("chat", opts)
+	if !errors.Is(err, tcp_client.LoginFailed) || !strings.Contains(err.Error(), tcp_server.UsernameTaken.Error()) {
+		t.Errorf("Expected the username to be taken, got: %v", err)
+	}
+}
+
+// TestRenameToStoredUser checks that a user cannot take the name of a user who is
+// offline, which would hand over the roles of that user
+func TestRenameToStoredUser(t *testing.T) {
+	server, _ := moderatedChat(t, map[string]tcp_server.Role{"olivia": tcp_server.ROLE_OWNER}, "mallory")
+	olivia := tcp_server.UserRecord{Username: "olivia", Created: time.Now()}
+	err := olivia.SetSecret("olivia's secret")
+	if err == nil {
+		err = server.Storage.SaveUser(olivia)
+	}
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	mallory := server.SessionByUsername("mallory")
+	err = server.Rename(mallory, "olivia")
+	if !errors.Is(err, tcp_server.UsernameTaken) {
+		t.Errorf("Expected the name of a stored user to be taken, got: %v", err)
+	}
+
+	err = server.Rename(mallory, "mal")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if mallory.Username() != "mal" || server.RoleOf("mal", "") != tcp_server.ROLE_MEMBER || server.RoleOf("olivia", "") != tcp_server.ROLE_OWNER {
+		t.Errorf("Expected only olivia to be owner, got %s as %s", mallory.Username(), server.RoleOf(mallory.Username(), ""))
+	}
+}
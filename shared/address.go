@@ -0,0 +1,40 @@
+package shared
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Addresses starting with UNIX_PREFIX are the path of a unix domain socket, e.g. "unix:/tmp/chat.sock"
+	UNIX_PREFIX = "unix:"
+	// Addresses starting with WEBSOCKET_PREFIX carry WebSocket connections, e.g. "ws:8080" or "ws:unix:/tmp/chat-ws.sock"
+	WEBSOCKET_PREFIX = "ws:"
+)
+
+// SplitAddress returns the network and address to listen on or dial for an address
+// given by the user. An address is the path of a unix socket after UNIX_PREFIX, a
+// host:port, or only a port for every interface. Every interface means both IPv4 and
+// IPv6, unless the host is 0.0.0.0 for only IPv4 or [::] for only IPv6.
+func SplitAddress(address string) (string, string) {
+	if path, ok := strings.CutPrefix(address, UNIX_PREFIX); ok {
+		return "unix", path
+	}
+
+	if _, err := strconv.Atoi(address); err == nil {
+		return "tcp", net.JoinHostPort("", address)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		switch host {
+		case "0.0.0.0":
+			return "tcp4", address
+		case "::":
+			return "tcp6", address
+		}
+	}
+
+	return "tcp", address
+}
@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"errors"
+	"strings"
+)
+
+var InvalidCommand = errors.New("Invalid command.")
+
+// Command is a line starting with "/" typed by the user. Room is the room
+// the user was in when typing it, used by commands acting on the current room.
+type Command struct {
+	Name string
+	Args []string
+	Room string
+}
+
+// CommandReply is sent by the server with the output of a command.
+// Longer output is sent as one reply per line.
+type CommandReply struct {
+	Command string
+	Msg     string
+}
+
+// PrivateMessage is a message sent with /msg to a single user
+type PrivateMessage struct {
+	From string
+	To   string
+	Msg  string
+}
+
+// ParseCommand parses a line typed by the user. It returns false if the line is
+// not a command. Lines starting with "//" are not commands, but messages
+// starting with a single "/".
+func ParseCommand(line string, room string) (Command, bool, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		return Command{}, false, nil
+	}
+
+	fields := strings.Fields(line[1:])
+	if len(fields) == 0 {
+		return Command{}, true, errors.Join(InvalidCommand, errors.New("Missing command name after '/'"))
+	}
+
+	return Command{
+		Name: strings.ToLower(fields[0]),
+		Args: fields[1:],
+		Room: room,
+	}, true, nil
+}
+
+// UnescapeLine removes the "/" escaping a message starting with "/"
+func UnescapeLine(line string) string {
+	if strings.HasPrefix(line, "//") {
+		return line[1:]
+	}
+
+	return line
+}
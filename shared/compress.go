@@ -0,0 +1,135 @@
+package shared
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	COMPRESSION_NONE    byte = 0
+	COMPRESSION_DEFLATE byte = 1
+)
+
+const (
+	// Frames with less data than this are never compressed
+	DEFAULT_COMPRESSION_THRESHOLD uint16 = 128
+	// Largest amount of data a compressed frame is allowed to inflate to
+	MAX_DECOMPRESSED_LEN int = MAX_DATA_LEN
+)
+
+var (
+	UnsupportedCompression = errors.New("Unsupported compression.")
+	DecompressionLimit     = errors.New("Decompressed data exceeds limit.")
+)
+
+// Hello is the first packet sent in both directions on a new connection,
+// and is used to agree on the compression used for the rest of the connection.
+type Hello struct {
+	Compression byte
+	Threshold   uint16
+}
+
+// Negotiate returns the settings both sides of a connection should use,
+// given the Hello sent by each of them.
+func Negotiate(local, remote Hello) Hello {
+	agreed := Hello{
+		Compression: COMPRESSION_NONE,
+		Threshold:   max(local.Threshold, remote.Threshold),
+	}
+
+	if local.Compression == COMPRESSION_DEFLATE && remote.Compression == COMPRESSION_DEFLATE {
+		agreed.Compression = COMPRESSION_DEFLATE
+	}
+
+	return agreed
+}
+
+func (p *Packet) IsCompressed() bool {
+	return p.Header.Flags&FLAG_COMPRESSED != 0
+}
+
+// Compress returns a compressed copy of the packet. If compression does not
+// make the data smaller the packet itself is returned.
+func (p *Packet) Compress() (*Packet, error) {
+	if p.IsCompressed() {
+		return p, nil
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(p.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= len(p.Data) {
+		return p, nil
+	}
+
+	return &Packet{
+		Header: PacketHeader{
+			Version:    p.Header.Version,
+			DataLength: uint16(buf.Len()),
+			Flags:      p.Header.Flags | FLAG_COMPRESSED,
+		},
+		Data: buf.Bytes(),
+	}, nil
+}
+
+// Decompress returns an uncompressed copy of the packet. Inflating more than
+// MAX_DECOMPRESSED_LEN bytes is treated as an error.
+func (p *Packet) Decompress() (*Packet, error) {
+	if !p.IsCompressed() {
+		return p, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(p.Data))
+	defer r.Close()
+
+	// Read one byte past the limit, to be able to tell if it was exceeded
+	data, err := io.ReadAll(io.LimitReader(r, int64(MAX_DECOMPRESSED_LEN)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > MAX_DECOMPRESSED_LEN {
+		return nil, errors.Join(DecompressionLimit, errors.New(fmt.Sprintf("Limit is %d bytes", MAX_DECOMPRESSED_LEN)))
+	}
+
+	return &Packet{
+		Header: PacketHeader{
+			Version:    p.Header.Version,
+			DataLength: uint16(len(data)),
+			Flags:      p.Header.Flags &^ FLAG_COMPRESSED,
+		},
+		Data: data,
+	}, nil
+}
+
+// CompressFor compresses the packet if the negotiated settings allow it,
+// and the packet holds at least Threshold bytes of data.
+func (h Hello) CompressFor(p *Packet) (*Packet, error) {
+	switch h.Compression {
+	case COMPRESSION_NONE:
+		return p, nil
+	case COMPRESSION_DEFLATE:
+		if p.Header.DataLength < h.Threshold {
+			return p, nil
+		}
+		return p.Compress()
+	default:
+		return nil, errors.Join(UnsupportedCompression, errors.New(fmt.Sprintf("Compression '%d' is not supported", h.Compression)))
+	}
+}
@@ -0,0 +1,38 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+)
+
+const (
+	// UDP port servers answer discovery probes on
+	DISCOVERY_PORT = 42068
+	// Multicast group probes are sent to as well as broadcast, for networks dropping broadcasts
+	DISCOVERY_GROUP = "239.255.42.68"
+)
+
+// DiscoveryProbe is sent by clients over UDP, to find the servers on the local network.
+// Servers answer it with a DiscoveryReply holding the same Nonce.
+type DiscoveryProbe struct {
+	Nonce uint64
+}
+
+// ParseDatagram parses a packet sent over UDP, where every datagram holds a single packet
+func ParseDatagram(data []byte) (*Packet, error) {
+	return ParsePacket(bufio.NewReader(bytes.NewReader(data)))
+}
+
+// DiscoveryReply describes a server answering a DiscoveryProbe. Host is the address
+// the server advertises, or empty to connect to the address the reply came from.
+type DiscoveryReply struct {
+	Nonce uint64
+	Name  string
+	Host  string
+	Port  uint16
+	// Protocol version of the server, as "major.minor"
+	Version string
+	Rooms   uint16
+	Users   uint16
+	TLS     bool
+}
@@ -0,0 +1,21 @@
+package shared
+
+// Edit replaces the text of a stored message. Clients send ID, Room and Msg, and
+// the server passes it on to the room with Username set to who edited it and
+// Time to when. Only the author of the message or a moderator may edit it.
+type Edit struct {
+	ID       uint64
+	Room     string
+	Msg      string
+	Username string
+	Time     int64
+}
+
+// Delete removes the text of a stored message, leaving it in the history as deleted.
+// Clients send ID and Room, and the server fills in Username and Time like for Edit.
+type Delete struct {
+	ID       uint64
+	Room     string
+	Username string
+	Time     int64
+}
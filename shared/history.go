@@ -0,0 +1,23 @@
+package shared
+
+// Most messages sent for a single HistoryRequest
+const MAX_HISTORY_PAGE = 100
+
+// HistoryRequest asks the server for stored messages of a room. Before and After
+// are message IDs, 0 means no limit. Without After the newest messages are sent,
+// with After the oldest messages following it.
+type HistoryRequest struct {
+	Room   string
+	Before uint64
+	After  uint64
+	Limit  uint8
+}
+
+// HistoryEnd follows the messages sent for a HistoryRequest, or when joining a room.
+// The messages are sent as KIND_HISTORY, oldest first. More tells if the store
+// holds more messages in the direction of the request.
+type HistoryEnd struct {
+	Room  string
+	Count uint16
+	More  bool
+}
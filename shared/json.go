@@ -0,0 +1,64 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// JSONMessage is the JSON representation of a packet holding a registered message.
+// Type is the name the message was registered under, and Data is the message itself,
+// using the field names of the registered type, e.g.
+//
+//	{"type":"message","data":{"Username":"","Msg":"Hello"}}
+type JSONMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func PacketToJSON(p *Packet) ([]byte, error) {
+	kind, msg, err := p.DecodeMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(JSONMessage{
+		Type: kind.String(),
+		Data: data,
+	})
+}
+
+func PacketFromJSON(data []byte) (*Packet, error) {
+	var jsonMsg JSONMessage
+	err := json.Unmarshal(data, &jsonMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, ok := KindByName(jsonMsg.Type)
+	if !ok {
+		return nil, errors.Join(UnknownKind, errors.New(fmt.Sprintf("No message registered as '%s'", jsonMsg.Type)))
+	}
+
+	msg, err := NewMessage(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jsonMsg.Data) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(jsonMsg.Data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(msg)
+		if err != nil {
+			return nil, errors.Join(InvalidType, err)
+		}
+	}
+
+	return PacketFromMessage(kind, msg)
+}
@@ -0,0 +1,132 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_PING_INTERVAL    = 15 * time.Second
+	DEFAULT_MAX_MISSED_PONGS = 3
+)
+
+var MissedPongs = errors.New("Too many missed pongs.")
+
+// Ping asks the other side of the connection to reply with a Pong
+// holding the same Nonce and Time.
+type Ping struct {
+	Nonce uint32
+	// Unix time in nanoseconds of when the ping was sent
+	Time int64
+}
+
+type Pong struct {
+	Nonce uint32
+	Time  int64
+}
+
+func init() {
+	RegisterMessage(KIND_PING, "ping", Ping{})
+	RegisterMessage(KIND_PONG, "pong", Pong{})
+}
+
+// Heartbeat keeps track of the pings sent on a connection, and the round trip
+// time measured from the pongs received. It is safe for concurrent use.
+type Heartbeat struct {
+	Interval  time.Duration
+	MaxMissed int
+
+	mu          sync.Mutex
+	nonce       uint32
+	outstanding int
+	rtt         time.Duration
+}
+
+func NewHeartbeat(interval time.Duration, maxMissed int) *Heartbeat {
+	return &Heartbeat{
+		Interval:  interval,
+		MaxMissed: maxMissed,
+	}
+}
+
+func (h *Heartbeat) Enabled() bool {
+	return h != nil && h.Interval > 0
+}
+
+// NextPing returns the next ping to send. It returns MissedPongs instead,
+// if MaxMissed pings in a row have been sent without receiving a pong.
+func (h *Heartbeat) NextPing() (*Packet, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.MaxMissed > 0 && h.outstanding >= h.MaxMissed {
+		return nil, errors.Join(MissedPongs, errors.New(fmt.Sprintf("No pong received for the last %d pings", h.outstanding)))
+	}
+
+	h.nonce += 1
+	h.outstanding += 1
+
+	return PacketFromMessage(KIND_PING, Ping{
+		Nonce: h.nonce,
+		Time:  time.Now().UnixNano(),
+	})
+}
+
+func (h *Heartbeat) HandlePong(pong Pong) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.outstanding = 0
+	h.rtt = time.Since(time.Unix(0, pong.Time))
+}
+
+// RTT returns the round trip time measured by the latest pong,
+// or 0 if no pong has been received yet.
+func (h *Heartbeat) RTT() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.rtt
+}
+
+// ReadTimeout is how long a connection may go without receiving anything,
+// before the other side is considered gone.
+func (h *Heartbeat) ReadTimeout() time.Duration {
+	return h.Interval * time.Duration(max(h.MaxMissed, 1)+1)
+}
+
+// HandleKeepalive answers pings and records pongs. It returns true if the
+// packet was a ping or a pong, and should not be passed on to the application.
+// The reply to a ping is passed to send.
+func (h *Heartbeat) HandleKeepalive(p *Packet, send func(*Packet) error) (bool, error) {
+	switch p.Kind() {
+	case KIND_PING:
+		var ping Ping
+		err := p.IntoMessage(&ping)
+		if err != nil {
+			return true, err
+		}
+
+		pong, err := PacketFromMessage(KIND_PONG, Pong(ping))
+		if err != nil {
+			return true, err
+		}
+
+		return true, send(pong)
+	case KIND_PONG:
+		var pong Pong
+		err := p.IntoMessage(&pong)
+		if err != nil {
+			return true, err
+		}
+
+		if h != nil {
+			h.HandlePong(pong)
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+}
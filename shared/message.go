@@ -0,0 +1,297 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// MessageKind is stored in the first byte of the data of a packet,
+// and tells which registered type the rest of the data decodes into.
+type MessageKind byte
+
+const (
+	KIND_HELLO MessageKind = iota + 1
+	KIND_MESSAGE
+	KIND_PING
+	KIND_PONG
+	KIND_LOGIN
+	KIND_WELCOME
+	KIND_JOIN
+	KIND_LEAVE
+	KIND_ERROR
+	KIND_COMMAND
+	KIND_COMMAND_REPLY
+	KIND_PRIVATE_MESSAGE
+	KIND_HISTORY_REQUEST
+	KIND_HISTORY
+	KIND_HISTORY_END
+	KIND_ACK
+	KIND_PRESENCE
+	KIND_TYPING
+	KIND_EDIT
+	KIND_DELETE
+	KIND_REACTION
+	KIND_THREAD_REQUEST
+	KIND_THREAD
+	KIND_THREAD_INFO
+	KIND_FILE_OFFER
+	KIND_FILE_ANSWER
+	KIND_FILE_CHUNK
+	KIND_FILE_PROGRESS
+	KIND_FILE_DONE
+	KIND_DISCOVERY_PROBE
+	KIND_DISCOVERY_REPLY
+)
+
+// Room every user joins when logging in
+const DEFAULT_ROOM = "general"
+
+var (
+	UnknownKind    = errors.New("Unknown message kind.")
+	MismatchedKind = errors.New("Mismatched message kind.")
+)
+
+// Message is a chat line sent to a room. Clients only fill in Msg, Room, Action,
+// Nonce and Parent, the server fills in the rest before passing the message on
+// to other clients.
+type Message struct {
+	Username string
+	Msg      string
+	Room     string
+	// Action messages are written with /me, and shown as "* username msg"
+	Action bool
+	// Assigned by the message store of the server, increasing with every message
+	ID uint64
+	// When the server received the message, in unix milliseconds
+	Time int64
+	// Chosen by the sending client, and returned in the Ack. A message sent again
+	// with the same nonce is acknowledged again, but not passed on twice.
+	Nonce uint64
+	// When the message was last edited, in unix milliseconds, 0 if it never was
+	Edited int64
+	// Deleted messages are kept in the history without their text
+	Deleted bool
+	// Kept up to date by the server as Reactions arrive
+	Reactions Reactions
+	// ID of the message this is a reply to, 0 for messages not in a thread.
+	// Replies to a reply are moved to the message that started the thread.
+	Parent uint64
+	// How many replies the message has, kept up to date by the server
+	Replies uint16
+}
+
+// Login is the first message sent by a client after the Hello. ResumeToken is
+// empty for a new session, or the token from the Welcome of a previous session.
+// Secret proves the identity of the user, it is kept by the server the first time
+// it is given for a username, and needed for every login to it after that.
+type Login struct {
+	Username    string
+	ResumeToken string
+	Secret      string
+}
+
+// Welcome is the reply to a successful Login. If the previous session was
+// resumed, the Missed messages sent to its rooms follow the Welcome.
+type Welcome struct {
+	Username    string
+	ResumeToken string
+	Resumed     bool
+	Missed      uint16
+}
+
+// Join is sent by a client to join a room, and by the server to confirm it
+type Join struct {
+	Room string
+}
+
+// Leave is sent by a client to leave a room, and by the server to confirm it
+type Leave struct {
+	Room string
+}
+
+// ErrorMessage is sent by the server when a request from the client fails.
+// Command is the name of the command that failed, if the request was a command.
+// Nonce is the nonce of the message that failed, if the request was a message.
+type ErrorMessage struct {
+	Msg     string
+	Command string
+	Nonce   uint64
+}
+
+// Ack confirms that the message with the nonce was stored and passed on to the room
+type Ack struct {
+	Nonce uint64
+	ID    uint64
+	Time  int64
+	Room  string
+}
+
+type messageType struct {
+	name string
+	typ  reflect.Type
+}
+
+var messageTypes = make(map[MessageKind]messageType)
+
+func init() {
+	RegisterMessage(KIND_HELLO, "hello", Hello{})
+	RegisterMessage(KIND_MESSAGE, "message", Message{})
+	RegisterMessage(KIND_LOGIN, "login", Login{})
+	RegisterMessage(KIND_WELCOME, "welcome", Welcome{})
+	RegisterMessage(KIND_JOIN, "join", Join{})
+	RegisterMessage(KIND_LEAVE, "leave", Leave{})
+	RegisterMessage(KIND_ERROR, "error", ErrorMessage{})
+	RegisterMessage(KIND_COMMAND, "command", Command{})
+	RegisterMessage(KIND_COMMAND_REPLY, "command_reply", CommandReply{})
+	RegisterMessage(KIND_PRIVATE_MESSAGE, "private_message", PrivateMessage{})
+	RegisterMessage(KIND_HISTORY_REQUEST, "history_request", HistoryRequest{})
+	RegisterMessage(KIND_HISTORY, "history", Message{})
+	RegisterMessage(KIND_HISTORY_END, "history_end", HistoryEnd{})
+	RegisterMessage(KIND_ACK, "ack", Ack{})
+	RegisterMessage(KIND_PRESENCE, "presence", Presence{})
+	RegisterMessage(KIND_TYPING, "typing", Typing{})
+	RegisterMessage(KIND_EDIT, "edit", Edit{})
+	RegisterMessage(KIND_DELETE, "delete", Delete{})
+	RegisterMessage(KIND_REACTION, "reaction", Reaction{})
+	RegisterMessage(KIND_THREAD_REQUEST, "thread_request", ThreadRequest{})
+	RegisterMessage(KIND_THREAD, "thread", Message{})
+	RegisterMessage(KIND_THREAD_INFO, "thread_info", ThreadInfo{})
+	RegisterMessage(KIND_FILE_OFFER, "file_offer", FileOffer{})
+	RegisterMessage(KIND_FILE_ANSWER, "file_answer", FileAnswer{})
+	RegisterMessage(KIND_FILE_CHUNK, "file_chunk", FileChunk{})
+	RegisterMessage(KIND_FILE_PROGRESS, "file_progress", FileProgress{})
+	RegisterMessage(KIND_FILE_DONE, "file_done", FileDone{})
+	RegisterMessage(KIND_DISCOVERY_PROBE, "discovery_probe", DiscoveryProbe{})
+	RegisterMessage(KIND_DISCOVERY_REPLY, "discovery_reply", DiscoveryReply{})
+}
+
+// RegisterMessage makes the type of prototype known under the given kind and name.
+// Registering the same kind twice panics.
+func RegisterMessage(kind MessageKind, name string, prototype interface{}) {
+	if kind == 0 {
+		panic("Message kind 0 is reserved")
+	}
+
+	if existing, ok := messageTypes[kind]; ok {
+		panic(fmt.Sprintf("Message kind %d already registered as '%s'", kind, existing.name))
+	}
+
+	messageTypes[kind] = messageType{
+		name: name,
+		typ:  reflect.TypeOf(prototype),
+	}
+}
+
+// RegisteredKinds returns every registered kind in ascending order
+func RegisteredKinds() []MessageKind {
+	kinds := make([]MessageKind, 0, len(messageTypes))
+	for kind := range messageTypes {
+		kinds = append(kinds, kind)
+	}
+
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+	return kinds
+}
+
+// KindByName looks up the kind registered under name
+func KindByName(name string) (MessageKind, bool) {
+	for kind, mt := range messageTypes {
+		if mt.name == name {
+			return kind, true
+		}
+	}
+
+	return 0, false
+}
+
+func (k MessageKind) String() string {
+	mt, ok := messageTypes[k]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", byte(k))
+	}
+
+	return mt.name
+}
+
+// NewMessage returns a pointer to a new zero value of the type registered for kind
+func NewMessage(kind MessageKind) (interface{}, error) {
+	mt, ok := messageTypes[kind]
+	if !ok {
+		return nil, errors.Join(UnknownKind, errors.New(fmt.Sprintf("Kind %d is not registered", kind)))
+	}
+
+	return reflect.New(mt.typ).Interface(), nil
+}
+
+func PacketFromMessage(kind MessageKind, msg interface{}) (*Packet, error) {
+	mt, ok := messageTypes[kind]
+	if !ok {
+		return nil, errors.Join(UnknownKind, errors.New(fmt.Sprintf("Kind %d is not registered", kind)))
+	}
+
+	rv := reflect.Indirect(reflect.ValueOf(msg))
+	if rv.Type() != mt.typ {
+		return nil, errors.Join(MismatchedKind, errors.New(fmt.Sprintf("Kind '%s' expects type %s, got %s", mt.name, mt.typ, rv.Type())))
+	}
+
+	data, err := getBytesFromValue(rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return PacketFromData(append([]byte{byte(kind)}, data...))
+}
+
+// Kind returns the kind of message held by the packet, or 0 if the packet has no data
+func (p *Packet) Kind() MessageKind {
+	if len(p.Data) == 0 {
+		return 0
+	}
+
+	return MessageKind(p.Data[0])
+}
+
+// IntoMessage decodes the message held by the packet into t,
+// which must be a pointer to the type registered for the kind of the packet.
+func (p *Packet) IntoMessage(t interface{}) error {
+	kind := p.Kind()
+	mt, ok := messageTypes[kind]
+	if !ok {
+		return errors.Join(UnknownKind, errors.New(fmt.Sprintf("Kind %d is not registered", kind)))
+	}
+
+	rv := reflect.ValueOf(t)
+	if rv.Kind() != reflect.Pointer || rv.Type().Elem() != mt.typ {
+		return errors.Join(MismatchedKind, errors.New(fmt.Sprintf("Packet holds '%s', which cannot be decoded into %T", mt.name, t)))
+	}
+
+	end, err := p.intoType(t, 1)
+	if err != nil {
+		return err
+	}
+
+	if end != uint64(len(p.Data)) {
+		return errors.Join(MalformedData, errors.New(fmt.Sprintf("%d trailing bytes after '%s'", uint64(len(p.Data))-end, mt.name)))
+	}
+
+	return nil
+}
+
+// DecodeMessage decodes the message held by the packet into a new value of
+// the registered type, and returns a pointer to it.
+func (p *Packet) DecodeMessage() (MessageKind, interface{}, error) {
+	kind := p.Kind()
+	msg, err := NewMessage(kind)
+	if err != nil {
+		return kind, nil, err
+	}
+
+	err = p.IntoMessage(msg)
+	if err != nil {
+		return kind, nil, err
+	}
+
+	return kind, msg, nil
+}
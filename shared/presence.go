@@ -0,0 +1,33 @@
+package shared
+
+type PresenceStatus byte
+
+const (
+	PRESENCE_ONLINE PresenceStatus = iota + 1
+	PRESENCE_AWAY
+	PRESENCE_OFFLINE
+)
+
+func (s PresenceStatus) String() string {
+	switch s {
+	case PRESENCE_ONLINE:
+		return "online"
+	case PRESENCE_AWAY:
+		return "away"
+	case PRESENCE_OFFLINE:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+// Presence tells the status of a user. It is sent to everyone sharing a room with
+// the user when the status changes, with Room empty. A user joining a room gets
+// the presence of every member, with Room set to the room joined.
+type Presence struct {
+	Username string
+	Status   PresenceStatus
+	// When the user was last active, in unix milliseconds
+	LastSeen int64
+	Room     string
+}
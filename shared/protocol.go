@@ -11,18 +11,26 @@ import (
 const (
 	MAJOR_VERSION byte = 1
 	MINOR_VERSION byte = 0
-	MAX_DATA_LEN  int  = 65535
+	// The data length is stored in 12 bits on the wire, the remaining
+	// 4 bits of the header are used for flags
+	MAX_DATA_LEN int = 4095
+)
+
+const (
+	FLAG_COMPRESSED byte = 1 << iota
 )
 
 var (
 	InvalidVersion  = errors.New("Invalid version.")
 	InvalidType     = errors.New("Invalid type.")
 	UnsupportedType = errors.New("Unsupported type.")
+	MalformedData   = errors.New("Malformed data.")
 )
 
 type PacketHeader struct {
 	Version    byte
 	DataLength uint16
+	Flags      byte
 }
 
 type Packet struct {
@@ -35,7 +43,7 @@ func (p *Packet) Encode() []byte {
 
 	bytes[0] = p.Header.Version
 	bytes[1] = byte(p.Header.DataLength >> 4)
-	bytes[2] = byte(p.Header.DataLength & 0x0f)
+	bytes[2] = (p.Header.Flags << 4) | byte(p.Header.DataLength&0x0f)
 
 	for i := range p.Header.DataLength {
 		bytes[i+3] = p.Data[i]
@@ -51,21 +59,36 @@ func (p *Packet) VersionString() string {
 }
 
 func (p *Packet) IntoType(t interface{}) error {
+	_, err := p.intoType(t, 0)
+	return err
+}
+
+// intoType decodes the data starting at byte start into t,
+// and returns the index of the first byte that was not read.
+func (p *Packet) intoType(t interface{}, start uint64) (uint64, error) {
 	if t == nil {
-		return errors.New("Cannot write packet into nil pointer")
+		return 0, errors.New("Cannot write packet into nil pointer")
 	}
 	rv := reflect.ValueOf(t)
 
 	if rv.Kind() != reflect.Pointer {
-		return errors.New("Cannot write packet into variable that is not a pointer")
+		return 0, errors.New("Cannot write packet into variable that is not a pointer")
 	}
 
 	elem := rv.Elem()
-	var byteIndex uint64
-	byteIndex = 0
+	byteIndex := start
 	err := p.setValue(&elem, &byteIndex)
 
-	return err
+	return byteIndex, err
+}
+
+// ensureBytes checks that n bytes can be read from the data, starting at byteIndex
+func (p *Packet) ensureBytes(byteIndex uint64, n uint64) error {
+	if byteIndex+n > uint64(len(p.Data)) {
+		return errors.Join(MalformedData, errors.New(fmt.Sprintf("Trying to read %d bytes at index %d, but data is only %d bytes long", n, byteIndex, len(p.Data))))
+	}
+
+	return nil
 }
 
 func (p *Packet) setValue(v *reflect.Value, byteIndex *uint64) error {
@@ -118,6 +141,9 @@ func (p *Packet) setStruct(v *reflect.Value, byteIndex *uint64) error {
 }
 
 func (p *Packet) setSliceOrArray(v *reflect.Value, byteIndex *uint64) error {
+	if err := p.ensureBytes(*byteIndex, 1); err != nil {
+		return err
+	}
 	numElem := p.Data[*byteIndex]
 	*byteIndex += 1
 	if !v.CanSet() {
@@ -151,8 +177,14 @@ func (p *Packet) setSliceOrArray(v *reflect.Value, byteIndex *uint64) error {
 
 func (p *Packet) setString(v *reflect.Value, byteIndex *uint64) error {
 	bIndex := *byteIndex
+	if err := p.ensureBytes(bIndex, 1); err != nil {
+		return err
+	}
 	bytesToRead := p.Data[bIndex]
 	bIndex += 1
+	if err := p.ensureBytes(bIndex, uint64(bytesToRead)); err != nil {
+		return err
+	}
 	data := p.Data[bIndex : bIndex+uint64(bytesToRead)]
 
 	v.SetString(string(data))
@@ -165,8 +197,8 @@ func (p *Packet) setUint(v *reflect.Value, byteIndex *uint64) error {
 	size := uint64(v.Type().Bits())
 	bytesToRead := size / 8
 
-	if bytesToRead+bIndex > uint64(p.Header.DataLength) {
-		return errors.New("Data incompatible with mapping type. Trying to read to many bytes")
+	if err := p.ensureBytes(bIndex, bytesToRead); err != nil {
+		return errors.Join(errors.New("Data incompatible with mapping type. Trying to read to many bytes"), err)
 	}
 
 	var newVal uint64
@@ -186,6 +218,10 @@ func (p *Packet) setInt(v *reflect.Value, byteIndex *uint64) error {
 	size := uint64(v.Type().Bits())
 	bytesToRead := size / 8
 
+	if err := p.ensureBytes(bIndex, bytesToRead); err != nil {
+		return err
+	}
+
 	var newVal int64
 	for i := range bytesToRead {
 		shiftVal := (8 * ((bytesToRead - 1) - i))
@@ -203,6 +239,10 @@ func (p *Packet) setFloat(v *reflect.Value, byteIndex *uint64) error {
 	size := uint64(v.Type().Bits())
 	bytesToRead := size / 8
 
+	if err := p.ensureBytes(bIndex, bytesToRead); err != nil {
+		return err
+	}
+
 	bits := uint64(0)
 	for i := range bytesToRead {
 		shiftVal := (8 * ((bytesToRead - 1) - i))
@@ -226,6 +266,9 @@ func (p *Packet) setFloat(v *reflect.Value, byteIndex *uint64) error {
 }
 
 func (p *Packet) setBool(v *reflect.Value, byteIndex *uint64) error {
+	if err := p.ensureBytes(*byteIndex, 1); err != nil {
+		return err
+	}
 	val := p.Data[*byteIndex]
 	b := false
 	if val == 1 {
@@ -263,6 +306,9 @@ func getBytesFromValue(v reflect.Value) ([]byte, error) {
 	case reflect.Struct:
 		data, err = getBytesFromStruct(v)
 	case reflect.String:
+		if v.Len() > math.MaxUint8 {
+			return nil, errors.New(fmt.Sprintf("String of length %d is too long, max length is %d", v.Len(), math.MaxUint8))
+		}
 		strLen := byte(v.Len())
 		strBytes := []byte(v.String())
 		data = []byte{strLen}
@@ -287,6 +333,10 @@ func getBytesFromValue(v reflect.Value) ([]byte, error) {
 }
 
 func getBytesFromSliceOrArray(v reflect.Value) ([]byte, error) {
+	if v.Len() > math.MaxUint8 {
+		return nil, errors.New(fmt.Sprintf("%s of length %d is too long, max length is %d", v.Kind().String(), v.Len(), math.MaxUint8))
+	}
+
 	data := make([]byte, 0)
 	data = append(data, byte(v.Len()))
 
@@ -416,6 +466,11 @@ func PacketFromData(data []byte) (*Packet, error) {
 	}, nil
 }
 
+// DataLength returns the length of the data after an encoded header, from its first 3 bytes
+func DataLength(header []byte) int {
+	return int(header[1])<<4 | int(header[2]&0x0f)
+}
+
 func ParsePacket(reader *bufio.Reader) (*Packet, error) {
 	headerBytes, err := readBytes(3, reader)
 	if err != nil {
@@ -430,7 +485,8 @@ func ParsePacket(reader *bufio.Reader) (*Packet, error) {
 
 	header := PacketHeader{
 		Version:    version,
-		DataLength: uint16((headerBytes[1] << 4) | headerBytes[2]),
+		DataLength: uint16(DataLength(headerBytes)),
+		Flags:      headerBytes[2] >> 4,
 	}
 
 	data, err := readBytes(int(header.DataLength), reader)
@@ -438,10 +494,16 @@ func ParsePacket(reader *bufio.Reader) (*Packet, error) {
 		return nil, err
 	}
 
-	return &Packet{
+	packet := &Packet{
 		Header: header,
 		Data:   data,
-	}, nil
+	}
+
+	if packet.IsCompressed() {
+		return packet.Decompress()
+	}
+
+	return packet, nil
 }
 
 func readBytes(n int, reader *bufio.Reader) ([]byte, error) {
@@ -0,0 +1,101 @@
+package shared
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Longest emoji or short code of a Reaction
+const MAX_EMOJI_LEN = 32
+
+// Reaction toggles a reaction of the user on a stored message. Clients send ID,
+// Room and Emoji, which is an emoji or a short code like ":tada:". The server
+// passes it on to the room with Username set, and Added telling whether the
+// reaction was added or removed.
+type Reaction struct {
+	ID       uint64
+	Room     string
+	Emoji    string
+	Username string
+	Added    bool
+}
+
+// ReactionGroup is everyone who reacted to a message with the same emoji,
+// in the order they reacted
+type ReactionGroup struct {
+	Emoji string
+	Users []string
+}
+
+// Reactions are the reactions to a message, in the order the emojis were first used
+type Reactions []ReactionGroup
+
+// Has reports whether the user reacted with the emoji
+func (r Reactions) Has(emoji string, username string) bool {
+	for _, group := range r {
+		if group.Emoji == emoji {
+			return slices.Contains(group.Users, username)
+		}
+	}
+
+	return false
+}
+
+// Set adds or removes the reaction of the user with the emoji, and returns the
+// changed reactions. Emojis nobody reacted with any longer are removed.
+func (r Reactions) Set(emoji string, username string, added bool) Reactions {
+	r = slices.Clone(r)
+
+	i := slices.IndexFunc(r, func(group ReactionGroup) bool { return group.Emoji == emoji })
+	if i == -1 {
+		if !added {
+			return r
+		}
+		return append(r, ReactionGroup{Emoji: emoji, Users: []string{username}})
+	}
+
+	users := slices.DeleteFunc(slices.Clone(r[i].Users), func(user string) bool { return user == username })
+	if added {
+		users = append(users, username)
+	}
+
+	if len(users) == 0 {
+		return slices.Delete(r, i, i+1)
+	}
+
+	r[i] = ReactionGroup{Emoji: emoji, Users: users}
+	return r
+}
+
+var shortCodes = map[string]string{
+	":+1:":         "👍",
+	":thumbsup:":   "👍",
+	":-1:":         "👎",
+	":thumbsdown:": "👎",
+	":heart:":      "❤️",
+	":smile:":      "😄",
+	":joy:":        "😂",
+	":tada:":       "🎉",
+	":eyes:":       "👀",
+	":fire:":       "🔥",
+	":rocket:":     "🚀",
+	":check:":      "✅",
+	":x:":          "❌",
+	":pray:":       "🙏",
+}
+
+// NormalizeEmoji turns the short codes of common emojis into the emoji, so
+// ":tada:" and "🎉" count as the same reaction. It reports false for an empty
+// emoji, one that is too long or one containing whitespace.
+func NormalizeEmoji(emoji string) (string, bool) {
+	if emoji == "" || len(emoji) > MAX_EMOJI_LEN || strings.IndexFunc(emoji, unicode.IsSpace) != -1 {
+		return emoji, false
+	}
+
+	if e, ok := shortCodes[strings.ToLower(emoji)]; ok {
+		return e, true
+	}
+
+	return emoji, true
+}
@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Packet was read from the connection by whoever recorded it
+	DIRECTION_IN byte = 0
+	// Packet was written to the connection by whoever recorded it
+	DIRECTION_OUT byte = 1
+)
+
+const RECORD_HEADER_LEN = 13
+
+// Record is a single packet sent or received on a recorded connection.
+//
+// On disk a record is the session id (4 bytes), the direction (1 byte), and
+// the time in unix nanoseconds (8 bytes), followed by the encoded packet.
+// Packets are always stored uncompressed.
+type Record struct {
+	Session   uint32
+	Direction byte
+	Time      time.Time
+	Packet    *Packet
+}
+
+// Recorder writes records to a session file. It is safe for concurrent use.
+type Recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+func (r *Recorder) Record(session uint32, direction byte, p *Packet) error {
+	p, err := p.Decompress()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, RECORD_HEADER_LEN)
+	binary.BigEndian.PutUint32(header[0:4], session)
+	header[4] = direction
+	binary.BigEndian.PutUint64(header[5:13], uint64(time.Now().UnixNano()))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err = r.w.Write(append(header, p.Encode()...))
+	return err
+}
+
+type RecordReader struct {
+	reader *bufio.Reader
+}
+
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF when there are no more records
+func (r *RecordReader) Next() (*Record, error) {
+	header, err := readBytes(RECORD_HEADER_LEN, r.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ParsePacket(r.reader)
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.Join(MalformedData, errors.New("Session file ends in the middle of a record"))
+		}
+		return nil, err
+	}
+
+	return &Record{
+		Session:   binary.BigEndian.Uint32(header[0:4]),
+		Direction: header[4],
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[5:13]))),
+		Packet:    p,
+	}, nil
+}
+
+// ReadRecords reads every record until the end of r
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	reader := NewRecordReader(r)
+	records := make([]*Record, 0)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+
+		records = append(records, record)
+	}
+}
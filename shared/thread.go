@@ -0,0 +1,21 @@
+package shared
+
+// ThreadRequest asks the server for a whole thread. ID is the message that
+// started the thread, or any reply in it. The server sends the message that
+// started the thread followed by every reply as KIND_THREAD, oldest first, and
+// ends with a ThreadInfo.
+type ThreadRequest struct {
+	Room string
+	ID   uint64
+}
+
+// ThreadInfo ends the messages sent for a ThreadRequest, and is sent to the room
+// whenever a reply is added, so clients can keep the reply count of the message
+// that started the thread up to date.
+type ThreadInfo struct {
+	Room    string
+	ID      uint64
+	Replies uint16
+	// When the latest reply was sent, in unix milliseconds
+	LastReply int64
+}
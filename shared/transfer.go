@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	// Most bytes of a file sent in a single FileChunk, the longest slice a packet can hold
+	FILE_CHUNK_SIZE = math.MaxUint8
+	// Senders keep at most this many chunks in flight before waiting for a FileProgress,
+	// so chat messages are not stuck behind a whole file
+	FILE_WINDOW = 16
+	// Largest file relayed by default
+	DEFAULT_MAX_FILE_SIZE = 1 << 20
+)
+
+// FileOffer is sent by a client to offer a file to another user, and passed on to
+// that user with From set. Transfer is chosen at random by the sender, and used by
+// every message of the transfer. Sum is the hex encoded SHA-256 of the file.
+type FileOffer struct {
+	Transfer uint64
+	From     string
+	To       string
+	Name     string
+	Size     uint64
+	Sum      string
+}
+
+// FileAnswer is sent by the user offered a file to accept or reject it, and passed on
+// to the sender. The sender starts sending FileChunks once the offer is accepted.
+type FileAnswer struct {
+	Transfer uint64
+	Accept   bool
+	Reason   string
+}
+
+// FileChunk is the part of the file starting at Offset, sent in order
+type FileChunk struct {
+	Transfer uint64
+	Offset   uint64
+	Data     []byte
+}
+
+// FileProgress is sent by the receiver as chunks arrive, and passed on to the sender
+type FileProgress struct {
+	Transfer uint64
+	Received uint64
+}
+
+// FileDone ends a transfer. The server sends it to both users once every chunk is
+// passed on and the SHA-256 matches, or when the transfer fails. Either user can
+// send it to cancel the transfer.
+type FileDone struct {
+	Transfer uint64
+	OK       bool
+	Reason   string
+}
+
+// NewTransferId returns a random ID for a new transfer
+func NewTransferId() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
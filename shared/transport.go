@@ -0,0 +1,229 @@
+package shared
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	TransportClosed = errors.New("Transport closed.")
+	NoListener      = errors.New("Nothing listening on the address.")
+)
+
+// Transport carries the streams between clients and servers. The chat protocol works
+// the same over every transport, since it only needs a reliable, ordered stream.
+type Transport interface {
+	// Listen accepts connections on addr
+	Listen(addr string) (net.Listener, error)
+	// Dial connects to a listener on addr
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCPTransport listens and dials over TCP, the network of an address is chosen by SplitAddress
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	network, addr := SplitAddress(addr)
+	return net.Listen(network, addr)
+}
+
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	network, addr := SplitAddress(addr)
+	return net.Dial(network, addr)
+}
+
+// UnixTransport listens and dials on unix domain sockets, addresses are the path of the
+// socket with or without UNIX_PREFIX
+type UnixTransport struct{}
+
+func (UnixTransport) Listen(addr string) (net.Listener, error) {
+	path := unixPath(addr)
+	removeStaleSocket(path)
+	return net.Listen("unix", path)
+}
+
+func (UnixTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", unixPath(addr))
+}
+
+func unixPath(addr string) string {
+	if network, path := SplitAddress(addr); network == "unix" {
+		return path
+	}
+
+	return addr
+}
+
+// removeStaleSocket removes the unix socket at path, left behind by a server that
+// was not stopped cleanly. Sockets a server is still listening on are kept.
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+
+	os.Remove(path)
+}
+
+// NetTransport uses UnixTransport for addresses starting with UNIX_PREFIX, and TCPTransport
+// for every other address. It is the transport of servers and clients unless they are given one.
+type NetTransport struct{}
+
+func (NetTransport) pick(addr string) Transport {
+	if network, _ := SplitAddress(addr); network == "unix" {
+		return UnixTransport{}
+	}
+
+	return TCPTransport{}
+}
+
+func (t NetTransport) Listen(addr string) (net.Listener, error) {
+	return t.pick(addr).Listen(addr)
+}
+
+func (t NetTransport) Dial(addr string) (net.Conn, error) {
+	return t.pick(addr).Dial(addr)
+}
+
+// TLSTransport runs TLS over another transport. Dial verifies the server name of
+// Config, or the host of the address without one.
+type TLSTransport struct {
+	Transport Transport
+	Config    *tls.Config
+}
+
+func (t TLSTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(listener, t.Config), nil
+}
+
+// Dial connects and completes the handshake, closing the connection if it fails
+func (t TLSTransport) Dial(addr string) (net.Conn, error) {
+	rawConn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := t.Config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			config.ServerName = host
+		}
+	}
+
+	conn := tls.Client(rawConn, config)
+	err = conn.Handshake()
+	if err != nil {
+		rawConn.Close()
+		return nil, errors.Join(errors.New("TLS handshake failed"), err)
+	}
+
+	return conn, nil
+}
+
+// PipeTransport connects clients and servers in the same process with net.Pipe, without
+// any sockets. Addresses are only names, and a name can be listened on once at a time.
+type PipeTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{listeners: make(map[string]*pipeListener)}
+}
+
+func (t *PipeTransport) Listen(addr string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.listeners[addr]; ok {
+		return nil, errors.New(fmt.Sprintf("Already listening on %s", addr))
+	}
+
+	listener := &pipeListener{
+		transport: t,
+		addr:      pipeAddr(addr),
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	t.listeners[addr] = listener
+	return listener, nil
+}
+
+// Dial returns one end of a new pipe, once the listener on addr has accepted the other
+func (t *PipeTransport) Dial(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	listener, ok := t.listeners[addr]
+	t.mu.Unlock()
+	if !ok {
+		return nil, errors.Join(NoListener, errors.New(fmt.Sprintf("Dialing %s", addr)))
+	}
+
+	client, server := net.Pipe()
+	select {
+	case listener.conns <- server:
+		return client, nil
+	case <-listener.done:
+		client.Close()
+		server.Close()
+		return nil, errors.Join(NoListener, errors.New(fmt.Sprintf("Dialing %s", addr)))
+	}
+}
+
+type pipeListener struct {
+	transport *PipeTransport
+	addr      pipeAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, TransportClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipeAddr is the name a PipeTransport listener was given
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
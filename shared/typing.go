@@ -0,0 +1,18 @@
+package shared
+
+import "time"
+
+const (
+	// Clients send Typing again this often while the user keeps typing
+	TYPING_RESEND_INTERVAL = 3 * time.Second
+	// Receivers stop showing a user as typing after this long without a new Typing
+	TYPING_TIMEOUT = 6 * time.Second
+)
+
+// Typing is sent by a client when the user starts or stops writing a line in a
+// room, and passed on to the other members of the room. It is never stored.
+type Typing struct {
+	Username string
+	Room     string
+	Typing   bool
+}
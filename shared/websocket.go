@@ -0,0 +1,537 @@
+package shared
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Subprotocol of WebSocket connections sending packets as binary messages
+	WEBSOCKET_PROTOCOL = "tcp-chat"
+	// Subprotocol of WebSocket connections sending packets as JSONMessage text messages
+	WEBSOCKET_PROTOCOL_JSON = "tcp-chat.json"
+	// Largest message accepted from the other end, fragmented or not
+	WEBSOCKET_MAX_MESSAGE = 1 << 16
+	// Appended to the key of the client to accept the handshake, from RFC 6455
+	WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+const (
+	OPCODE_CONTINUATION byte = 0x0
+	OPCODE_TEXT         byte = 0x1
+	OPCODE_BINARY       byte = 0x2
+	OPCODE_CLOSE        byte = 0x8
+	OPCODE_PING         byte = 0x9
+	OPCODE_PONG         byte = 0xa
+)
+
+const (
+	CLOSE_NORMAL         uint16 = 1000
+	CLOSE_PROTOCOL_ERROR uint16 = 1002
+	CLOSE_INVALID_DATA   uint16 = 1007
+	CLOSE_TOO_BIG        uint16 = 1009
+)
+
+var (
+	HandshakeFailed = errors.New("WebSocket handshake failed.")
+	InvalidFrame    = errors.New("Invalid WebSocket frame.")
+	MessageTooBig   = errors.New("WebSocket message too big.")
+)
+
+// WebSocketAccept returns the Sec-WebSocket-Accept header answering the Sec-WebSocket-Key of a client
+func WebSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// WebSocketTransport carries connections as WebSocket messages over another transport, so
+// browsers can connect. Listen serves HTTP on the address and upgrades every request to a
+// WebSocket, and Dial connects as a WebSocket client.
+//
+// The connections returned read and write the same packet stream as every other transport.
+// Binary messages hold packets as they are, and text messages hold a packet as a JSONMessage.
+// Packets are sent as text when the client asked for WEBSOCKET_PROTOCOL_JSON, and as binary otherwise.
+type WebSocketTransport struct {
+	Transport Transport
+	// Dial asks for WEBSOCKET_PROTOCOL_JSON instead of WEBSOCKET_PROTOCOL
+	JSON bool
+	// Origins of the web pages allowed to connect besides the host itself, like
+	// "https://chat.example.com", or "*" for every origin. Connections without an
+	// Origin do not come from a browser, and are always allowed.
+	AllowedOrigins []string
+}
+
+func (t WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	inner, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &websocketListener{
+		inner:   inner,
+		origins: t.AllowedOrigins,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	listener.server = &http.Server{Handler: listener, ReadHeaderTimeout: 10 * time.Second}
+	go listener.server.Serve(inner)
+
+	return listener, nil
+}
+
+// Dial connects over the transport and completes the handshake. The address is passed to
+// the transport, and sent as the Host of the request for "/".
+func (t WebSocketTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := WEBSOCKET_PROTOCOL
+	if t.JSON {
+		protocol = WEBSOCKET_PROTOCOL_JSON
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	request := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: %s\r\n\r\n", addr, key, protocol)
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Join(HandshakeFailed, err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != WebSocketAccept(key) {
+		conn.Close()
+		return nil, errors.Join(HandshakeFailed, errors.New(fmt.Sprintf("Server answered %s", response.Status)))
+	}
+
+	return newWebSocketConn(conn, reader, true, response.Header.Get("Sec-WebSocket-Protocol") == WEBSOCKET_PROTOCOL_JSON), nil
+}
+
+type websocketListener struct {
+	inner     net.Listener
+	origins   []string
+	server    *http.Server
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ServeHTTP upgrades the request to a WebSocket, and passes the connection on to Accept
+func (l *websocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "This is a tcp-chat WebSocket endpoint", http.StatusUpgradeRequired)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Invalid WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+
+	// Browsers let any page open a WebSocket, so a page elsewhere could chat as its visitors
+	if !l.allowed(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	protocol := ""
+	if headerHas(r.Header, "Sec-WebSocket-Protocol", WEBSOCKET_PROTOCOL_JSON) {
+		protocol = WEBSOCKET_PROTOCOL_JSON
+	} else if headerHas(r.Header, "Sec-WebSocket-Protocol", WEBSOCKET_PROTOCOL) {
+		protocol = WEBSOCKET_PROTOCOL
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets are not supported here", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", WebSocketAccept(key))
+	if protocol != "" {
+		response += fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", protocol)
+	}
+	_, err = conn.Write([]byte(response + "\r\n"))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// The server sets deadlines while reading the request, which the session manages from here on
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- newWebSocketConn(conn, buf.Reader, false, protocol == WEBSOCKET_PROTOCOL_JSON):
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *websocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *websocketListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// headerHas reports whether a comma separated header holds the token, ignoring case
+// allowed reports whether the request has no Origin, or one of the host it was sent to or
+// of the allowed origins
+func (l *websocketListener) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range l.origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func headerHas(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// websocketConn reads and writes the packet stream of a session as WebSocket messages
+type websocketConn struct {
+	net.Conn
+	// Clients mask the frames they send, servers do not
+	client bool
+	// Packets are written as JSONMessage text messages instead of binary messages
+	json bool
+
+	// Only used by the goroutine reading
+	reader  *bufio.Reader
+	pending []byte
+
+	// Guards writing frames, and the packet being written
+	writeMu sync.Mutex
+	partial []byte
+	closed  bool
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool, json bool) *websocketConn {
+	return &websocketConn{Conn: conn, reader: reader, client: client, json: json}
+}
+
+// Read returns the packets of the messages received, as a stream of encoded packets
+func (c *websocketConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		if opcode == OPCODE_BINARY {
+			c.pending = payload
+			continue
+		}
+
+		p, err := PacketFromJSON(payload)
+		if err != nil {
+			c.closeWith(CLOSE_INVALID_DATA, "Invalid JSON message")
+			return 0, err
+		}
+		c.pending = p.Encode()
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage returns the next text or binary message, answering the control frames before it
+func (c *websocketConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOpcode {
+		case OPCODE_PING:
+			c.writeFrame(OPCODE_PONG, payload)
+			continue
+		case OPCODE_PONG:
+			continue
+		case OPCODE_CLOSE:
+			c.sendClose(payload[:min(len(payload), 2)])
+			return 0, nil, io.EOF
+		case OPCODE_TEXT, OPCODE_BINARY:
+			if opcode != 0 {
+				c.closeWith(CLOSE_PROTOCOL_ERROR, "Expected a continuation frame")
+				return 0, nil, InvalidFrame
+			}
+			opcode = frameOpcode
+		case OPCODE_CONTINUATION:
+			if opcode == 0 {
+				c.closeWith(CLOSE_PROTOCOL_ERROR, "Continuation of nothing")
+				return 0, nil, InvalidFrame
+			}
+		default:
+			c.closeWith(CLOSE_PROTOCOL_ERROR, "Unknown opcode")
+			return 0, nil, errors.Join(InvalidFrame, errors.New(fmt.Sprintf("Unknown opcode %d", frameOpcode)))
+		}
+
+		if len(message)+len(payload) > WEBSOCKET_MAX_MESSAGE {
+			c.closeWith(CLOSE_TOO_BIG, "Message too big")
+			return 0, nil, MessageTooBig
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame, and unmasks its payload
+func (c *websocketConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	if header[0]&0x70 != 0 || masked == c.client {
+		c.closeWith(CLOSE_PROTOCOL_ERROR, "Invalid frame header")
+		return false, 0, nil, errors.Join(InvalidFrame, errors.New("Reserved bits set, or wrong masking"))
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	// Control frames are never fragmented, and hold at most 125 bytes
+	if opcode&0x8 != 0 && (!fin || length > 125) {
+		c.closeWith(CLOSE_PROTOCOL_ERROR, "Invalid control frame")
+		return false, 0, nil, errors.Join(InvalidFrame, errors.New("Fragmented or too long control frame"))
+	}
+
+	if length > WEBSOCKET_MAX_MESSAGE {
+		c.closeWith(CLOSE_TOO_BIG, "Message too big")
+		return false, 0, nil, MessageTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		_, err = io.ReadFull(c.reader, mask[:])
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Write sends every complete packet of the stream as a message. The rest of a
+// packet split over several writes is kept until it is complete.
+func (c *websocketConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.partial = append(c.partial, b...)
+	for len(c.partial) >= 3 {
+		length := 3 + DataLength(c.partial)
+		if len(c.partial) < length {
+			break
+		}
+
+		packet := c.partial[:length]
+		c.partial = c.partial[length:]
+		err := c.writePacket(packet)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// writePacket sends an encoded packet as a binary message, or as a JSONMessage
+func (c *websocketConn) writePacket(data []byte) error {
+	if !c.json {
+		return c.writeFrameLocked(OPCODE_BINARY, data)
+	}
+
+	p, err := ParseDatagram(data)
+	if err == nil {
+		p, err = p.Decompress()
+	}
+	if err != nil {
+		return err
+	}
+
+	text, err := PacketToJSON(p)
+	if err != nil {
+		return err
+	}
+
+	return c.writeFrameLocked(OPCODE_TEXT, text)
+}
+
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked sends the payload as a single frame, masked when sent by a client
+func (c *websocketConn) writeFrameLocked(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !c.client {
+		_, err := c.Conn.Write(append(frame, payload...))
+		return err
+	}
+
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// sendClose sends a close frame, unless one was sent already. Nothing is written after it.
+func (c *websocketConn) sendClose(payload []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	// The other end may have stopped reading
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrameLocked(OPCODE_CLOSE, payload)
+}
+
+// closeWith sends a close frame with the status code and reason, and closes the connection
+func (c *websocketConn) closeWith(code uint16, reason string) error {
+	c.sendClose(append(binary.BigEndian.AppendUint16(nil, code), reason...))
+	return c.Conn.Close()
+}
+
+// Close sends a normal close frame without waiting for the answer, and closes the connection
+func (c *websocketConn) Close() error {
+	return c.closeWith(CLOSE_NORMAL, "")
+}
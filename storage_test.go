@@ -0,0 +1,259 @@
+package shared_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func openDB(t *testing.T, dir string) *tcp_server.DB {
+	db, err := tcp_server.OpenDB(dir)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	return db
+}
+
+func checkValue(t *testing.T, db *tcp_server.DB, table string, key string, expected string, exists bool) {
+	value, ok := db.Get(table, key)
+	if ok != exists || string(value) != expected {
+		t.Errorf("Expected %s/%s to be '%s' (%v), got '%s' (%v)", table, key, expected, exists, value, ok)
+	}
+}
+
+func TestDBReplaysLog(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Put("t", "a", []byte("1"))
+	db.Put("t", "b", []byte("2"))
+	db.Put("t", "a", []byte("3"))
+	db.Delete("t", "b")
+
+	// Reopen without closing, as if the server was killed
+	db = openDB(t, dir)
+	checkValue(t, db, "t", "a", "3", true)
+	checkValue(t, db, "t", "b", "", false)
+
+	if keys := db.Keys("t"); !slices.Equal(keys, []string{"a"}) {
+		t.Errorf("Expected keys [a], got %v", keys)
+	}
+}
+
+func TestDBDropsPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Put("t", "a", []byte("1"))
+	db.Put("t", "b", []byte("2"))
+
+	// Cut the last record in half
+	path := filepath.Join(dir, tcp_server.DB_WAL_FILE)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	os.Truncate(path, info.Size()-3)
+
+	db = openDB(t, dir)
+	checkValue(t, db, "t", "a", "1", true)
+	checkValue(t, db, "t", "b", "", false)
+
+	// Writes after the recovery are kept
+	db.Put("t", "c", []byte("3"))
+	db = openDB(t, dir)
+	checkValue(t, db, "t", "c", "3", true)
+}
+
+func TestDBCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.Put("t", "a", []byte("1"))
+	db.Close()
+
+	// A record claiming a payload of 4GiB is not allocated, but fails opening the database
+	path := filepath.Join(dir, tcp_server.DB_WAL_FILE)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	file.Write([]byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 1, 2, 3})
+	file.Close()
+
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	_, err = tcp_server.OpenDB(dir)
+	if !errors.Is(err, tcp_server.CorruptRecord) {
+		t.Fatalf("Expected CorruptRecord, got %v", err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil || len(after) != len(before) {
+		t.Errorf("Expected the log to be left as it was, %d bytes became %d (%v)", len(before), len(after), err)
+	}
+
+	db = openDB(t, "")
+
+	err = db.Put("t", "big", make([]byte, tcp_server.DB_MAX_RECORD_SIZE))
+	if err == nil {
+		t.Errorf("Expected a value larger than DB_MAX_RECORD_SIZE to fail")
+	}
+}
+
+func TestDBCompacts(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.CompactSize = 200
+	for range 50 {
+		db.Put("t", "a", []byte("some value"))
+	}
+	db.Put("t", "b", []byte("last"))
+
+	info, err := os.Stat(filepath.Join(dir, tcp_server.DB_WAL_FILE))
+	if err != nil || info.Size() > 200 {
+		t.Errorf("Expected the log to be compacted, got %v, %v", info.Size(), err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Errorf("Did not expect error, but got: %s", err)
+	}
+
+	db = openDB(t, dir)
+	checkValue(t, db, "t", "a", "some value", true)
+	checkValue(t, db, "t", "b", "last", true)
+}
+
+func TestDBCompactionFails(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	db.CompactSize = 50
+
+	// A directory in the way of the new snapshot fails compacting
+	tmp := filepath.Join(dir, tcp_server.DB_SNAPSHOT_FILE+".tmp")
+	err := os.Mkdir(tmp, 0755)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	// The changes are in the log, so they succeed anyway
+	for range 5 {
+		err = db.Put("t", "a", []byte("some value"))
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+	}
+	checkValue(t, db, "t", "a", "some value", true)
+
+	os.Remove(tmp)
+	db.Put("t", "b", []byte("last"))
+	db.Close()
+
+	db = openDB(t, dir)
+	checkValue(t, db, "t", "a", "some value", true)
+	checkValue(t, db, "t", "b", "last", true)
+}
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := tcp_server.OpenStorage(dir)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	now := time.Now().Round(0)
+	storage.SaveUser(tcp_server.UserRecord{Username: "tobias", Created: now, LastSeen: now})
+	storage.AddMembership("tobias", "general")
+	storage.AddMembership("tobias", "lobby")
+	storage.RemoveMembership("tobias", "general")
+	storage.AddBan(tcp_server.BanRecord{Kind: tcp_server.BAN_IP, Target: "10.0.0.1", Reason: "spam"})
+	storage.AddBan(tcp_server.BanRecord{Kind: tcp_server.BAN_USERNAME, Target: "troll", Room: "lobby"})
+	storage.RemoveBan("", tcp_server.BAN_USERNAME, "troll")
+	storage.SetRole(tcp_server.RoleRecord{Room: "lobby", Username: "tobias", Role: tcp_server.ROLE_OWNER})
+	storage.SetRole(tcp_server.RoleRecord{Username: "tobias", Role: tcp_server.ROLE_MODERATOR})
+	storage.SetRole(tcp_server.RoleRecord{Username: "tobias", Role: tcp_server.ROLE_MEMBER})
+	storage.AddMute(tcp_server.MuteRecord{Room: "lobby", Username: "tobias", Reason: "shouting"})
+	storage.AppendAudit(tcp_server.AuditRecord{By: "admin", Action: tcp_server.AUDIT_MUTE, Target: "tobias", Room: "lobby"})
+	storage.AppendAudit(tcp_server.AuditRecord{By: "admin", Action: tcp_server.AUDIT_BAN, Target: "10.0.0.1"})
+	storage.Append(shared.Message{Username: "tobias", Msg: "hello", Room: "lobby"})
+	storage.RenameUser("tobias", "tobi")
+
+	// Reopen without closing, as if the server was killed
+	storage, err = tcp_server.OpenStorage(dir)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer storage.Close()
+
+	if _, ok, _ := storage.User("tobias"); ok {
+		t.Errorf("Expected the old username to be gone")
+	}
+
+	user, ok, err := storage.User("tobi")
+	if !ok || err != nil || !user.Created.Equal(now) {
+		t.Errorf("Expected user created at %s, got %v, %v, %v", now, user, ok, err)
+	}
+
+	rooms, _ := storage.Memberships("tobi")
+	if !slices.Equal(rooms, []string{"lobby"}) {
+		t.Errorf("Expected memberships [lobby], got %v", rooms)
+	}
+
+	bans, _ := storage.Bans()
+	if len(bans) != 2 || bans[0].Reason != "spam" || bans[1].Room != "lobby" {
+		t.Errorf("Expected a server ban and a room ban, got %v", bans)
+	}
+
+	role, ok, err := storage.Role("lobby", "tobi")
+	if !ok || err != nil || role.Role != tcp_server.ROLE_OWNER {
+		t.Errorf("Expected the room role to follow the rename, got %v, %v, %v", role, ok, err)
+	}
+
+	if _, ok, _ := storage.Role("", "tobi"); ok {
+		t.Errorf("Expected the server role to be taken away")
+	}
+
+	mute, ok, err := storage.Mute("lobby", "tobi")
+	if !ok || err != nil || mute.Reason != "shouting" || mute.Username != "tobi" {
+		t.Errorf("Expected the mute to follow the rename, got %v, %v, %v", mute, ok, err)
+	}
+
+	audit, err := storage.Audit("lobby", 10)
+	if err != nil || len(audit) != 1 || audit[0].Action != tcp_server.AUDIT_MUTE {
+		t.Errorf("Expected the mute in the audit log of lobby, got %v, %v", audit, err)
+	}
+
+	record, err := storage.AppendAudit(tcp_server.AuditRecord{By: "admin", Action: tcp_server.AUDIT_UNMUTE, Target: "tobi", Room: "lobby"})
+	if err != nil || record.ID != 3 {
+		t.Errorf("Expected audit ID 3 after reopening, got %d, %v", record.ID, err)
+	}
+
+	audit, _ = storage.Audit("", 2)
+	if len(audit) != 2 || audit[0].Action != tcp_server.AUDIT_BAN || audit[1].Action != tcp_server.AUDIT_UNMUTE {
+		t.Errorf("Expected the latest two actions oldest first, got %v", audit)
+	}
+
+	msg, err := storage.Append(shared.Message{Username: "tobi", Msg: "again", Room: "lobby"})
+	if err != nil || msg.ID != 2 {
+		t.Errorf("Expected ID 2 after reopening, got %d, %v", msg.ID, err)
+	}
+
+	msgs, more, err := storage.Page("lobby", 0, 0, 10)
+	if err != nil || more || len(msgs) != 2 || msgs[0].Msg != "hello" {
+		t.Errorf("Expected both messages, got %v, %v, %v", msgs, more, err)
+	}
+}
@@ -0,0 +1,23 @@
+package tcp_client
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff returns the delay before reconnect attempt number attempt. The delay doubles
+// with every attempt up to maxDelay, and a random half of it is jitter, so clients
+// dropped at the same time do not all reconnect at the same time.
+func backoff(attempt int, minDelay time.Duration, maxDelay time.Duration) time.Duration {
+	delay := maxDelay
+	if attempt < 32 {
+		delay = minDelay << attempt
+	}
+
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	return half + rand.N(half+1)
+}
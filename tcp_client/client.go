@@ -2,39 +2,455 @@ package tcp_client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/TobiasTheDanish/tcp-chat/shared"
 )
 
+var (
+	NotConnected = errors.New("Not connected.")
+	LoginFailed  = errors.New("Login failed.")
+)
+
 type Client struct {
-	addr *net.TCPAddr
-	conn *net.TCPConn
+	addr string
+	opts Options
+
+	// mu guards the current connection, and the login state that is
+	// carried over when reconnecting
+	mu        sync.Mutex
+	conn      net.Conn
+	settings  shared.Hello
+	heartbeat *shared.Heartbeat
+	connDone  chan struct{}
+	username  string
+	token     string
+	rooms     map[string]bool
+	closed    bool
+	// Chat messages sent without an Ack yet, by nonce
+	pending   map[uint64]shared.Message
+	lastNonce uint64
+
+	// transferMu guards the files being sent and received
+	transferMu   sync.Mutex
+	transfers    map[uint64]*transfer
+	lastTransfer int
+
+	// reader is only used by the goroutine reading from the connection
+	reader   *bufio.Reader
+	recorder *shared.Recorder
+	writeMu  sync.Mutex
+	done     chan struct{}
+}
+
+type Options struct {
+	// Username to log in with
+	Username string
+	// Proves the identity of the user. The server keeps it on the first login with
+	// a secret, and only lets the username log in with it after that.
+	Secret string
+	// Records every packet sent and received, including the initial handshake, when set
+	Recorder *shared.Recorder
+	// How often the server is pinged, 0 disables pings and read deadlines
+	PingInterval time.Duration
+	// The connection is closed after this many pings in a row go unanswered
+	MaxMissedPongs int
+	// Reconnect when the connection is lost while listening
+	Reconnect bool
+	// Delay before the first reconnect attempt, doubled for every failed attempt
+	MinBackoff time.Duration
+	// Longest delay between reconnect attempts
+	MaxBackoff time.Duration
+	// Where status messages, like lost connections, are printed
+	Output io.Writer
+	// Connects over TLS when set, the server name defaults to the host of the address
+	TLS *tls.Config
+	// Carries the connection to the server, shared.NetTransport when nil
+	Transport shared.Transport
 }
 
-func Connect(addr string) (*Client, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
+func DefaultOptions() Options {
+	return Options{
+		PingInterval:   shared.DEFAULT_PING_INTERVAL,
+		MaxMissedPongs: shared.DEFAULT_MAX_MISSED_PONGS,
+		Reconnect:      true,
+		MinBackoff:     500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Output:         os.Stdout,
+	}
+}
+
+func Connect(addr string, username string) (*Client, error) {
+	opts := DefaultOptions()
+	opts.Username = username
+	return ConnectWithOptions(addr, opts)
+}
+
+func ConnectWithOptions(addr string, opts Options) (*Client, error) {
+	client := &Client{
+		addr:      addr,
+		opts:      opts,
+		username:  opts.Username,
+		rooms:     make(map[string]bool),
+		pending:   make(map[uint64]shared.Message),
+		transfers: make(map[uint64]*transfer),
+		recorder:  opts.Recorder,
+		done:      make(chan struct{}),
+	}
+
+	err := client.connect()
 	if err != nil {
 		return nil, err
 	}
 
-	tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+	return client, nil
+}
+
+// connect dials the server, negotiates the connection and logs in,
+// resuming the previous session if there was one.
+func (c *Client) connect() error {
+	conn, err := c.dial()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &Client{addr: tcpAddr, conn: tcpConn}, nil
+	heartbeat := shared.NewHeartbeat(c.opts.PingInterval, c.opts.MaxMissedPongs)
+	connDone := make(chan struct{})
+
+	c.mu.Lock()
+	c.conn = conn
+	c.settings = shared.Hello{}
+	c.heartbeat = heartbeat
+	c.connDone = connDone
+	c.mu.Unlock()
+	c.reader = bufio.NewReader(conn)
+
+	err = c.negotiate(shared.Hello{
+		Compression: shared.COMPRESSION_DEFLATE,
+		Threshold:   shared.DEFAULT_COMPRESSION_THRESHOLD,
+	})
+	if err == nil {
+		err = c.login()
+	}
+	if err != nil {
+		c.disconnect()
+		return err
+	}
+
+	go c.keepalive(heartbeat, connDone)
+
+	return nil
 }
 
-func (c *Client) ReadPacket() (*shared.Packet, error) {
-	data, err := shared.ParsePacket(bufio.NewReader(c.conn))
+// dial connects to the address with the transport of the options, under TLS when configured.
+// Addresses that are ws:// or wss:// URLs, or start with shared.WEBSOCKET_PREFIX, connect
+// over a WebSocket, where wss:// is always over TLS.
+func (c *Client) dial() (net.Conn, error) {
+	var transport shared.Transport = shared.NetTransport{}
+	if c.opts.Transport != nil {
+		transport = c.opts.Transport
+	}
+
+	config := c.opts.TLS
+	addr := c.addr
+	websocket := false
+	if url, ok := strings.CutPrefix(addr, "wss://"); ok {
+		// The path is left out, the server accepts WebSockets on every path
+		addr, _, _ = strings.Cut(url, "/")
+		websocket = true
+		if config == nil {
+			config = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+	} else if url, ok := strings.CutPrefix(addr, "ws://"); ok {
+		addr, _, _ = strings.Cut(url, "/")
+		websocket = true
+	} else {
+		addr, websocket = strings.CutPrefix(addr, shared.WEBSOCKET_PREFIX)
+	}
+
+	if config != nil {
+		transport = shared.TLSTransport{Transport: transport, Config: config}
+	}
+
+	if websocket {
+		transport = shared.WebSocketTransport{Transport: transport}
+	}
+
+	return transport.Dial(addr)
+}
+
+// negotiate sends the Hello of the client, and reads the settings
+// the server has agreed to use for the connection.
+func (c *Client) negotiate(local shared.Hello) error {
+	p, err := shared.PacketFromMessage(shared.KIND_HELLO, local)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return data, nil
+	err = c.SendPacket(p)
+	if err != nil {
+		return err
+	}
+
+	reply, err := c.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	var agreed shared.Hello
+	err = reply.IntoMessage(&agreed)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.settings = agreed
+	c.mu.Unlock()
+	return nil
+}
+
+// login logs in with the resume token of the previous session if there is one,
+// and rejoins the rooms the client was in.
+func (c *Client) login() error {
+	c.mu.Lock()
+	login := shared.Login{Username: c.username, ResumeToken: c.token, Secret: c.opts.Secret}
+	rooms := c.roomsLocked()
+	c.mu.Unlock()
+
+	err := c.SendMessage(shared.KIND_LOGIN, login)
+	if err != nil {
+		return err
+	}
+
+	reply, err := c.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	if reply.Kind() == shared.KIND_ERROR {
+		var msg shared.ErrorMessage
+		reply.IntoMessage(&msg)
+		return errors.Join(LoginFailed, errors.New(msg.Msg))
+	}
+
+	var welcome shared.Welcome
+	err = reply.IntoMessage(&welcome)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.username = welcome.Username
+	c.token = welcome.ResumeToken
+	c.mu.Unlock()
+
+	// A resumed session is still in its rooms on the server
+	if welcome.Resumed {
+		rooms = nil
+	}
+
+	for _, room := range rooms {
+		err = c.SendMessage(shared.KIND_JOIN, shared.Join{Room: room})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Messages sent again are only acknowledged if the server already got them
+	for _, msg := range c.Pending() {
+		err = c.SendMessage(shared.KIND_MESSAGE, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disconnect closes the current connection, without closing the client
+func (c *Client) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disconnectLocked()
+}
+
+// disconnectConn closes the connection of connDone, unless it has already been replaced
+func (c *Client) disconnectConn(connDone chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.connDone == connDone {
+		c.disconnectLocked()
+	}
+}
+
+func (c *Client) disconnectLocked() {
+	if c.conn == nil {
+		return
+	}
+
+	close(c.connDone)
+	c.conn.Close()
+	c.conn = nil
+}
+
+// reconnect keeps trying to connect again, waiting longer after every failed attempt.
+// It only gives up if the client is closed.
+func (c *Client) reconnect() error {
+	c.disconnect()
+
+	for attempt := 0; ; attempt++ {
+		delay := backoff(attempt, c.opts.MinBackoff, c.opts.MaxBackoff)
+		c.printf("Reconnecting in %s\n", delay.Round(time.Millisecond))
+
+		select {
+		case <-c.done:
+			return NotConnected
+		case <-time.After(delay):
+		}
+
+		err := c.connect()
+		if err == nil {
+			c.printf("Reconnected\n")
+			return nil
+		}
+
+		c.printf("Reconnect failed: %s\n", err)
+	}
+}
+
+// ReadPacket returns the next packet sent by the server. Pings are answered
+// and pongs are recorded, without being returned.
+func (c *Client) ReadPacket() (*shared.Packet, error) {
+	c.mu.Lock()
+	conn := c.conn
+	heartbeat := c.heartbeat
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil, NotConnected
+	}
+
+	for {
+		if heartbeat.Enabled() {
+			conn.SetReadDeadline(time.Now().Add(heartbeat.ReadTimeout()))
+		}
+
+		data, err := shared.ParsePacket(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		c.record(shared.DIRECTION_IN, data)
+
+		handled, err := heartbeat.HandleKeepalive(data, c.SendPacket)
+		if err != nil {
+			return nil, err
+		}
+
+		if !handled {
+			return data, nil
+		}
+	}
+}
+
+// keepalive pings the server on every interval of the heartbeat,
+// and closes the connection when too many pings go unanswered.
+func (c *Client) keepalive(heartbeat *shared.Heartbeat, connDone chan struct{}) {
+	if !heartbeat.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-connDone:
+			return
+		case <-ticker.C:
+			ping, err := heartbeat.NextPing()
+			if err != nil {
+				c.printf("Closing connection: %s\n", err)
+				c.disconnectConn(connDone)
+				return
+			}
+
+			err = c.SendPacket(ping)
+			if err != nil {
+				c.disconnectConn(connDone)
+				return
+			}
+		}
+	}
+}
+
+// Latency returns the round trip time measured by the latest ping,
+// or 0 if no ping has been answered yet.
+func (c *Client) Latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.heartbeat.RTT()
+}
+
+// Username returns the username the server accepted for the client
+func (c *Client) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.username
+}
+
+// Rooms returns every room the client is in
+func (c *Client) Rooms() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.roomsLocked()
+}
+
+func (c *Client) roomsLocked() []string {
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Close closes the connection, and stops the client from reconnecting
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mu.Unlock()
+
+	c.disconnect()
+	c.dropTransfers("Client closed")
+	return nil
+}
+
+// Closed reports whether Close was called, or the user quit with /quit
+func (c *Client) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
 }
 
 func (c *Client) ReadSend(r io.Reader) error {
@@ -45,14 +461,110 @@ func (c *Client) ReadSend(r io.Reader) error {
 		return err
 	}
 
-	return c.SendBytes([]byte(text))
+	_, err = c.SendLine(text, "")
+	return err
+}
+
+// SendLine sends a line typed by the user to room. Lines starting with "/" are
+// sent as commands, and "/quit" closes the client after sending it. It returns
+// the nonce of the chat message, or 0 for a command.
+func (c *Client) SendLine(line string, room string) (uint64, error) {
+	return c.SendReply(line, room, 0)
+}
+
+// SendReply sends a line typed by the user like SendLine, but a chat message is
+// sent as a reply to the message with the ID parent. A parent of 0 sends it to the room.
+func (c *Client) SendReply(line string, room string, parent uint64) (uint64, error) {
+	cmd, ok, err := shared.ParseCommand(line, room)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return c.SendChat(shared.Message{Msg: shared.UnescapeLine(line), Room: room, Parent: parent})
+	}
+
+	err = c.SendMessage(shared.KIND_COMMAND, cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	if cmd.Name == "quit" {
+		return 0, c.Close()
+	}
+
+	return 0, nil
 }
 
 func (c *Client) SendPacket(p *shared.Packet) error {
-	_, err := c.conn.Write(p.Encode())
+	c.mu.Lock()
+	conn := c.conn
+	settings := c.settings
+	c.mu.Unlock()
+
+	if conn == nil {
+		return NotConnected
+	}
+
+	c.record(shared.DIRECTION_OUT, p)
+
+	p, err := settings.CompressFor(p)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err = conn.Write(p.Encode())
 	return err
 }
 
+// SendChat sends a chat message with a new nonce, and returns the nonce. The message
+// is pending until the server acknowledges it. Pending messages are sent again after
+// reconnecting, so while the client can reconnect, a message that could not be sent
+// is kept pending instead of failing.
+func (c *Client) SendChat(msg shared.Message) (uint64, error) {
+	c.mu.Lock()
+	c.lastNonce += 1
+	msg.Nonce = c.lastNonce
+	c.pending[msg.Nonce] = msg
+	c.mu.Unlock()
+
+	err := c.SendMessage(shared.KIND_MESSAGE, msg)
+	if err != nil && (!c.opts.Reconnect || c.Closed()) {
+		c.mu.Lock()
+		delete(c.pending, msg.Nonce)
+		c.mu.Unlock()
+		return msg.Nonce, err
+	}
+
+	return msg.Nonce, nil
+}
+
+// Pending returns the chat messages not acknowledged by the server, oldest first
+func (c *Client) Pending() []shared.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msgs := make([]shared.Message, 0, len(c.pending))
+	for _, msg := range c.pending {
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Nonce < msgs[j].Nonce })
+	return msgs
+}
+
+func (c *Client) SendMessage(kind shared.MessageKind, msg interface{}) error {
+	p, err := shared.PacketFromMessage(kind, msg)
+	if err != nil {
+		return err
+	}
+
+	return c.SendPacket(p)
+}
+
 func (c *Client) SendBytes(bytes []byte) error {
 	p, err := shared.PacketFromData(bytes)
 	if err != nil {
@@ -64,16 +576,85 @@ func (c *Client) SendBytes(bytes []byte) error {
 
 type MessageHandler func(*shared.Packet)
 
+// Listen passes every packet from the server to handler. If the connection is lost,
+// and the client was connected with Reconnect, it reconnects and keeps listening.
+// Listen returns when the client is closed, or the connection is lost for good.
 func (c *Client) Listen(handler MessageHandler) {
 	for {
 		// Read from the connection untill a new line is send
 		packet, err := c.ReadPacket()
 		if err != nil {
-			fmt.Println(err)
-			return
+			if c.Closed() {
+				return
+			}
+
+			c.printf("%s\n", err)
+			c.dropTransfers("Connection lost")
+			if !c.opts.Reconnect || c.reconnect() != nil {
+				return
+			}
+			continue
 		}
 
+		c.track(packet)
+
 		// Print the data read from the connection to the terminal
 		handler(packet)
 	}
 }
+
+// track keeps the rooms, pending messages and transfers of the client up to date
+// with the confirmations from the server
+func (c *Client) track(p *shared.Packet) {
+	c.trackTransfer(p)
+
+	switch p.Kind() {
+	case shared.KIND_ACK:
+		var ack shared.Ack
+		if p.IntoMessage(&ack) == nil {
+			c.mu.Lock()
+			delete(c.pending, ack.Nonce)
+			c.mu.Unlock()
+		}
+	case shared.KIND_ERROR:
+		var msg shared.ErrorMessage
+		if p.IntoMessage(&msg) == nil && msg.Nonce != 0 {
+			c.mu.Lock()
+			delete(c.pending, msg.Nonce)
+			c.mu.Unlock()
+		}
+	case shared.KIND_JOIN:
+		var join shared.Join
+		if p.IntoMessage(&join) == nil {
+			c.mu.Lock()
+			c.rooms[join.Room] = true
+			c.mu.Unlock()
+		}
+	case shared.KIND_LEAVE:
+		var leave shared.Leave
+		if p.IntoMessage(&leave) == nil {
+			c.mu.Lock()
+			delete(c.rooms, leave.Room)
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *Client) record(direction byte, p *shared.Packet) {
+	if c.recorder == nil {
+		return
+	}
+
+	err := c.recorder.Record(0, direction, p)
+	if err != nil {
+		c.printf("ERROR: recording session: %s\n", err)
+	}
+}
+
+func (c *Client) printf(format string, a ...any) {
+	if c.opts.Output == nil {
+		return
+	}
+
+	fmt.Fprintf(c.opts.Output, format, a...)
+}
@@ -0,0 +1,131 @@
+package tcp_client
+
+import (
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// DiscoveredServer is a server that answered Discover
+type DiscoveredServer struct {
+	// The host:port to connect to
+	Addr string
+	shared.DiscoveryReply
+}
+
+// Discover looks for servers on the local network, by sending a probe to the UDP port
+// as a broadcast and to shared.DISCOVERY_GROUP. It returns the servers answering within
+// the timeout, sorted by name.
+func Discover(port int, timeout time.Duration) ([]DiscoveredServer, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	nonce := rand.Uint64()
+	probe, err := shared.PacketFromMessage(shared.KIND_DISCOVERY_PROBE, shared.DiscoveryProbe{Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sending fails on networks without a route for some of the targets, one is enough
+	sent := 0
+	for _, target := range probeTargets(port) {
+		_, err = conn.WriteToUDP(probe.Encode(), target)
+		if err == nil {
+			sent += 1
+		}
+	}
+	if sent == 0 {
+		return nil, err
+	}
+
+	servers := make(map[string]DiscoveredServer)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	buf := make([]byte, shared.MAX_DATA_LEN+3)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The deadline ends the search
+			break
+		}
+
+		p, err := shared.ParseDatagram(buf[:n])
+		if err != nil || p.Kind() != shared.KIND_DISCOVERY_REPLY {
+			continue
+		}
+
+		var reply shared.DiscoveryReply
+		err = p.IntoMessage(&reply)
+		if err != nil || reply.Nonce != nonce {
+			continue
+		}
+
+		host := reply.Host
+		if host == "" {
+			host = from.IP.String()
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(int(reply.Port)))
+		servers[addr] = DiscoveredServer{Addr: addr, DiscoveryReply: reply}
+	}
+
+	found := make([]DiscoveredServer, 0, len(servers))
+	for _, server := range servers {
+		found = append(found, server)
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Name != found[j].Name {
+			return found[i].Name < found[j].Name
+		}
+		return found[i].Addr < found[j].Addr
+	})
+
+	return found, nil
+}
+
+// probeTargets returns the addresses a probe is sent to: the discovery group, the
+// broadcast address, and the broadcast address of every IPv4 network the machine is on
+func probeTargets(port int) []*net.UDPAddr {
+	targets := []*net.UDPAddr{
+		{IP: net.ParseIP(shared.DISCOVERY_GROUP), Port: port},
+		{IP: net.IPv4bcast, Port: port},
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return targets
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || len(ipNet.Mask) != net.IPv4len {
+				continue
+			}
+
+			broadcast := make(net.IP, net.IPv4len)
+			for i, b := range ipNet.IP.To4() {
+				broadcast[i] = b | ^ipNet.Mask[i]
+			}
+			targets = append(targets, &net.UDPAddr{IP: broadcast, Port: port})
+		}
+	}
+
+	return targets
+}
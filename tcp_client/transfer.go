@@ -0,0 +1,513 @@
+package tcp_client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+var UnknownTransfer = errors.New("Unknown file transfer.")
+
+type TransferState int
+
+const (
+	// Offered, and waiting for the receiver to answer
+	TRANSFER_OFFERED TransferState = iota
+	// Accepted, and chunks are being sent
+	TRANSFER_ACTIVE
+	TRANSFER_DONE
+	TRANSFER_FAILED
+)
+
+func (s TransferState) String() string {
+	switch s {
+	case TRANSFER_OFFERED:
+		return "offered"
+	case TRANSFER_ACTIVE:
+		return "active"
+	case TRANSFER_DONE:
+		return "done"
+	case TRANSFER_FAILED:
+		return "failed"
+	}
+
+	return fmt.Sprintf("TransferState(%d)", int(s))
+}
+
+// Transfer is a file sent or received by the client
+type Transfer struct {
+	Offer shared.FileOffer
+	// Short number of the transfer, counting up from 1, for the user to refer to it by
+	Number int
+	// Whether the client is sending the file
+	Outgoing bool
+	// Where the file is read from, or where it is written once accepted
+	Path  string
+	State TransferState
+	// How many bytes the receiver has got
+	Progress uint64
+	// Why the transfer failed
+	Reason string
+}
+
+// Percent returns how much of the file the receiver has got
+func (t Transfer) Percent() int {
+	if t.Offer.Size == 0 {
+		return 100
+	}
+
+	return int(t.Progress * 100 / t.Offer.Size)
+}
+
+// Finished reports whether the transfer is done or failed
+func (t Transfer) Finished() bool {
+	return t.State == TRANSFER_DONE || t.State == TRANSFER_FAILED
+}
+
+type transfer struct {
+	Transfer
+	// The file being sent, or the partial file being received
+	file *os.File
+	// SHA-256 of the chunks received so far
+	hash hash.Hash
+	// Chunks received since the last FileProgress
+	chunks int
+	// Signalled when the receiver reports progress
+	progress chan struct{}
+	// Closed when the transfer is finished
+	stop chan struct{}
+}
+
+// SendFile offers the file at path to the user. Chunks are sent once the user accepts it,
+// interleaved with other messages, so the chat keeps flowing while the file is sent.
+func (c *Client) SendFile(to string, path string) (Transfer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		err = errors.New(fmt.Sprintf("%s is a directory", path))
+	}
+	if err != nil {
+		file.Close()
+		return Transfer{}, err
+	}
+
+	sum := sha256.New()
+	_, err = io.Copy(sum, file)
+	if err != nil {
+		file.Close()
+		return Transfer{}, err
+	}
+
+	offer := shared.FileOffer{
+		Transfer: shared.NewTransferId(),
+		From:     c.Username(),
+		To:       to,
+		Name:     filepath.Base(path),
+		Size:     uint64(info.Size()),
+		Sum:      hex.EncodeToString(sum.Sum(nil)),
+	}
+
+	t := c.addTransfer(offer, true)
+	t.Path = path
+	t.file = file
+
+	err = c.SendMessage(shared.KIND_FILE_OFFER, offer)
+	if err != nil {
+		c.transferMu.Lock()
+		c.endLocked(t, TRANSFER_FAILED, err.Error())
+		c.transferMu.Unlock()
+	}
+
+	return c.snapshot(t), err
+}
+
+// AcceptFile accepts a file offered to the client, and writes it to path once every chunk
+// is received and the SHA-256 matches. An empty path writes it to the working directory
+// with the name it was offered with, and so does a path to a directory.
+// Existing files are never overwritten.
+func (c *Client) AcceptFile(id uint64, path string) (Transfer, error) {
+	c.transferMu.Lock()
+	t, err := c.offered(id)
+	if err != nil {
+		c.transferMu.Unlock()
+		return Transfer{}, err
+	}
+
+	if path == "" {
+		path = t.Offer.Name
+	} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, t.Offer.Name)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		c.transferMu.Unlock()
+		return c.snapshot(t), errors.New(fmt.Sprintf("%s already exists", path))
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		c.transferMu.Unlock()
+		return c.snapshot(t), err
+	}
+
+	t.Path = path
+	t.file = file
+	t.hash = sha256.New()
+	t.State = TRANSFER_ACTIVE
+	c.transferMu.Unlock()
+
+	err = c.SendMessage(shared.KIND_FILE_ANSWER, shared.FileAnswer{Transfer: id, Accept: true})
+	if err != nil {
+		c.transferMu.Lock()
+		c.endLocked(t, TRANSFER_FAILED, err.Error())
+		c.transferMu.Unlock()
+	}
+
+	return c.snapshot(t), err
+}
+
+// RejectFile rejects a file offered to the client
+func (c *Client) RejectFile(id uint64, reason string) error {
+	c.transferMu.Lock()
+	t, err := c.offered(id)
+	if err == nil {
+		c.endLocked(t, TRANSFER_FAILED, "Rejected")
+	}
+	c.transferMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return c.SendMessage(shared.KIND_FILE_ANSWER, shared.FileAnswer{Transfer: id, Reason: reason})
+}
+
+// CancelFile stops sending or receiving a file
+func (c *Client) CancelFile(id uint64) error {
+	c.transferMu.Lock()
+	t, ok := c.transfers[id]
+	if !ok || t.Finished() {
+		c.transferMu.Unlock()
+		return errors.Join(UnknownTransfer, errors.New(fmt.Sprintf("No file transfer %d in progress", id)))
+	}
+	c.endLocked(t, TRANSFER_FAILED, "Cancelled")
+	c.transferMu.Unlock()
+
+	return c.SendMessage(shared.KIND_FILE_DONE, shared.FileDone{Transfer: id})
+}
+
+// Transfer returns the transfer with the ID
+func (c *Client) Transfer(id uint64) (Transfer, bool) {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	t, ok := c.transfers[id]
+	if !ok {
+		return Transfer{}, false
+	}
+
+	return t.Transfer, true
+}
+
+// Transfers returns every transfer of the client, including finished ones, by number
+func (c *Client) Transfers() []Transfer {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	transfers := make([]Transfer, 0, len(c.transfers))
+	for _, t := range c.transfers {
+		transfers = append(transfers, t.Transfer)
+	}
+
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Number < transfers[j].Number })
+	return transfers
+}
+
+func (c *Client) addTransfer(offer shared.FileOffer, outgoing bool) *transfer {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	c.lastTransfer += 1
+	t := &transfer{
+		Transfer: Transfer{
+			Offer:    offer,
+			Number:   c.lastTransfer,
+			Outgoing: outgoing,
+			State:    TRANSFER_OFFERED,
+		},
+		progress: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	c.transfers[offer.Transfer] = t
+	return t
+}
+
+func (c *Client) snapshot(t *transfer) Transfer {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	return t.Transfer
+}
+
+// offered returns a file offered to the client, and not answered yet.
+// c.transferMu must be held.
+func (c *Client) offered(id uint64) (*transfer, error) {
+	t, ok := c.transfers[id]
+	if !ok || t.Outgoing || t.State != TRANSFER_OFFERED {
+		return nil, errors.Join(UnknownTransfer, errors.New(fmt.Sprintf("No file offered as transfer %d", id)))
+	}
+
+	return t, nil
+}
+
+// endLocked finishes the transfer, removing the partial file of a failed download.
+// c.transferMu must be held.
+func (c *Client) endLocked(t *transfer, state TransferState, reason string) {
+	if t.Finished() {
+		return
+	}
+
+	t.State = state
+	t.Reason = reason
+	close(t.stop)
+
+	if t.file != nil {
+		t.file.Close()
+		if !t.Outgoing && state == TRANSFER_FAILED {
+			os.Remove(t.file.Name())
+		}
+	}
+}
+
+// sendChunks sends the file in order, keeping at most FILE_WINDOW chunks
+// ahead of the progress reported by the receiver
+func (c *Client) sendChunks(t *transfer) {
+	buf := make([]byte, shared.FILE_CHUNK_SIZE)
+	size := t.Offer.Size
+	window := uint64(shared.FILE_WINDOW * shared.FILE_CHUNK_SIZE)
+
+	for offset := uint64(0); offset < size; {
+		for {
+			c.transferMu.Lock()
+			progress := t.Progress
+			c.transferMu.Unlock()
+
+			if offset-progress < window {
+				break
+			}
+
+			select {
+			case <-t.progress:
+			case <-t.stop:
+				return
+			}
+		}
+
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+
+		n, err := t.file.ReadAt(buf[:min(uint64(len(buf)), size-offset)], int64(offset))
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = errors.New("File changed while sending it")
+			}
+			c.failTransfer(t, err.Error())
+			return
+		}
+
+		err = c.SendMessage(shared.KIND_FILE_CHUNK, shared.FileChunk{Transfer: t.Offer.Transfer, Offset: offset, Data: buf[:n]})
+		if err != nil {
+			// The transfer fails with the connection
+			return
+		}
+
+		offset += uint64(n)
+	}
+}
+
+// receiveChunk writes a chunk of a file being received, and reports the progress
+// to the sender for every half window of chunks, and once the whole file is received
+func (c *Client) receiveChunk(chunk shared.FileChunk) {
+	c.transferMu.Lock()
+	t, ok := c.transfers[chunk.Transfer]
+	if !ok || t.Outgoing || t.State != TRANSFER_ACTIVE {
+		c.transferMu.Unlock()
+		return
+	}
+
+	if chunk.Offset != t.Progress {
+		c.transferMu.Unlock()
+		c.failTransfer(t, fmt.Sprintf("Expected chunk at offset %d, got %d", t.Progress, chunk.Offset))
+		return
+	}
+
+	_, err := t.file.Write(chunk.Data)
+	if err != nil {
+		c.transferMu.Unlock()
+		c.failTransfer(t, err.Error())
+		return
+	}
+
+	t.hash.Write(chunk.Data)
+	t.Progress += uint64(len(chunk.Data))
+	t.chunks += 1
+
+	report := t.chunks >= shared.FILE_WINDOW/2 || t.Progress >= t.Offer.Size
+	if report {
+		t.chunks = 0
+	}
+	progress := shared.FileProgress{Transfer: chunk.Transfer, Received: t.Progress}
+	c.transferMu.Unlock()
+
+	if report {
+		c.SendMessage(shared.KIND_FILE_PROGRESS, progress)
+	}
+}
+
+// finishTransfer ends the transfer when the server reports it done or failed.
+// A received file is checked against the SHA-256 of the offer before it is moved into place.
+func (c *Client) finishTransfer(done shared.FileDone) {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	t, ok := c.transfers[done.Transfer]
+	if !ok {
+		return
+	}
+
+	if !done.OK {
+		c.endLocked(t, TRANSFER_FAILED, done.Reason)
+		return
+	}
+
+	if t.Outgoing {
+		t.Progress = t.Offer.Size
+		c.endLocked(t, TRANSFER_DONE, "")
+		return
+	}
+
+	if t.State != TRANSFER_ACTIVE {
+		return
+	}
+
+	sum := hex.EncodeToString(t.hash.Sum(nil))
+	if t.Progress != t.Offer.Size || sum != t.Offer.Sum {
+		c.endLocked(t, TRANSFER_FAILED, "SHA-256 of the received file does not match the offer")
+		return
+	}
+
+	err := t.file.Close()
+	if err == nil {
+		err = os.Chmod(t.file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(t.file.Name(), t.Path)
+	}
+	if err != nil {
+		c.endLocked(t, TRANSFER_FAILED, err.Error())
+		return
+	}
+
+	c.endLocked(t, TRANSFER_DONE, "")
+}
+
+// failTransfer fails the transfer, and tells the other user through the server
+func (c *Client) failTransfer(t *transfer, reason string) {
+	c.transferMu.Lock()
+	finished := t.Finished()
+	c.endLocked(t, TRANSFER_FAILED, reason)
+	c.transferMu.Unlock()
+
+	if !finished {
+		c.SendMessage(shared.KIND_FILE_DONE, shared.FileDone{Transfer: t.Offer.Transfer, Reason: reason})
+	}
+}
+
+// dropTransfers fails every unfinished transfer, when the connection they were sent over is lost
+func (c *Client) dropTransfers(reason string) {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	for _, t := range c.transfers {
+		c.endLocked(t, TRANSFER_FAILED, reason)
+	}
+}
+
+// trackTransfer keeps the transfers of the client up to date with the messages from the server
+func (c *Client) trackTransfer(p *shared.Packet) {
+	switch p.Kind() {
+	case shared.KIND_FILE_OFFER:
+		var offer shared.FileOffer
+		if p.IntoMessage(&offer) == nil {
+			c.addTransfer(offer, false)
+		}
+	case shared.KIND_FILE_ANSWER:
+		var answer shared.FileAnswer
+		if p.IntoMessage(&answer) != nil {
+			return
+		}
+
+		c.transferMu.Lock()
+		defer c.transferMu.Unlock()
+
+		t, ok := c.transfers[answer.Transfer]
+		if !ok || !t.Outgoing || t.State != TRANSFER_OFFERED {
+			return
+		}
+
+		if !answer.Accept {
+			reason := fmt.Sprintf("Rejected by %s", t.Offer.To)
+			if answer.Reason != "" {
+				reason += ": " + answer.Reason
+			}
+			c.endLocked(t, TRANSFER_FAILED, reason)
+			return
+		}
+
+		t.State = TRANSFER_ACTIVE
+		go c.sendChunks(t)
+	case shared.KIND_FILE_CHUNK:
+		var chunk shared.FileChunk
+		if p.IntoMessage(&chunk) == nil {
+			c.receiveChunk(chunk)
+		}
+	case shared.KIND_FILE_PROGRESS:
+		var progress shared.FileProgress
+		if p.IntoMessage(&progress) != nil {
+			return
+		}
+
+		c.transferMu.Lock()
+		t, ok := c.transfers[progress.Transfer]
+		if ok && t.Outgoing && progress.Received > t.Progress && progress.Received <= t.Offer.Size {
+			t.Progress = progress.Received
+		}
+		c.transferMu.Unlock()
+
+		if ok {
+			select {
+			case t.progress <- struct{}{}:
+			default:
+			}
+		}
+	case shared.KIND_FILE_DONE:
+		var done shared.FileDone
+		if p.IntoMessage(&done) == nil {
+			c.finishTransfer(done)
+		}
+	}
+}
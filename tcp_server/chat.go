@@ -0,0 +1,437 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+const MAX_USERNAME_LEN = 32
+
+var InvalidUsername = errors.New("Invalid username.")
+
+// HandleChat is the ConnectionHandler for the chat protocol. It logs the client in,
+// handles joining and leaving rooms, and passes every chat message on to c.
+func HandleChat(session *Session, c chan *shared.Packet) {
+	server := session.server
+
+	err := server.login(session)
+	if err != nil {
+		fmt.Printf("Login from %s failed: %s\n", session.RemoteAddr(), err)
+		session.SendError(err.Error())
+		return
+	}
+
+	for {
+		p, err := session.ReadPacket()
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Connection to %s closed\n", session.Username())
+			} else {
+				fmt.Printf("ERROR: %s\n", err)
+			}
+			return
+		}
+
+		err = server.handlePacket(session, p, c)
+		if err != nil {
+			session.SendError(err.Error())
+		}
+	}
+}
+
+func (s *Server) handlePacket(session *Session, p *shared.Packet, c chan *shared.Packet) error {
+	s.touch(session)
+
+	switch p.Kind() {
+	case shared.KIND_MESSAGE:
+		var msg shared.Message
+		err := p.IntoMessage(&msg)
+		if err != nil {
+			return err
+		}
+
+		err = s.handleMessage(session, msg, c)
+		if err != nil && msg.Nonce != 0 {
+			return session.SendMessage(shared.KIND_ERROR, shared.ErrorMessage{Msg: err.Error(), Nonce: msg.Nonce})
+		}
+
+		return err
+
+	case shared.KIND_JOIN:
+		var join shared.Join
+		err := p.IntoMessage(&join)
+		if err != nil {
+			return err
+		}
+
+		return s.Join(session, join.Room)
+
+	case shared.KIND_LEAVE:
+		var leave shared.Leave
+		err := p.IntoMessage(&leave)
+		if err != nil {
+			return err
+		}
+
+		return s.Leave(session, leave.Room)
+
+	case shared.KIND_TYPING:
+		var typing shared.Typing
+		err := p.IntoMessage(&typing)
+		if err != nil {
+			return err
+		}
+
+		return s.handleTyping(session, typing)
+
+	case shared.KIND_EDIT:
+		var edit shared.Edit
+		err := p.IntoMessage(&edit)
+		if err != nil {
+			return err
+		}
+
+		return s.EditMessage(session, edit.Room, edit.ID, edit.Msg)
+
+	case shared.KIND_DELETE:
+		var del shared.Delete
+		err := p.IntoMessage(&del)
+		if err != nil {
+			return err
+		}
+
+		return s.DeleteMessage(session, del.Room, del.ID)
+
+	case shared.KIND_REACTION:
+		var reaction shared.Reaction
+		err := p.IntoMessage(&reaction)
+		if err != nil {
+			return err
+		}
+
+		return s.React(session, reaction.Room, reaction.ID, reaction.Emoji)
+
+	case shared.KIND_THREAD_REQUEST:
+		var req shared.ThreadRequest
+		err := p.IntoMessage(&req)
+		if err != nil {
+			return err
+		}
+
+		return s.SendThread(session, req.Room, req.ID)
+
+	case shared.KIND_FILE_OFFER:
+		var offer shared.FileOffer
+		err := p.IntoMessage(&offer)
+		if err != nil {
+			return err
+		}
+
+		return s.offerFile(session, offer)
+
+	case shared.KIND_FILE_ANSWER:
+		var answer shared.FileAnswer
+		err := p.IntoMessage(&answer)
+		if err != nil {
+			return err
+		}
+
+		return s.answerFile(session, answer)
+
+	case shared.KIND_FILE_CHUNK:
+		var chunk shared.FileChunk
+		err := p.IntoMessage(&chunk)
+		if err != nil {
+			return err
+		}
+
+		return s.passChunk(session, chunk)
+
+	case shared.KIND_FILE_PROGRESS:
+		var progress shared.FileProgress
+		err := p.IntoMessage(&progress)
+		if err != nil {
+			return err
+		}
+
+		return s.passProgress(session, progress)
+
+	case shared.KIND_FILE_DONE:
+		var done shared.FileDone
+		err := p.IntoMessage(&done)
+		if err != nil {
+			return err
+		}
+
+		return s.cancelTransfer(session, done)
+
+	case shared.KIND_HISTORY_REQUEST:
+		var req shared.HistoryRequest
+		err := p.IntoMessage(&req)
+		if err != nil {
+			return err
+		}
+
+		return s.SendHistory(session, req.Room, req.Before, req.After, int(req.Limit))
+
+	case shared.KIND_COMMAND:
+		var cmd shared.Command
+		err := p.IntoMessage(&cmd)
+		if err != nil {
+			return err
+		}
+
+		return s.runCommand(session, cmd, c)
+
+	default:
+		return errors.New(fmt.Sprintf("Unexpected message '%s'", p.Kind()))
+	}
+}
+
+// handleMessage passes a chat message from the client on to c, and acknowledges
+// it if the client gave it a nonce.
+func (s *Server) handleMessage(session *Session, msg shared.Message, c chan *shared.Packet) error {
+	if ack, ok := s.ackFor(session, msg.Nonce); ok {
+		// Sent again after reconnecting, without the first Ack arriving
+		return session.SendMessage(shared.KIND_ACK, ack)
+	}
+
+	msg.Username = session.Username()
+	msg.Msg = strings.Trim(msg.Msg, "\r\n \t")
+	msg.ID = 0
+	msg.Edited = 0
+	msg.Deleted = false
+	msg.Reactions = nil
+	msg.Replies = 0
+	if msg.Room == "" {
+		msg.Room = shared.DEFAULT_ROOM
+	}
+
+	if !session.InRoom(msg.Room) {
+		return errors.New(fmt.Sprintf("Not in room '%s'", msg.Room))
+	}
+
+	err := s.checkMuted(session, msg.Room)
+	if err != nil {
+		return err
+	}
+
+	if msg.Parent != 0 {
+		parent, err := s.threadStart(session, msg.Room, msg.Parent)
+		if err != nil {
+			return err
+		}
+		msg.Parent = parent.ID
+	}
+
+	session.stoppedTyping(msg.Room)
+
+	msg, err = s.publish(msg, c)
+	if err != nil {
+		return err
+	}
+
+	if msg.Parent != 0 {
+		err = s.addReply(msg)
+		if err != nil {
+			fmt.Printf("ERROR: counting reply %d: %s\n", msg.ID, err)
+		}
+	}
+
+	if msg.Nonce == 0 {
+		return nil
+	}
+
+	ack := shared.Ack{Nonce: msg.Nonce, ID: msg.ID, Time: msg.Time, Room: msg.Room}
+	s.rememberAck(session, ack)
+	return session.SendMessage(shared.KIND_ACK, ack)
+}
+
+func validateUsername(username string) error {
+	if username == "" {
+		return errors.Join(InvalidUsername, errors.New("Username cannot be empty"))
+	}
+
+	if len(username) > MAX_USERNAME_LEN {
+		return errors.Join(InvalidUsername, errors.New(fmt.Sprintf("Username cannot be longer than %d characters", MAX_USERNAME_LEN)))
+	}
+
+	if strings.ContainsAny(username, " \t\r\n") {
+		return errors.Join(InvalidUsername, errors.New("Username cannot contain whitespace"))
+	}
+
+	return nil
+}
+
+// login reads the Login of the client, and either resumes the session of its
+// resume token, or starts a new session in the default room.
+func (s *Server) login(session *Session) error {
+	p, err := session.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	var login shared.Login
+	err = p.IntoMessage(&login)
+	if err != nil {
+		return err
+	}
+
+	var state resumeState
+	resumed := false
+	token := login.ResumeToken
+	if token != "" {
+		state, resumed = s.attach(token, session)
+	}
+
+	username, missed := state.username, state.missed
+
+	// Bans given while the session was detached end it
+	if resumed {
+		err = s.checkBanned("", username)
+		if err != nil {
+			s.forget(username)
+			return err
+		}
+	}
+
+	if !resumed {
+		username = strings.TrimSpace(login.Username)
+		err = validateUsername(username)
+		if err != nil {
+			return err
+		}
+
+		err = s.checkBanned("", username)
+		if err != nil {
+			return err
+		}
+
+		err = s.authenticate(username, login.Secret)
+		if err != nil {
+			return err
+		}
+
+		token, err = s.register(username, session)
+		if err != nil {
+			return err
+		}
+	}
+
+	session.setLogin(username, token)
+
+	welcome, err := shared.PacketFromMessage(shared.KIND_WELCOME, shared.Welcome{
+		Username:    username,
+		ResumeToken: token,
+		Resumed:     resumed,
+		Missed:      uint16(len(missed)),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = session.WritePacket(welcome)
+	if err != nil {
+		return err
+	}
+
+	// The rooms are restored without history, the missed messages fill the gap
+	for _, room := range state.rooms {
+		if s.checkBanned(room, username) == nil {
+			s.addToRoom(session, room)
+		}
+	}
+
+	for _, p := range missed {
+		err = session.WritePacket(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resumed {
+		fmt.Printf("%s resumed their session, %d missed messages\n", username, len(missed))
+		return s.SetPresence(session, shared.PRESENCE_ONLINE, false)
+	}
+
+	fmt.Printf("%s logged in\n", username)
+
+	err = s.SetPresence(session, shared.PRESENCE_ONLINE, false)
+	if err != nil {
+		return err
+	}
+
+	rooms, err := s.registerUser(username, login.Secret)
+	if err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		err = s.Join(session, room)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.sendMOTD(session)
+}
+
+// registerUser stores the user if it is new, along with the secret it logged in with if
+// it has none yet, and returns the rooms it should join. Returning users rejoin the rooms
+// they were in, new users join the default room.
+func (s *Server) registerUser(username string, secret string) ([]string, error) {
+	now := time.Now()
+	user, ok, err := s.Storage.User(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		user = UserRecord{Username: username, Created: now}
+	}
+	user.LastSeen = now
+
+	if secret != "" && !user.HasSecret() {
+		err = user.SetSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.Storage.SaveUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms, err := s.Storage.Memberships(username)
+	if err != nil || len(rooms) > 0 {
+		return rooms, err
+	}
+
+	return []string{shared.DEFAULT_ROOM}, nil
+}
+
+// seen updates when the user of the session was last seen
+func (s *Server) seen(session *Session) {
+	username := session.Username()
+	if username == "" {
+		return
+	}
+
+	user, ok, err := s.Storage.User(username)
+	if err != nil || !ok {
+		return
+	}
+
+	user.LastSeen = time.Now()
+	err = s.Storage.SaveUser(user)
+	if err != nil {
+		fmt.Printf("ERROR: saving user %s: %s\n", username, err)
+	}
+}
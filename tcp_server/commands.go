@@ -0,0 +1,862 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+var UnknownCommand = errors.New("Unknown command.")
+
+type CommandArg struct {
+	Name string
+	// Optional arguments can be left out, they must come after the required arguments
+	Optional bool
+	// The last argument can take the rest of the line, joined by single spaces
+	Rest bool
+}
+
+// CommandContext is passed to a CommandHandler, with the arguments validated against the CommandSpec
+type CommandContext struct {
+	Session *Session
+	Server  *Server
+	Spec    CommandSpec
+	// One string per argument of the spec, optional arguments that were left out are empty
+	Args []string
+	// The room the user was in when typing the command
+	Room string
+	out  chan *shared.Packet
+}
+
+type CommandHandler func(ctx *CommandContext) error
+
+type CommandSpec struct {
+	Name    string
+	Args    []CommandArg
+	Help    string
+	Handler CommandHandler
+}
+
+// Usage returns how the command is typed, e.g. "/msg <user> <text...>"
+func (spec CommandSpec) Usage() string {
+	var b strings.Builder
+	b.WriteString("/" + spec.Name)
+
+	for _, arg := range spec.Args {
+		name := arg.Name
+		if arg.Rest {
+			name += "..."
+		}
+
+		if arg.Optional {
+			b.WriteString(fmt.Sprintf(" [%s]", name))
+		} else {
+			b.WriteString(fmt.Sprintf(" <%s>", name))
+		}
+	}
+
+	return b.String()
+}
+
+// parseArgs matches the arguments typed by the user with the arguments of the spec
+func (spec CommandSpec) parseArgs(args []string) ([]string, error) {
+	required := 0
+	for _, arg := range spec.Args {
+		if !arg.Optional {
+			required += 1
+		}
+	}
+
+	rest := len(spec.Args) > 0 && spec.Args[len(spec.Args)-1].Rest
+	if len(args) < required || (!rest && len(args) > len(spec.Args)) {
+		return nil, errors.New(fmt.Sprintf("Usage: %s", spec.Usage()))
+	}
+
+	parsed := make([]string, len(spec.Args))
+	for i := range spec.Args {
+		if i >= len(args) {
+			break
+		}
+
+		if i == len(spec.Args)-1 && rest {
+			parsed[i] = strings.Join(args[i:], " ")
+			break
+		}
+
+		parsed[i] = args[i]
+	}
+
+	return parsed, nil
+}
+
+// RegisterCommand makes the command available to clients.
+// Registering the same name twice panics.
+func (s *Server) RegisterCommand(spec CommandSpec) {
+	s.commandsMu.Lock()
+	defer s.commandsMu.Unlock()
+
+	if _, ok := s.commands[spec.Name]; ok {
+		panic(fmt.Sprintf("Command '%s' already registered", spec.Name))
+	}
+
+	s.commands[spec.Name] = spec
+}
+
+// Commands returns every registered command, sorted by name
+func (s *Server) Commands() []CommandSpec {
+	s.commandsMu.Lock()
+	defer s.commandsMu.Unlock()
+
+	specs := make([]CommandSpec, 0, len(s.commands))
+	for _, spec := range s.commands {
+		specs = append(specs, spec)
+	}
+
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+func (s *Server) command(name string) (CommandSpec, bool) {
+	s.commandsMu.Lock()
+	defer s.commandsMu.Unlock()
+
+	spec, ok := s.commands[name]
+	return spec, ok
+}
+
+// runCommand validates the command and runs its handler. Failures are sent to
+// the client as errors referencing the command.
+func (s *Server) runCommand(session *Session, cmd shared.Command, out chan *shared.Packet) error {
+	spec, ok := s.command(cmd.Name)
+	if !ok {
+		return session.SendCommandError(cmd.Name, fmt.Sprintf("Unknown command '/%s', see /help", cmd.Name))
+	}
+
+	args, err := spec.parseArgs(cmd.Args)
+	if err != nil {
+		return session.SendCommandError(cmd.Name, err.Error())
+	}
+
+	room := cmd.Room
+	if room == "" {
+		room = shared.DEFAULT_ROOM
+	}
+
+	ctx := &CommandContext{
+		Session: session,
+		Server:  s,
+		Spec:    spec,
+		Args:    args,
+		Room:    room,
+		out:     out,
+	}
+
+	err = spec.Handler(ctx)
+	if err != nil {
+		return session.SendCommandError(cmd.Name, err.Error())
+	}
+
+	return nil
+}
+
+// Reply sends text to the client, one reply per line
+func (ctx *CommandContext) Reply(text string) error {
+	for _, line := range strings.Split(text, "\n") {
+		err := ctx.Session.SendMessage(shared.KIND_COMMAND_REPLY, shared.CommandReply{
+			Command: ctx.Spec.Name,
+			Msg:     truncateString(line, math.MaxUint8),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Publish stores a chat message and passes it on, as if it was sent by the client
+func (ctx *CommandContext) Publish(msg shared.Message) error {
+	_, err := ctx.Server.publish(msg, ctx.out)
+	return err
+}
+
+// truncateString cuts s to at most n bytes, without splitting a character
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n -= 1
+	}
+
+	return s[:n]
+}
+
+// defaultCommands are the commands every server starts with
+func defaultCommands() map[string]CommandSpec {
+	specs := []CommandSpec{{
+		Name:    "join",
+		Args:    []CommandArg{{Name: "room"}},
+		Help:    "Join a room, creating it if it does not exist",
+		Handler: joinCommand,
+	}, {
+		Name:    "leave",
+		Args:    []CommandArg{{Name: "room", Optional: true}},
+		Help:    "Leave a room, or the current room",
+		Handler: leaveCommand,
+	}, {
+		Name:    "msg",
+		Args:    []CommandArg{{Name: "user"}, {Name: "text", Rest: true}},
+		Help:    "Send a private message to a user",
+		Handler: msgCommand,
+	}, {
+		Name:    "nick",
+		Args:    []CommandArg{{Name: "username"}},
+		Help:    "Change your username",
+		Handler: nickCommand,
+	}, {
+		Name:    "who",
+		Args:    []CommandArg{{Name: "room", Optional: true}},
+		Help:    "List the users in a room or the current room, or everyone online with /who *",
+		Handler: whoCommand,
+	}, {
+		Name:    "away",
+		Help:    "Mark yourself as away until /back",
+		Handler: awayCommand,
+	}, {
+		Name:    "back",
+		Help:    "Mark yourself as online again",
+		Handler: backCommand,
+	}, {
+		Name:    "me",
+		Args:    []CommandArg{{Name: "action", Rest: true}},
+		Help:    "Describe what you are doing, e.g. /me waves",
+		Handler: meCommand,
+	}, {
+		Name:    "reply",
+		Args:    []CommandArg{{Name: "id"}, {Name: "text", Rest: true}},
+		Help:    "Reply to a message in the current room, starting or adding to its thread",
+		Handler: replyCommand,
+	}, {
+		Name:    "thread",
+		Args:    []CommandArg{{Name: "id"}},
+		Help:    "Show a message in the current room and every reply to it",
+		Handler: threadCommand,
+	}, {
+		Name:    "edit",
+		Args:    []CommandArg{{Name: "id"}, {Name: "text", Rest: true}},
+		Help:    "Replace the text of one of your messages in the current room",
+		Handler: editCommand,
+	}, {
+		Name:    "delete",
+		Args:    []CommandArg{{Name: "id"}},
+		Help:    "Delete one of your messages in the current room",
+		Handler: deleteCommand,
+	}, {
+		Name:    "react",
+		Args:    []CommandArg{{Name: "id"}, {Name: "emoji"}},
+		Help:    "Add or remove your reaction to a message in the current room, e.g. /react 12 :tada:",
+		Handler: reactCommand,
+	}, {
+		Name:    "edits",
+		Args:    []CommandArg{{Name: "id"}},
+		Help:    "Show the edit history of one of your messages in the current room",
+		Handler: editsCommand,
+	}, {
+		Name:    "kick",
+		Args:    []CommandArg{{Name: "user"}, {Name: "reason", Optional: true, Rest: true}},
+		Help:    "Remove a user from the current room",
+		Handler: kickCommand,
+	}, {
+		Name:    "ban",
+		Args:    []CommandArg{{Name: "user"}, {Name: "duration", Optional: true}, {Name: "reason", Optional: true, Rest: true}},
+		Help:    "Ban a user from the current room, for a duration like 30m or 7d, or until unbanned",
+		Handler: banCommand,
+	}, {
+		Name:    "unban",
+		Args:    []CommandArg{{Name: "user"}},
+		Help:    "Lift the ban of a user from the current room",
+		Handler: unbanCommand,
+	}, {
+		Name:    "mute",
+		Args:    []CommandArg{{Name: "user"}, {Name: "duration", Optional: true}, {Name: "reason", Optional: true, Rest: true}},
+		Help:    "Stop a user from talking in the current room, for a duration like 30m or 7d, or until unmuted",
+		Handler: muteCommand,
+	}, {
+		Name:    "unmute",
+		Args:    []CommandArg{{Name: "user"}},
+		Help:    "Let a muted user talk in the current room again",
+		Handler: unmuteCommand,
+	}, {
+		Name:    "role",
+		Args:    []CommandArg{{Name: "user"}, {Name: "role"}},
+		Help:    "Make a user a member, moderator or owner of the current room",
+		Handler: roleCommand,
+	}, {
+		Name:    "roles",
+		Args:    []CommandArg{{Name: "room", Optional: true}},
+		Help:    "List the owners and moderators of a room or the current room, or of the server with /roles *",
+		Handler: rolesCommand,
+	}, {
+		Name:    "serverkick",
+		Args:    []CommandArg{{Name: "user"}, {Name: "reason", Optional: true, Rest: true}},
+		Help:    "Disconnect a user from the server",
+		Handler: serverKickCommand,
+	}, {
+		Name:    "serverban",
+		Args:    []CommandArg{{Name: "target"}, {Name: "duration", Optional: true}, {Name: "reason", Optional: true, Rest: true}},
+		Help:    "Ban a user or an IP address from the server, for a duration like 30m or 7d, or until unbanned",
+		Handler: serverBanCommand,
+	}, {
+		Name:    "serverunban",
+		Args:    []CommandArg{{Name: "target"}},
+		Help:    "Lift the ban of a user or an IP address from the server",
+		Handler: serverUnbanCommand,
+	}, {
+		Name:    "servermute",
+		Args:    []CommandArg{{Name: "user"}, {Name: "duration", Optional: true}, {Name: "reason", Optional: true, Rest: true}},
+		Help:    "Stop a user from talking in every room, for a duration like 30m or 7d, or until unmuted",
+		Handler: serverMuteCommand,
+	}, {
+		Name:    "serverunmute",
+		Args:    []CommandArg{{Name: "user"}},
+		Help:    "Let a user muted in every room talk again",
+		Handler: serverUnmuteCommand,
+	}, {
+		Name:    "serverrole",
+		Args:    []CommandArg{{Name: "user"}, {Name: "role"}},
+		Help:    "Make a user a member, moderator or owner of the whole server",
+		Handler: serverRoleCommand,
+	}, {
+		Name:    "audit",
+		Args:    []CommandArg{{Name: "count", Optional: true}},
+		Help:    "Show the latest moderation actions in the current room, or on the whole server for server moderators",
+		Handler: auditCommand,
+	}, {
+		Name:    "motd",
+		Help:    "Show the message of the day",
+		Handler: motdCommand,
+	}, {
+		Name:    "help",
+		Args:    []CommandArg{{Name: "command", Optional: true}},
+		Help:    "List the commands, or show the help of a single command",
+		Handler: helpCommand,
+	}, {
+		Name:    "quit",
+		Help:    "Disconnect from the server",
+		Handler: quitCommand,
+	}}
+
+	commands := make(map[string]CommandSpec, len(specs))
+	for _, spec := range specs {
+		commands[spec.Name] = spec
+	}
+
+	return commands
+}
+
+func joinCommand(ctx *CommandContext) error {
+	return ctx.Server.Join(ctx.Session, ctx.Args[0])
+}
+
+func leaveCommand(ctx *CommandContext) error {
+	room := ctx.Args[0]
+	if room == "" {
+		room = ctx.Room
+	}
+
+	return ctx.Server.Leave(ctx.Session, room)
+}
+
+func msgCommand(ctx *CommandContext) error {
+	to := ctx.Server.SessionByUsername(ctx.Args[0])
+	if to == nil {
+		return errors.New(fmt.Sprintf("No user named '%s' is online", ctx.Args[0]))
+	}
+
+	pm := shared.PrivateMessage{
+		From: ctx.Session.Username(),
+		To:   to.Username(),
+		Msg:  ctx.Args[1],
+	}
+
+	err := to.SendMessage(shared.KIND_PRIVATE_MESSAGE, pm)
+	if err != nil {
+		return err
+	}
+
+	if to != ctx.Session {
+		return ctx.Session.SendMessage(shared.KIND_PRIVATE_MESSAGE, pm)
+	}
+	return nil
+}
+
+func nickCommand(ctx *CommandContext) error {
+	old := ctx.Session.Username()
+	err := ctx.Server.Rename(ctx.Session, ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("%s is now known as %s", old, ctx.Session.Username()))
+}
+
+func whoCommand(ctx *CommandContext) error {
+	now := time.Now()
+
+	room := ctx.Args[0]
+	if room == "*" {
+		online := ctx.Server.Online()
+		names := make([]string, 0, len(online))
+		for _, presence := range online {
+			names = append(names, describePresence(presence, now))
+		}
+
+		return ctx.Reply(fmt.Sprintf("%d online: %s", len(names), strings.Join(names, ", ")))
+	}
+
+	if room == "" {
+		room = ctx.Room
+	}
+
+	members, err := ctx.Server.RoomPresence(room)
+	if err != nil {
+		return err
+	}
+
+	if len(members) == 0 {
+		return errors.New(fmt.Sprintf("No users in '%s'", room))
+	}
+
+	names := make([]string, 0, len(members))
+	for _, presence := range members {
+		names = append(names, describePresence(presence, now))
+	}
+
+	return ctx.Reply(fmt.Sprintf("Users in %s: %s", room, strings.Join(names, ", ")))
+}
+
+func awayCommand(ctx *CommandContext) error {
+	err := ctx.Server.SetPresence(ctx.Session, shared.PRESENCE_AWAY, true)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply("You are now away")
+}
+
+func backCommand(ctx *CommandContext) error {
+	err := ctx.Server.SetPresence(ctx.Session, shared.PRESENCE_ONLINE, true)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply("You are online again")
+}
+
+func meCommand(ctx *CommandContext) error {
+	if !ctx.Session.InRoom(ctx.Room) {
+		return errors.New(fmt.Sprintf("Not in room '%s'", ctx.Room))
+	}
+
+	err := ctx.Server.checkMuted(ctx.Session, ctx.Room)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Publish(shared.Message{
+		Username: ctx.Session.Username(),
+		Msg:      ctx.Args[0],
+		Room:     ctx.Room,
+		Action:   true,
+	})
+}
+
+// parseMessageId parses the ID of a message given as a command argument, with or without a leading #
+func parseMessageId(arg string) (uint64, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid message ID '%s'", arg))
+	}
+
+	return id, nil
+}
+
+func replyCommand(ctx *CommandContext) error {
+	id, err := parseMessageId(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Server.handleMessage(ctx.Session, shared.Message{
+		Msg:    ctx.Args[1],
+		Room:   ctx.Room,
+		Parent: id,
+	}, ctx.out)
+}
+
+func threadCommand(ctx *CommandContext) error {
+	id, err := parseMessageId(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Server.SendThread(ctx.Session, ctx.Room, id)
+}
+
+func editCommand(ctx *CommandContext) error {
+	id, err := parseMessageId(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Server.EditMessage(ctx.Session, ctx.Room, id, ctx.Args[1])
+}
+
+func deleteCommand(ctx *CommandContext) error {
+	id, err := parseMessageId(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Server.DeleteMessage(ctx.Session, ctx.Room, id)
+}
+
+func reactCommand(ctx *CommandContext) error {
+	id, err := parseMessageId(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Server.React(ctx.Session, ctx.Room, id, ctx.Args[1])
+}
+
+func editsCommand(ctx *CommandContext) error {
+	id, err := parseMessageId(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	msg, err := ctx.Server.authorize(ctx.Session, ctx.Room, id)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := ctx.Server.Store.Revisions(ctx.Room, id)
+	if err != nil {
+		return err
+	}
+
+	if len(revisions) == 0 {
+		return ctx.Reply(fmt.Sprintf("Message %d was never edited", id))
+	}
+
+	lines := []string{fmt.Sprintf("Versions of message %d by %s, oldest first:", id, msg.Username)}
+	for _, revision := range append(revisions, msg) {
+		when := time.UnixMilli(revision.Time)
+		if revision.Edited != 0 {
+			when = time.UnixMilli(revision.Edited)
+		}
+
+		text := revision.Msg
+		if revision.Deleted {
+			text = "(deleted)"
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s", when.Format("2006-01-02 15:04"), text))
+	}
+
+	return ctx.Reply(strings.Join(lines, "\n"))
+}
+
+// sanctionArgs splits the optional duration and reason of /ban and /mute. A duration
+// that does not parse is the first word of the reason.
+func sanctionArgs(ctx *CommandContext) (time.Duration, string) {
+	duration, ok := parseDuration(ctx.Args[1])
+	if ok {
+		return duration, ctx.Args[2]
+	}
+
+	return 0, strings.TrimSpace(ctx.Args[1] + " " + ctx.Args[2])
+}
+
+// announce tells the room about a moderation action, as an action of the moderator
+func (ctx *CommandContext) announce(room string, text string, reason string) error {
+	if reason != "" {
+		text += fmt.Sprintf(" (%s)", reason)
+	}
+
+	return ctx.Publish(shared.Message{
+		Username: ctx.Session.Username(),
+		Msg:      text,
+		Room:     room,
+		Action:   true,
+	})
+}
+
+// forDuration describes how long a ban or mute lasts, e.g. " for 2h0m0s"
+func forDuration(duration time.Duration) string {
+	if duration == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" for %s", duration)
+}
+
+func kickCommand(ctx *CommandContext) error {
+	user, reason := ctx.Args[0], ctx.Args[1]
+	err := ctx.Server.Kick(ctx.Session, ctx.Room, user, reason)
+	if err != nil {
+		return err
+	}
+
+	return ctx.announce(ctx.Room, fmt.Sprintf("kicked %s", user), reason)
+}
+
+func banCommand(ctx *CommandContext) error {
+	user := ctx.Args[0]
+	duration, reason := sanctionArgs(ctx)
+	err := ctx.Server.Ban(ctx.Session, ctx.Room, user, duration, reason)
+	if err != nil {
+		return err
+	}
+
+	return ctx.announce(ctx.Room, fmt.Sprintf("banned %s%s", user, forDuration(duration)), reason)
+}
+
+func unbanCommand(ctx *CommandContext) error {
+	err := ctx.Server.Unban(ctx.Session, ctx.Room, ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("%s can join %s again", ctx.Args[0], ctx.Room))
+}
+
+func muteCommand(ctx *CommandContext) error {
+	user := ctx.Args[0]
+	duration, reason := sanctionArgs(ctx)
+	err := ctx.Server.Mute(ctx.Session, ctx.Room, user, duration, reason)
+	if err != nil {
+		return err
+	}
+
+	return ctx.announce(ctx.Room, fmt.Sprintf("muted %s%s", user, forDuration(duration)), reason)
+}
+
+func unmuteCommand(ctx *CommandContext) error {
+	err := ctx.Server.Unmute(ctx.Session, ctx.Room, ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.announce(ctx.Room, fmt.Sprintf("unmuted %s", ctx.Args[0]), "")
+}
+
+func roleCommand(ctx *CommandContext) error {
+	role, err := ParseRole(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Server.SetRole(ctx.Session, ctx.Room, ctx.Args[0], role)
+	if err != nil {
+		return err
+	}
+
+	return ctx.announce(ctx.Room, fmt.Sprintf("made %s a %s of %s", ctx.Args[0], role, ctx.Room), "")
+}
+
+func rolesCommand(ctx *CommandContext) error {
+	room := ctx.Args[0]
+	if room == "" {
+		room = ctx.Room
+	}
+
+	where := room
+	byRole := map[Role][]string{
+		ROLE_OWNER:     {},
+		ROLE_MODERATOR: {},
+	}
+
+	if room == "*" {
+		room, where = "", "the server"
+		for _, user := range ctx.Server.live().owners {
+			byRole[ROLE_OWNER] = append(byRole[ROLE_OWNER], user)
+		}
+		for _, user := range ctx.Server.live().moderators {
+			byRole[ROLE_MODERATOR] = append(byRole[ROLE_MODERATOR], user)
+		}
+	}
+
+	roles, err := ctx.Server.Storage.Roles(room)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		if _, ok := byRole[role.Role]; ok && !slices.Contains(byRole[role.Role], role.Username) {
+			byRole[role.Role] = append(byRole[role.Role], role.Username)
+		}
+	}
+
+	lines := []string{fmt.Sprintf("Roles in %s:", where)}
+	for _, role := range []Role{ROLE_OWNER, ROLE_MODERATOR} {
+		users := byRole[role]
+		sort.Strings(users)
+		if len(users) == 0 {
+			users = []string{"none"}
+		}
+		lines = append(lines, fmt.Sprintf("  %ss: %s", role, strings.Join(users, ", ")))
+	}
+
+	return ctx.Reply(strings.Join(lines, "\n"))
+}
+
+func serverKickCommand(ctx *CommandContext) error {
+	err := ctx.Server.KickFromServer(ctx.Session, ctx.Args[0], ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("Disconnected %s", ctx.Args[0]))
+}
+
+func serverBanCommand(ctx *CommandContext) error {
+	duration, reason := sanctionArgs(ctx)
+	err := ctx.Server.Ban(ctx.Session, "", ctx.Args[0], duration, reason)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("Banned %s from the server%s", ctx.Args[0], forDuration(duration)))
+}
+
+func serverUnbanCommand(ctx *CommandContext) error {
+	err := ctx.Server.Unban(ctx.Session, "", ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("Lifted the ban of %s from the server", ctx.Args[0]))
+}
+
+func serverMuteCommand(ctx *CommandContext) error {
+	duration, reason := sanctionArgs(ctx)
+	err := ctx.Server.Mute(ctx.Session, "", ctx.Args[0], duration, reason)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("Muted %s in every room%s", ctx.Args[0], forDuration(duration)))
+}
+
+func serverUnmuteCommand(ctx *CommandContext) error {
+	err := ctx.Server.Unmute(ctx.Session, "", ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("Unmuted %s in every room", ctx.Args[0]))
+}
+
+func serverRoleCommand(ctx *CommandContext) error {
+	role, err := ParseRole(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Server.SetRole(ctx.Session, "", ctx.Args[0], role)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Reply(fmt.Sprintf("%s is now a %s of the server", ctx.Args[0], role))
+}
+
+func auditCommand(ctx *CommandContext) error {
+	count := 20
+	if ctx.Args[0] != "" {
+		n, err := strconv.Atoi(ctx.Args[0])
+		if err != nil || n <= 0 {
+			return errors.New(fmt.Sprintf("Invalid count '%s'", ctx.Args[0]))
+		}
+		count = n
+	}
+
+	// Server moderators see every action, room moderators the actions in their room
+	username := ctx.Session.Username()
+	room := ""
+	if ctx.Server.ServerRole(username) < ROLE_MODERATOR {
+		if !ctx.Server.IsModerator(username, ctx.Room) {
+			return errors.Join(NotAllowed, errors.New("Only moderators can see the audit log"))
+		}
+		room = ctx.Room
+	}
+
+	records, err := ctx.Server.Storage.Audit(room, count)
+	if err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		return ctx.Reply("No moderation actions yet")
+	}
+
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		line := fmt.Sprintf("%s %s %s %s", record.Time.Format("2006-01-02 15:04"), record.By, record.Action, record.Target)
+		if record.Room != "" {
+			line += " in " + record.Room
+		}
+		if !record.Expires.IsZero() {
+			line += " until " + record.Expires.Format("2006-01-02 15:04")
+		}
+		if record.Reason != "" {
+			line += ": " + record.Reason
+		}
+		lines = append(lines, line)
+	}
+
+	return ctx.Reply(strings.Join(lines, "\n"))
+}
+
+func helpCommand(ctx *CommandContext) error {
+	if name := strings.TrimPrefix(ctx.Args[0], "/"); name != "" {
+		spec, ok := ctx.Server.command(name)
+		if !ok {
+			return errors.Join(UnknownCommand, errors.New(fmt.Sprintf("No command named '/%s'", name)))
+		}
+
+		return ctx.Reply(fmt.Sprintf("%s - %s", spec.Usage(), spec.Help))
+	}
+
+	lines := []string{"Commands:"}
+	for _, spec := range ctx.Server.Commands() {
+		lines = append(lines, fmt.Sprintf("  %s - %s", spec.Usage(), spec.Help))
+	}
+	lines = append(lines, "Start a message with // to send a message starting with /")
+
+	return ctx.Reply(strings.Join(lines, "\n"))
+}
+
+func motdCommand(ctx *CommandContext) error {
+	if ctx.Server.live().motd == "" {
+		return ctx.Reply("There is no message of the day")
+	}
+
+	return ctx.Server.sendMOTD(ctx.Session)
+}
+
+func quitCommand(ctx *CommandContext) error {
+	ctx.Reply("Bye!")
+	return ctx.Session.Close()
+}
@@ -0,0 +1,348 @@
+package tcp_server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+var InvalidConfig = errors.New("Invalid configuration.")
+
+// Duration is a time.Duration written like "90s" or "5m" in a config file
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid duration '%s'", value))
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// Config is the configuration of a server. In a config file it is a JSON object,
+// using the names of the flags of the server as keys.
+type Config struct {
+	// Addresses to listen on, see shared.SplitAddress, with shared.WEBSOCKET_PREFIX for WebSocket connections
+	Listen []string `json:"listen"`
+	// Host or host:port printed for clients to connect to, instead of the addresses of the machine
+	Advertise string `json:"advertise"`
+	// Name of the server in discovery replies, the host name of the machine when empty
+	Name string `json:"name"`
+	// UDP port discovery probes are answered on, 0 disables discovery
+	DiscoveryPort int `json:"discovery-port"`
+	// Certificate and key in PEM files, the server only accepts TLS connections when set
+	TLSCert string `json:"tls-cert"`
+	TLSKey  string `json:"tls-key"`
+	// Origins of web pages allowed to open WebSocket connections, besides the server itself
+	AllowedOrigins []string `json:"allowed-origins"`
+
+	// Directory keeping users, rooms, memberships and history
+	Data string `json:"data"`
+	// File keeping the history, instead of memory or Data
+	HistoryFile string `json:"history-file"`
+	// Messages per room kept in memory, without HistoryFile or Data
+	HistorySize   int `json:"history-size"`
+	HistoryOnJoin int `json:"history-on-join"`
+
+	// File printed messages are appended to, instead of stdout
+	Log string `json:"log"`
+	// File every packet of every session is recorded to
+	Record string `json:"record"`
+
+	PingInterval   Duration `json:"ping-interval"`
+	MaxMissedPongs int      `json:"max-missed-pongs"`
+	AwayAfter      Duration `json:"away-after"`
+	MaxFileSize    int64    `json:"max-file-size"`
+
+	Owners     []string `json:"owners"`
+	Moderators []string `json:"moderators"`
+	// Rooms created when the server starts, so they are not owned by whoever joins them first
+	Rooms []string `json:"rooms"`
+	// Message of the day, sent to users when they log in
+	MOTD string `json:"motd"`
+
+	SessionMessages Limit    `json:"session-messages"`
+	SessionBytes    Limit    `json:"session-bytes"`
+	IPMessages      Limit    `json:"ip-messages"`
+	IPBytes         Limit    `json:"ip-bytes"`
+	IPConnections   Limit    `json:"ip-connections"`
+	MaxConnsPerIP   int      `json:"max-conns-per-ip"`
+	FloodPenalty    Penalty  `json:"flood-penalty"`
+	FloodMute       Duration `json:"flood-mute"`
+}
+
+func DefaultConfig() Config {
+	limits := DefaultRateLimits()
+
+	return Config{
+		DiscoveryPort:   shared.DISCOVERY_PORT,
+		HistorySize:     DEFAULT_HISTORY_SIZE,
+		HistoryOnJoin:   DEFAULT_HISTORY_ON_JOIN,
+		PingInterval:    Duration(shared.DEFAULT_PING_INTERVAL),
+		MaxMissedPongs:  shared.DEFAULT_MAX_MISSED_PONGS,
+		AwayAfter:       Duration(DEFAULT_AWAY_AFTER),
+		MaxFileSize:     shared.DEFAULT_MAX_FILE_SIZE,
+		SessionMessages: limits.SessionMessages,
+		SessionBytes:    limits.SessionBytes,
+		IPMessages:      limits.IPMessages,
+		IPBytes:         limits.IPBytes,
+		IPConnections:   limits.IPConnections,
+		MaxConnsPerIP:   limits.MaxConnsPerIP,
+		FloodPenalty:    limits.Penalty,
+		FloodMute:       Duration(limits.MuteFor),
+	}
+}
+
+// LoadConfig reads the config file at path over config, keeping the values the file leaves out
+func LoadConfig(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(config)
+	if err != nil {
+		return errors.Join(InvalidConfig, errors.New(fmt.Sprintf("%s: %s", path, err)))
+	}
+
+	return nil
+}
+
+// TLSConfig loads the certificate and key, and returns nil when TLS is not configured
+func (c Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+func (c Config) RateLimits() RateLimits {
+	return RateLimits{
+		SessionMessages: c.SessionMessages,
+		SessionBytes:    c.SessionBytes,
+		IPMessages:      c.IPMessages,
+		IPBytes:         c.IPBytes,
+		IPConnections:   c.IPConnections,
+		MaxConnsPerIP:   c.MaxConnsPerIP,
+		Penalty:         c.FloodPenalty,
+		MuteFor:         time.Duration(c.FloodMute),
+	}
+}
+
+// Validate returns every problem with the configuration, joined with InvalidConfig
+func (c Config) Validate() error {
+	problems := make([]error, 0)
+	problem := func(format string, args ...any) {
+		problems = append(problems, errors.New(fmt.Sprintf(format, args...)))
+	}
+
+	if len(c.Listen) == 0 {
+		problem("No address to listen on, set listen or give a port")
+	}
+	for _, address := range c.Listen {
+		network, addr := shared.SplitAddress(strings.TrimPrefix(address, shared.WEBSOCKET_PREFIX))
+		if network == "unix" {
+			if addr == "" {
+				problem("No path for the unix socket '%s'", address)
+			}
+		} else if _, port, err := net.SplitHostPort(addr); err != nil {
+			problem("Invalid listen address '%s'", address)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			problem("Invalid port '%s'", port)
+		}
+	}
+
+	if _, port, err := net.SplitHostPort(c.Advertise); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			problem("Invalid advertised port '%s'", port)
+		}
+	}
+
+	if c.DiscoveryPort < 0 || c.DiscoveryPort > 65535 {
+		problem("Invalid discovery-port %d", c.DiscoveryPort)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problem("Both tls-cert and tls-key are needed for TLS")
+	} else if _, err := c.TLSConfig(); err != nil {
+		problem("Cannot load TLS certificate: %s", err)
+	}
+
+	if c.HistorySize <= 0 {
+		problem("history-size must be at least 1")
+	}
+	if c.HistoryOnJoin < 0 {
+		problem("history-on-join cannot be negative")
+	}
+	if c.PingInterval < 0 || c.AwayAfter < 0 || c.FloodMute < 0 {
+		problem("Durations cannot be negative")
+	}
+	if c.PingInterval > 0 && c.MaxMissedPongs < 1 {
+		problem("max-missed-pongs must be at least 1 when pinging")
+	}
+	if c.MaxFileSize < 0 {
+		problem("max-file-size cannot be negative")
+	}
+	if c.MaxConnsPerIP < 0 {
+		problem("max-conns-per-ip cannot be negative")
+	}
+	// A bucket holding less than a packet never lets one through
+	bytes := []Limit{c.SessionBytes, c.IPBytes}
+	for i, name := range []string{"session-bytes", "ip-bytes"} {
+		if bytes[i].Enabled() && bytes[i].Burst < float64(shared.MAX_DATA_LEN+3) {
+			problem("The burst of %s must be at least %d bytes, the largest packet", name, shared.MAX_DATA_LEN+3)
+		}
+	}
+
+	penalty := c.FloodPenalty
+	if err := penalty.Set(string(c.FloodPenalty)); err != nil {
+		problem("%s", err)
+	}
+
+	for _, username := range append(append([]string{}, c.Owners...), c.Moderators...) {
+		if err := validateUsername(username); err != nil {
+			problem("Invalid username '%s': %s", username, reason(err))
+		}
+	}
+
+	for _, room := range c.Rooms {
+		if err := validateRoom(room); err != nil {
+			problem("Invalid room '%s': %s", room, reason(err))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return errors.Join(InvalidConfig, errors.Join(problems...))
+}
+
+// reason returns the last line of an error joined with the error it is a kind of
+func reason(err error) string {
+	text := err.Error()
+	return text[strings.LastIndex(text, "\n")+1:]
+}
+
+// liveSettings are the parts of the configuration that can change while the server runs
+type liveSettings struct {
+	owners        []string
+	moderators    []string
+	motd          string
+	historyOnJoin int
+	maxFileSize   int64
+	limits        RateLimits
+}
+
+// live returns the settings that Reload can change
+func (s *Server) live() liveSettings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+
+	return liveSettings{
+		owners:        s.Owners,
+		moderators:    s.Moderators,
+		motd:          s.MOTD,
+		historyOnJoin: s.HistoryOnJoin,
+		maxFileSize:   s.MaxFileSize,
+		limits:        s.Limits,
+	}
+}
+
+// Reload applies the settings of the configuration that can change while the server runs:
+// the owners and moderators, the MOTD, the history sent on join, the largest file and the
+// rate limits, and creates the rooms that do not exist yet. New rates only count for
+// sessions connecting after the reload.
+func (s *Server) Reload(config Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	s.settingsMu.Lock()
+	s.Owners = config.Owners
+	s.Moderators = config.Moderators
+	s.MOTD = config.MOTD
+	s.HistoryOnJoin = config.HistoryOnJoin
+	s.MaxFileSize = config.MaxFileSize
+	s.Limits = config.RateLimits()
+	s.settingsMu.Unlock()
+
+	for _, room := range config.Rooms {
+		err = s.CreateRoom(room)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateRoom stores the room if it does not exist yet, without an owner
+func (s *Server) CreateRoom(room string) error {
+	err := validateRoom(room)
+	if err != nil {
+		return err
+	}
+
+	_, ok, err := s.Storage.Room(room)
+	if err != nil || ok {
+		return err
+	}
+
+	fmt.Printf("Created room %s\n", room)
+	return s.Storage.SaveRoom(RoomRecord{Name: room, Created: time.Now()})
+}
+
+// sendMOTD sends the message of the day to the session, a line at a time
+func (s *Server) sendMOTD(session *Session) error {
+	motd := s.live().motd
+	if motd == "" {
+		return nil
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(motd, "\n"), "\n") {
+		err := session.SendMessage(shared.KIND_COMMAND_REPLY, shared.CommandReply{
+			Command: "motd",
+			Msg:     truncateString(line, math.MaxUint8),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
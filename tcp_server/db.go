@@ -0,0 +1,410 @@
+package tcp_server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	DB_WAL_FILE      = "wal"
+	DB_SNAPSHOT_FILE = "snapshot"
+	// The write-ahead log is compacted into a new snapshot once it grows past this size
+	DEFAULT_DB_COMPACT_SIZE = 4 << 20
+	// Largest payload of a record, longer lengths read from disk are corrupt
+	DB_MAX_RECORD_SIZE = 16 << 20
+)
+
+const (
+	DB_OP_PUT byte = iota + 1
+	DB_OP_DELETE
+)
+
+var (
+	DBClosed      = errors.New("Database is closed.")
+	CorruptRecord = errors.New("Corrupt database record.")
+)
+
+// DB is a small embedded key-value database, holding every table in memory.
+// Every change is appended to a write-ahead log and synced to disk before it is
+// applied. Once the log grows past CompactSize, the tables are written to a new
+// snapshot and the log starts over.
+//
+// A record only partially written at the end of the log, when the process stopped,
+// is dropped when the database is opened again. Any other invalid record fails
+// opening the database, instead of losing the records after it.
+type DB struct {
+	// The log is compacted once it grows past this many bytes, 0 disables compaction
+	CompactSize int64
+	mu          sync.Mutex
+	// Empty for a database only held in memory
+	dir     string
+	wal     *os.File
+	walSize int64
+	tables  map[string]map[string][]byte
+	closed  bool
+}
+
+// OpenDB opens the database in dir, creating dir if it does not exist.
+// An empty dir gives a database only held in memory.
+func OpenDB(dir string) (*DB, error) {
+	db := &DB{
+		CompactSize: DEFAULT_DB_COMPACT_SIZE,
+		dir:         dir,
+		tables:      make(map[string]map[string][]byte),
+	}
+
+	if dir == "" {
+		return db, nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadSnapshot()
+	if err != nil {
+		return nil, errors.Join(errors.New(fmt.Sprintf("Could not load snapshot of '%s'", dir)), err)
+	}
+
+	err = db.replayWAL()
+	if err != nil {
+		return nil, errors.Join(errors.New(fmt.Sprintf("Could not replay log of '%s'", dir)), err)
+	}
+
+	return db, nil
+}
+
+func (db *DB) loadSnapshot() error {
+	file, err := os.Open(filepath.Join(db.dir, DB_SNAPSHOT_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Snapshots are renamed into place once complete, so any error is corruption
+	_, err = db.readRecords(file)
+	return err
+}
+
+func (db *DB) replayWAL() error {
+	wal, err := os.OpenFile(filepath.Join(db.dir, DB_WAL_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	size, err := db.readRecords(wal)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		wal.Close()
+		return errors.Join(errors.New(fmt.Sprintf("Invalid record at offset %d", size)), err)
+	}
+
+	// Drop the partially written record at the end, if any
+	err = wal.Truncate(size)
+	if err == nil {
+		_, err = wal.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		wal.Close()
+		return err
+	}
+
+	db.wal = wal
+	db.walSize = size
+	return nil
+}
+
+// readRecords applies every record read from r, and returns the size of the
+// records read without errors.
+func (db *DB) readRecords(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+
+	var size int64
+	for {
+		n, err := db.readRecord(reader)
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+
+		size += int64(n)
+	}
+}
+
+// A record is the CRC-32 and length of its payload, followed by the payload:
+// the op, the table and key prefixed with their length, and the value.
+func encodeRecord(op byte, table string, key string, value []byte) []byte {
+	payload := make([]byte, 0, 4+len(table)+len(key)+len(value))
+	payload = append(payload, op, byte(len(table)))
+	payload = append(payload, table...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(key)))
+	payload = append(payload, key...)
+	payload = append(payload, value...)
+
+	record := make([]byte, 0, 8+len(payload))
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(payload)))
+	return append(record, payload...)
+}
+
+func (db *DB) readRecord(reader *bufio.Reader) (int, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := binary.BigEndian.Uint32(header[:4])
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > DB_MAX_RECORD_SIZE {
+		return 0, errors.Join(CorruptRecord, errors.New(fmt.Sprintf("Record of %d bytes", length)))
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != sum || len(payload) < 4 {
+		return 0, CorruptRecord
+	}
+
+	op := payload[0]
+	tableLen := int(payload[1])
+	if len(payload) < 4+tableLen {
+		return 0, CorruptRecord
+	}
+	table := string(payload[2 : 2+tableLen])
+
+	keyLen := int(binary.BigEndian.Uint16(payload[2+tableLen:]))
+	rest := payload[4+tableLen:]
+	if len(rest) < keyLen {
+		return 0, CorruptRecord
+	}
+	key := string(rest[:keyLen])
+	value := rest[keyLen:]
+
+	switch op {
+	case DB_OP_PUT:
+		db.apply(table, key, value)
+	case DB_OP_DELETE:
+		db.apply(table, key, nil)
+	default:
+		return 0, CorruptRecord
+	}
+
+	return len(header) + len(payload), nil
+}
+
+// apply changes the tables in memory, a nil value deletes the key
+func (db *DB) apply(table string, key string, value []byte) {
+	if value == nil {
+		delete(db.tables[table], key)
+		return
+	}
+
+	t, ok := db.tables[table]
+	if !ok {
+		t = make(map[string][]byte)
+		db.tables[table] = t
+	}
+	t[key] = value
+}
+
+// write logs the change and applies it, db.mu must be held
+func (db *DB) write(op byte, table string, key string, value []byte) error {
+	if db.closed {
+		return DBClosed
+	}
+
+	if len(table) > 255 || len(key) > 65535 {
+		return errors.New(fmt.Sprintf("Table or key too long: '%s' '%s'", table, key))
+	}
+
+	if 4+len(table)+len(key)+len(value) > DB_MAX_RECORD_SIZE {
+		return errors.New(fmt.Sprintf("Value of '%s' in '%s' too large, %d bytes", key, table, len(value)))
+	}
+
+	if db.wal != nil {
+		record := encodeRecord(op, table, key, value)
+		_, err := db.wal.Write(record)
+		if err == nil {
+			err = db.wal.Sync()
+		}
+		if err != nil {
+			// Remove what was written of the record, so the records after it can be replayed
+			truncErr := db.wal.Truncate(db.walSize)
+			if truncErr == nil {
+				_, truncErr = db.wal.Seek(db.walSize, io.SeekStart)
+			}
+			return errors.Join(err, truncErr)
+		}
+		db.walSize += int64(len(record))
+	}
+
+	if op == DB_OP_DELETE {
+		value = nil
+	}
+	db.apply(table, key, value)
+
+	if db.wal != nil && db.CompactSize > 0 && db.walSize > db.CompactSize {
+		// The change is already in the log, a failed compaction is retried on the next write
+		err := db.compactLocked()
+		if err != nil {
+			fmt.Printf("ERROR: Could not compact database '%s': %s\n", db.dir, err)
+		}
+	}
+
+	return nil
+}
+
+// Put sets the value of key in table
+func (db *DB) Put(table string, key string, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.write(DB_OP_PUT, table, key, append([]byte{}, value...))
+}
+
+// Delete removes key from table
+func (db *DB) Delete(table string, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.tables[table][key]; !ok {
+		return nil
+	}
+
+	return db.write(DB_OP_DELETE, table, key, nil)
+}
+
+// Get returns the value of key in table
+func (db *DB) Get(table string, key string) ([]byte, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	value, ok := db.tables[table][key]
+	return value, ok
+}
+
+// Keys returns every key of table, sorted
+func (db *DB) Keys(table string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	keys := make([]string, 0, len(db.tables[table]))
+	for key := range db.tables[table] {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Compact writes every table to a new snapshot, and empties the log
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return DBClosed
+	}
+
+	if db.wal == nil {
+		return nil
+	}
+
+	return db.compactLocked()
+}
+
+func (db *DB) compactLocked() error {
+	path := filepath.Join(db.dir, DB_SNAPSHOT_FILE)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for table, t := range db.tables {
+		for key, value := range t {
+			_, err = writer.Write(encodeRecord(DB_OP_PUT, table, key, value))
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	// The log is only emptied once the snapshot is in place. Stopping in between
+	// replays the log on top of the new snapshot, which gives the same tables.
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	syncDir(db.dir)
+
+	err = db.wal.Truncate(0)
+	if err == nil {
+		_, err = db.wal.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	db.walSize = 0
+	return db.wal.Sync()
+}
+
+// syncDir makes a rename in dir durable, where the platform supports it
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Close compacts the log and closes the database
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	if db.wal == nil {
+		return nil
+	}
+
+	err := db.compactLocked()
+	return errors.Join(err, db.wal.Close())
+}
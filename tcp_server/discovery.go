@@ -0,0 +1,134 @@
+package tcp_server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// hostname returns the name of the machine, the default name of a server
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "tcp-chat"
+	}
+
+	return name
+}
+
+// startDiscovery answers the discovery probes of clients on the local network, sent
+// to the port by broadcast or to shared.DISCOVERY_GROUP. Failing to listen is printed
+// and otherwise ignored, clients can still connect by address.
+func (s *Server) startDiscovery(port int, listenPort int) {
+	group := &net.UDPAddr{IP: net.ParseIP(shared.DISCOVERY_GROUP), Port: port}
+
+	// Listening on the group also receives broadcasts to the port
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		fmt.Printf("Could not join discovery group %s: %s\n", group, err)
+
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+		if err != nil {
+			fmt.Printf("ERROR: discovery disabled: %s\n", err)
+			return
+		}
+	}
+
+	fmt.Printf("Answering discovery probes on UDP port %d\n", port)
+	go s.answerProbes(conn, listenPort)
+}
+
+func (s *Server) answerProbes(conn *net.UDPConn, listenPort int) {
+	defer conn.Close()
+
+	buf := make([]byte, shared.MAX_DATA_LEN+3)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("ERROR: discovery stopped: %s\n", err)
+			return
+		}
+
+		// The reply is larger than the probe, so answering a forged source anywhere on
+		// the internet would send it traffic it never asked for
+		if !localSource(addr.IP) {
+			continue
+		}
+
+		p, err := shared.ParseDatagram(buf[:n])
+		if err != nil || p.Kind() != shared.KIND_DISCOVERY_PROBE {
+			continue
+		}
+
+		var probe shared.DiscoveryProbe
+		err = p.IntoMessage(&probe)
+		if err != nil {
+			continue
+		}
+
+		reply, err := shared.PacketFromMessage(shared.KIND_DISCOVERY_REPLY, s.describe(probe.Nonce, listenPort))
+		if err != nil {
+			fmt.Printf("ERROR: discovery reply: %s\n", err)
+			continue
+		}
+
+		conn.WriteToUDP(reply.Encode(), addr)
+	}
+}
+
+// localSource reports whether a probe from ip can come from the local network: a loopback,
+// link-local or private address, or one in the network of an interface of the machine
+func localSource(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsPrivate() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// describe returns the DiscoveryReply of the server, with the advertised address if it is pinned
+func (s *Server) describe(nonce uint64, listenPort int) shared.DiscoveryReply {
+	host, port := "", listenPort
+	if s.Advertise != "" {
+		host = s.Advertise
+		if pinnedHost, pinnedPort, err := net.SplitHostPort(s.Advertise); err == nil {
+			host = pinnedHost
+			port, _ = strconv.Atoi(pinnedPort)
+		}
+	}
+
+	rooms, err := s.Storage.Rooms()
+	if err != nil {
+		fmt.Printf("ERROR: counting rooms: %s\n", err)
+	}
+
+	s.connsMu.Lock()
+	users := len(s.Conns)
+	s.connsMu.Unlock()
+
+	return shared.DiscoveryReply{
+		Nonce:   nonce,
+		Name:    truncateString(s.Name, math.MaxUint8),
+		Host:    host,
+		Port:    uint16(port),
+		Version: fmt.Sprintf("%d.%d", shared.MAJOR_VERSION, shared.MINOR_VERSION),
+		Rooms:   uint16(min(len(rooms), math.MaxUint16)),
+		Users:   uint16(min(users, math.MaxUint16)),
+		TLS:     s.TLS != nil,
+	}
+}
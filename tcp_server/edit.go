@@ -0,0 +1,156 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+var NotAllowed = errors.New("Not allowed.")
+
+// stored returns the stored message of a room the session is in
+func (s *Server) stored(session *Session, room string, id uint64) (shared.Message, error) {
+	if !session.InRoom(room) {
+		return shared.Message{}, errors.Join(InvalidRoom, errors.New(fmt.Sprintf("Not in room '%s'", room)))
+	}
+
+	if s.Store == nil {
+		return shared.Message{}, errors.Join(MessageNotFound, errors.New("Messages are not stored by this server"))
+	}
+
+	msg, ok, err := s.Store.Get(room, id)
+	if err != nil {
+		return msg, err
+	}
+	if !ok {
+		return msg, errors.Join(MessageNotFound, errors.New(fmt.Sprintf("No message %d in '%s'", id, room)))
+	}
+
+	return msg, nil
+}
+
+// authorize returns the stored message, if the session may change it. Anyone can log in
+// with the name of an author without a secret, so those authors can only change the
+// messages sent by their current login.
+func (s *Server) authorize(session *Session, room string, id uint64) (shared.Message, error) {
+	msg, err := s.stored(session, room, id)
+	if err != nil {
+		return msg, err
+	}
+
+	username := session.Username()
+	author := msg.Username == username && (s.hasSecret(username) || s.sentBy(session, id))
+	if !author && !s.IsModerator(username, room) {
+		return msg, errors.Join(NotAllowed, errors.New("Only the author or a moderator can change a message"))
+	}
+
+	return msg, nil
+}
+
+// EditMessage replaces the text of a stored message, and tells the room.
+// The replaced text is kept in the edit history of the store.
+func (s *Server) EditMessage(session *Session, room string, id uint64, text string) error {
+	text = strings.Trim(text, "\r\n \t")
+	if text == "" {
+		return errors.New("Message cannot be empty, delete it instead")
+	}
+
+	err := s.checkMuted(session, room)
+	if err != nil {
+		return err
+	}
+
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	msg, err := s.authorize(session, room, id)
+	if err != nil {
+		return err
+	}
+
+	if msg.Deleted {
+		return errors.Join(MessageNotFound, errors.New(fmt.Sprintf("Message %d was deleted", id)))
+	}
+
+	edit := shared.Edit{
+		ID:       id,
+		Room:     room,
+		Msg:      text,
+		Username: session.Username(),
+		Time:     time.Now().UnixMilli(),
+	}
+
+	msg.Msg = text
+	msg.Edited = edit.Time
+	err = fits(msg)
+	if err != nil {
+		return err
+	}
+
+	err = s.Store.Update(msg)
+	if err != nil {
+		return err
+	}
+
+	p, err := shared.PacketFromMessage(shared.KIND_EDIT, edit)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] %s edited message %d: %s\n", room, edit.Username, id, text)
+	s.BroadcastRoom(room, p)
+	return nil
+}
+
+// DeleteMessage removes the text of a stored message, and tells the room.
+// The message stays in the history marked as deleted.
+func (s *Server) DeleteMessage(session *Session, room string, id uint64) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	msg, err := s.authorize(session, room, id)
+	if err != nil {
+		return err
+	}
+
+	if msg.Deleted {
+		return nil
+	}
+
+	del := shared.Delete{
+		ID:       id,
+		Room:     room,
+		Username: session.Username(),
+		Time:     time.Now().UnixMilli(),
+	}
+
+	msg.Msg = ""
+	msg.Deleted = true
+	msg.Reactions = nil
+	err = s.Store.Update(msg)
+	if err != nil {
+		return err
+	}
+
+	p, err := shared.PacketFromMessage(shared.KIND_DELETE, del)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] %s deleted message %d\n", room, del.Username, id)
+	s.BroadcastRoom(room, p)
+	return nil
+}
+
+// fits checks that the changed message can still be sent in a single packet
+func fits(msg shared.Message) error {
+	_, err := shared.PacketFromMessage(shared.KIND_HISTORY, msg)
+	if err != nil {
+		return errors.Join(errors.New(fmt.Sprintf("Message %d would be too long", msg.ID)), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+package tcp_server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// fileEntry is where a message is stored in the file of a FileStore
+type fileEntry struct {
+	id     uint64
+	offset int64
+	size   int
+}
+
+// StoreFile is the file a FileStore keeps its messages in, usually an *os.File
+type StoreFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.Closer
+	Truncate(size int64) error
+}
+
+// FileStore appends every message to a file, as encoded KIND_MESSAGE packets.
+// Only an index of the messages is kept in memory, the messages are read from
+// the file when requested. An updated message is appended again with the same ID,
+// and replaces the earlier version in the index.
+type FileStore struct {
+	mu     sync.Mutex
+	file   StoreFile
+	size   int64
+	rooms  map[string][]fileEntry
+	nextId uint64
+	// Where the earlier versions of edited messages are stored
+	revisions map[uint64][]fileEntry
+	// IDs of the replies to every message with replies
+	threads map[uint64][]uint64
+}
+
+// OpenFileStore opens or creates the file at path, and indexes the messages in it.
+// A message only partially written at the end, when the server stopped while writing it, is
+// removed. Any other invalid message fails opening the store, instead of losing the messages after it.
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewFileStore(file)
+	if err != nil {
+		return nil, errors.Join(errors.New(fmt.Sprintf("Could not load message store '%s'", path)), err)
+	}
+
+	return store, nil
+}
+
+// NewFileStore indexes the messages in file, like OpenFileStore. The file is closed if it can not be loaded.
+func NewFileStore(file StoreFile) (*FileStore, error) {
+	store := &FileStore{
+		file:      file,
+		rooms:     make(map[string][]fileEntry),
+		nextId:    1,
+		revisions: make(map[uint64][]fileEntry),
+		threads:   make(map[uint64][]uint64),
+	}
+
+	err := store.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (f *FileStore) load() error {
+	_, err := f.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f.file)
+	var offset int64
+	for {
+		data, err := readStoredPacket(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// Only the last message can be partially written, drop it
+			err = f.file.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg shared.Message
+		p, err := shared.ParseDatagram(data)
+		if err == nil {
+			err = p.IntoMessage(&msg)
+		}
+		if err != nil {
+			return errors.Join(errors.New(fmt.Sprintf("Invalid message at offset %d", offset)), err)
+		}
+
+		err = f.index(msg, offset, len(data))
+		if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+
+	f.size = offset
+	_, err = f.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readStoredPacket reads the next encoded packet from the file. It returns io.EOF at the end of
+// the file, and io.ErrUnexpectedEOF when the file ends within the packet.
+func readStoredPacket(reader *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length := shared.DataLength(header)
+	data := make([]byte, 3+length)
+	copy(data, header)
+	_, err = io.ReadFull(reader, data[3:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+func (f *FileStore) index(msg shared.Message, offset int64, size int) error {
+	entry := fileEntry{
+		id:     msg.ID,
+		offset: offset,
+		size:   size,
+	}
+
+	if i, ok := f.find(msg.Room, msg.ID); ok {
+		entries := f.rooms[msg.Room]
+		old, err := f.read(entries[i])
+		if err != nil {
+			return err
+		}
+
+		if revised(old, msg) {
+			f.revisions[msg.ID] = append(f.revisions[msg.ID], entries[i])
+		}
+		entries[i] = entry
+		return nil
+	}
+
+	f.rooms[msg.Room] = append(f.rooms[msg.Room], entry)
+	f.nextId = max(f.nextId, msg.ID+1)
+	if msg.Parent != 0 {
+		f.threads[msg.Parent] = append(f.threads[msg.Parent], msg.ID)
+	}
+	return nil
+}
+
+// find returns the position of the message with the ID in the index of the room
+func (f *FileStore) find(room string, id uint64) (int, bool) {
+	entries := f.rooms[room]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].id >= id })
+	return i, i < len(entries) && entries[i].id == id
+}
+
+// write appends the message to the file and indexes it
+func (f *FileStore) write(msg shared.Message) error {
+	p, err := shared.PacketFromMessage(shared.KIND_MESSAGE, msg)
+	if err != nil {
+		return err
+	}
+
+	data := p.Encode()
+	n, err := f.file.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		// Remove what was written of the message, so the messages after it can be loaded
+		truncErr := f.file.Truncate(f.size)
+		if truncErr == nil {
+			_, truncErr = f.file.Seek(f.size, io.SeekStart)
+		}
+		return errors.Join(err, truncErr)
+	}
+
+	offset := f.size
+	f.size += int64(len(data))
+	return f.index(msg, offset, len(data))
+}
+
+func (f *FileStore) Append(msg shared.Message) (shared.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return msg, StoreClosed
+	}
+
+	msg.ID = f.nextId
+	return msg, f.write(msg)
+}
+
+func (f *FileStore) Page(room string, before uint64, after uint64, limit int) ([]shared.Message, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil, false, StoreClosed
+	}
+
+	entries := f.rooms[room]
+	start, end, more := pageRange(len(entries), func(i int) uint64 { return entries[i].id }, before, after, limit)
+
+	msgs := make([]shared.Message, 0, end-start)
+	for _, entry := range entries[start:end] {
+		msg, err := f.read(entry)
+		if err != nil {
+			return nil, false, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, more, nil
+}
+
+func (f *FileStore) Get(room string, id uint64) (shared.Message, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return shared.Message{}, false, StoreClosed
+	}
+
+	i, ok := f.find(room, id)
+	if !ok {
+		return shared.Message{}, false, nil
+	}
+
+	msg, err := f.read(f.rooms[room][i])
+	return msg, err == nil, err
+}
+
+func (f *FileStore) Update(msg shared.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return StoreClosed
+	}
+
+	if _, ok := f.find(msg.Room, msg.ID); !ok {
+		return errors.Join(MessageNotFound, errors.New(fmt.Sprintf("No message %d in '%s'", msg.ID, msg.Room)))
+	}
+
+	return f.write(msg)
+}
+
+func (f *FileStore) Revisions(room string, id uint64) ([]shared.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil, StoreClosed
+	}
+
+	msgs := make([]shared.Message, 0, len(f.revisions[id]))
+	for _, entry := range f.revisions[id] {
+		msg, err := f.read(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func (f *FileStore) Thread(room string, id uint64) ([]shared.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil, StoreClosed
+	}
+
+	msgs := make([]shared.Message, 0, len(f.threads[id]))
+	for _, reply := range f.threads[id] {
+		i, ok := f.find(room, reply)
+		if !ok {
+			continue
+		}
+
+		msg, err := f.read(f.rooms[room][i])
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func (f *FileStore) read(entry fileEntry) (shared.Message, error) {
+	var msg shared.Message
+
+	buf := make([]byte, entry.size)
+	_, err := f.file.ReadAt(buf, entry.offset)
+	if err != nil {
+		return msg, err
+	}
+
+	p, err := shared.ParsePacket(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		return msg, err
+	}
+
+	err = p.IntoMessage(&msg)
+	return msg, err
+}
+
+func (f *FileStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,295 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+const (
+	// How many messages of each room are kept by the default MemoryStore
+	DEFAULT_HISTORY_SIZE = 1000
+	// How many messages are sent to a user joining a room
+	DEFAULT_HISTORY_ON_JOIN = 20
+)
+
+var (
+	StoreClosed     = errors.New("Message store is closed.")
+	MessageNotFound = errors.New("Message not found.")
+)
+
+// MessageStore keeps the messages sent to rooms, so they can be sent to users
+// joining later.
+type MessageStore interface {
+	// Append gives the message the next ID and stores it
+	Append(msg shared.Message) (shared.Message, error)
+	// Page returns up to limit messages of the room, oldest first. Before and After
+	// are message IDs, 0 means no limit. Without After the newest messages are
+	// returned, with After the oldest messages following it. The bool tells if
+	// the store holds more messages in that direction.
+	Page(room string, before uint64, after uint64, limit int) ([]shared.Message, bool, error)
+	// Get returns the stored message of the room with the ID
+	Get(room string, id uint64) (shared.Message, bool, error)
+	// Update replaces the stored message with the room and ID of msg. When the
+	// text changes, the replaced version is kept in the edit history of the message.
+	Update(msg shared.Message) error
+	// Revisions returns the earlier versions of the message, oldest first
+	Revisions(room string, id uint64) ([]shared.Message, error)
+	// Thread returns the stored replies to the message, oldest first
+	Thread(room string, id uint64) ([]shared.Message, error)
+	Close() error
+}
+
+// pageRange finds the messages of a page among n messages sorted by ID,
+// and returns them as the range [start, end).
+func pageRange(n int, id func(i int) uint64, before uint64, after uint64, limit int) (int, int, bool) {
+	hi := n
+	if before != 0 {
+		hi = sort.Search(n, func(i int) bool { return id(i) >= before })
+	}
+
+	lo := 0
+	if after != 0 {
+		lo = min(sort.Search(n, func(i int) bool { return id(i) > after }), hi)
+	}
+
+	if after != 0 {
+		end := min(lo+limit, hi)
+		return lo, end, end < hi
+	}
+
+	start := max(hi-limit, lo)
+	return start, hi, start > lo
+}
+
+// revised reports whether replacing old with msg changes the text of the message
+func revised(old shared.Message, msg shared.Message) bool {
+	return old.Msg != msg.Msg || old.Deleted != msg.Deleted
+}
+
+// ring holds the newest messages of a room, overwriting the oldest when full
+type ring struct {
+	buf   []shared.Message
+	start int
+	len   int
+}
+
+func (r *ring) at(i int) shared.Message {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+// push adds the message, and returns the message it overwrote if the ring was full
+func (r *ring) push(msg shared.Message) (shared.Message, bool) {
+	if r.len < len(r.buf) {
+		r.buf[(r.start+r.len)%len(r.buf)] = msg
+		r.len += 1
+		return shared.Message{}, false
+	}
+
+	oldest := r.buf[r.start]
+	r.buf[r.start] = msg
+	r.start = (r.start + 1) % len(r.buf)
+	return oldest, true
+}
+
+// find returns the position of the message with the ID
+func (r *ring) find(id uint64) (int, bool) {
+	i := sort.Search(r.len, func(i int) bool { return r.at(i).ID >= id })
+	return i, i < r.len && r.at(i).ID == id
+}
+
+// MemoryStore keeps the newest messages of every room in memory
+type MemoryStore struct {
+	mu     sync.Mutex
+	size   int
+	rooms  map[string]*ring
+	nextId uint64
+	// Earlier versions of edited messages, dropped with the message
+	revisions map[uint64][]shared.Message
+	// IDs of the replies to every message with replies, dropped with the message
+	threads map[uint64][]uint64
+}
+
+// NewMemoryStore keeps up to size messages per room
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{
+		size:      max(size, 1),
+		rooms:     make(map[string]*ring),
+		nextId:    1,
+		revisions: make(map[uint64][]shared.Message),
+		threads:   make(map[uint64][]uint64),
+	}
+}
+
+func (m *MemoryStore) Append(msg shared.Message) (shared.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[msg.Room]
+	if !ok {
+		r = &ring{buf: make([]shared.Message, m.size)}
+		m.rooms[msg.Room] = r
+	}
+
+	msg.ID = m.nextId
+	m.nextId += 1
+	if oldest, ok := r.push(msg); ok {
+		delete(m.revisions, oldest.ID)
+		delete(m.threads, oldest.ID)
+	}
+	if msg.Parent != 0 {
+		m.threads[msg.Parent] = append(m.threads[msg.Parent], msg.ID)
+	}
+
+	return msg, nil
+}
+
+func (m *MemoryStore) Page(room string, before uint64, after uint64, limit int) ([]shared.Message, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[room]
+	if !ok {
+		return nil, false, nil
+	}
+
+	start, end, more := pageRange(r.len, func(i int) uint64 { return r.at(i).ID }, before, after, limit)
+
+	msgs := make([]shared.Message, 0, end-start)
+	for i := start; i < end; i++ {
+		msgs = append(msgs, r.at(i))
+	}
+
+	return msgs, more, nil
+}
+
+func (m *MemoryStore) Get(room string, id uint64) (shared.Message, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[room]
+	if !ok {
+		return shared.Message{}, false, nil
+	}
+
+	i, ok := r.find(id)
+	if !ok {
+		return shared.Message{}, false, nil
+	}
+
+	return r.at(i), true, nil
+}
+
+func (m *MemoryStore) Update(msg shared.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[msg.Room]
+	if !ok {
+		return errors.Join(MessageNotFound, errors.New(fmt.Sprintf("No message %d in '%s'", msg.ID, msg.Room)))
+	}
+
+	i, ok := r.find(msg.ID)
+	if !ok {
+		return errors.Join(MessageNotFound, errors.New(fmt.Sprintf("No message %d in '%s'", msg.ID, msg.Room)))
+	}
+
+	if old := r.at(i); revised(old, msg) {
+		m.revisions[msg.ID] = append(m.revisions[msg.ID], old)
+	}
+	r.buf[(r.start+i)%len(r.buf)] = msg
+	return nil
+}
+
+func (m *MemoryStore) Revisions(room string, id uint64) ([]shared.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.revisions[id]), nil
+}
+
+func (m *MemoryStore) Thread(room string, id uint64) ([]shared.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := make([]shared.Message, 0, len(m.threads[id]))
+	r, ok := m.rooms[room]
+	if !ok {
+		return msgs, nil
+	}
+
+	for _, reply := range m.threads[id] {
+		// Replies dropped from the ring are skipped
+		if i, ok := r.find(reply); ok {
+			msgs = append(msgs, r.at(i))
+		}
+	}
+
+	return msgs, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// publish stores the message, and passes it on to c with its ID and time
+func (s *Server) publish(msg shared.Message, c chan *shared.Packet) (shared.Message, error) {
+	msg.Time = time.Now().UnixMilli()
+
+	if s.Store != nil {
+		var err error
+		msg, err = s.Store.Append(msg)
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	p, err := shared.PacketFromMessage(shared.KIND_MESSAGE, msg)
+	if err != nil {
+		return msg, err
+	}
+
+	c <- p
+	return msg, nil
+}
+
+// SendHistory sends a page of stored messages of the room to the session,
+// followed by a HistoryEnd. See MessageStore.Page for before and after.
+func (s *Server) SendHistory(session *Session, room string, before uint64, after uint64, limit int) error {
+	if !session.InRoom(room) {
+		return errors.Join(InvalidRoom, errors.New(fmt.Sprintf("Not in room '%s'", room)))
+	}
+
+	if limit <= 0 {
+		limit = DEFAULT_HISTORY_ON_JOIN
+	}
+	limit = min(limit, shared.MAX_HISTORY_PAGE)
+
+	var msgs []shared.Message
+	more := false
+	if s.Store != nil {
+		var err error
+		msgs, more, err = s.Store.Page(room, before, after, limit)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, msg := range msgs {
+		err := session.SendMessage(shared.KIND_HISTORY, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return session.SendMessage(shared.KIND_HISTORY_END, shared.HistoryEnd{
+		Room:  room,
+		Count: uint16(len(msgs)),
+		More:  more,
+	})
+}
@@ -2,17 +2,44 @@ package ip
 
 import (
 	"net"
+	"sort"
 )
 
-// Get preferred outbound ip of this machine
-func ExternalIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// Addresses returns the addresses of the network interfaces that are up, IPv4 first.
+// Loopback and link-local addresses are left out, as other machines cannot connect to them.
+func Addresses() ([]net.IP, error) {
+	interfaces, err := net.Interfaces()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer conn.Close()
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	ips := make([]net.IP, 0)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
 
-	return localAddr.IP.String(), nil
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !reachable(ipNet.IP) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].To4() != nil && ips[j].To4() == nil
+	})
+
+	return ips, nil
+}
+
+func reachable(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() && !ip.IsMulticast()
 }
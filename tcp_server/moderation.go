@@ -0,0 +1,531 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// Role is what a user may do in a room, or on the whole server. Server roles
+// apply in every room, and a higher role may do everything a lower role may.
+type Role byte
+
+const (
+	ROLE_MEMBER Role = iota + 1
+	ROLE_MODERATOR
+	ROLE_OWNER
+)
+
+func (r Role) String() string {
+	switch r {
+	case ROLE_MEMBER:
+		return "member"
+	case ROLE_MODERATOR:
+		return "moderator"
+	case ROLE_OWNER:
+		return "owner"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseRole(name string) (Role, error) {
+	for _, role := range []Role{ROLE_MEMBER, ROLE_MODERATOR, ROLE_OWNER} {
+		if strings.EqualFold(name, role.String()) {
+			return role, nil
+		}
+	}
+
+	return 0, errors.New(fmt.Sprintf("Unknown role '%s', use member, moderator or owner", name))
+}
+
+const (
+	// Moderation actions, as kept in the audit log
+	AUDIT_KICK   = "kick"
+	AUDIT_BAN    = "ban"
+	AUDIT_UNBAN  = "unban"
+	AUDIT_MUTE   = "mute"
+	AUDIT_UNMUTE = "unmute"
+	AUDIT_ROLE   = "role"
+)
+
+var (
+	Banned = errors.New("Banned.")
+	Muted  = errors.New("Muted.")
+)
+
+// ServerRole returns the role of the user on the whole server, given by Owners,
+// Moderators or /serverrole
+func (s *Server) ServerRole(username string) Role {
+	live := s.live()
+	if slices.Contains(live.owners, username) {
+		return ROLE_OWNER
+	}
+
+	role := ROLE_MEMBER
+	if slices.Contains(live.moderators, username) {
+		role = ROLE_MODERATOR
+	}
+
+	return max(role, s.storedRole("", username))
+}
+
+// RoleOf returns the role of the user in the room, the highest of its room and server role
+func (s *Server) RoleOf(username string, room string) Role {
+	return max(s.ServerRole(username), s.storedRole(room, username))
+}
+
+// storedRole returns the role given to the user in the room. Roles of users without a
+// secret, stored before roles needed one, do not count.
+func (s *Server) storedRole(room string, username string) Role {
+	record, ok, err := s.Storage.Role(room, username)
+	if err != nil {
+		fmt.Printf("ERROR: reading role of %s: %s\n", username, err)
+		return ROLE_MEMBER
+	}
+	if !ok || !s.hasSecret(username) {
+		return ROLE_MEMBER
+	}
+
+	return record.Role
+}
+
+// IsModerator reports whether the user may moderate the room, and edit and delete the messages of others
+func (s *Server) IsModerator(username string, room string) bool {
+	return s.RoleOf(username, room) >= ROLE_MODERATOR
+}
+
+// canModerate checks that the session may act on the user in the room, or on the whole
+// server for an empty room. Only users with a higher role can be acted on, and a room
+// role does not reach users with a higher server role.
+func (s *Server) canModerate(session *Session, room string, username string) error {
+	actor := session.Username()
+	if username == actor {
+		return errors.Join(NotAllowed, errors.New("You cannot do that to yourself"))
+	}
+
+	actorRole, targetRole := s.ServerRole(actor), s.ServerRole(username)
+	if room != "" {
+		if actorRole < targetRole {
+			return errors.Join(NotAllowed, errors.New(fmt.Sprintf("%s is a server %s", username, targetRole)))
+		}
+		actorRole, targetRole = s.RoleOf(actor, room), s.RoleOf(username, room)
+	}
+
+	if actorRole < ROLE_MODERATOR {
+		return errors.Join(NotAllowed, errors.New("Only moderators can do that"))
+	}
+
+	if actorRole <= targetRole {
+		return errors.Join(NotAllowed, errors.New(fmt.Sprintf("%s is a %s too", username, targetRole)))
+	}
+
+	return nil
+}
+
+// audit adds the action to the audit log
+func (s *Server) audit(record AuditRecord) {
+	record.Time = time.Now()
+
+	where := "the server"
+	if record.Room != "" {
+		where = record.Room
+	}
+	reason := ""
+	if record.Reason != "" {
+		reason = ": " + record.Reason
+	}
+	fmt.Printf("[audit] %s %s %s in %s%s\n", record.By, record.Action, record.Target, where, reason)
+
+	_, err := s.Storage.AppendAudit(record)
+	if err != nil {
+		fmt.Printf("ERROR: writing audit log: %s\n", err)
+	}
+}
+
+// findBan returns the ban of the target from the room, or from the whole server for an
+// empty room. Bans that have run out are removed.
+func (s *Server) findBan(room string, kind string, target string) (BanRecord, bool) {
+	bans, err := s.Storage.Bans()
+	if err != nil {
+		fmt.Printf("ERROR: reading bans: %s\n", err)
+		return BanRecord{}, false
+	}
+
+	now := time.Now()
+	for _, ban := range bans {
+		if ban.Room != room || ban.Kind != kind || ban.Target != target {
+			continue
+		}
+
+		if ban.Expired(now) {
+			s.Storage.RemoveBan(ban.Room, ban.Kind, ban.Target)
+			return BanRecord{}, false
+		}
+
+		return ban, true
+	}
+
+	return BanRecord{}, false
+}
+
+// bannedAddr returns the ban of the IP address from the server
+func (s *Server) bannedAddr(addr net.Addr) (BanRecord, bool) {
+	return s.findBan("", BAN_IP, remoteIP(addr))
+}
+
+// checkBanned returns an error if the user is banned from the room, or from the server for an empty room
+func (s *Server) checkBanned(room string, username string) error {
+	ban, ok := s.findBan(room, BAN_USERNAME, username)
+	if !ok {
+		return nil
+	}
+
+	where := "this server"
+	if room != "" {
+		where = fmt.Sprintf("'%s'", room)
+	}
+
+	return errors.Join(Banned, errors.New(fmt.Sprintf("%s is banned from %s%s", username, where, describeSanction(ban.By, ban.Reason, ban.Expires))))
+}
+
+// checkMuted returns an error if the user of the session is muted in the room or in every room
+func (s *Server) checkMuted(session *Session, room string) error {
+	username := session.Username()
+
+	now := time.Now()
+	for _, scope := range []string{"", room} {
+		mute, ok, err := s.Storage.Mute(scope, username)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if mute.Expired(now) {
+			s.Storage.RemoveMute(scope, username)
+			continue
+		}
+
+		return errors.Join(Muted, errors.New(fmt.Sprintf("You are muted%s", describeSanction(mute.By, mute.Reason, mute.Expires))))
+	}
+
+	return nil
+}
+
+// describeSanction says who gave a ban or mute, why and until when, e.g. " by tobias until 15:04: spam"
+func describeSanction(by string, reason string, expires time.Time) string {
+	text := ""
+	if by != "" {
+		text += " by " + by
+	}
+	if !expires.IsZero() {
+		text += " until " + expires.Format("2006-01-02 15:04")
+	}
+	if reason != "" {
+		text += ": " + reason
+	}
+
+	return text
+}
+
+// expires returns when a sanction of the duration given at now runs out, zero for no duration
+func expires(now time.Time, duration time.Duration) time.Time {
+	if duration <= 0 {
+		return time.Time{}
+	}
+
+	return now.Add(duration)
+}
+
+// expel tells the sessions of the user, or every session from the IP address, why they are
+// removed and closes them. A closed login cannot be resumed.
+func (s *Server) expel(kind string, target string, reason string) {
+	s.connsMu.Lock()
+	conns := make([]*Session, 0)
+	for _, conn := range s.Conns {
+		if (kind == BAN_USERNAME && conn.Username() == target) || (kind == BAN_IP && conn.IP() == target) {
+			conns = append(conns, conn)
+		}
+	}
+	s.connsMu.Unlock()
+
+	for _, conn := range conns {
+		s.forget(conn.Username())
+		conn.SendError(reason)
+		conn.Close()
+	}
+}
+
+// Kick removes the user from the room
+func (s *Server) Kick(session *Session, room string, username string, reason string) error {
+	err := s.canModerate(session, room, username)
+	if err != nil {
+		return err
+	}
+
+	target := s.SessionByUsername(username)
+	if target == nil || !target.InRoom(room) {
+		return errors.New(fmt.Sprintf("%s is not in '%s'", username, room))
+	}
+
+	err = s.removeMember(target, room, fmt.Sprintf("Kicked from '%s'%s", room, describeSanction(session.Username(), reason, time.Time{})))
+	if err != nil {
+		return err
+	}
+
+	s.audit(AuditRecord{By: session.Username(), Action: AUDIT_KICK, Target: username, Room: room, Reason: reason})
+	return nil
+}
+
+// KickFromServer disconnects the user, who can log in again
+func (s *Server) KickFromServer(session *Session, username string, reason string) error {
+	err := s.canModerate(session, "", username)
+	if err != nil {
+		return err
+	}
+
+	if s.SessionByUsername(username) == nil {
+		return errors.New(fmt.Sprintf("No user named '%s' is online", username))
+	}
+
+	s.expel(BAN_USERNAME, username, "Kicked from the server"+describeSanction(session.Username(), reason, time.Time{}))
+	s.audit(AuditRecord{By: session.Username(), Action: AUDIT_KICK, Target: username, Reason: reason})
+	return nil
+}
+
+// removeMember removes the session from the room for good, and tells it why
+func (s *Server) removeMember(session *Session, room string, why string) error {
+	err := s.Storage.RemoveMembership(session.Username(), room)
+	if err != nil {
+		return err
+	}
+
+	s.removeFromRoom(session, room)
+
+	return errors.Join(
+		session.SendMessage(shared.KIND_LEAVE, shared.Leave{Room: room}),
+		session.SendError(why),
+	)
+}
+
+// Ban bans the user from the room, or a user or IP address from the whole server for an
+// empty room, and removes them. A duration of 0 bans them until unbanned.
+func (s *Server) Ban(session *Session, room string, target string, duration time.Duration, reason string) error {
+	kind := BAN_USERNAME
+	if net.ParseIP(target) != nil {
+		kind = BAN_IP
+		if room != "" {
+			return errors.New("IP addresses can only be banned from the whole server, use /serverban")
+		}
+		if s.ServerRole(session.Username()) < ROLE_MODERATOR {
+			return errors.Join(NotAllowed, errors.New("Only moderators can do that"))
+		}
+
+		err := s.canBanAddr(session, target)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := s.canModerate(session, room, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	ban := BanRecord{
+		Kind:    kind,
+		Target:  target,
+		Room:    room,
+		Reason:  reason,
+		By:      session.Username(),
+		Role:    s.RoleOf(session.Username(), room),
+		Created: now,
+		Expires: expires(now, duration),
+	}
+
+	err := s.Storage.AddBan(ban)
+	if err != nil {
+		return err
+	}
+
+	s.audit(AuditRecord{By: ban.By, Action: AUDIT_BAN, Target: target, Room: room, Reason: reason, Expires: ban.Expires})
+
+	if room == "" {
+		s.expel(kind, target, "Banned from the server"+describeSanction(ban.By, reason, ban.Expires))
+		return nil
+	}
+
+	err = s.Storage.RemoveMembership(target, room)
+	if err != nil {
+		return err
+	}
+
+	if member := s.SessionByUsername(target); member != nil && member.InRoom(room) {
+		return s.removeMember(member, room, fmt.Sprintf("Banned from '%s'%s", room, describeSanction(ban.By, reason, ban.Expires)))
+	}
+
+	return nil
+}
+
+// canBanAddr checks that banning the IP address does not remove the session itself,
+// or a user with the same or a higher server role connected from the address
+func (s *Server) canBanAddr(session *Session, addr string) error {
+	s.connsMu.Lock()
+	usernames := make([]string, 0)
+	for _, conn := range s.Conns {
+		if conn.IP() == addr && conn.Username() != "" {
+			usernames = append(usernames, conn.Username())
+		}
+	}
+	s.connsMu.Unlock()
+
+	for _, username := range usernames {
+		err := s.canModerate(session, "", username)
+		if err != nil {
+			return errors.Join(err, errors.New(fmt.Sprintf("%s is connected from %s", username, addr)))
+		}
+	}
+
+	return nil
+}
+
+// Unban lifts the ban of the user from the room, or of a user or IP address from the whole server.
+// Like a ban, it needs a higher role than the one the ban was given with, unless the session gave it.
+func (s *Server) Unban(session *Session, room string, target string) error {
+	kind := BAN_USERNAME
+	if net.ParseIP(target) != nil {
+		kind = BAN_IP
+	}
+
+	role := s.RoleOf(session.Username(), room)
+	if role < ROLE_MODERATOR {
+		return errors.Join(NotAllowed, errors.New("Only moderators can do that"))
+	}
+
+	ban, ok := s.findBan(room, kind, target)
+	if !ok {
+		return errors.New(fmt.Sprintf("%s is not banned", target))
+	}
+
+	if ban.By != session.Username() && role <= ban.Role {
+		return errors.Join(NotAllowed, errors.New(fmt.Sprintf("%s was banned by a %s", target, ban.Role)))
+	}
+
+	err := s.Storage.RemoveBan(room, kind, target)
+	if err != nil {
+		return err
+	}
+
+	s.audit(AuditRecord{By: session.Username(), Action: AUDIT_UNBAN, Target: target, Room: room})
+	return nil
+}
+
+// Mute stops the user from sending messages, reactions and edits to the room, or to every
+// room for an empty room. A duration of 0 mutes them until unmuted.
+func (s *Server) Mute(session *Session, room string, username string, duration time.Duration, reason string) error {
+	err := s.canModerate(session, room, username)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	mute := MuteRecord{
+		Room:     room,
+		Username: username,
+		Reason:   reason,
+		By:       session.Username(),
+		Created:  now,
+		Expires:  expires(now, duration),
+	}
+
+	err = s.Storage.AddMute(mute)
+	if err != nil {
+		return err
+	}
+
+	s.audit(AuditRecord{By: mute.By, Action: AUDIT_MUTE, Target: username, Room: room, Reason: reason, Expires: mute.Expires})
+
+	if target := s.SessionByUsername(username); target != nil {
+		where := "in every room"
+		if room != "" {
+			where = fmt.Sprintf("in '%s'", room)
+		}
+		target.SendError(fmt.Sprintf("You are muted %s%s", where, describeSanction(mute.By, reason, mute.Expires)))
+	}
+
+	return nil
+}
+
+// Unmute lets the user talk in the room again, or in every room for an empty room
+func (s *Server) Unmute(session *Session, room string, username string) error {
+	err := s.canModerate(session, room, username)
+	if err != nil {
+		return err
+	}
+
+	if _, ok, _ := s.Storage.Mute(room, username); !ok {
+		return errors.New(fmt.Sprintf("%s is not muted", username))
+	}
+
+	err = s.Storage.RemoveMute(room, username)
+	if err != nil {
+		return err
+	}
+
+	s.audit(AuditRecord{By: session.Username(), Action: AUDIT_UNMUTE, Target: username, Room: room})
+	return nil
+}
+
+// SetRole gives the user a role in the room, or on the whole server for an empty room.
+// Only owners can give roles, and only to users with a secret.
+func (s *Server) SetRole(session *Session, room string, username string, role Role) error {
+	actor := session.Username()
+	if username == actor {
+		return errors.Join(NotAllowed, errors.New("You cannot change your own role"))
+	}
+
+	actorRole := s.ServerRole(actor)
+	if room != "" {
+		actorRole = s.RoleOf(actor, room)
+	}
+	if actorRole < ROLE_OWNER {
+		return errors.Join(NotAllowed, errors.New("Only owners can give roles"))
+	}
+
+	live := s.live()
+	if room == "" && (slices.Contains(live.owners, username) || slices.Contains(live.moderators, username)) {
+		return errors.New(fmt.Sprintf("The server role of %s is set in the server configuration", username))
+	}
+
+	if role > ROLE_MEMBER && !s.hasSecret(username) {
+		return errors.Join(NotAllowed, errors.New(fmt.Sprintf("%s has no secret, anyone could log in with the role", username)))
+	}
+
+	err := s.Storage.SetRole(RoleRecord{Room: room, Username: username, Role: role, By: actor, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	s.audit(AuditRecord{By: actor, Action: AUDIT_ROLE, Target: username, Room: room, Reason: role.String()})
+	return nil
+}
+
+// parseDuration parses how long a ban or mute lasts, like "90s", "2h" or "7d"
+func parseDuration(arg string) (time.Duration, bool) {
+	if days, ok := strings.CutSuffix(arg, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err == nil && n > 0
+	}
+
+	d, err := time.ParseDuration(arg)
+	return d, err == nil && d > 0
+}
@@ -0,0 +1,265 @@
+package tcp_server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// Users are marked away after this long without sending anything
+const DEFAULT_AWAY_AFTER = 5 * time.Minute
+
+// Presence returns the status of the session, and when it was last active
+func (s *Session) Presence() shared.Presence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return shared.Presence{
+		Username: s.username,
+		Status:   s.status,
+		LastSeen: s.lastActive.UnixMilli(),
+	}
+}
+
+// setStatus changes the status of the session, and reports whether it changed
+func (s *Session) setStatus(status shared.PresenceStatus, manual bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.manualAway = manual && status == shared.PRESENCE_AWAY
+	if s.status == status {
+		return false
+	}
+
+	s.status = status
+	return true
+}
+
+// SetPresence changes the status of the session, and tells everyone sharing a
+// room with it. Manually set away is not cleared by activity, only by setting
+// the status again.
+func (s *Server) SetPresence(session *Session, status shared.PresenceStatus, manual bool) error {
+	if !session.setStatus(status, manual) {
+		return nil
+	}
+
+	return s.notifyPresence(session, session.Presence())
+}
+
+// touch marks the session as active, bringing it back from being automatically away
+func (s *Server) touch(session *Session) {
+	session.mu.Lock()
+	session.lastActive = time.Now()
+	back := session.status == shared.PRESENCE_AWAY && !session.manualAway
+	session.mu.Unlock()
+
+	if back {
+		s.SetPresence(session, shared.PRESENCE_ONLINE, false)
+	}
+}
+
+// notifyPresence sends the presence to the session and everyone sharing a room with it
+func (s *Server) notifyPresence(session *Session, presence shared.Presence) error {
+	p, err := shared.PacketFromMessage(shared.KIND_PRESENCE, presence)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range s.roomMates(session) {
+		other.WritePacket(p)
+	}
+
+	return session.WritePacket(p)
+}
+
+// roomMates returns every other session sharing a room with the session
+func (s *Server) roomMates(session *Session) []*Session {
+	seen := map[*Session]bool{session: true}
+	mates := make([]*Session, 0)
+
+	for _, room := range session.Rooms() {
+		for _, member := range s.Members(room) {
+			if !seen[member] {
+				seen[member] = true
+				mates = append(mates, member)
+			}
+		}
+	}
+
+	return mates
+}
+
+// sendRoomPresence tells a session joining the room the presence of every member,
+// and the members the presence of the session.
+func (s *Server) sendRoomPresence(session *Session, room string) error {
+	joined := session.Presence()
+	joined.Room = room
+
+	p, err := shared.PacketFromMessage(shared.KIND_PRESENCE, joined)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range s.Members(room) {
+		if member == session {
+			continue
+		}
+		member.WritePacket(p)
+
+		presence := member.Presence()
+		presence.Room = room
+		err = session.SendMessage(shared.KIND_PRESENCE, presence)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// goOffline tells the room mates a closed session had that its user went offline,
+// unless the user is still connected through another session. It is called once the
+// session is removed, so the user is not listed as online after the notification.
+func (s *Server) goOffline(session *Session, mates []*Session) {
+	username := session.Username()
+	if username == "" {
+		return
+	}
+
+	s.connsMu.Lock()
+	for _, other := range s.Conns {
+		if other != session && other.Username() == username {
+			s.connsMu.Unlock()
+			return
+		}
+	}
+	s.connsMu.Unlock()
+
+	p, err := shared.PacketFromMessage(shared.KIND_PRESENCE, shared.Presence{
+		Username: username,
+		Status:   shared.PRESENCE_OFFLINE,
+		LastSeen: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return
+	}
+
+	for _, other := range mates {
+		other.WritePacket(p)
+	}
+}
+
+// watchPresence marks sessions away once they have been idle for AwayAfter
+func (s *Server) watchPresence() {
+	if s.AwayAfter <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(min(s.AwayAfter/2, 10*time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.connsMu.Lock()
+		conns := make([]*Session, len(s.Conns))
+		copy(conns, s.Conns)
+		s.connsMu.Unlock()
+
+		now := time.Now()
+		for _, session := range conns {
+			presence := session.Presence()
+			idle := now.Sub(time.UnixMilli(presence.LastSeen))
+			if presence.Status == shared.PRESENCE_ONLINE && idle >= s.AwayAfter {
+				s.SetPresence(session, shared.PRESENCE_AWAY, false)
+			}
+		}
+	}
+}
+
+// describePresence formats the presence for listings, e.g. "bob (away)"
+func describePresence(presence shared.Presence, now time.Time) string {
+	switch presence.Status {
+	case shared.PRESENCE_ONLINE:
+		return presence.Username
+	case shared.PRESENCE_OFFLINE:
+		if presence.LastSeen == 0 {
+			return fmt.Sprintf("%s (offline)", presence.Username)
+		}
+		ago := formatAgo(now.Sub(time.UnixMilli(presence.LastSeen)))
+		return fmt.Sprintf("%s (offline, last seen %s)", presence.Username, ago)
+	default:
+		return fmt.Sprintf("%s (%s)", presence.Username, presence.Status)
+	}
+}
+
+func formatAgo(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
+
+// Online returns the presence of every logged in user, sorted by username
+func (s *Server) Online() []shared.Presence {
+	s.connsMu.Lock()
+	conns := make([]*Session, len(s.Conns))
+	copy(conns, s.Conns)
+	s.connsMu.Unlock()
+
+	online := make([]shared.Presence, 0, len(conns))
+	seen := make(map[string]bool)
+	for _, session := range conns {
+		presence := session.Presence()
+		if presence.Username == "" || seen[presence.Username] {
+			continue
+		}
+
+		seen[presence.Username] = true
+		online = append(online, presence)
+	}
+
+	sort.Slice(online, func(i, j int) bool { return online[i].Username < online[j].Username })
+	return online
+}
+
+// RoomPresence returns the presence of every user in the room, including the
+// stored members that are offline, sorted by username.
+func (s *Server) RoomPresence(room string) ([]shared.Presence, error) {
+	presences := make(map[string]shared.Presence)
+	for _, member := range s.Members(room) {
+		presence := member.Presence()
+		presences[presence.Username] = presence
+	}
+
+	stored, err := s.Storage.RoomMembers(room)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, username := range stored {
+		if _, ok := presences[username]; ok {
+			continue
+		}
+
+		presence := shared.Presence{Username: username, Status: shared.PRESENCE_OFFLINE}
+		if user, ok, err := s.Storage.User(username); err == nil && ok {
+			presence.LastSeen = user.LastSeen.UnixMilli()
+		}
+		presences[username] = presence
+	}
+
+	list := make([]shared.Presence, 0, len(presences))
+	for _, presence := range presences {
+		list = append(list, presence)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
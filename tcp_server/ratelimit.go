@@ -0,0 +1,327 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// Penalty is what happens to a session sending faster than its limits allow
+type Penalty string
+
+const (
+	// The packet is dropped without telling the client
+	PENALTY_DROP Penalty = "drop"
+	// The packet is dropped, and the client is told to slow down
+	PENALTY_WARN Penalty = "warn"
+	// The packet is dropped, and the user is muted in every room for RateLimits.MuteFor
+	PENALTY_MUTE Penalty = "mute"
+	// The session is closed
+	PENALTY_DISCONNECT Penalty = "disconnect"
+)
+
+// Set parses the name of a penalty, so Penalty can be used as a flag
+func (p *Penalty) Set(value string) error {
+	for _, penalty := range []Penalty{PENALTY_DROP, PENALTY_WARN, PENALTY_MUTE, PENALTY_DISCONNECT} {
+		if strings.EqualFold(value, string(penalty)) {
+			*p = penalty
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Unknown penalty '%s', use drop, warn, mute or disconnect", value))
+}
+
+func (p *Penalty) String() string {
+	return string(*p)
+}
+
+// Limit is the rate of a token bucket, Rate tokens a second and at most Burst at once.
+// A Rate of 0 is no limit.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+func (l *Limit) String() string {
+	if !l.Enabled() {
+		return "0"
+	}
+
+	return fmt.Sprintf("%g/%g", l.Rate, l.Burst)
+}
+
+// Set parses "rate/burst", or "rate" for a burst of a single second, so Limit can be used as a flag
+func (l *Limit) Set(value string) error {
+	rateString, burstString, hasBurst := strings.Cut(value, "/")
+
+	rate, err := strconv.ParseFloat(rateString, 64)
+	if err != nil || rate < 0 {
+		return errors.New(fmt.Sprintf("Invalid rate '%s'", rateString))
+	}
+
+	burst := rate
+	if hasBurst {
+		burst, err = strconv.ParseFloat(burstString, 64)
+		if err != nil || burst < 1 {
+			return errors.New(fmt.Sprintf("Invalid burst '%s'", burstString))
+		}
+	}
+
+	*l = Limit{Rate: rate, Burst: max(burst, 1)}
+	return nil
+}
+
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Limit) UnmarshalText(text []byte) error {
+	return l.Set(string(text))
+}
+
+// Bucket is a token bucket, filled at the rate of its Limit. It is not safe for concurrent use.
+type Bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket
+func NewBucket(limit Limit) *Bucket {
+	return &Bucket{limit: limit, tokens: limit.Burst}
+}
+
+func (b *Bucket) fill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = min(b.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// Take takes n tokens at now, and reports false without taking any if there are too few
+func (b *Bucket) Take(n float64, now time.Time) bool {
+	if !b.limit.Enabled() {
+		return true
+	}
+
+	b.fill(now)
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// Has reports whether n tokens can be taken at now, without taking them
+func (b *Bucket) Has(n float64, now time.Time) bool {
+	if !b.limit.Enabled() {
+		return true
+	}
+
+	b.fill(now)
+	return b.tokens >= n
+}
+
+// Full reports whether the bucket has filled up again at now
+func (b *Bucket) Full(now time.Time) bool {
+	b.fill(now)
+	return b.tokens >= b.limit.Burst
+}
+
+// RateLimits protects the server from clients sending too much. Every limit is
+// kept both per session and per remote IP, so opening more connections does not help.
+type RateLimits struct {
+	// Packets from a session, not counting pongs and file chunks
+	SessionMessages Limit
+	// Bytes of every packet from a session
+	SessionBytes Limit
+	// Packets from every session of an IP, like SessionMessages
+	IPMessages Limit
+	// Bytes from every session of an IP
+	IPBytes Limit
+	// New connections from an IP
+	IPConnections Limit
+	// Most sessions connected from an IP at once, 0 is no limit
+	MaxConnsPerIP int
+	// What happens to sessions going over the message or byte limits
+	Penalty Penalty
+	// How long PENALTY_MUTE mutes the user
+	MuteFor time.Duration
+}
+
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		SessionMessages: Limit{Rate: 10, Burst: 30},
+		SessionBytes:    Limit{Rate: 64 << 10, Burst: 256 << 10},
+		IPMessages:      Limit{Rate: 50, Burst: 150},
+		IPBytes:         Limit{Rate: 256 << 10, Burst: 1 << 20},
+		IPConnections:   Limit{Rate: 2, Burst: 10},
+		MaxConnsPerIP:   20,
+		Penalty:         PENALTY_WARN,
+		MuteFor:         time.Minute,
+	}
+}
+
+// sessionLimits are the buckets of a session, only used by the goroutine reading from it
+type sessionLimits struct {
+	messages *Bucket
+	bytes    *Bucket
+	// Whether the client was told to slow down since it last went over a limit
+	warned bool
+}
+
+// ipLimits are the buckets shared by every session from an IP, guarded by Server.ipsMu
+type ipLimits struct {
+	messages    *Bucket
+	bytes       *Bucket
+	connections *Bucket
+	conns       int
+}
+
+func (l *ipLimits) idle(now time.Time) bool {
+	return l.conns == 0 && l.messages.Full(now) && l.bytes.Full(now) && l.connections.Full(now)
+}
+
+// remoteIP returns the IP address of addr without the port. Connections without an
+// IP address, like over a unix socket, are named after their network instead.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.Network()
+	}
+
+	return host
+}
+
+// admit counts a new connection from the IP, unless it goes over the connection limits
+func (s *Server) admit(ip string) error {
+	config := s.live().limits
+
+	s.ipsMu.Lock()
+	defer s.ipsMu.Unlock()
+
+	now := time.Now()
+	for other, limits := range s.ips {
+		if other != ip && limits.idle(now) {
+			delete(s.ips, other)
+		}
+	}
+
+	limits, ok := s.ips[ip]
+	if !ok {
+		limits = &ipLimits{
+			messages:    NewBucket(config.IPMessages),
+			bytes:       NewBucket(config.IPBytes),
+			connections: NewBucket(config.IPConnections),
+		}
+		s.ips[ip] = limits
+	}
+
+	if config.MaxConnsPerIP > 0 && limits.conns >= config.MaxConnsPerIP {
+		return errors.New(fmt.Sprintf("%d connections already open", limits.conns))
+	}
+
+	if !limits.connections.Take(1, now) {
+		return errors.New("connecting too often")
+	}
+
+	limits.conns += 1
+	return nil
+}
+
+// release stops counting a closed connection from the IP
+func (s *Server) release(ip string) {
+	s.ipsMu.Lock()
+	defer s.ipsMu.Unlock()
+
+	if limits, ok := s.ips[ip]; ok {
+		limits.conns -= 1
+	}
+}
+
+// allow takes the packet from the buckets of the session and its IP, and reports
+// whether it should be handled. Tokens are only taken when every bucket has enough.
+// Sessions going over a limit get the penalty.
+func (s *Server) allow(session *Session, p *shared.Packet) bool {
+	now := time.Now()
+	size := float64(p.Header.DataLength) + 3
+	// File chunks and progress are kept in check by the window of the transfer, and
+	// pongs by how often the server pings
+	messages := 1.0
+	switch p.Kind() {
+	case shared.KIND_FILE_CHUNK, shared.KIND_FILE_PROGRESS, shared.KIND_PONG:
+		messages = 0
+	}
+
+	limits := &session.limits
+	allowed := limits.bytes.Has(size, now) && limits.messages.Has(messages, now)
+
+	s.ipsMu.Lock()
+	ip, ok := s.ips[session.IP()]
+	if allowed && ok {
+		allowed = ip.bytes.Has(size, now) && ip.messages.Has(messages, now)
+	}
+	if allowed {
+		limits.bytes.Take(size, now)
+		limits.messages.Take(messages, now)
+		if ok {
+			ip.bytes.Take(size, now)
+			ip.messages.Take(messages, now)
+		}
+	}
+	s.ipsMu.Unlock()
+
+	if allowed {
+		limits.warned = false
+		return true
+	}
+
+	s.penalize(session)
+	return false
+}
+
+// penalize gives the penalty of RateLimits to a session sending too fast
+func (s *Server) penalize(session *Session) {
+	limits := &session.limits
+	username := session.Username()
+	config := s.live().limits
+
+	switch config.Penalty {
+	case PENALTY_WARN:
+		if !limits.warned {
+			limits.warned = true
+			session.SendError("You are sending too fast, slow down")
+		}
+	case PENALTY_MUTE:
+		if limits.warned {
+			return
+		}
+		limits.warned = true
+
+		now := time.Now()
+		mute := MuteRecord{Username: username, Reason: "Flooding", By: "server", Created: now, Expires: expires(now, config.MuteFor)}
+		err := s.Storage.AddMute(mute)
+		if err != nil {
+			fmt.Printf("ERROR: muting %s: %s\n", username, err)
+			return
+		}
+
+		s.audit(AuditRecord{By: mute.By, Action: AUDIT_MUTE, Target: username, Reason: mute.Reason, Expires: mute.Expires})
+		session.SendError(fmt.Sprintf("You are muted in every room%s for sending too fast", forDuration(config.MuteFor)))
+	case PENALTY_DISCONNECT:
+		fmt.Printf("Disconnecting %s for sending too fast\n", username)
+		session.SendError("Disconnected for sending too fast")
+		session.Close()
+	}
+}
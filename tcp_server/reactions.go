@@ -0,0 +1,62 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+var InvalidEmoji = errors.New("Invalid emoji.")
+
+// React toggles the reaction of the session with the emoji on a stored message,
+// and tells the room whether it was added or removed.
+func (s *Server) React(session *Session, room string, id uint64, emoji string) error {
+	emoji, ok := shared.NormalizeEmoji(emoji)
+	if !ok {
+		return errors.Join(InvalidEmoji, errors.New(fmt.Sprintf("Emojis cannot be empty, contain whitespace or be longer than %d bytes", shared.MAX_EMOJI_LEN)))
+	}
+
+	err := s.checkMuted(session, room)
+	if err != nil {
+		return err
+	}
+
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	msg, err := s.stored(session, room, id)
+	if err != nil {
+		return err
+	}
+
+	if msg.Deleted {
+		return errors.Join(MessageNotFound, errors.New(fmt.Sprintf("Message %d was deleted", id)))
+	}
+
+	reaction := shared.Reaction{
+		ID:       id,
+		Room:     room,
+		Emoji:    emoji,
+		Username: session.Username(),
+		Added:    !msg.Reactions.Has(emoji, session.Username()),
+	}
+
+	msg.Reactions = msg.Reactions.Set(emoji, reaction.Username, reaction.Added)
+	if fits(msg) != nil {
+		return errors.New(fmt.Sprintf("Too many reactions on message %d", id))
+	}
+
+	err = s.Store.Update(msg)
+	if err != nil {
+		return err
+	}
+
+	p, err := shared.PacketFromMessage(shared.KIND_REACTION, reaction)
+	if err != nil {
+		return err
+	}
+
+	s.BroadcastRoom(room, p)
+	return nil
+}
@@ -0,0 +1,272 @@
+package tcp_server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+const (
+	DEFAULT_RESUME_WINDOW  = 5 * time.Minute
+	DEFAULT_RESUME_BACKLOG = 256
+	// How many acks are remembered per login, to recognize messages sent again
+	MAX_REMEMBERED_ACKS = 256
+)
+
+var UsernameTaken = errors.New("Username is taken.")
+
+// resumeState is what the server remembers about a login, so a client
+// can resume it with the token after losing its connection.
+type resumeState struct {
+	username string
+	// nil while no connection is using the state
+	session *Session
+	// Rooms the session was in when it was detached
+	rooms []string
+	// Messages sent to rooms while detached
+	missed  []*shared.Packet
+	expires time.Time
+	// The latest acks sent, by nonce, oldest first in ackOrder
+	acks     map[uint64]shared.Ack
+	ackOrder []uint64
+}
+
+func (r *resumeState) expired(now time.Time) bool {
+	return r.session == nil && now.After(r.expires)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// attach gives session the login of token, if the token is known and has not expired.
+// A connection still using the token is closed, as it has been replaced by session.
+// It returns the state of the login, with the rooms it was in and the messages
+// missed while no connection was using the token.
+func (s *Server) attach(token string, session *Session) (resumeState, bool) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	state, ok := s.resumes[token]
+	if !ok || state.expired(time.Now()) {
+		return resumeState{}, false
+	}
+
+	var rooms []string
+	if state.session != nil {
+		rooms = state.session.Rooms()
+		state.session.Close()
+	} else {
+		rooms = state.rooms
+	}
+
+	resumed := *state
+	resumed.rooms = rooms
+
+	state.session = session
+	state.missed = nil
+	state.rooms = nil
+
+	return resumed, true
+}
+
+// register creates a new token for the username, unless it is used by another login.
+// A fresh login takes over a detached session of the same user, which can then no
+// longer be resumed.
+func (s *Server) register(username string, session *Session) (string, error) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	now := time.Now()
+	for token, state := range s.resumes {
+		if state.expired(now) {
+			delete(s.resumes, token)
+			continue
+		}
+
+		if state.username != username {
+			continue
+		}
+
+		if state.session != nil {
+			return "", UsernameTaken
+		}
+
+		delete(s.resumes, token)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.resumes[token] = &resumeState{
+		username: username,
+		session:  session,
+	}
+
+	return token, nil
+}
+
+// Rename changes the username of the session, unless it is used by another login,
+// belongs to a stored user, whose roles and memberships would be taken over, or has a
+// server role waiting for its user to log in
+func (s *Server) Rename(session *Session, username string) error {
+	err := validateUsername(username)
+	if err != nil {
+		return err
+	}
+
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	state, ok := s.resumes[session.resumeToken()]
+	if !ok || state.session != session {
+		return errors.New("Session is not logged in")
+	}
+
+	now := time.Now()
+	for _, other := range s.resumes {
+		if other != state && !other.expired(now) && other.username == username {
+			return UsernameTaken
+		}
+	}
+
+	if username != state.username {
+		_, exists, err := s.Storage.User(username)
+		if err != nil {
+			return err
+		}
+		if exists || s.ServerRole(username) > ROLE_MEMBER {
+			return UsernameTaken
+		}
+	}
+
+	err = s.checkBanned("", username)
+	if err != nil {
+		return err
+	}
+
+	err = s.Storage.RenameUser(state.username, username)
+	if err != nil {
+		return err
+	}
+
+	state.username = username
+	session.setLogin(username, session.resumeToken())
+	return nil
+}
+
+// forget drops every login of the user, so it cannot be resumed
+func (s *Server) forget(username string) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	for token, state := range s.resumes {
+		if state.username == username {
+			delete(s.resumes, token)
+		}
+	}
+}
+
+// ackFor returns the ack already sent for the nonce by the login of session
+func (s *Server) ackFor(session *Session, nonce uint64) (shared.Ack, bool) {
+	if nonce == 0 {
+		return shared.Ack{}, false
+	}
+
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	state, ok := s.resumes[session.resumeToken()]
+	if !ok {
+		return shared.Ack{}, false
+	}
+
+	ack, ok := state.acks[nonce]
+	return ack, ok
+}
+
+// sentBy reports whether the message with the ID is among the latest messages
+// acknowledged to the login of session
+func (s *Server) sentBy(session *Session, id uint64) bool {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	state, ok := s.resumes[session.resumeToken()]
+	if !ok {
+		return false
+	}
+
+	for _, ack := range state.acks {
+		if ack.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) rememberAck(session *Session, ack shared.Ack) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	state, ok := s.resumes[session.resumeToken()]
+	if !ok {
+		return
+	}
+
+	if state.acks == nil {
+		state.acks = make(map[uint64]shared.Ack)
+	}
+
+	state.acks[ack.Nonce] = ack
+	state.ackOrder = append(state.ackOrder, ack.Nonce)
+	if len(state.ackOrder) > MAX_REMEMBERED_ACKS {
+		delete(state.acks, state.ackOrder[0])
+		state.ackOrder = state.ackOrder[1:]
+	}
+}
+
+// detach marks the login of session as unused, so it can be resumed until
+// the resume window runs out.
+func (s *Server) detach(session *Session) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	state, ok := s.resumes[session.resumeToken()]
+	if !ok || state.session != session {
+		return
+	}
+
+	state.session = nil
+	state.rooms = session.Rooms()
+	state.expires = time.Now().Add(s.ResumeWindow)
+}
+
+func (s *Server) keepForDetached(room string, p *shared.Packet) {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	now := time.Now()
+	for _, state := range s.resumes {
+		if state.session != nil || state.expired(now) || !slices.Contains(state.rooms, room) {
+			continue
+		}
+
+		state.missed = append(state.missed, p)
+		if len(state.missed) > s.MaxResumeBacklog {
+			state.missed = state.missed[len(state.missed)-s.MaxResumeBacklog:]
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+const MAX_ROOM_NAME_LEN = 32
+
+var InvalidRoom = errors.New("Invalid room.")
+
+func validateRoom(room string) error {
+	if room == "" {
+		return errors.Join(InvalidRoom, errors.New("Room name cannot be empty"))
+	}
+
+	if len(room) > MAX_ROOM_NAME_LEN {
+		return errors.Join(InvalidRoom, errors.New(fmt.Sprintf("Room name cannot be longer than %d characters", MAX_ROOM_NAME_LEN)))
+	}
+
+	if strings.ContainsAny(room, " \t\r\n") {
+		return errors.Join(InvalidRoom, errors.New("Room name cannot contain whitespace"))
+	}
+
+	return nil
+}
+
+// Join adds the session to the room, creating the room if it does not exist,
+// and confirms it to the client. The newest messages of the room follow the
+// confirmation, unless the session already was in the room.
+func (s *Server) Join(session *Session, room string) error {
+	err := validateRoom(room)
+	if err != nil {
+		return err
+	}
+
+	err = s.checkBanned(room, session.Username())
+	if err != nil {
+		return err
+	}
+
+	err = s.saveMembership(session.Username(), room)
+	if err != nil {
+		return err
+	}
+
+	joined := !session.InRoom(room)
+	s.addToRoom(session, room)
+
+	p, err := shared.PacketFromMessage(shared.KIND_JOIN, shared.Join{Room: room})
+	if err != nil {
+		return err
+	}
+
+	err = session.WritePacket(p)
+	if err != nil || !joined {
+		return err
+	}
+
+	historyOnJoin := s.live().historyOnJoin
+	err = s.sendRoomPresence(session, room)
+	if err != nil || historyOnJoin <= 0 {
+		return err
+	}
+
+	return s.SendHistory(session, room, 0, 0, historyOnJoin)
+}
+
+func (s *Server) addToRoom(session *Session, room string) {
+	s.roomsMu.Lock()
+	members, ok := s.rooms[room]
+	if !ok {
+		members = make(map[*Session]bool)
+		s.rooms[room] = members
+	}
+	members[session] = true
+	s.roomsMu.Unlock()
+
+	session.addRoom(room)
+}
+
+// Leave removes the session from the room, and confirms it to the client.
+func (s *Server) Leave(session *Session, room string) error {
+	if !session.InRoom(room) {
+		return errors.Join(InvalidRoom, errors.New(fmt.Sprintf("Not in room '%s'", room)))
+	}
+
+	err := s.Storage.RemoveMembership(session.Username(), room)
+	if err != nil {
+		return err
+	}
+
+	s.removeFromRoom(session, room)
+
+	p, err := shared.PacketFromMessage(shared.KIND_LEAVE, shared.Leave{Room: room})
+	if err != nil {
+		return err
+	}
+
+	return session.WritePacket(p)
+}
+
+func (s *Server) removeFromRoom(session *Session, room string) {
+	s.roomsMu.Lock()
+	members := s.rooms[room]
+	delete(members, session)
+	if len(members) == 0 {
+		delete(s.rooms, room)
+	}
+	s.roomsMu.Unlock()
+
+	session.removeRoom(room)
+}
+
+// leaveAll removes the session from every room, without telling the client
+func (s *Server) leaveAll(session *Session) {
+	for _, room := range session.Rooms() {
+		s.removeFromRoom(session, room)
+	}
+}
+
+// Rooms returns the name of every room with at least one member
+func (s *Server) Rooms() []string {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Members returns every session in the room
+func (s *Server) Members(room string) []*Session {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	members := make([]*Session, 0, len(s.rooms[room]))
+	for session := range s.rooms[room] {
+		members = append(members, session)
+	}
+
+	return members
+}
+
+// BroadcastRoom writes the packet to every member of the room, and keeps it
+// for detached sessions that were in the room, so they can get it on resume.
+func (s *Server) BroadcastRoom(room string, p *shared.Packet) {
+	for _, session := range s.Members(room) {
+		session.WritePacket(p)
+	}
+
+	s.keepForDetached(room, p)
+}
+
+// saveMembership stores that the user is in the room, and the room if it is new.
+// The user creating a room owns it if the user has a secret, except for the default room.
+func (s *Server) saveMembership(username string, room string) error {
+	_, ok, err := s.Storage.Room(room)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		now := time.Now()
+		err = s.Storage.SaveRoom(RoomRecord{Name: room, Created: now})
+		if err == nil && room != shared.DEFAULT_ROOM && s.hasSecret(username) {
+			err = s.Storage.SetRole(RoleRecord{Room: room, Username: username, Role: ROLE_OWNER, Created: now})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Storage.AddMembership(username, room)
+}
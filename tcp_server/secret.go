@@ -0,0 +1,73 @@
+package tcp_server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+var WrongSecret = errors.New("Wrong secret.")
+
+func hashSecret(salt []byte, secret string) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), secret...))
+	return sum[:]
+}
+
+// HasSecret reports whether the user logs in with a secret
+func (u UserRecord) HasSecret() bool {
+	return len(u.SecretHash) > 0
+}
+
+// SetSecret keeps the hash of the secret, with a new salt
+func (u *UserRecord) SetSecret(secret string) error {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+
+	u.SecretSalt = salt
+	u.SecretHash = hashSecret(salt, secret)
+	return nil
+}
+
+// CheckSecret reports whether secret is the secret of the user
+func (u UserRecord) CheckSecret(secret string) bool {
+	return u.HasSecret() && subtle.ConstantTimeCompare(hashSecret(u.SecretSalt, secret), u.SecretHash) == 1
+}
+
+// hasSecret reports whether the stored user has a secret. Only users with a secret
+// can be given roles, as anyone can log in with the name of a user without one.
+func (s *Server) hasSecret(username string) bool {
+	user, ok, err := s.Storage.User(username)
+	if err != nil {
+		fmt.Printf("ERROR: reading user %s: %s\n", username, err)
+		return false
+	}
+
+	return ok && user.HasSecret()
+}
+
+// authenticate checks the secret given to log in as the user. Users with a secret need
+// it, and users with a server role cannot log in before they have one.
+func (s *Server) authenticate(username string, secret string) error {
+	user, ok, err := s.Storage.User(username)
+	if err != nil {
+		return err
+	}
+
+	if ok && user.HasSecret() {
+		if !user.CheckSecret(secret) {
+			return errors.Join(WrongSecret, errors.New(fmt.Sprintf("%s logs in with a secret", username)))
+		}
+		return nil
+	}
+
+	if role := s.ServerRole(username); role > ROLE_MEMBER {
+		return errors.Join(NotAllowed, errors.New(fmt.Sprintf("%s is a server %s without a secret, log in with a secret before getting the role", username, role)))
+	}
+
+	return nil
+}
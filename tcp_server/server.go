@@ -1,54 +1,262 @@
 package tcp_server
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/TobiasTheDanish/tcp-chat/shared"
 	"github.com/TobiasTheDanish/tcp-chat/tcp_server/internal/ip"
 )
 
-type ConnectionHandler func(net.Conn, chan *shared.Packet)
+type ConnectionHandler func(*Session, chan *shared.Packet)
 
 type Server struct {
-	Conns   []net.Conn
-	PChan   chan *shared.Packet
-	handler ConnectionHandler
+	Conns []*Session
+	PChan chan *shared.Packet
+	// Compression offered to clients when they connect
+	Compression shared.Hello
+	// Records every packet of every session when set
+	Recorder *shared.Recorder
+	// How often sessions are pinged, 0 disables pings and read deadlines
+	PingInterval time.Duration
+	// Sessions are closed after this many pings in a row go unanswered
+	MaxMissedPongs int
+	// How long a disconnected session can be resumed
+	ResumeWindow time.Duration
+	// How many missed messages are kept for a disconnected session
+	MaxResumeBacklog int
+	// Stores the messages sent to rooms, nil disables history
+	Store MessageStore
+	// Keeps users, rooms and memberships across restarts
+	Storage Storage
+	// How many stored messages are sent to a user joining a room
+	HistoryOnJoin int
+	// Users are marked away after being idle this long, 0 disables it
+	AwayAfter time.Duration
+	// Users owning the whole server, who can give server roles
+	Owners []string
+	// Users moderating every room, who can also edit and delete the messages of others
+	Moderators []string
+	// Largest file passed on between users, 0 disables file transfer
+	MaxFileSize int64
+	// Rate limits for sessions and remote IPs
+	Limits RateLimits
+	// Message of the day, sent to users when they log in
+	MOTD string
+	// Carries the connections of clients, shared.NetTransport unless set
+	Transport shared.Transport
+	// Only TLS connections are accepted when set, over any transport
+	TLS *tls.Config
+	// Origins of web pages allowed to open WebSocket connections besides the server itself,
+	// see shared.WebSocketTransport
+	AllowedOrigins []string
+	// The host or host:port printed for clients to connect to, instead of the addresses of the machine
+	Advertise string
+	// Finds the addresses of the machine printed for clients to connect to, the addresses of
+	// the network interfaces unless set
+	Interfaces func() ([]net.IP, error)
+	// Name of the server in discovery replies
+	Name string
+	// UDP port discovery probes are answered on, 0 disables discovery
+	DiscoveryPort int
+	// Guards the settings Reload can change
+	settingsMu sync.RWMutex
+	handler    ConnectionHandler
+	connsMu    sync.Mutex
+	sessionId  atomic.Uint32
+	rooms      map[string]map[*Session]bool
+	roomsMu    sync.Mutex
+	resumes    map[string]*resumeState
+	resumeMu   sync.Mutex
+	commands   map[string]CommandSpec
+	commandsMu sync.Mutex
+	// Held while changing a stored message, so concurrent changes are not lost
+	changeMu    sync.Mutex
+	transfers   map[uint64]*transfer
+	transfersMu sync.Mutex
+	ips         map[string]*ipLimits
+	ipsMu       sync.Mutex
 }
 
 func Create(handler ConnectionHandler) Server {
 	return Server{
-		Conns:   make([]net.Conn, 0),
-		PChan:   make(chan *shared.Packet),
-		handler: handler,
+		Conns: make([]*Session, 0),
+		PChan: make(chan *shared.Packet),
+		Compression: shared.Hello{
+			Compression: shared.COMPRESSION_DEFLATE,
+			Threshold:   shared.DEFAULT_COMPRESSION_THRESHOLD,
+		},
+		PingInterval:     shared.DEFAULT_PING_INTERVAL,
+		MaxMissedPongs:   shared.DEFAULT_MAX_MISSED_PONGS,
+		ResumeWindow:     DEFAULT_RESUME_WINDOW,
+		MaxResumeBacklog: DEFAULT_RESUME_BACKLOG,
+		Store:            NewMemoryStore(DEFAULT_HISTORY_SIZE),
+		HistoryOnJoin:    DEFAULT_HISTORY_ON_JOIN,
+		Storage:          NewMemoryStorage(),
+		AwayAfter:        DEFAULT_AWAY_AFTER,
+		MaxFileSize:      shared.DEFAULT_MAX_FILE_SIZE,
+		Name:             hostname(),
+		DiscoveryPort:    shared.DISCOVERY_PORT,
+		Limits:           DefaultRateLimits(),
+		Transport:        shared.NetTransport{},
+		Interfaces:       ip.Addresses,
+		handler:          handler,
+		rooms:            make(map[string]map[*Session]bool),
+		resumes:          make(map[string]*resumeState),
+		commands:         defaultCommands(),
+		transfers:        make(map[uint64]*transfer),
+		ips:              make(map[string]*ipLimits),
 	}
 }
 
-func (s *Server) Start(port string) error {
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("0.0.0.0:%s", port))
+// Start listens on every address of the transport, and accepts connections on all of them in
+// the background. For shared.NetTransport an address is a host:port, only a port, or the path
+// of a unix socket, see shared.SplitAddress. Addresses starting with shared.WEBSOCKET_PREFIX
+// accept WebSocket connections from browsers. Sessions work the same whichever address they connected to.
+func (s *Server) Start(addresses ...string) error {
+	if len(addresses) == 0 {
+		return errors.New("No address to listen on")
+	}
 
-	if err != nil {
-		return err
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		listener, err := s.listen(address)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	// Discovery and the advertised address use the port of the first TCP listener for native clients
+	port := 0
+	for i, listener := range listeners {
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if ok && !strings.HasPrefix(addresses[i], shared.WEBSOCKET_PREFIX) {
+			port = addr.Port
+			break
+		}
+	}
+
+	if s.Advertise != "" && port > 0 {
+		fmt.Printf("Connect here: %s\n", s.Advertised(port))
 	}
+	for i, listener := range listeners {
+		address, websocket := strings.CutPrefix(addresses[i], shared.WEBSOCKET_PREFIX)
+		network, _ := shared.SplitAddress(address)
 
-	ip, err := ip.ExternalIP()
+		scheme := ""
+		if websocket && s.TLS != nil {
+			scheme = "wss://"
+		} else if websocket {
+			scheme = "ws://"
+		}
+		s.advertise(network, listener.Addr(), scheme)
+	}
+
+	if s.TLS != nil {
+		fmt.Println("Only accepting TLS connections")
+	}
+	for _, listener := range listeners {
+		go s.accept(listener)
+	}
+
+	if s.DiscoveryPort > 0 && port > 0 {
+		s.startDiscovery(s.DiscoveryPort, port)
+	}
+	go s.watchPresence()
+
+	return nil
+}
+
+// listen listens on the address with the transport of the server, under TLS when it is set
+func (s *Server) listen(address string) (net.Listener, error) {
+	transport := s.Transport
+	if s.TLS != nil {
+		transport = shared.TLSTransport{Transport: transport, Config: s.TLS}
+	}
+
+	if addr, ok := strings.CutPrefix(address, shared.WEBSOCKET_PREFIX); ok {
+		return shared.WebSocketTransport{Transport: transport, AllowedOrigins: s.AllowedOrigins}.Listen(addr)
+	}
+
+	return transport.Listen(address)
+}
+
+// Advertised returns the Advertise address, with the port when it does not pin one
+func (s *Server) Advertised(port int) string {
+	host, pinnedPort, err := net.SplitHostPort(s.Advertise)
 	if err != nil {
-		return err
+		return net.JoinHostPort(s.Advertise, strconv.Itoa(port))
 	}
 
-	fmt.Printf("Connect here: %s:%s\n", ip, port)
+	return net.JoinHostPort(host, pinnedPort)
+}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
+// advertise prints the addresses clients can connect to a listener on. TCP listeners are
+// left out when the Advertise address is set, otherwise every address of the machine the
+// listener is reachable on is printed. Failing to find them never stops the server.
+// WebSocket listeners have the scheme of their URL, and are always printed.
+func (s *Server) advertise(network string, addr net.Addr, scheme string) {
+	url := func(address string) string {
+		if scheme != "" {
+			return scheme + address + "/"
+		}
+		return address
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		if _, ok := addr.(*net.UnixAddr); ok && scheme != "" {
+			fmt.Printf("Connect here: %s%s%s\n", shared.WEBSOCKET_PREFIX, shared.UNIX_PREFIX, addr)
+		} else if ok {
+			fmt.Printf("Connect here: %s%s\n", shared.UNIX_PREFIX, addr)
+		} else {
+			fmt.Printf("Connect here: %s (%s)\n", addr, addr.Network())
+		}
+		return
+	}
+
+	if s.Advertise != "" && scheme == "" {
+		return
+	}
 
+	if !tcpAddr.IP.IsUnspecified() {
+		fmt.Printf("Connect here: %s\n", url(tcpAddr.String()))
+		return
+	}
+
+	ips, err := s.Interfaces()
 	if err != nil {
-		return err
+		fmt.Printf("Could not find the addresses of this machine: %s\n", err)
 	}
-	go s.accept(listener)
 
-	return nil
+	port := strconv.Itoa(tcpAddr.Port)
+	found := false
+	for _, ip := range ips {
+		// 0.0.0.0 only listens on IPv4, and [::] only on IPv6
+		if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+			continue
+		}
+		fmt.Printf("Connect here: %s\n", url(net.JoinHostPort(ip.String(), port)))
+		found = true
+	}
+
+	if !found {
+		fmt.Printf("No network addresses found, connect from this machine with %s\n", url(net.JoinHostPort("localhost", port)))
+	}
 }
 
-func (s *Server) accept(listener *net.TCPListener) {
+func (s *Server) accept(listener net.Listener) {
 	for {
 		// Accept new connections
 		conn, err := listener.Accept()
@@ -56,9 +264,86 @@ func (s *Server) accept(listener *net.TCPListener) {
 			fmt.Println(err)
 			return
 		}
-		s.Conns = append(s.Conns, conn)
 		fmt.Printf("New connection from Local IP: %s\n", conn.LocalAddr().String())
+		if ban, ok := s.bannedAddr(conn.RemoteAddr()); ok {
+			fmt.Printf("Refused %s, banned%s\n", conn.RemoteAddr(), describeSanction(ban.By, ban.Reason, ban.Expires))
+			conn.Close()
+			continue
+		}
+		ip := remoteIP(conn.RemoteAddr())
+		if err := s.admit(ip); err != nil {
+			fmt.Printf("Refused %s, %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
 		// Handle new connections in a Goroutine for concurrency
-		go s.handler(conn, s.PChan)
+		heartbeat := shared.NewHeartbeat(s.PingInterval, s.MaxMissedPongs)
+		go s.handle(newSession(s.sessionId.Add(1), s, conn, s.Recorder, heartbeat))
+	}
+}
+
+func (s *Server) handle(session *Session) {
+	defer s.release(session.IP())
+
+	err := session.negotiate(s.Compression)
+	if err != nil {
+		fmt.Printf("ERROR: negotiating with %s: %s\n", session.RemoteAddr(), err)
+		session.Close()
+		return
+	}
+
+	s.connsMu.Lock()
+	s.Conns = append(s.Conns, session)
+	s.connsMu.Unlock()
+
+	go session.keepalive()
+	s.handler(session, s.PChan)
+
+	session.Close()
+	s.seen(session)
+	mates := s.roomMates(session)
+	s.dropTransfers(session)
+	s.detach(session)
+	s.leaveAll(session)
+	s.remove(session)
+	s.goOffline(session, mates)
+}
+
+func (s *Server) remove(session *Session) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for i, conn := range s.Conns {
+		if conn == session {
+			s.Conns = append(s.Conns[:i], s.Conns[i+1:]...)
+			return
+		}
 	}
 }
+
+// Broadcast writes the packet to every connected session
+func (s *Server) Broadcast(p *shared.Packet) {
+	s.connsMu.Lock()
+	conns := make([]*Session, len(s.Conns))
+	copy(conns, s.Conns)
+	s.connsMu.Unlock()
+
+	for _, conn := range conns {
+		conn.WritePacket(p)
+	}
+}
+
+// SessionByUsername returns the connected session logged in as username, or nil
+func (s *Server) SessionByUsername(username string) *Session {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for _, conn := range s.Conns {
+		if conn.Username() == username {
+			return conn
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package tcp_server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// Session is a single client connection, with the settings negotiated
+// with that client.
+type Session struct {
+	id        uint32
+	server    *Server
+	conn      net.Conn
+	reader    *bufio.Reader
+	settings  shared.Hello
+	recorder  *shared.Recorder
+	heartbeat *shared.Heartbeat
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
+	// Only used by the goroutine reading from the session
+	limits sessionLimits
+
+	mu         sync.Mutex
+	username   string
+	token      string
+	rooms      map[string]bool
+	status     shared.PresenceStatus
+	manualAway bool
+	// When the client last sent something other than a ping or pong
+	lastActive time.Time
+	// Whether the session is typing, and when it last started, by room
+	typing map[string]typingState
+}
+
+func newSession(id uint32, server *Server, conn net.Conn, recorder *shared.Recorder, heartbeat *shared.Heartbeat) *Session {
+	limits := server.live().limits
+
+	return &Session{
+		id:         id,
+		server:     server,
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		recorder:   recorder,
+		heartbeat:  heartbeat,
+		done:       make(chan struct{}),
+		rooms:      make(map[string]bool),
+		typing:     make(map[string]typingState),
+		lastActive: time.Now(),
+		limits: sessionLimits{
+			messages: NewBucket(limits.SessionMessages),
+			bytes:    NewBucket(limits.SessionBytes),
+		},
+	}
+}
+
+func (s *Session) ID() uint32 {
+	return s.id
+}
+
+// IP returns the IP address the client connected from
+func (s *Session) IP() string {
+	return remoteIP(s.RemoteAddr())
+}
+
+// Username returns the username the session logged in with,
+// or an empty string before the session has logged in.
+func (s *Session) Username() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.username
+}
+
+func (s *Session) setLogin(username string, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.username = username
+	s.token = token
+}
+
+func (s *Session) resumeToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.token
+}
+
+func (s *Session) InRoom(room string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rooms[room]
+}
+
+// Rooms returns every room the session is in
+func (s *Session) Rooms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (s *Session) addRoom(room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rooms[room] = true
+}
+
+func (s *Session) removeRoom(room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, room)
+}
+
+// negotiate reads the Hello sent by the client, and replies with the
+// settings that will be used for the rest of the connection.
+func (s *Session) negotiate(local shared.Hello) error {
+	p, err := s.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	var remote shared.Hello
+	err = p.IntoMessage(&remote)
+	if err != nil {
+		return err
+	}
+
+	agreed := shared.Negotiate(local, remote)
+
+	reply, err := shared.PacketFromMessage(shared.KIND_HELLO, agreed)
+	if err != nil {
+		return err
+	}
+
+	err = s.WritePacket(reply)
+	if err != nil {
+		return err
+	}
+
+	s.settings = agreed
+	return nil
+}
+
+// ReadPacket returns the next packet sent by the client. Pings are answered
+// and pongs are recorded, without being returned. Packets going over the rate
+// limits are dropped.
+func (s *Session) ReadPacket() (*shared.Packet, error) {
+	for {
+		if s.heartbeat.Enabled() {
+			s.conn.SetReadDeadline(time.Now().Add(s.heartbeat.ReadTimeout()))
+		}
+
+		p, err := shared.ParsePacket(s.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		s.record(shared.DIRECTION_IN, p)
+
+		// Limited before pings are answered, so flooding pings is limited too
+		if !s.server.allow(s, p) {
+			if s.Closed() {
+				return nil, net.ErrClosed
+			}
+			continue
+		}
+
+		handled, err := s.heartbeat.HandleKeepalive(p, s.WritePacket)
+		if err != nil {
+			return nil, err
+		}
+
+		if !handled {
+			return p, nil
+		}
+	}
+}
+
+// keepalive pings the client on every interval of the heartbeat,
+// and closes the session when too many pings go unanswered.
+func (s *Session) keepalive() {
+	if !s.heartbeat.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(s.heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			ping, err := s.heartbeat.NextPing()
+			if err != nil {
+				fmt.Printf("Closing session %d: %s\n", s.id, err)
+				s.Close()
+				return
+			}
+
+			err = s.WritePacket(ping)
+			if err != nil {
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+// Latency returns the round trip time measured by the latest ping,
+// or 0 if no ping has been answered yet.
+func (s *Session) Latency() time.Duration {
+	if s.heartbeat == nil {
+		return 0
+	}
+
+	return s.heartbeat.RTT()
+}
+
+func (s *Session) WritePacket(p *shared.Packet) error {
+	s.record(shared.DIRECTION_OUT, p)
+
+	p, err := s.settings.CompressFor(p)
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	_, err = s.conn.Write(p.Encode())
+	return err
+}
+
+func (s *Session) SendMessage(kind shared.MessageKind, msg interface{}) error {
+	p, err := shared.PacketFromMessage(kind, msg)
+	if err != nil {
+		return err
+	}
+
+	return s.WritePacket(p)
+}
+
+func (s *Session) SendError(msg string) error {
+	return s.SendMessage(shared.KIND_ERROR, shared.ErrorMessage{Msg: msg})
+}
+
+// SendCommandError sends an error caused by the command
+func (s *Session) SendCommandError(command string, msg string) error {
+	return s.SendMessage(shared.KIND_ERROR, shared.ErrorMessage{Msg: msg, Command: command})
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Closed reports whether the session has been closed
+func (s *Session) Closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+	})
+
+	return err
+}
+
+func (s *Session) record(direction byte, p *shared.Packet) {
+	if s.recorder == nil {
+		return
+	}
+
+	err := s.recorder.Record(s.id, direction, p)
+	if err != nil {
+		fmt.Printf("ERROR: recording session %d: %s\n", s.id, err)
+	}
+}
@@ -0,0 +1,640 @@
+package tcp_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+const (
+	TABLE_USERS       = "users"
+	TABLE_ROOMS       = "rooms"
+	TABLE_MEMBERSHIPS = "memberships"
+	TABLE_BANS        = "bans"
+	TABLE_MESSAGES    = "messages"
+	TABLE_REVISIONS   = "revisions"
+	TABLE_THREADS     = "threads"
+	TABLE_ROLES       = "roles"
+	TABLE_MUTES       = "mutes"
+	TABLE_AUDIT       = "audit"
+)
+
+const (
+	BAN_USERNAME = "username"
+	BAN_IP       = "ip"
+)
+
+type UserRecord struct {
+	Username string
+	Created  time.Time
+	LastSeen time.Time
+	// The salted SHA-256 of the secret of the user, empty for users without a secret
+	SecretSalt []byte
+	SecretHash []byte
+}
+
+type RoomRecord struct {
+	Name    string
+	Created time.Time
+}
+
+// BanRecord bans a username or an IP address, Kind is BAN_USERNAME or BAN_IP
+type BanRecord struct {
+	Kind   string
+	Target string
+	// Empty for a ban from the whole server
+	Room   string
+	Reason string
+	By     string
+	// The role By had when giving the ban, lifting it takes a higher role
+	Role    Role
+	Created time.Time
+	// Zero for a ban that never expires
+	Expires time.Time
+}
+
+func banKey(room string, kind string, target string) string {
+	if room == "" {
+		return kind + ":" + target
+	}
+
+	return room + "\x00" + kind + ":" + target
+}
+
+// Expired reports whether the ban has run out at now
+func (b BanRecord) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// RoleRecord gives a user a role in a room, or on the whole server when Room is empty
+type RoleRecord struct {
+	Room     string
+	Username string
+	Role     Role
+	By       string
+	Created  time.Time
+}
+
+// MuteRecord stops a user from talking in a room, or in every room when Room is empty
+type MuteRecord struct {
+	Room     string
+	Username string
+	Reason   string
+	By       string
+	Created  time.Time
+	// Zero for a mute that never expires
+	Expires time.Time
+}
+
+// Expired reports whether the mute has run out at now
+func (m MuteRecord) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+// AuditRecord is a moderation action kept in the audit log
+type AuditRecord struct {
+	ID     uint64
+	Time   time.Time
+	By     string
+	Action string
+	Target string
+	// Empty for an action on the whole server
+	Room    string
+	Reason  string
+	Expires time.Time
+}
+
+// Storage keeps the state of the server that should survive a restart
+type Storage interface {
+	MessageStore
+	User(username string) (UserRecord, bool, error)
+	SaveUser(user UserRecord) error
+	// RenameUser moves the user and its memberships to the new username
+	RenameUser(old string, username string) error
+	Room(name string) (RoomRecord, bool, error)
+	SaveRoom(room RoomRecord) error
+	Rooms() ([]RoomRecord, error)
+	// Memberships returns the rooms of the user, sorted
+	Memberships(username string) ([]string, error)
+	// RoomMembers returns the users that are in the room, sorted
+	RoomMembers(room string) ([]string, error)
+	AddMembership(username string, room string) error
+	RemoveMembership(username string, room string) error
+	Bans() ([]BanRecord, error)
+	AddBan(ban BanRecord) error
+	RemoveBan(room string, kind string, target string) error
+	// Role returns the role given to the user in the room, or on the whole server for an empty room
+	Role(room string, username string) (RoleRecord, bool, error)
+	// Roles returns every role given in the room, or on the whole server for an empty room
+	Roles(room string) ([]RoleRecord, error)
+	// SetRole gives the user the role, ROLE_MEMBER takes the given role away
+	SetRole(role RoleRecord) error
+	// Mute returns the mute of the user in the room, or in every room for an empty room
+	Mute(room string, username string) (MuteRecord, bool, error)
+	AddMute(mute MuteRecord) error
+	RemoveMute(room string, username string) error
+	// AppendAudit adds an action to the audit log, and returns it with its ID
+	AppendAudit(record AuditRecord) (AuditRecord, error)
+	// Audit returns the latest limit actions taken in the room, or anywhere for an
+	// empty room, oldest first
+	Audit(room string, limit int) ([]AuditRecord, error)
+}
+
+// DBStorage is a Storage kept in a DB. Values are stored as JSON.
+type DBStorage struct {
+	db *DB
+	mu sync.Mutex
+	// IDs of the stored messages of every room, in ascending order
+	messages  map[string][]uint64
+	nextId    uint64
+	nextAudit uint64
+}
+
+// OpenStorage opens the storage in the directory, see OpenDB
+func OpenStorage(dir string) (*DBStorage, error) {
+	db, err := OpenDB(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStorage(db)
+}
+
+// NewMemoryStorage returns a storage that is lost when the server stops
+func NewMemoryStorage() *DBStorage {
+	db, _ := OpenDB("")
+	storage, _ := NewStorage(db)
+	return storage
+}
+
+// NewStorage keeps the storage in db, and indexes the messages already stored
+func NewStorage(db *DB) (*DBStorage, error) {
+	s := &DBStorage{
+		db:        db,
+		messages:  make(map[string][]uint64),
+		nextId:    1,
+		nextAudit: 1,
+	}
+
+	for _, key := range db.Keys(TABLE_MESSAGES) {
+		room, id, err := parseMessageKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		s.messages[room] = append(s.messages[room], id)
+		s.nextId = max(s.nextId, id+1)
+	}
+
+	if keys := db.Keys(TABLE_AUDIT); len(keys) > 0 {
+		var id uint64
+		_, err := fmt.Sscanf(keys[len(keys)-1], "%d", &id)
+		if err != nil {
+			return nil, errors.Join(CorruptRecord, errors.New(fmt.Sprintf("Invalid audit key '%q'", keys[len(keys)-1])))
+		}
+		s.nextAudit = id + 1
+	}
+
+	return s, nil
+}
+
+// Messages are keyed by room and zero padded ID, so the keys sort by room and ID
+func messageKey(room string, id uint64) string {
+	return fmt.Sprintf("%s\x00%020d", room, id)
+}
+
+func parseMessageKey(key string) (string, uint64, error) {
+	room, idString, ok := strings.Cut(key, "\x00")
+
+	var id uint64
+	_, err := fmt.Sscanf(idString, "%d", &id)
+	if !ok || err != nil {
+		return "", 0, errors.Join(CorruptRecord, errors.New(fmt.Sprintf("Invalid message key '%q'", key)))
+	}
+
+	return room, id, nil
+}
+
+func (s *DBStorage) get(table string, key string, v any) (bool, error) {
+	value, ok := s.db.Get(table, key)
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(value, v)
+}
+
+func (s *DBStorage) put(table string, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Put(table, key, value)
+}
+
+func (s *DBStorage) Append(msg shared.Message) (shared.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg.ID = s.nextId
+	err := s.put(TABLE_MESSAGES, messageKey(msg.Room, msg.ID), msg)
+	if err != nil {
+		return msg, err
+	}
+
+	if msg.Parent != 0 {
+		err = s.db.Put(TABLE_THREADS, threadKey(msg.Room, msg.Parent, msg.ID), []byte{})
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	s.nextId += 1
+	s.messages[msg.Room] = append(s.messages[msg.Room], msg.ID)
+	return msg, nil
+}
+
+func (s *DBStorage) Page(room string, before uint64, after uint64, limit int) ([]shared.Message, bool, error) {
+	s.mu.Lock()
+	ids := s.messages[room]
+	start, end, more := pageRange(len(ids), func(i int) uint64 { return ids[i] }, before, after, limit)
+	ids = slices.Clone(ids[start:end])
+	s.mu.Unlock()
+
+	msgs := make([]shared.Message, 0, len(ids))
+	for _, id := range ids {
+		var msg shared.Message
+		_, err := s.get(TABLE_MESSAGES, messageKey(room, id), &msg)
+		if err != nil {
+			return nil, false, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, more, nil
+}
+
+func (s *DBStorage) Get(room string, id uint64) (shared.Message, bool, error) {
+	var msg shared.Message
+	ok, err := s.get(TABLE_MESSAGES, messageKey(room, id), &msg)
+	return msg, ok, err
+}
+
+// Revisions are keyed by the key of the message and their number, oldest first
+func revisionKey(room string, id uint64, n int) string {
+	return fmt.Sprintf("%s\x00%06d", messageKey(room, id), n)
+}
+
+func (s *DBStorage) Update(msg shared.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok, err := s.Get(msg.Room, msg.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Join(MessageNotFound, errors.New(fmt.Sprintf("No message %d in '%s'", msg.ID, msg.Room)))
+	}
+
+	if revised(old, msg) {
+		prefix := messageKey(msg.Room, msg.ID) + "\x00"
+		n := 0
+		for _, key := range s.db.Keys(TABLE_REVISIONS) {
+			if strings.HasPrefix(key, prefix) {
+				n += 1
+			}
+		}
+
+		err = s.put(TABLE_REVISIONS, revisionKey(msg.Room, msg.ID, n), old)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.put(TABLE_MESSAGES, messageKey(msg.Room, msg.ID), msg)
+}
+
+func (s *DBStorage) Revisions(room string, id uint64) ([]shared.Message, error) {
+	prefix := messageKey(room, id) + "\x00"
+
+	msgs := make([]shared.Message, 0)
+	for _, key := range s.db.Keys(TABLE_REVISIONS) {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		var msg shared.Message
+		_, err := s.get(TABLE_REVISIONS, key, &msg)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// Replies are indexed by the key of the message they reply to and their ID
+func threadKey(room string, parent uint64, id uint64) string {
+	return fmt.Sprintf("%s\x00%020d", messageKey(room, parent), id)
+}
+
+func (s *DBStorage) Thread(room string, id uint64) ([]shared.Message, error) {
+	prefix := messageKey(room, id) + "\x00"
+
+	msgs := make([]shared.Message, 0)
+	for _, key := range s.db.Keys(TABLE_THREADS) {
+		idString, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+
+		var reply uint64
+		_, err := fmt.Sscanf(idString, "%d", &reply)
+		if err != nil {
+			return nil, errors.Join(CorruptRecord, errors.New(fmt.Sprintf("Invalid thread key '%q'", key)))
+		}
+
+		msg, ok, err := s.Get(room, reply)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs, nil
+}
+
+func (s *DBStorage) User(username string) (UserRecord, bool, error) {
+	var user UserRecord
+	ok, err := s.get(TABLE_USERS, username, &user)
+	return user, ok, err
+}
+
+func (s *DBStorage) SaveUser(user UserRecord) error {
+	return s.put(TABLE_USERS, user.Username, user)
+}
+
+func (s *DBStorage) RenameUser(old string, username string) error {
+	user, ok, err := s.User(old)
+	if err != nil || !ok {
+		return err
+	}
+
+	rooms, err := s.Memberships(old)
+	if err != nil {
+		return err
+	}
+
+	user.Username = username
+	err = s.SaveUser(user)
+	if err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		err = errors.Join(s.AddMembership(username, room), s.RemoveMembership(old, room))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Roles and mutes follow the user
+	for _, table := range []string{TABLE_ROLES, TABLE_MUTES} {
+		err = s.renameIn(table, old, username)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.db.Delete(TABLE_USERS, old)
+}
+
+// renameIn moves the records of a table keyed by userKey to the new username
+func (s *DBStorage) renameIn(table string, old string, username string) error {
+	for _, key := range s.db.Keys(table) {
+		room, user, _ := strings.Cut(key, "\x00")
+		if user != old {
+			continue
+		}
+
+		value, _ := s.db.Get(table, key)
+		var record map[string]any
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return err
+		}
+		record["Username"] = username
+
+		err = s.put(table, userKey(room, username), record)
+		if err == nil {
+			err = s.db.Delete(table, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *DBStorage) Room(name string) (RoomRecord, bool, error) {
+	var room RoomRecord
+	ok, err := s.get(TABLE_ROOMS, name, &room)
+	return room, ok, err
+}
+
+func (s *DBStorage) SaveRoom(room RoomRecord) error {
+	return s.put(TABLE_ROOMS, room.Name, room)
+}
+
+func (s *DBStorage) Rooms() ([]RoomRecord, error) {
+	keys := s.db.Keys(TABLE_ROOMS)
+
+	rooms := make([]RoomRecord, 0, len(keys))
+	for _, key := range keys {
+		room, _, err := s.Room(key)
+		if err != nil {
+			return nil, err
+		}
+
+		rooms = append(rooms, room)
+	}
+
+	return rooms, nil
+}
+
+// Memberships are keyed by username and room
+func membershipKey(username string, room string) string {
+	return username + "\x00" + room
+}
+
+func (s *DBStorage) Memberships(username string) ([]string, error) {
+	rooms := make([]string, 0)
+	for _, key := range s.db.Keys(TABLE_MEMBERSHIPS) {
+		user, room, _ := strings.Cut(key, "\x00")
+		if user == username {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms, nil
+}
+
+func (s *DBStorage) RoomMembers(room string) ([]string, error) {
+	users := make([]string, 0)
+	for _, key := range s.db.Keys(TABLE_MEMBERSHIPS) {
+		user, r, _ := strings.Cut(key, "\x00")
+		if r == room {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+func (s *DBStorage) AddMembership(username string, room string) error {
+	if _, ok := s.db.Get(TABLE_MEMBERSHIPS, membershipKey(username, room)); ok {
+		return nil
+	}
+
+	return s.db.Put(TABLE_MEMBERSHIPS, membershipKey(username, room), []byte{})
+}
+
+func (s *DBStorage) RemoveMembership(username string, room string) error {
+	return s.db.Delete(TABLE_MEMBERSHIPS, membershipKey(username, room))
+}
+
+func (s *DBStorage) Bans() ([]BanRecord, error) {
+	keys := s.db.Keys(TABLE_BANS)
+
+	bans := make([]BanRecord, 0, len(keys))
+	for _, key := range keys {
+		var ban BanRecord
+		_, err := s.get(TABLE_BANS, key, &ban)
+		if err != nil {
+			return nil, err
+		}
+
+		bans = append(bans, ban)
+	}
+
+	return bans, nil
+}
+
+func (s *DBStorage) AddBan(ban BanRecord) error {
+	return s.put(TABLE_BANS, banKey(ban.Room, ban.Kind, ban.Target), ban)
+}
+
+func (s *DBStorage) RemoveBan(room string, kind string, target string) error {
+	return s.db.Delete(TABLE_BANS, banKey(room, kind, target))
+}
+
+// Roles and mutes are keyed by room and username, with an empty room for the whole server
+func userKey(room string, username string) string {
+	return room + "\x00" + username
+}
+
+func (s *DBStorage) Role(room string, username string) (RoleRecord, bool, error) {
+	var role RoleRecord
+	ok, err := s.get(TABLE_ROLES, userKey(room, username), &role)
+	return role, ok, err
+}
+
+func (s *DBStorage) Roles(room string) ([]RoleRecord, error) {
+	roles := make([]RoleRecord, 0)
+	for _, key := range s.db.Keys(TABLE_ROLES) {
+		r, _, _ := strings.Cut(key, "\x00")
+		if r != room {
+			continue
+		}
+
+		var role RoleRecord
+		_, err := s.get(TABLE_ROLES, key, &role)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+func (s *DBStorage) SetRole(role RoleRecord) error {
+	if role.Role == ROLE_MEMBER {
+		return s.db.Delete(TABLE_ROLES, userKey(role.Room, role.Username))
+	}
+
+	return s.put(TABLE_ROLES, userKey(role.Room, role.Username), role)
+}
+
+func (s *DBStorage) Mute(room string, username string) (MuteRecord, bool, error) {
+	var mute MuteRecord
+	ok, err := s.get(TABLE_MUTES, userKey(room, username), &mute)
+	return mute, ok, err
+}
+
+func (s *DBStorage) AddMute(mute MuteRecord) error {
+	return s.put(TABLE_MUTES, userKey(mute.Room, mute.Username), mute)
+}
+
+func (s *DBStorage) RemoveMute(room string, username string) error {
+	return s.db.Delete(TABLE_MUTES, userKey(room, username))
+}
+
+// Audit records are keyed by their zero padded ID, so the keys sort by ID
+func (s *DBStorage) AppendAudit(record AuditRecord) (AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.ID = s.nextAudit
+	err := s.put(TABLE_AUDIT, fmt.Sprintf("%020d", record.ID), record)
+	if err != nil {
+		return record, err
+	}
+
+	s.nextAudit += 1
+	return record, nil
+}
+
+func (s *DBStorage) Audit(room string, limit int) ([]AuditRecord, error) {
+	keys := s.db.Keys(TABLE_AUDIT)
+
+	records := make([]AuditRecord, 0)
+	for i := len(keys) - 1; i >= 0 && len(records) < limit; i-- {
+		var record AuditRecord
+		_, err := s.get(TABLE_AUDIT, keys[i], &record)
+		if err != nil {
+			return nil, err
+		}
+
+		if room == "" || record.Room == room {
+			records = append(records, record)
+		}
+	}
+
+	slices.Reverse(records)
+	return records, nil
+}
+
+// Compact writes a new snapshot of the database, see DB.Compact
+func (s *DBStorage) Compact() error {
+	return s.db.Compact()
+}
+
+func (s *DBStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,76 @@
+package tcp_server
+
+import (
+	"math"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// threadStart returns the message that started the thread of the message with
+// the ID, which is the message itself unless it is a reply
+func (s *Server) threadStart(session *Session, room string, id uint64) (shared.Message, error) {
+	msg, err := s.stored(session, room, id)
+	if err != nil || msg.Parent == 0 {
+		return msg, err
+	}
+
+	return s.stored(session, room, msg.Parent)
+}
+
+// addReply counts the reply on the message that started its thread, and tells
+// the room the new count
+func (s *Server) addReply(reply shared.Message) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	parent, ok, err := s.Store.Get(reply.Room, reply.Parent)
+	if err != nil || !ok {
+		return err
+	}
+
+	parent.Replies = uint16(min(int(parent.Replies)+1, math.MaxUint16))
+	err = s.Store.Update(parent)
+	if err != nil {
+		return err
+	}
+
+	p, err := shared.PacketFromMessage(shared.KIND_THREAD_INFO, shared.ThreadInfo{
+		Room:      reply.Room,
+		ID:        parent.ID,
+		Replies:   parent.Replies,
+		LastReply: reply.Time,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.BroadcastRoom(reply.Room, p)
+	return nil
+}
+
+// SendThread sends the message that started the thread of the message with the
+// ID to the session, followed by every stored reply and a ThreadInfo
+func (s *Server) SendThread(session *Session, room string, id uint64) error {
+	parent, err := s.threadStart(session, room, id)
+	if err != nil {
+		return err
+	}
+
+	replies, err := s.Store.Thread(room, parent.ID)
+	if err != nil {
+		return err
+	}
+
+	info := shared.ThreadInfo{Room: room, ID: parent.ID, Replies: parent.Replies}
+	for _, msg := range append([]shared.Message{parent}, replies...) {
+		err = session.SendMessage(shared.KIND_THREAD, msg)
+		if err != nil {
+			return err
+		}
+		if msg.Parent != 0 {
+			info.LastReply = msg.Time
+		}
+	}
+
+	return session.SendMessage(shared.KIND_THREAD_INFO, info)
+}
@@ -0,0 +1,249 @@
+package tcp_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"strings"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+var UnknownTransfer = errors.New("Unknown file transfer.")
+
+// transfer is a file being passed on from one session to another
+type transfer struct {
+	offer    shared.FileOffer
+	sender   *Session
+	receiver *Session
+	accepted bool
+	// How many bytes have been passed on, and their SHA-256
+	sent uint64
+	hash hash.Hash
+}
+
+// other returns the session at the other end of the transfer
+func (t *transfer) other(session *Session) *Session {
+	if session == t.sender {
+		return t.receiver
+	}
+
+	return t.sender
+}
+
+// offerFile checks the offer and passes it on to the user it is for.
+// Offers that cannot be passed on are answered with a failed FileDone.
+func (s *Server) offerFile(session *Session, offer shared.FileOffer) error {
+	reject := func(reason string) error {
+		return session.SendMessage(shared.KIND_FILE_DONE, shared.FileDone{Transfer: offer.Transfer, Reason: reason})
+	}
+
+	maxFileSize := s.live().maxFileSize
+	if maxFileSize <= 0 {
+		return reject("File transfer is disabled on this server")
+	}
+
+	if offer.Size > uint64(maxFileSize) {
+		return reject(fmt.Sprintf("Files cannot be larger than %d bytes", maxFileSize))
+	}
+
+	// Only the name is passed on, never a path
+	name := path.Base(strings.ReplaceAll(offer.Name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return reject(fmt.Sprintf("Invalid file name '%s'", offer.Name))
+	}
+
+	sum, err := hex.DecodeString(offer.Sum)
+	if err != nil || len(sum) != sha256.Size {
+		return reject("Sum must be a hex encoded SHA-256")
+	}
+
+	to := s.SessionByUsername(offer.To)
+	if to == nil {
+		return reject(fmt.Sprintf("No user named '%s' is online", offer.To))
+	}
+	if to.Username() == session.Username() {
+		return reject("Cannot send a file to yourself")
+	}
+
+	offer.From = session.Username()
+	offer.To = to.Username()
+	offer.Name = name
+
+	s.transfersMu.Lock()
+	if _, ok := s.transfers[offer.Transfer]; ok || offer.Transfer == 0 {
+		s.transfersMu.Unlock()
+		return reject("Transfer ID already in use")
+	}
+	s.transfers[offer.Transfer] = &transfer{
+		offer:    offer,
+		sender:   session,
+		receiver: to,
+		hash:     sha256.New(),
+	}
+	s.transfersMu.Unlock()
+
+	fmt.Printf("%s offers %s (%d bytes) to %s\n", offer.From, offer.Name, offer.Size, offer.To)
+	return to.SendMessage(shared.KIND_FILE_OFFER, offer)
+}
+
+// transferOf returns the transfer with the ID, if the session is one of its ends.
+// s.transfersMu must be held.
+func (s *Server) transferOf(session *Session, id uint64) (*transfer, error) {
+	t, ok := s.transfers[id]
+	if !ok || (t.sender != session && t.receiver != session) {
+		return nil, errors.Join(UnknownTransfer, errors.New(fmt.Sprintf("No file transfer %d", id)))
+	}
+
+	return t, nil
+}
+
+// answerFile passes the answer of the receiver on to the sender
+func (s *Server) answerFile(session *Session, answer shared.FileAnswer) error {
+	s.transfersMu.Lock()
+	t, err := s.transferOf(session, answer.Transfer)
+	if err == nil && (t.receiver != session || t.accepted) {
+		err = errors.Join(UnknownTransfer, errors.New(fmt.Sprintf("No file offered as transfer %d", answer.Transfer)))
+	}
+	if err != nil {
+		s.transfersMu.Unlock()
+		return err
+	}
+
+	t.accepted = answer.Accept
+	if !answer.Accept {
+		delete(s.transfers, answer.Transfer)
+	}
+	s.transfersMu.Unlock()
+
+	err = t.sender.SendMessage(shared.KIND_FILE_ANSWER, answer)
+	if err != nil || !answer.Accept || t.offer.Size > 0 {
+		return err
+	}
+
+	// Nothing to send for an empty file
+	return s.finishTransfer(t)
+}
+
+// passChunk checks that the chunk continues the file, and passes it on to the receiver.
+// Once the whole file is passed on, the transfer is finished.
+func (s *Server) passChunk(session *Session, chunk shared.FileChunk) error {
+	s.transfersMu.Lock()
+	t, err := s.transferOf(session, chunk.Transfer)
+	if err != nil {
+		s.transfersMu.Unlock()
+		return err
+	}
+
+	reason := ""
+	switch {
+	case t.sender != session || !t.accepted:
+		reason = "Chunk sent before the file was accepted"
+	case chunk.Offset != t.sent:
+		reason = fmt.Sprintf("Expected chunk at offset %d, got %d", t.sent, chunk.Offset)
+	case t.sent+uint64(len(chunk.Data)) > t.offer.Size:
+		reason = "File is larger than offered"
+	}
+
+	if reason != "" {
+		delete(s.transfers, chunk.Transfer)
+		s.transfersMu.Unlock()
+		return s.failTransfer(t, reason)
+	}
+
+	t.hash.Write(chunk.Data)
+	t.sent += uint64(len(chunk.Data))
+	complete := t.sent == t.offer.Size
+	s.transfersMu.Unlock()
+
+	err = t.receiver.SendMessage(shared.KIND_FILE_CHUNK, chunk)
+	if err != nil || !complete {
+		return err
+	}
+
+	return s.finishTransfer(t)
+}
+
+// passProgress passes the progress of the receiver on to the sender
+func (s *Server) passProgress(session *Session, progress shared.FileProgress) error {
+	s.transfersMu.Lock()
+	t, err := s.transferOf(session, progress.Transfer)
+	s.transfersMu.Unlock()
+	// The last progress arrives after the transfer is finished
+	if err != nil || session != t.receiver {
+		return nil
+	}
+
+	return t.sender.SendMessage(shared.KIND_FILE_PROGRESS, progress)
+}
+
+// cancelTransfer ends the transfer when either user gives up on it
+func (s *Server) cancelTransfer(session *Session, done shared.FileDone) error {
+	s.transfersMu.Lock()
+	t, err := s.transferOf(session, done.Transfer)
+	if err == nil {
+		delete(s.transfers, done.Transfer)
+	}
+	s.transfersMu.Unlock()
+	// Cancelling a transfer that just finished or failed is not an error
+	if err != nil {
+		return nil
+	}
+
+	reason := fmt.Sprintf("Cancelled by %s", session.Username())
+	if done.Reason != "" {
+		reason += ": " + done.Reason
+	}
+
+	return t.other(session).SendMessage(shared.KIND_FILE_DONE, shared.FileDone{Transfer: done.Transfer, Reason: reason})
+}
+
+// finishTransfer checks the SHA-256 of the file passed on, and tells both users the result
+func (s *Server) finishTransfer(t *transfer) error {
+	s.transfersMu.Lock()
+	delete(s.transfers, t.offer.Transfer)
+	sum := hex.EncodeToString(t.hash.Sum(nil))
+	s.transfersMu.Unlock()
+
+	if !strings.EqualFold(sum, t.offer.Sum) {
+		return s.failTransfer(t, "SHA-256 of the file does not match the offer")
+	}
+
+	fmt.Printf("%s sent %s (%d bytes) to %s\n", t.offer.From, t.offer.Name, t.offer.Size, t.offer.To)
+
+	done := shared.FileDone{Transfer: t.offer.Transfer, OK: true}
+	return errors.Join(
+		t.sender.SendMessage(shared.KIND_FILE_DONE, done),
+		t.receiver.SendMessage(shared.KIND_FILE_DONE, done),
+	)
+}
+
+// failTransfer tells both users that the transfer failed, it must already be removed
+func (s *Server) failTransfer(t *transfer, reason string) error {
+	done := shared.FileDone{Transfer: t.offer.Transfer, Reason: reason}
+	return errors.Join(
+		t.sender.SendMessage(shared.KIND_FILE_DONE, done),
+		t.receiver.SendMessage(shared.KIND_FILE_DONE, done),
+	)
+}
+
+// dropTransfers fails every transfer of a closed session
+func (s *Server) dropTransfers(session *Session) {
+	s.transfersMu.Lock()
+	dropped := make([]*transfer, 0)
+	for id, t := range s.transfers {
+		if t.sender == session || t.receiver == session {
+			delete(s.transfers, id)
+			dropped = append(dropped, t)
+		}
+	}
+	s.transfersMu.Unlock()
+
+	for _, t := range dropped {
+		done := shared.FileDone{Transfer: t.offer.Transfer, Reason: fmt.Sprintf("%s disconnected", session.Username())}
+		t.other(session).SendMessage(shared.KIND_FILE_DONE, done)
+	}
+}
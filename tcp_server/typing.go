@@ -0,0 +1,78 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+)
+
+// A session has Typing passed on at most this often per room
+const TYPING_RATE_LIMIT = time.Second
+
+// typingState is whether a session is typing in a room, and when it last started
+type typingState struct {
+	started time.Time
+	typing  bool
+}
+
+// allowTyping reports whether a Typing from the session should be passed on. Starts are
+// limited by TYPING_RATE_LIMIT, also across stops, and stops are only passed on after a start.
+func (s *Session) allowTyping(room string, typing bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.typing[room]
+	if !typing {
+		if !state.typing {
+			return false
+		}
+		state.typing = false
+		s.typing[room] = state
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(state.started) < TYPING_RATE_LIMIT {
+		return false
+	}
+
+	s.typing[room] = typingState{started: now, typing: true}
+	return true
+}
+
+// stoppedTyping forgets that the session is typing in the room, once its message is sent
+func (s *Session) stoppedTyping(room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.typing[room]
+	state.typing = false
+	s.typing[room] = state
+}
+
+// handleTyping passes the Typing on to the other members of the room
+func (s *Server) handleTyping(session *Session, typing shared.Typing) error {
+	if !session.InRoom(typing.Room) {
+		return errors.Join(InvalidRoom, errors.New(fmt.Sprintf("Not in room '%s'", typing.Room)))
+	}
+
+	if !session.allowTyping(typing.Room, typing.Typing) {
+		return nil
+	}
+
+	typing.Username = session.Username()
+	p, err := shared.PacketFromMessage(shared.KIND_TYPING, typing)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range s.Members(typing.Room) {
+		if member != session {
+			member.WritePacket(p)
+		}
+	}
+
+	return nil
+}
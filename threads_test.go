@@ -0,0 +1,84 @@
+package shared_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+// sendReply sends the reply from the client, and returns the ID it was stored with
+func sendReply(t *testing.T, client *tcp_client.Client, packets chan *shared.Packet, line string, room string, parent uint64) uint64 {
+	_, err := client.SendReply(line, room, parent)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	var ack shared.Ack
+	receiveKind(t, packets, shared.KIND_ACK, &ack)
+	return ack.ID
+}
+
+func TestThreads(t *testing.T) {
+	pipe := shared.NewPipeTransport()
+	server := startChat(t, pipe, nil, "chat")
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = pipe
+	opts.PingInterval = 0
+
+	alicePackets := make(chan *shared.Packet, 100)
+	alice := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) { alicePackets <- p })
+	bobPackets := make(chan *shared.Packet, 100)
+	bob := connectClient(t, "chat", "bob", opts, func(p *shared.Packet) { bobPackets <- p })
+	waitFor(t, func() bool { return len(alice.Rooms()) > 0 && len(bob.Rooms()) > 0 })
+
+	start := sendReply(t, alice, alicePackets, "start", shared.DEFAULT_ROOM, 0)
+	first := sendReply(t, bob, bobPackets, "first", shared.DEFAULT_ROOM, start)
+	nested := sendReply(t, alice, alicePackets, "nested", shared.DEFAULT_ROOM, first)
+
+	// A reply to a reply joins the thread of the message it replies to
+	msg, ok, err := server.Store.Get(shared.DEFAULT_ROOM, nested)
+	if !ok || err != nil || msg.Parent != start {
+		t.Errorf("Expected the nested reply to belong to %d, got %v, %v, %v", start, msg, ok, err)
+	}
+
+	msg, ok, err = server.Store.Get(shared.DEFAULT_ROOM, start)
+	if !ok || err != nil || msg.Replies != 2 {
+		t.Errorf("Expected the start of the thread to count 2 replies, got %v, %v, %v", msg, ok, err)
+	}
+
+	// Asking for the thread of any of its messages sends the whole thread
+	err = server.SendThread(server.SessionByUsername("alice"), shared.DEFAULT_ROOM, first)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	for _, expected := range []uint64{start, first, nested} {
+		receiveKind(t, alicePackets, shared.KIND_THREAD, &msg)
+		if msg.ID != expected {
+			t.Errorf("Expected message %d of the thread, got %d", expected, msg.ID)
+		}
+	}
+
+	var info shared.ThreadInfo
+	receiveKind(t, alicePackets, shared.KIND_THREAD_INFO, &info)
+	if info.ID != start || info.Replies != 2 || info.LastReply != msg.Time {
+		t.Errorf("Expected 2 replies to %d, the last at %d, got %v", start, msg.Time, info)
+	}
+
+	// Threads of rooms the session is not in are not sent
+	err = server.Join(server.SessionByUsername("bob"), "secret")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	waitFor(t, func() bool { return len(bob.Rooms()) > 1 })
+	hidden := sendReply(t, bob, bobPackets, "hidden", "secret", 0)
+
+	err = server.SendThread(server.SessionByUsername("alice"), "secret", hidden)
+	if !errors.Is(err, tcp_server.InvalidRoom) {
+		t.Errorf("Expected InvalidRoom for a room alice is not in, got: %v", err)
+	}
+}
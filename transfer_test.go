@@ -0,0 +1,222 @@
+package shared_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+)
+
+// transferChat logs in alice and bob, and passes on the IDs of the files offered to bob
+func transferChat(t *testing.T) (*tcp_client.Client, *tcp_client.Client, chan uint64) {
+	transport := shared.NewPipeTransport()
+	startChat(t, transport, nil, "chat")
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	opts.PingInterval = 0
+
+	offers := make(chan uint64, 10)
+	alice := connectClient(t, "chat", "alice", opts, func(p *shared.Packet) {})
+	bob := connectClient(t, "chat", "bob", opts, func(p *shared.Packet) {
+		var offer shared.FileOffer
+		if p.Kind() == shared.KIND_FILE_OFFER && p.IntoMessage(&offer) == nil {
+			offers <- offer.Transfer
+		}
+	})
+
+	return alice, bob, offers
+}
+
+// writeFile writes size random bytes to a new file in dir
+func writeFile(t *testing.T, dir string, name string, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	return path, data
+}
+
+func receiveOffer(t *testing.T, offers chan uint64) uint64 {
+	select {
+	case id := <-offers:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive the offer")
+		return 0
+	}
+}
+
+// finished waits for the transfer to finish on every client
+func finished(t *testing.T, id uint64, clients ...*tcp_client.Client) []tcp_client.Transfer {
+	transfers := make([]tcp_client.Transfer, len(clients))
+	waitFor(t, func() bool {
+		for i, client := range clients {
+			transfer, ok := client.Transfer(id)
+			if !ok || !transfer.Finished() {
+				return false
+			}
+			transfers[i] = transfer
+		}
+		return true
+	})
+
+	return transfers
+}
+
+func TestFileTransfer(t *testing.T) {
+	alice, bob, offers := transferChat(t)
+	dir := t.TempDir()
+
+	// Larger than the window, so the sender waits for progress
+	path, data := writeFile(t, dir, "notes.txt", 3*shared.FILE_WINDOW*shared.FILE_CHUNK_SIZE+7)
+	sent, err := alice.SendFile("bob", path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	id := receiveOffer(t, offers)
+	offered, _ := bob.Transfer(id)
+	if id != sent.Offer.Transfer || offered.Offer.From != "alice" || offered.Offer.Name != "notes.txt" || offered.Offer.Size != uint64(len(data)) {
+		t.Fatalf("Expected the offer of notes.txt from alice, got %+v", offered.Offer)
+	}
+
+	received := filepath.Join(dir, "received")
+	os.Mkdir(received, 0755)
+	_, err = bob.AcceptFile(id, received)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	for _, transfer := range finished(t, id, alice, bob) {
+		if transfer.State != tcp_client.TRANSFER_DONE || transfer.Percent() != 100 {
+			t.Errorf("Expected the transfer to be done, got %s at %d%%: %s", transfer.State, transfer.Percent(), transfer.Reason)
+		}
+	}
+
+	written, err := os.ReadFile(filepath.Join(received, "notes.txt"))
+	if err != nil || !bytes.Equal(written, data) {
+		t.Errorf("Expected the received file to match the one sent (%v)", err)
+	}
+}
+
+// TestFileTransferSumMismatch changes the file after offering it, so the chunks
+// passed on do not match the SHA-256 of the offer
+func TestFileTransferSumMismatch(t *testing.T) {
+	alice, bob, offers := transferChat(t)
+	dir := t.TempDir()
+
+	path, _ := writeFile(t, dir, "notes.txt", 1000)
+	_, err := alice.SendFile("bob", path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	id := receiveOffer(t, offers)
+	writeFile(t, dir, "notes.txt", 1000)
+
+	received := filepath.Join(dir, "received.txt")
+	_, err = bob.AcceptFile(id, received)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	for _, transfer := range finished(t, id, alice, bob) {
+		if transfer.State != tcp_client.TRANSFER_FAILED || !strings.Contains(transfer.Reason, "SHA-256") {
+			t.Errorf("Expected the transfer to fail on the SHA-256, got %s: %s", transfer.State, transfer.Reason)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected no received or partial file to be kept, got %v", entries)
+	}
+}
+
+func TestFileTransferTooLarge(t *testing.T) {
+	alice, bob, _ := transferChat(t)
+
+	path, _ := writeFile(t, t.TempDir(), "large.bin", shared.DEFAULT_MAX_FILE_SIZE+1)
+	sent, err := alice.SendFile("bob", path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	transfer := finished(t, sent.Offer.Transfer, alice)[0]
+	if transfer.State != tcp_client.TRANSFER_FAILED || !strings.Contains(transfer.Reason, "larger than") {
+		t.Errorf("Expected the offer to be refused for its size, got %s: %s", transfer.State, transfer.Reason)
+	}
+
+	if transfers := bob.Transfers(); len(transfers) != 0 {
+		t.Errorf("Expected bob not to be offered the file, got %v", transfers)
+	}
+}
+
+func TestFileTransferRejected(t *testing.T) {
+	alice, bob, offers := transferChat(t)
+
+	path, _ := writeFile(t, t.TempDir(), "notes.txt", 10)
+	_, err := alice.SendFile("bob", path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	id := receiveOffer(t, offers)
+	err = bob.RejectFile(id, "no thanks")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	transfers := finished(t, id, alice, bob)
+	if transfers[0].State != tcp_client.TRANSFER_FAILED || transfers[0].Reason != "Rejected by bob: no thanks" {
+		t.Errorf("Expected alice to see the rejection, got %s: %s", transfers[0].State, transfers[0].Reason)
+	}
+	if transfers[1].State != tcp_client.TRANSFER_FAILED || transfers[1].Reason != "Rejected" {
+		t.Errorf("Expected bob to have rejected the file, got %s: %s", transfers[1].State, transfers[1].Reason)
+	}
+
+	_, err = bob.AcceptFile(id, "")
+	if err == nil {
+		t.Errorf("Expected a rejected file not to be accepted")
+	}
+}
+
+func TestFileTransferCancelled(t *testing.T) {
+	alice, bob, offers := transferChat(t)
+
+	path, _ := writeFile(t, t.TempDir(), "notes.txt", 10)
+	sent, err := alice.SendFile("bob", path)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	id := receiveOffer(t, offers)
+	err = alice.CancelFile(sent.Offer.Transfer)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	transfers := finished(t, id, alice, bob)
+	if transfers[0].State != tcp_client.TRANSFER_FAILED || transfers[0].Reason != "Cancelled" {
+		t.Errorf("Expected alice to have cancelled the file, got %s: %s", transfers[0].State, transfers[0].Reason)
+	}
+	if transfers[1].State != tcp_client.TRANSFER_FAILED || transfers[1].Reason != "Cancelled by alice" {
+		t.Errorf("Expected bob to see the cancellation, got %s: %s", transfers[1].State, transfers[1].Reason)
+	}
+
+	_, err = bob.AcceptFile(id, "")
+	if err == nil {
+		t.Errorf("Expected a cancelled file not to be accepted")
+	}
+}
@@ -0,0 +1,233 @@
+package shared_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func TestPipeTransport(t *testing.T) {
+	transport := shared.NewPipeTransport()
+
+	_, err := transport.Dial("chat")
+	if !errors.Is(err, shared.NoListener) {
+		t.Fatalf("Expected no listener error, got: %v", err)
+	}
+
+	listener, err := transport.Listen("chat")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	_, err = transport.Listen("chat")
+	if err == nil {
+		t.Errorf("Expected listening twice on the same name to fail")
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := transport.Dial("chat")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer conn.Close()
+
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("Expected the echo 'hello', got '%s' (%v)", buf, err)
+	}
+
+	listener.Close()
+	_, err = listener.Accept()
+	if !errors.Is(err, shared.TransportClosed) {
+		t.Errorf("Expected transport closed error, got: %v", err)
+	}
+
+	_, err = transport.Dial("chat")
+	if !errors.Is(err, shared.NoListener) {
+		t.Errorf("Expected no listener error after closing, got: %v", err)
+	}
+}
+
+// selfSigned returns a server and client TLS config trusting a new certificate for "chat"
+func selfSigned(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "chat"},
+		DNSNames:     []string{"chat"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client := &tls.Config{RootCAs: pool, ServerName: "chat"}
+	return server, client
+}
+
+// TestChatOverTransports runs a whole server and many clients in-process, and checks
+// that a message reaches every client in the room
+func TestChatOverTransports(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+
+	tests := []struct {
+		name      string
+		serverTLS *tls.Config
+		clientTLS *tls.Config
+	}{
+		{"pipe", nil, nil},
+		{"tls over pipe", serverTLS, clientTLS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := shared.NewPipeTransport()
+			startChat(t, transport, test.serverTLS, "chat")
+
+			const CLIENTS = 10
+			received := make(chan shared.Message, CLIENTS)
+			clients := make([]*tcp_client.Client, 0, CLIENTS)
+			for i := range CLIENTS {
+				opts := tcp_client.DefaultOptions()
+				opts.Transport = transport
+				opts.TLS = test.clientTLS
+				clients = append(clients, connectChat(t, "chat", fmt.Sprintf("user%d", i), opts, received))
+			}
+
+			expectHello(t, clients, "user0", received)
+		})
+	}
+}
+
+// startChat starts a chat server on the addresses of the transport
+func startChat(t *testing.T, transport shared.Transport, config *tls.Config, addresses ...string) *tcp_server.Server {
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = transport
+	server.TLS = config
+	server.Limits = tcp_server.RateLimits{}
+	startServer(t, &server, addresses...)
+	return &server
+}
+
+// startServer starts a server created with HandleChat, and broadcasts the messages sent to rooms
+func startServer(t *testing.T, server *tcp_server.Server, addresses ...string) {
+	err := server.Start(addresses...)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	go func() {
+		for p := range server.PChan {
+			var msg shared.Message
+			p.IntoMessage(&msg)
+			server.BroadcastRoom(msg.Room, p)
+		}
+	}()
+}
+
+// connectChat logs in as username, and passes every "hello" message received on to received
+func connectChat(t *testing.T, addr string, username string, opts tcp_client.Options, received chan shared.Message) *tcp_client.Client {
+	return connectClient(t, addr, username, opts, func(p *shared.Packet) {
+		var msg shared.Message
+		if p.Kind() == shared.KIND_MESSAGE && p.IntoMessage(&msg) == nil && msg.Msg == "hello" {
+			received <- msg
+		}
+	})
+}
+
+// connectClient logs in as username, and passes every packet received to handler
+func connectClient(t *testing.T, addr string, username string, opts tcp_client.Options, handler tcp_client.MessageHandler) *tcp_client.Client {
+	opts.Username = username
+	opts.Reconnect = false
+	opts.Output = io.Discard
+
+	client, err := tcp_client.ConnectWithOptions(addr, opts)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	go client.Listen(handler)
+	return client
+}
+
+// expectHello sends "hello" from the client logged in as from, once every client has joined
+// the default room, and checks that every client receives it
+func expectHello(t *testing.T, clients []*tcp_client.Client, from string, received chan shared.Message) {
+	// Clients join the default room when they log in
+	waitFor(t, func() bool {
+		for _, client := range clients {
+			if len(client.Rooms()) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	for _, client := range clients {
+		if client.Username() != from {
+			continue
+		}
+
+		_, err := client.SendLine("hello", shared.DEFAULT_ROOM)
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+	}
+
+	for range clients {
+		select {
+		case msg := <-received:
+			if msg.Username != from {
+				t.Errorf("Expected the message from %s, got it from %s", from, msg.Username)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Not every client received the message from %s", from)
+		}
+	}
+}
+
+func waitFor(t *testing.T, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
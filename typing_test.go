@@ -0,0 +1,95 @@
+package shared_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+)
+
+// typingUntilHello connects two users, and returns the Typing received by the second
+// until it receives a "hello" message, which is sent after every Typing of the first
+func typingUntilHello(t *testing.T, send func(alice *tcp_client.Client)) ([]shared.Typing, []shared.Typing) {
+	transport := shared.NewPipeTransport()
+	server := startChat(t, transport, nil, "chat")
+
+	received := map[string]chan *shared.Packet{
+		"alice": make(chan *shared.Packet, 100),
+		"bob":   make(chan *shared.Packet, 100),
+	}
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	opts.PingInterval = 0
+
+	clients := make([]*tcp_client.Client, 0, 2)
+	for _, username := range []string{"alice", "bob"} {
+		clients = append(clients, connectClient(t, "chat", username, opts, func(p *shared.Packet) {
+			received[username] <- p
+		}))
+	}
+	waitFor(t, func() bool { return len(clients[0].Rooms()) > 0 && len(clients[1].Rooms()) > 0 })
+
+	send(clients[0])
+	clients[0].SendLine("hello", shared.DEFAULT_ROOM)
+
+	typing := make(map[string][]shared.Typing)
+	for username, packets := range received {
+		for done := false; !done; {
+			select {
+			case p := <-packets:
+				var msg shared.Message
+				var event shared.Typing
+				if p.Kind() == shared.KIND_MESSAGE && p.IntoMessage(&msg) == nil && msg.Msg == "hello" {
+					done = true
+				} else if p.Kind() == shared.KIND_TYPING && p.IntoMessage(&event) == nil {
+					typing[username] = append(typing[username], event)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s did not receive the message", username)
+			}
+		}
+	}
+
+	// Typing is never stored
+	msgs, _, err := server.Store.Page(shared.DEFAULT_ROOM, 0, 0, 10)
+	if err != nil || len(msgs) != 1 {
+		t.Errorf("Expected only the message to be stored, got %v, %v", msgs, err)
+	}
+
+	return typing["alice"], typing["bob"]
+}
+
+func TestTypingPassedOn(t *testing.T) {
+	alice, bob := typingUntilHello(t, func(alice *tcp_client.Client) {
+		// A stop without a start is not passed on
+		alice.SendMessage(shared.KIND_TYPING, shared.Typing{Room: shared.DEFAULT_ROOM, Typing: false})
+		alice.SendMessage(shared.KIND_TYPING, shared.Typing{Room: shared.DEFAULT_ROOM, Typing: true})
+		alice.SendMessage(shared.KIND_TYPING, shared.Typing{Room: shared.DEFAULT_ROOM, Typing: false})
+	})
+
+	if len(alice) != 0 {
+		t.Errorf("Expected alice not to get her own typing, got %v", alice)
+	}
+
+	expected := []shared.Typing{
+		{Username: "alice", Room: shared.DEFAULT_ROOM, Typing: true},
+		{Username: "alice", Room: shared.DEFAULT_ROOM, Typing: false},
+	}
+	if len(bob) != len(expected) || bob[0] != expected[0] || bob[1] != expected[1] {
+		t.Errorf("Expected bob to get %v, got %v", expected, bob)
+	}
+}
+
+func TestTypingRateLimitedAcrossStops(t *testing.T) {
+	_, bob := typingUntilHello(t, func(alice *tcp_client.Client) {
+		for range 10 {
+			alice.SendMessage(shared.KIND_TYPING, shared.Typing{Room: shared.DEFAULT_ROOM, Typing: true})
+			alice.SendMessage(shared.KIND_TYPING, shared.Typing{Room: shared.DEFAULT_ROOM, Typing: false})
+		}
+	})
+
+	if len(bob) != 2 || !bob[0].Typing || bob[1].Typing {
+		t.Errorf("Expected a single start and stop within TYPING_RATE_LIMIT, got %v", bob)
+	}
+}
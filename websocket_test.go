@@ -0,0 +1,191 @@
+package shared_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/TobiasTheDanish/tcp-chat/shared"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_client"
+	"github.com/TobiasTheDanish/tcp-chat/tcp_server"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// The example handshake of RFC 6455
+	accept := shared.WebSocketAccept("dGhlIHNhbXBsZSBub25jZQ==")
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Expected s3pPLMBiTxaQ9kYGzzhZRbK+xOo=, got %s", accept)
+	}
+}
+
+// TestChatOverWebSocket checks that native clients, and WebSocket clients sending
+// binary packets or JSON, share a room
+func TestChatOverWebSocket(t *testing.T) {
+	transport := shared.NewPipeTransport()
+	startChat(t, transport, nil, "chat", shared.WEBSOCKET_PREFIX+"web")
+
+	received := make(chan shared.Message, 3)
+	clients := make([]*tcp_client.Client, 0, 3)
+
+	opts := tcp_client.DefaultOptions()
+	opts.Transport = transport
+	clients = append(clients, connectChat(t, "chat", "native", opts, received))
+	clients = append(clients, connectChat(t, "ws://web/", "binary", opts, received))
+
+	opts.Transport = shared.WebSocketTransport{Transport: transport, JSON: true}
+	clients = append(clients, connectChat(t, "web", "json", opts, received))
+
+	expectHello(t, clients, "json", received)
+	expectHello(t, clients, "native", received)
+	expectHello(t, clients, "binary", received)
+}
+
+// writeFrame writes a masked frame, like a browser does. Failing writes show up as failing reads.
+func writeFrame(conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	conn.Write(frame)
+}
+
+// readFrame reads an unmasked frame of less than 64KiB, like the server sends them
+func readFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if header[1]&0x80 != 0 || header[1] == 127 {
+		t.Fatalf("Expected an unmasked frame of less than 64KiB, got header %v", header)
+	}
+
+	length := int(header[1])
+	if length == 126 {
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(reader, extended)
+		if err != nil {
+			t.Fatalf("Did not expect error, but got: %s", err)
+		}
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	return header[0] & 0x0f, payload
+}
+
+// TestWebSocketJSONFrames speaks JSON over a hand made WebSocket, the way a browser would
+func TestWebSocketJSONFrames(t *testing.T) {
+	transport := shared.NewPipeTransport()
+	startChat(t, transport, nil, shared.WEBSOCKET_PREFIX+"web")
+
+	conn, err := transport.Dial("web")
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer conn.Close()
+
+	go conn.Write([]byte("GET /chat HTTP/1.1\r\nHost: web\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: " + shared.WEBSOCKET_PROTOCOL_JSON + "\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected the handshake to be accepted, got %s %v", response.Status, response.Header)
+	}
+
+	if protocol := response.Header.Get("Sec-WebSocket-Protocol"); protocol != shared.WEBSOCKET_PROTOCOL_JSON {
+		t.Errorf("Expected protocol %s, got %s", shared.WEBSOCKET_PROTOCOL_JSON, protocol)
+	}
+
+	go writeFrame(conn, shared.OPCODE_TEXT, []byte(`{"type":"hello","data":{"Compression":0,"Threshold":0}}`))
+	opcode, payload := readFrame(t, reader)
+
+	var hello shared.JSONMessage
+	err = json.Unmarshal(payload, &hello)
+	if opcode != shared.OPCODE_TEXT || err != nil || hello.Type != "hello" {
+		t.Fatalf("Expected a hello as JSON text, got opcode %d: %s", opcode, payload)
+	}
+
+	go writeFrame(conn, shared.OPCODE_TEXT, []byte(`{"type":"login","data":{"Username":"browser","ResumeToken":""}}`))
+	opcode, payload = readFrame(t, reader)
+	if opcode != shared.OPCODE_TEXT || !strings.Contains(string(payload), `"browser"`) {
+		t.Fatalf("Expected to be welcomed as browser, got opcode %d: %s", opcode, payload)
+	}
+
+	// Pings of the WebSocket itself are answered with the same payload
+	go writeFrame(conn, shared.OPCODE_PING, []byte("are you there"))
+	for {
+		opcode, payload = readFrame(t, reader)
+		if opcode == shared.OPCODE_PONG {
+			break
+		}
+	}
+	if string(payload) != "are you there" {
+		t.Errorf("Expected the pong to echo the ping, got %s", payload)
+	}
+}
+
+// handshakeStatus opens a WebSocket on the address with the Origin, like a browser on that
+// page would, and returns the status of the response
+func handshakeStatus(t *testing.T, transport shared.Transport, addr string, origin string) int {
+	conn, err := transport.Dial(addr)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	defer conn.Close()
+
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + addr + "\r\nOrigin: " + origin + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Did not expect error, but got: %s", err)
+	}
+	response.Body.Close()
+
+	return response.StatusCode
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	transport := shared.NewPipeTransport()
+	server := tcp_server.Create(tcp_server.HandleChat)
+	server.Transport = transport
+	server.Limits = tcp_server.RateLimits{}
+	server.AllowedOrigins = []string{"https://chat.example.com"}
+	startServer(t, &server, shared.WEBSOCKET_PREFIX+"web")
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{"http://web", http.StatusSwitchingProtocols},
+		{"https://chat.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		if status := handshakeStatus(t, transport, "web", test.origin); status != test.status {
+			t.Errorf("Expected a page from %s to get %d, got %d", test.origin, test.status, status)
+		}
+	}
+}